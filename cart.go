@@ -0,0 +1,508 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/lib/pq"
+)
+
+var ErrEmptyCart error = errors.New("cart is empty")
+
+const MaxCartQuantity = 99
+
+// CartLine is a quantity of an item or variant in a user's cart, with its live price
+type CartLine struct {
+	lineId    int
+	itemId    int
+	variantId int // 0 if the item has no variants
+	itemName  string
+	sku       string
+	unitPrice int
+	currency  Currency // the item's currency
+	quantity  int
+}
+
+func (c CartLine) String() string {
+	price := Money{c.unitPrice, c.currency}
+	return fmt.Sprintf("line: %v, item: %v, name: %v, sku: %v, price: %v, quantity: %v, subtotal: %v",
+		c.lineId, c.itemId, c.itemName, c.sku, price, c.quantity, price.Mul(c.quantity))
+}
+
+// cartTotal returns the value of the lines in currency
+func cartTotal(lines []CartLine, currency Currency, rates RateProvider) (Money, error) {
+	total := Money{currency: currency}
+	for _, line := range lines {
+		subtotal, err := convertMoney(Money{line.unitPrice * line.quantity, line.currency}, currency, rates)
+		if err != nil {
+			return Money{}, err
+		}
+		total.amount += subtotal.amount
+	}
+	return total, nil
+}
+
+// checkPurchasable returns sql.ErrNoRows if the item or variant doesn't exist and
+// ErrVariantRequired if no variant was chosen for an item that has them
+func checkPurchasable(tx *sql.Tx, itemId int, variantId int) error {
+	var exists, hasVariants, variantExists bool
+	query := `SELECT EXISTS (SELECT 1 FROM items WHERE item_id=$1),
+			  EXISTS (SELECT 1 FROM item_variants WHERE item_id=$1),
+			  $2=0 OR EXISTS (SELECT 1 FROM item_variants WHERE item_id=$1 AND variant_id=$2)`
+	err := tx.QueryRow(query, itemId, variantId).Scan(&exists, &hasVariants, &variantExists)
+	if err != nil {
+		return err
+	}
+	switch {
+	case !exists || !variantExists:
+		return sql.ErrNoRows
+	case hasVariants && variantId == 0:
+		return ErrVariantRequired
+	}
+	return nil
+}
+
+func (s *SqlDB) Cart(userId int) ([]CartLine, error) {
+	query := `SELECT cart_lines.line_id, cart_lines.item_id, COALESCE(cart_lines.variant_id, 0), items.name, COALESCE(item_variants.sku, ''),
+			  CAST(COALESCE(item_variants.price, items.price)*100 AS BIGINT), items.currency, cart_lines.quantity
+			  FROM cart_lines
+			  JOIN items ON cart_lines.item_id=items.item_id
+			  LEFT JOIN item_variants ON cart_lines.variant_id=item_variants.variant_id
+			  WHERE cart_lines.user_id=$1
+			  ORDER BY cart_lines.line_id`
+	rows, err := s.db.Query(query, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var lines []CartLine
+	var line CartLine
+
+	for rows.Next() {
+		err := rows.Scan(&line.lineId, &line.itemId, &line.variantId, &line.itemName, &line.sku, &line.unitPrice, &line.currency, &line.quantity)
+		if err != nil {
+			return nil, err
+		}
+		lines = append(lines, line)
+	}
+
+	return lines, rows.Err()
+}
+
+// AddToCart adds quantity to the user's line for the item or variant, creating it if needed
+func (s *SqlDB) AddToCart(userId int, itemId int, variantId int, quantity int) (err error) {
+	var tx *sql.Tx
+	tx, err = s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	// Rollback or commit depending on err
+	defer func() {
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	if err = checkPurchasable(tx, itemId, variantId); err != nil {
+		return err
+	}
+
+	query := `INSERT INTO cart_lines (user_id, item_id, variant_id, quantity) VALUES ($1, $2, NULLIF($3, 0), $4)
+			  ON CONFLICT (user_id, item_id, variant_id) DO UPDATE SET quantity=LEAST(cart_lines.quantity+EXCLUDED.quantity, $5)`
+	_, err = tx.Exec(query, userId, itemId, variantId, quantity, MaxCartQuantity)
+	return err
+}
+
+func (s *SqlDB) UpdateCartLine(userId int, lineId int, quantity int) error {
+	query := `UPDATE cart_lines SET quantity=$1 WHERE line_id=$2 AND user_id=$3`
+	result, err := s.db.Exec(query, quantity, lineId, userId)
+	if err != nil {
+		return err
+	}
+	return expectRowsAffected(result)
+}
+
+func (s *SqlDB) RemoveCartLine(userId int, lineId int) error {
+	query := `DELETE FROM cart_lines WHERE line_id=$1 AND user_id=$2`
+	result, err := s.db.Exec(query, lineId, userId)
+	if err != nil {
+		return err
+	}
+	return expectRowsAffected(result)
+}
+
+// expectRowsAffected returns sql.ErrNoRows if result didn't touch any rows
+func expectRowsAffected(result sql.Result) error {
+	count, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// Checkout purchases every line in the user's cart as one order paid from the user's wallet
+// in currency in a single transaction, either all lines are bought or none are. Rows are
+// locked items first, then variants, then the coupon, then the buyer's and sellers' wallets,
+// each in id order, the same order Purchase uses so they can't deadlock
+func (s *SqlDB) Checkout(userId int, couponCode string, currency Currency) (orderId int, total int, err error) {
+	var tx *sql.Tx
+	tx, err = s.db.Begin()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// Rollback or commit depending on err
+	defer func() {
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	// Lock cart so concurrent checkouts and edits serialise
+	linesQuery := `SELECT line_id, item_id, COALESCE(variant_id, 0), quantity FROM cart_lines WHERE user_id=$1 ORDER BY line_id FOR UPDATE`
+	rows, err := tx.Query(linesQuery, userId)
+	if err != nil {
+		return 0, 0, err
+	}
+	var lines []CartLine
+	var itemIds, variantIds []int64
+	for rows.Next() {
+		var line CartLine
+		if err = rows.Scan(&line.lineId, &line.itemId, &line.variantId, &line.quantity); err != nil {
+			rows.Close()
+			return 0, 0, err
+		}
+		lines = append(lines, line)
+		itemIds = append(itemIds, int64(line.itemId))
+		if line.variantId != 0 {
+			variantIds = append(variantIds, int64(line.variantId))
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, 0, err
+	}
+	if len(lines) == 0 {
+		return 0, 0, ErrEmptyCart
+	}
+
+	// Lock items and read prices
+	itemPrices := make(map[int]int)
+	itemCurrencies := make(map[int]Currency)
+	itemHasVariants := make(map[int]bool)
+	itemsQuery := `SELECT item_id, CAST(price*100 AS BIGINT), currency, EXISTS (SELECT 1 FROM item_variants WHERE item_variants.item_id=items.item_id)
+				   FROM items WHERE item_id=ANY($1) ORDER BY item_id FOR UPDATE`
+	rows, err = tx.Query(itemsQuery, pq.Int64Array(itemIds))
+	if err != nil {
+		return 0, 0, err
+	}
+	for rows.Next() {
+		var itemId, price int
+		var itemCurrency Currency
+		var hasVariants bool
+		if err = rows.Scan(&itemId, &price, &itemCurrency, &hasVariants); err != nil {
+			rows.Close()
+			return 0, 0, err
+		}
+		itemPrices[itemId] = price
+		itemCurrencies[itemId] = itemCurrency
+		itemHasVariants[itemId] = hasVariants
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, 0, err
+	}
+
+	// Lock variants and read prices and stock
+	variantPrices := make(map[int]int)
+	variantStock := make(map[int]int)
+	variantsQuery := `SELECT variant_id, CAST(price*100 AS BIGINT), stock FROM item_variants WHERE variant_id=ANY($1) ORDER BY variant_id FOR UPDATE`
+	rows, err = tx.Query(variantsQuery, pq.Int64Array(variantIds))
+	if err != nil {
+		return 0, 0, err
+	}
+	for rows.Next() {
+		var variantId, price, stock int
+		if err = rows.Scan(&variantId, &price, &stock); err != nil {
+			rows.Close()
+			return 0, 0, err
+		}
+		variantPrices[variantId] = price
+		variantStock[variantId] = stock
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, 0, err
+	}
+
+	// Price every line in the currency paid with, any unavailable line fails the whole order
+	orderLines := make([]OrderLine, len(lines))
+	for i, line := range lines {
+		price, ok := itemPrices[line.itemId]
+		if !ok {
+			return 0, 0, sql.ErrNoRows
+		}
+		if line.variantId != 0 {
+			if price, ok = variantPrices[line.variantId]; !ok {
+				return 0, 0, sql.ErrNoRows
+			}
+			if variantStock[line.variantId] < line.quantity {
+				return 0, 0, ErrOutOfStock
+			}
+		} else if itemHasVariants[line.itemId] {
+			return 0, 0, ErrVariantRequired
+		}
+		var unitPrice Money
+		unitPrice, err = convertMoney(Money{price, itemCurrencies[line.itemId]}, currency, s.rates)
+		if err != nil {
+			return 0, 0, err
+		}
+		orderLines[i] = OrderLine{itemId: line.itemId, variantId: line.variantId, quantity: line.quantity, unitPrice: unitPrice.amount}
+	}
+
+	// Apply coupon
+	var couponId int
+	if len(couponCode) != 0 {
+		couponId, err = applyCoupon(tx, couponCode, userId, orderLines, currency, s.rates)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	total, _ = orderTotals(orderLines)
+
+	// Take stock and record the order, paid from the wallet
+	updateStockQuery := `UPDATE item_variants SET stock=stock-$1 WHERE variant_id=$2`
+	for _, line := range lines {
+		if line.variantId != 0 {
+			if _, err = tx.Exec(updateStockQuery, line.quantity, line.variantId); err != nil {
+				return 0, 0, err
+			}
+		}
+	}
+	orderId, err = createOrder(tx, userId, OrderPaid, currency, orderLines, couponId)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// Empty cart
+	_, err = tx.Exec(`DELETE FROM cart_lines WHERE user_id=$1`, userId)
+	return orderId, total, err
+}
+
+// parseQuantity parses a cart quantity, which must be between 1 and MaxCartQuantity
+func parseQuantity(value string) (int, error) {
+	if len(value) == 0 {
+		return 1, nil
+	}
+	quantity, err := strconv.Atoi(value)
+	if err != nil || quantity <= 0 || quantity > MaxCartQuantity {
+		return 0, strconv.ErrSyntax
+	}
+	return quantity, nil
+}
+
+func (env *Env) Cart(w http.ResponseWriter, r *http.Request) {
+	userId, ok := r.Context().Value(CtxUserId).(int)
+	if !ok {
+		env.logger.Println("context does not include userId for protected endpoint")
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	// Get currency to total in
+	currency, err := parseCurrency(r.FormValue("currency"))
+	if err != nil {
+		http.Error(w, "Unknown currency", http.StatusBadRequest)
+		return
+	}
+
+	// Get cart with live prices
+	lines, err := env.db.Cart(userId)
+	if err != nil {
+		env.logger.Println(err.Error())
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	total, err := cartTotal(lines, currency, env.rates)
+	if err != nil {
+		http.Error(w, "No exchange rate", http.StatusBadRequest)
+		return
+	}
+
+	// Print lines and total
+	for _, line := range lines {
+		fmt.Fprintln(w, line)
+	}
+	fmt.Fprintln(w, "Total:", total)
+}
+
+func (env *Env) AddToCart(w http.ResponseWriter, r *http.Request) {
+	userId, ok := r.Context().Value(CtxUserId).(int)
+	if !ok {
+		env.logger.Println("context does not include userId for protected endpoint")
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	// Get item id, optional variant id and quantity
+	itemId, err := strconv.Atoi(r.FormValue("id"))
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	var variantId int
+	if variant := r.FormValue("variant"); len(variant) != 0 {
+		variantId, err = strconv.Atoi(variant)
+		if err != nil || variantId <= 0 {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+	}
+	quantity, err := parseQuantity(r.FormValue("quantity"))
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	// Add to cart
+	if err := env.db.AddToCart(userId, itemId, variantId, quantity); err != nil {
+		switch err {
+		case ErrVariantRequired:
+			http.Error(w, "Variant required", http.StatusBadRequest)
+		case sql.ErrNoRows:
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		default:
+			env.logger.Println(err.Error())
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	fmt.Fprintln(w, "Success")
+}
+
+func (env *Env) UpdateCartLine(w http.ResponseWriter, r *http.Request) {
+	userId, ok := r.Context().Value(CtxUserId).(int)
+	if !ok {
+		env.logger.Println("context does not include userId for protected endpoint")
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	// Get line id and new quantity
+	lineId, err := strconv.Atoi(r.PathValue("lineId"))
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	if len(r.FormValue("quantity")) == 0 {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	quantity, err := parseQuantity(r.FormValue("quantity"))
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	// Update line
+	if err := env.db.UpdateCartLine(userId, lineId, quantity); err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+		env.logger.Println(err.Error())
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	fmt.Fprintln(w, "Success")
+}
+
+func (env *Env) RemoveCartLine(w http.ResponseWriter, r *http.Request) {
+	userId, ok := r.Context().Value(CtxUserId).(int)
+	if !ok {
+		env.logger.Println("context does not include userId for protected endpoint")
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	// Get line id
+	lineId, err := strconv.Atoi(r.PathValue("lineId"))
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	// Remove line
+	if err := env.db.RemoveCartLine(userId, lineId); err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+		env.logger.Println(err.Error())
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	fmt.Fprintln(w, "Success")
+}
+
+func (env *Env) Checkout(w http.ResponseWriter, r *http.Request) {
+	userId, ok := r.Context().Value(CtxUserId).(int)
+	if !ok {
+		env.logger.Println("context does not include userId for protected endpoint")
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	// Get currency to pay in
+	currency, err := parseCurrency(r.FormValue("currency"))
+	if err != nil {
+		http.Error(w, "Unknown currency", http.StatusBadRequest)
+		return
+	}
+
+	// Attempt checkout
+	orderId, total, err := env.db.Checkout(userId, r.FormValue("coupon"), currency)
+	if err != nil {
+		if message, ok := couponErrorMessage(err); ok {
+			http.Error(w, message, http.StatusBadRequest)
+			return
+		}
+		switch err {
+		case ErrEmptyCart:
+			http.Error(w, "Cart is empty", http.StatusBadRequest)
+		case ErrInsufficientFunds:
+			http.Error(w, "Insufficient funds", http.StatusForbidden)
+		case ErrNoExchangeRate:
+			http.Error(w, "No exchange rate", http.StatusBadRequest)
+		case ErrOutOfStock:
+			http.Error(w, "Out of stock", http.StatusConflict)
+		case ErrVariantRequired:
+			http.Error(w, "Variant required", http.StatusBadRequest)
+		case sql.ErrNoRows:
+			http.Error(w, "Item no longer available", http.StatusConflict)
+		default:
+			env.logger.Println(err.Error())
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	fmt.Fprintln(w, "Success, order:", orderId, "total:", Money{total, currency})
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+var ErrCouponNotFound error = errors.New("coupon not found")
+var ErrCouponExpired error = errors.New("coupon expired")
+var ErrCouponUsedUp error = errors.New("coupon usage limit reached")
+var ErrCouponMinSpend error = errors.New("order below coupon minimum spend")
+var ErrCouponNotApplicable error = errors.New("coupon does not apply to any items")
+
+type CouponKind string
+
+const (
+	CouponPercent CouponKind = "percent"
+	CouponFixed   CouponKind = "fixed"
+)
+
+// Coupon is a discount code. For percent coupons amount is a whole percentage, for fixed
+// coupons it is money in currency, as is the minimum spend. Zero limits are unlimited
+type Coupon struct {
+	couponId       int
+	code           string
+	kind           CouponKind
+	amount         int
+	minSpend       int
+	currency       Currency
+	expiresAt      time.Time // zero if the coupon doesn't expire
+	maxUses        int
+	maxUsesPerUser int
+	uses           int
+	itemIds        []int64
+	categoryIds    []int64 // restricted categories and all their descendants
+}
+
+// normaliseCouponCode makes codes case insensitive, they are stored upper case
+func normaliseCouponCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// appliesTo reports whether the coupon covers an item in the given categories
+func (c Coupon) appliesTo(itemId int, categoryIds []int64) bool {
+	if len(c.itemIds) == 0 && len(c.categoryIds) == 0 {
+		return true
+	}
+	if slices.Contains(c.itemIds, int64(itemId)) {
+		return true
+	}
+	return slices.ContainsFunc(categoryIds, func(id int64) bool { return slices.Contains(c.categoryIds, id) })
+}
+
+// inCurrency returns the coupon with its money amounts converted to currency
+func (c Coupon) inCurrency(currency Currency, rates RateProvider) (Coupon, error) {
+	minSpend, err := convertMoney(Money{c.minSpend, c.currency}, currency, rates)
+	if err != nil {
+		return Coupon{}, err
+	}
+	if c.kind == CouponFixed {
+		amount, err := convertMoney(Money{c.amount, c.currency}, currency, rates)
+		if err != nil {
+			return Coupon{}, err
+		}
+		c.amount = amount.amount
+	}
+	c.minSpend, c.currency = minSpend.amount, currency
+	return c, nil
+}
+
+// Discount validates the coupon for an order and returns the discount for each line.
+// userUses is how many of the user's orders have already used the coupon. Percent
+// discounts round down per line, fixed discounts are capped at the eligible subtotal and
+// split across eligible lines in proportion to their value
+func (c Coupon) Discount(lines []OrderLine, itemCategories map[int][]int64, userUses int, now time.Time) ([]int, error) {
+	if !c.expiresAt.IsZero() && !now.Before(c.expiresAt) {
+		return nil, ErrCouponExpired
+	}
+	if (c.maxUses > 0 && c.uses >= c.maxUses) || (c.maxUsesPerUser > 0 && userUses >= c.maxUsesPerUser) {
+		return nil, ErrCouponUsedUp
+	}
+
+	subtotal, eligible := 0, 0
+	for _, line := range lines {
+		subtotal += line.unitPrice * line.quantity
+		if c.appliesTo(line.itemId, itemCategories[line.itemId]) {
+			eligible += line.unitPrice * line.quantity
+		}
+	}
+	if subtotal < c.minSpend {
+		return nil, ErrCouponMinSpend
+	}
+	if eligible == 0 {
+		return nil, ErrCouponNotApplicable
+	}
+
+	discounts := make([]int, len(lines))
+	switch c.kind {
+	case CouponPercent:
+		for i, line := range lines {
+			if c.appliesTo(line.itemId, itemCategories[line.itemId]) {
+				discounts[i] = line.unitPrice * line.quantity * c.amount / 100
+			}
+		}
+	case CouponFixed:
+		total := min(c.amount, eligible)
+		remaining, last := total, -1
+		for i, line := range lines {
+			if c.appliesTo(line.itemId, itemCategories[line.itemId]) {
+				discounts[i] = total * line.unitPrice * line.quantity / eligible
+				remaining -= discounts[i]
+				last = i
+			}
+		}
+		// Rounding leftovers go on the last eligible line
+		discounts[last] += remaining
+	}
+	return discounts, nil
+}
+
+// unitDiscounts splits a line discount across its units, earlier units take the remainder
+func unitDiscounts(discount int, quantity int) []int {
+	units := make([]int, quantity)
+	for i := range units {
+		units[i] = discount / quantity
+		if i < discount%quantity {
+			units[i]++
+		}
+	}
+	return units
+}
+
+// loadCoupon locks the coupon with code and reads its restrictions and the user's
+// previous uses. Coupons are locked after items and variants and before users
+func loadCoupon(tx *sql.Tx, code string, userId int) (Coupon, int, error) {
+	var coupon Coupon
+	var expiresAt sql.NullTime
+	var maxUses, maxUsesPerUser sql.NullInt64
+	couponQuery := `SELECT coupon_id, code, kind, CAST(amount*CASE WHEN kind='fixed' THEN 100 ELSE 1 END AS BIGINT),
+					CAST(min_spend*100 AS BIGINT), currency, expires_at, max_uses, max_uses_per_user, uses
+					FROM coupons WHERE code=$1 FOR UPDATE`
+	err := tx.QueryRow(couponQuery, normaliseCouponCode(code)).Scan(&coupon.couponId, &coupon.code, &coupon.kind, &coupon.amount,
+		&coupon.minSpend, &coupon.currency, &expiresAt, &maxUses, &maxUsesPerUser, &coupon.uses)
+	if err == sql.ErrNoRows {
+		return Coupon{}, 0, ErrCouponNotFound
+	} else if err != nil {
+		return Coupon{}, 0, err
+	}
+	coupon.expiresAt = expiresAt.Time
+	coupon.maxUses = int(maxUses.Int64)
+	coupon.maxUsesPerUser = int(maxUsesPerUser.Int64)
+
+	restrictionsQuery := `SELECT
+						  ARRAY(SELECT item_id FROM coupon_items WHERE coupon_id=$1),
+						  ARRAY(
+							  WITH RECURSIVE subtree AS (
+								  SELECT category_id FROM coupon_categories WHERE coupon_id=$1
+								  UNION
+								  SELECT categories.category_id FROM categories JOIN subtree ON categories.parent_id=subtree.category_id
+							  )
+							  SELECT category_id FROM subtree
+						  ),
+						  (SELECT COUNT(*) FROM orders WHERE coupon_id=$1 AND user_id=$2 AND status<>'cancelled')`
+	var userUses int
+	err = tx.QueryRow(restrictionsQuery, coupon.couponId, userId).Scan((*pq.Int64Array)(&coupon.itemIds), (*pq.Int64Array)(&coupon.categoryIds), &userUses)
+	return coupon, userUses, err
+}
+
+// itemCategories returns the direct categories of each item
+func itemCategories(tx *sql.Tx, itemIds []int64) (map[int][]int64, error) {
+	query := `SELECT item_id, category_id FROM item_categories WHERE item_id=ANY($1)`
+	rows, err := tx.Query(query, pq.Int64Array(itemIds))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	categories := make(map[int][]int64)
+	for rows.Next() {
+		var itemId int
+		var categoryId int64
+		if err := rows.Scan(&itemId, &categoryId); err != nil {
+			return nil, err
+		}
+		categories[itemId] = append(categories[itemId], categoryId)
+	}
+	return categories, rows.Err()
+}
+
+// applyCoupon prices lines in currency with the coupon with code in tx, recording each
+// line's discount and counting the use. The coupon id is returned for the order
+func applyCoupon(tx *sql.Tx, code string, userId int, lines []OrderLine, currency Currency, rates RateProvider) (int, error) {
+	coupon, userUses, err := loadCoupon(tx, code, userId)
+	if err != nil {
+		return 0, err
+	}
+	coupon, err = coupon.inCurrency(currency, rates)
+	if err != nil {
+		return 0, err
+	}
+
+	itemIds := make([]int64, len(lines))
+	for i, line := range lines {
+		itemIds[i] = int64(line.itemId)
+	}
+	categories, err := itemCategories(tx, itemIds)
+	if err != nil {
+		return 0, err
+	}
+
+	discounts, err := coupon.Discount(lines, categories, userUses, time.Now())
+	if err != nil {
+		return 0, err
+	}
+	for i := range lines {
+		lines[i].discount = discounts[i]
+	}
+
+	_, err = tx.Exec(`UPDATE coupons SET uses=uses+1 WHERE coupon_id=$1`, coupon.couponId)
+	return coupon.couponId, err
+}
+
+// couponErrorMessage returns the client message for coupon errors
+func couponErrorMessage(err error) (string, bool) {
+	switch err {
+	case ErrCouponNotFound:
+		return "Invalid coupon", true
+	case ErrCouponExpired:
+		return "Coupon expired", true
+	case ErrCouponUsedUp:
+		return "Coupon usage limit reached", true
+	case ErrCouponMinSpend:
+		return "Order below coupon minimum spend", true
+	case ErrCouponNotApplicable:
+		return "Coupon does not apply to these items", true
+	}
+	return "", false
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+)
+
+var testCouponLines = []OrderLine{
+	{itemId: 1, quantity: 1, unitPrice: 1000},
+	{itemId: 2, quantity: 2, unitPrice: 1500},
+	{itemId: 3, quantity: 1, unitPrice: 999},
+}
+
+var testCouponCategories = map[int][]int64{1: {3}, 2: {2}, 3: {3}}
+
+var testCouponDiscountTable = map[string]struct {
+	coupon   Coupon
+	userUses int
+	expected []int
+	err      error
+}{
+	"percent":            {Coupon{kind: CouponPercent, amount: 10}, 0, []int{100, 300, 99}, nil},
+	"percent item":       {Coupon{kind: CouponPercent, amount: 50, itemIds: []int64{3}}, 0, []int{0, 0, 499}, nil},
+	"percent category":   {Coupon{kind: CouponPercent, amount: 20, categoryIds: []int64{2}}, 0, []int{0, 600, 0}, nil},
+	"fixed prorated":     {Coupon{kind: CouponFixed, amount: 1000}, 0, []int{200, 600, 200}, nil},
+	"fixed capped":       {Coupon{kind: CouponFixed, amount: 5000, itemIds: []int64{1}}, 0, []int{1000, 0, 0}, nil},
+	"fixed remainder":    {Coupon{kind: CouponFixed, amount: 100, itemIds: []int64{1, 3}}, 0, []int{50, 0, 50}, nil},
+	"min spend met":      {Coupon{kind: CouponFixed, amount: 100, minSpend: 4999}, 0, []int{20, 60, 20}, nil},
+	"min spend not met":  {Coupon{kind: CouponFixed, amount: 100, minSpend: 5000}, 0, nil, ErrCouponMinSpend},
+	"expired":            {Coupon{kind: CouponPercent, amount: 10, expiresAt: time.Now().Add(-time.Minute)}, 0, nil, ErrCouponExpired},
+	"not expired":        {Coupon{kind: CouponPercent, amount: 10, expiresAt: time.Now().Add(time.Hour)}, 0, []int{100, 300, 99}, nil},
+	"used up":            {Coupon{kind: CouponPercent, amount: 10, maxUses: 5, uses: 5}, 0, nil, ErrCouponUsedUp},
+	"used up by user":    {Coupon{kind: CouponPercent, amount: 10, maxUsesPerUser: 1}, 1, nil, ErrCouponUsedUp},
+	"not applicable":     {Coupon{kind: CouponPercent, amount: 10, categoryIds: []int64{4}}, 0, nil, ErrCouponNotApplicable},
+	"uses under the max": {Coupon{kind: CouponPercent, amount: 10, maxUses: 5, uses: 4, maxUsesPerUser: 2}, 1, []int{100, 300, 99}, nil},
+}
+
+func TestCouponDiscount(t *testing.T) {
+	t.Parallel()
+	for name, args := range testCouponDiscountTable {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			discounts, err := args.coupon.Discount(testCouponLines, testCouponCategories, args.userUses, time.Now())
+			if err != args.err {
+				t.Fatalf("bad error for %v, expected %v, got %v", name, args.err, err)
+			}
+			if !slices.Equal(discounts, args.expected) {
+				t.Errorf("bad discounts for %v, expected %v, got %v", name, args.expected, discounts)
+			}
+		})
+	}
+}
+
+func TestUnitDiscounts(t *testing.T) {
+	t.Parallel()
+	for _, args := range []struct {
+		discount int
+		quantity int
+		expected []int
+	}{
+		{0, 2, []int{0, 0}},
+		{100, 1, []int{100}},
+		{100, 3, []int{34, 33, 33}},
+		{2, 3, []int{1, 1, 0}},
+	} {
+		if units := unitDiscounts(args.discount, args.quantity); !slices.Equal(units, args.expected) {
+			t.Errorf("bad unit discounts for %v over %v, expected %v, got %v", args.discount, args.quantity, args.expected, units)
+		}
+	}
+}
+
+func TestPurchaseCoupon(t *testing.T) {
+	env := NewTestEnv()
+	env.db = newTestDB(t)
+	richUserId := 2
+
+	for _, args := range []struct {
+		name     string
+		coupon   string
+		expected int
+	}{
+		{"PurchaseUnknownCoupon", "NOPE", http.StatusBadRequest},
+		{"PurchaseExpiredCoupon", "expired", http.StatusBadRequest},
+		{"PurchaseCoupon", "tenoff", http.StatusOK},
+		{"PurchaseCouponReused", "TENOFF", http.StatusBadRequest},
+	} {
+		t.Run(args.name, func(t *testing.T) {
+			startBalance, _ := env.db.Balance(richUserId, DefaultCurrency)
+			recorder := httptest.NewRecorder()
+			env.Purchase(recorder, newCartRequest("POST", "/api/purchase?id=2&coupon="+args.coupon, richUserId))
+			if result := recorder.Result(); result.StatusCode != args.expected {
+				t.Fatalf("bad status code for coupon %q, expected %v, got %v", args.coupon, args.expected, result.StatusCode)
+			}
+
+			expectedBalance := startBalance
+			if args.expected == http.StatusOK {
+				expectedBalance.amount -= 12999 - 1299
+			}
+			if balance, _ := env.db.Balance(richUserId, DefaultCurrency); balance != expectedBalance {
+				t.Errorf("bad balance after coupon %q, expected %v, got %v", args.coupon, expectedBalance, balance)
+			}
+		})
+	}
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var ErrDepositSettled error = errors.New("deposit already settled")
+
+// Deposit is money paid in through the payment provider. It is credited to the wallet
+// when the provider reports the payment succeeded
+type Deposit struct {
+	depositId int
+	userId    int
+	amount    Money
+	intentId  string // the provider's payment intent
+	status    PaymentStatus
+	createdAt time.Time
+	updatedAt time.Time
+}
+
+func (d Deposit) String() string {
+	return fmt.Sprintf("deposit: %v, amount: %v, status: %v, created: %v, updated: %v",
+		d.depositId, d.amount, d.status, d.createdAt.String(), d.updatedAt.String())
+}
+
+const depositColumns = `deposit_id, user_id, CAST(amount*100 AS BIGINT), currency, intent_id, status, created_at, updated_at`
+
+func scanDeposit(row *sql.Row) (Deposit, error) {
+	var deposit Deposit
+	err := row.Scan(&deposit.depositId, &deposit.userId, &deposit.amount.amount, &deposit.amount.currency,
+		&deposit.intentId, &deposit.status, &deposit.createdAt, &deposit.updatedAt)
+	return deposit, err
+}
+
+// CreateDeposit records a pending deposit for a payment intent created for the user
+func (s *SqlDB) CreateDeposit(userId int, intent PaymentIntent) (Deposit, error) {
+	query := `INSERT INTO deposits (user_id, amount, currency, intent_id, status)
+			  VALUES ($1, CAST($2 AS NUMERIC(12, 0))/100, $3, $4, $5)
+			  RETURNING ` + depositColumns
+	return scanDeposit(s.db.QueryRow(query, userId, intent.amount.amount, intent.amount.currency, intent.intentId, PaymentPending))
+}
+
+// GetDeposit returns one of the user's deposits
+func (s *SqlDB) GetDeposit(userId int, depositId int) (Deposit, error) {
+	query := `SELECT ` + depositColumns + ` FROM deposits WHERE deposit_id=$1 AND user_id=$2`
+	return scanDeposit(s.db.QueryRow(query, depositId, userId))
+}
+
+// SettleDeposit moves the pending deposit for an intent to the status reported by the
+// provider, crediting the wallet if the payment succeeded. A succeeded deposit can still
+// be refunded by the provider, which takes it back out of the wallet or fails with
+// ErrInsufficientFunds if it has been spent. Settling to the status the deposit already
+// has does nothing so repeated webhooks are harmless. If the wallet can't hold the deposit
+// ErrBalanceTooLarge is returned with the unchanged deposit, so its payment can be refunded
+func (s *SqlDB) SettleDeposit(intentId string, to PaymentStatus) (deposit Deposit, err error) {
+	var tx *sql.Tx
+	tx, err = s.db.Begin()
+	if err != nil {
+		return Deposit{}, err
+	}
+
+	// Rollback or commit depending on err
+	defer func() {
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	getDepositQuery := `SELECT ` + depositColumns + ` FROM deposits WHERE intent_id=$1 FOR UPDATE`
+	deposit, err = scanDeposit(tx.QueryRow(getDepositQuery, intentId))
+	if err != nil {
+		return Deposit{}, err
+	}
+	if deposit.status == to {
+		return deposit, nil
+	}
+	refunding := deposit.status == PaymentSucceeded && to == PaymentRefunded
+	if (deposit.status != PaymentPending && !refunding) || to == PaymentPending {
+		return Deposit{}, ErrDepositSettled
+	}
+
+	if refunding {
+		reversal := LedgerEntry{userId: deposit.userId, amount: deposit.amount, kind: LedgerDepositReversal, referenceId: deposit.depositId}
+		if err = debitWallet(tx, reversal); err != nil {
+			return Deposit{}, err
+		}
+	}
+	if to == PaymentSucceeded {
+		credit := LedgerEntry{userId: deposit.userId, amount: deposit.amount, kind: LedgerDeposit, referenceId: deposit.depositId}
+		if _, err = creditWallet(tx, credit); err != nil {
+			return deposit, err
+		}
+		event := depositSucceededEvent{deposit.depositId, deposit.userId, deposit.amount}
+		if err = recordEvent(tx, EventDepositSucceeded, deposit.userId, event); err != nil {
+			return Deposit{}, err
+		}
+	}
+
+	updateQuery := `UPDATE deposits SET status=$1, updated_at=NOW() WHERE deposit_id=$2 RETURNING updated_at`
+	err = tx.QueryRow(updateQuery, to, deposit.depositId).Scan(&deposit.updatedAt)
+	if err != nil {
+		return Deposit{}, err
+	}
+	deposit.status = to
+	return deposit, nil
+}
+
+// settleDeposit records the provider's outcome for an intent. Payments the wallet can't
+// hold are refunded instead of credited
+func (env *Env) settleDeposit(intentId string, status PaymentStatus) (Deposit, error) {
+	deposit, err := env.db.SettleDeposit(intentId, status)
+	if err == ErrBalanceTooLarge {
+		if err := env.payments.Refund(intentId, deposit.amount); err != nil {
+			return Deposit{}, err
+		}
+		return env.db.SettleDeposit(intentId, PaymentRefunded)
+	}
+	return deposit, err
+}
+
+func (env *Env) Deposit(w http.ResponseWriter, r *http.Request) {
+	userId, ok := r.Context().Value(CtxUserId).(int)
+	if !ok {
+		env.logger.Println("context does not include userId for protected endpoint")
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if env.payments == nil {
+		http.Error(w, "Deposits unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	// Parse wallet currency
+	currency, err := parseCurrency(r.FormValue("currency"))
+	if err != nil {
+		http.Error(w, "Unknown currency", http.StatusBadRequest)
+		return
+	}
+
+	// Parse deposit amount exactly and check it is within the deposit limits
+	amount, err := ParseMoney(r.FormValue("amount"), currency)
+	if err != nil {
+		http.Error(w, "Invalid amount", http.StatusBadRequest)
+		return
+	}
+	if amount.amount < MinDeposit || amount.amount > MaxDeposit {
+		http.Error(w, fmt.Sprintf("Deposit must be between %v and %v",
+			Money{MinDeposit, currency}, Money{MaxDeposit, currency}), http.StatusBadRequest)
+		return
+	}
+
+	// Don't take payments the wallet can't hold, settling checks again in case of racing deposits
+	balance, err := env.db.Balance(userId, currency)
+	if err != nil {
+		env.logger.Println(err.Error())
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if balance.amount+amount.amount > MaxAmount {
+		http.Error(w, "Balance limit exceeded", http.StatusBadRequest)
+		return
+	}
+
+	// Create the payment, the wallet is credited once it succeeds
+	intent, err := env.payments.CreateIntent(amount)
+	if err != nil {
+		env.logger.Println(err.Error())
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return
+	}
+	deposit, err := env.db.CreateDeposit(userId, intent)
+	if err != nil {
+		env.logger.Println(err.Error())
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintln(w, deposit)
+}
+
+// userDeposit gets the deposit in the path for the user, writing an error if it can't
+func (env *Env) userDeposit(w http.ResponseWriter, r *http.Request, userId int) (Deposit, bool) {
+	depositId, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return Deposit{}, false
+	}
+
+	// Other users' deposits are reported as not found
+	deposit, err := env.db.GetDeposit(userId, depositId)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return Deposit{}, false
+		}
+		env.logger.Println(err.Error())
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return Deposit{}, false
+	}
+	return deposit, true
+}
+
+func (env *Env) DepositStatus(w http.ResponseWriter, r *http.Request) {
+	userId, ok := r.Context().Value(CtxUserId).(int)
+	if !ok {
+		env.logger.Println("context does not include userId for protected endpoint")
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	if deposit, ok := env.userDeposit(w, r, userId); ok {
+		fmt.Fprintln(w, deposit)
+	}
+}
+
+// ConfirmDeposit asks the provider to confirm the deposit's payment. Providers that
+// confirm asynchronously report the outcome to PaymentWebhook instead
+func (env *Env) ConfirmDeposit(w http.ResponseWriter, r *http.Request) {
+	userId, ok := r.Context().Value(CtxUserId).(int)
+	if !ok {
+		env.logger.Println("context does not include userId for protected endpoint")
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if env.payments == nil {
+		http.Error(w, "Deposits unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	deposit, ok := env.userDeposit(w, r, userId)
+	if !ok {
+		return
+	}
+
+	// Confirm the payment and settle the deposit if the outcome is already known
+	intent, err := env.payments.Confirm(deposit.intentId)
+	if err != nil {
+		env.logger.Println(err.Error())
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return
+	}
+	if intent.status != PaymentPending {
+		deposit, err = env.settleDeposit(deposit.intentId, intent.status)
+		if err != nil {
+			if err == ErrDepositSettled {
+				http.Error(w, "Deposit already settled", http.StatusConflict)
+				return
+			}
+			env.logger.Println(err.Error())
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+	}
+	fmt.Fprintln(w, deposit)
+}
+
+// PaymentWebhook receives payment outcomes from the provider. It isn't behind a session,
+// the provider's signature is checked instead
+func (env *Env) PaymentWebhook(w http.ResponseWriter, r *http.Request) {
+	if env.payments == nil {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	// Read and verify the event
+	payload, err := io.ReadAll(http.MaxBytesReader(w, r.Body, MaxWebhookSize))
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	event, err := env.payments.VerifyWebhook(r.Header, payload, time.Now())
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	switch event.Status {
+	case PaymentPending:
+		return
+	case PaymentSucceeded, PaymentFailed, PaymentRefunded:
+	default:
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	// Settle the deposit, unknown intents are reported so the provider retries them
+	_, err = env.settleDeposit(event.IntentId, event.Status)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+		if err == ErrDepositSettled {
+			env.logger.Printf("payment %v reported %v for a settled deposit", event.IntentId, event.Status)
+			http.Error(w, "Deposit already settled", http.StatusConflict)
+			return
+		}
+		if err == ErrInsufficientFunds {
+			// Left for support to recover, the refund is retried in case money comes in
+			env.logger.Printf("payment %v refunded after the deposit was spent", event.IntentId)
+			http.Error(w, "Deposit already spent", http.StatusConflict)
+			return
+		}
+		env.logger.Println(err.Error())
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+}
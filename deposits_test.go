@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// createTestDeposit creates a pending deposit of amount through the handler
+func createTestDeposit(t *testing.T, env *Env, userId int, amount string) Deposit {
+	t.Helper()
+	recorder := httptest.NewRecorder()
+	env.Deposit(recorder, newCartRequest("PATCH", "/api/deposit?amount="+amount, userId))
+	result := recorder.Result()
+	body, _ := io.ReadAll(result.Body)
+	if result.StatusCode != http.StatusOK {
+		t.Fatalf("bad status code creating deposit, expected %v, got %v: %s", http.StatusOK, result.StatusCode, body)
+	}
+
+	var depositId int
+	if _, err := fmt.Sscanf(string(body), "deposit: %d", &depositId); err != nil {
+		t.Fatalf("deposit id missing from %q", body)
+	}
+	deposit, err := env.db.GetDeposit(userId, depositId)
+	if err != nil {
+		t.Fatalf("created deposit not found, %v", err)
+	}
+	return deposit
+}
+
+func newWebhookRequest(payload []byte, header http.Header) *http.Request {
+	request := httptest.NewRequest("POST", "/api/payments/webhook", bytes.NewReader(payload))
+	for key, values := range header {
+		request.Header[key] = values
+	}
+	return request
+}
+
+// sendTestWebhook signs event with the test provider and delivers it, returning the status
+func sendTestWebhook(t *testing.T, env *Env, event PaymentEvent) int {
+	t.Helper()
+	payload, header, err := testPayments.SignWebhook(event, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := httptest.NewRecorder()
+	env.PaymentWebhook(recorder, newWebhookRequest(payload, header))
+	return recorder.Result().StatusCode
+}
+
+func TestDeposit(t *testing.T) {
+	env := NewTestEnv()
+	env.db = newTestDB(t)
+	userId := 1
+	startBalance, _ := env.db.Balance(userId, DefaultCurrency)
+
+	// Deposits are only credited once paid
+	for _, args := range []struct {
+		amount   string
+		expected int
+	}{
+		{"abc", http.StatusBadRequest},
+		{"1e6", http.StatusBadRequest},
+		{"NaN", http.StatusBadRequest},
+		{"-5", http.StatusBadRequest},
+		{"1.001", http.StatusBadRequest},
+		{"0.99", http.StatusBadRequest},
+		{"10000.01", http.StatusBadRequest},
+		{"0.29", http.StatusBadRequest},
+		{"1.29", http.StatusOK},
+		{"10000", http.StatusOK},
+	} {
+		recorder := httptest.NewRecorder()
+		env.Deposit(recorder, newCartRequest("PATCH", "/api/deposit?amount="+args.amount, userId))
+		if result := recorder.Result(); result.StatusCode != args.expected {
+			t.Errorf("bad status code for deposit of %q, expected %v, got %v", args.amount, args.expected, result.StatusCode)
+		}
+		if balance, _ := env.db.Balance(userId, DefaultCurrency); balance != startBalance {
+			t.Errorf("balance changed by unpaid deposit of %q, expected %v, got %v", args.amount, startBalance, balance)
+		}
+	}
+
+	// Deposits that would overflow the balance column are rejected
+	creditTestWallet(userId, Money{MaxAmount - startBalance.amount, DefaultCurrency})
+	recorder := httptest.NewRecorder()
+	env.Deposit(recorder, newCartRequest("PATCH", "/api/deposit?amount=1", userId))
+	if result := recorder.Result(); result.StatusCode != http.StatusBadRequest {
+		t.Errorf("bad status code for deposit over the balance limit, expected %v, got %v", http.StatusBadRequest, result.StatusCode)
+	}
+
+	// Without a provider deposits are disabled
+	env.payments = nil
+	recorder = httptest.NewRecorder()
+	env.Deposit(recorder, newCartRequest("PATCH", "/api/deposit?amount=5", userId))
+	if result := recorder.Result(); result.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("bad status code for deposit without a provider, expected %v, got %v", http.StatusServiceUnavailable, result.StatusCode)
+	}
+}
+
+func TestConfirmDeposit(t *testing.T) {
+	env := NewTestEnv()
+	env.db = newTestDB(t)
+	userId := 1
+	startBalance, _ := env.db.Balance(userId, DefaultCurrency)
+
+	deposit := createTestDeposit(t, env, userId, "25.50")
+	if deposit.status != PaymentPending {
+		t.Fatalf("new deposit should be pending, got %v", deposit.status)
+	}
+
+	for _, args := range []struct {
+		name     string
+		userId   int
+		expected int
+		balance  int
+	}{
+		{"ConfirmOtherUsersDeposit", 2, http.StatusNotFound, 0},
+		{"ConfirmDeposit", userId, http.StatusOK, 2550},
+		{"ConfirmDepositAgain", userId, http.StatusOK, 2550},
+	} {
+		recorder := httptest.NewRecorder()
+		request := newCartRequest("POST", fmt.Sprintf("/api/deposits/%v/confirm", deposit.depositId), args.userId)
+		request.SetPathValue("id", fmt.Sprint(deposit.depositId))
+		env.ConfirmDeposit(recorder, request)
+		if result := recorder.Result(); result.StatusCode != args.expected {
+			t.Errorf("bad status code for %v, expected %v, got %v", args.name, args.expected, result.StatusCode)
+		}
+		if balance, _ := env.db.Balance(userId, DefaultCurrency); balance.amount != startBalance.amount+args.balance {
+			t.Errorf("bad balance after %v, expected %v, got %v", args.name, startBalance.amount+args.balance, balance.amount)
+		}
+	}
+
+	if deposit, _ = env.db.GetDeposit(userId, deposit.depositId); deposit.status != PaymentSucceeded {
+		t.Errorf("confirmed deposit should have succeeded, got %v", deposit.status)
+	}
+}
+
+func TestDepositRefundedOverLimit(t *testing.T) {
+	for name, confirm := range map[string]bool{"Confirmed": true, "WebhookOnly": false} {
+		t.Run(name, func(t *testing.T) {
+			env := NewTestEnv()
+			env.db = newTestDB(t)
+			userId := 1
+			startBalance, _ := env.db.Balance(userId, DefaultCurrency)
+
+			// The wallet fills up between creating and paying the deposit
+			deposit := createTestDeposit(t, env, userId, "5")
+			creditTestWallet(userId, Money{MaxAmount - startBalance.amount, DefaultCurrency})
+			if confirm {
+				if _, err := testPayments.Confirm(deposit.intentId); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if status := sendTestWebhook(t, env, PaymentEvent{deposit.intentId, PaymentSucceeded}); status != http.StatusOK {
+				t.Fatalf("bad status code for webhook, expected %v, got %v", http.StatusOK, status)
+			}
+			if deposit, _ = env.db.GetDeposit(userId, deposit.depositId); deposit.status != PaymentRefunded {
+				t.Errorf("deposit over the balance limit should be refunded, got %v", deposit.status)
+			}
+			if balance, _ := env.db.Balance(userId, DefaultCurrency); balance.amount != MaxAmount {
+				t.Errorf("refunded deposit changed the balance, expected %v, got %v", MaxAmount, balance.amount)
+			}
+		})
+	}
+}
+
+func TestPaymentWebhook(t *testing.T) {
+	env := NewTestEnv()
+	env.db = newTestDB(t)
+	userId := 1
+	startBalance, _ := env.db.Balance(userId, DefaultCurrency)
+
+	paid := createTestDeposit(t, env, userId, "10")
+	declined := createTestDeposit(t, env, userId, "20")
+	spent := createTestDeposit(t, env, userId, "30")
+
+	for _, args := range []struct {
+		name     string
+		event    PaymentEvent
+		expected int
+		balance  int
+	}{
+		{"WebhookUnknownIntent", PaymentEvent{"fake_unknown", PaymentSucceeded}, http.StatusNotFound, 0},
+		{"WebhookUnknownStatus", PaymentEvent{paid.intentId, "bogus"}, http.StatusBadRequest, 0},
+		{"WebhookPending", PaymentEvent{paid.intentId, PaymentPending}, http.StatusOK, 0},
+		{"WebhookSucceeded", PaymentEvent{paid.intentId, PaymentSucceeded}, http.StatusOK, 1000},
+		{"WebhookRedelivered", PaymentEvent{paid.intentId, PaymentSucceeded}, http.StatusOK, 1000},
+		{"WebhookFailed", PaymentEvent{declined.intentId, PaymentFailed}, http.StatusOK, 1000},
+		{"WebhookSucceededAfterFailed", PaymentEvent{declined.intentId, PaymentSucceeded}, http.StatusConflict, 1000},
+		{"WebhookRefunded", PaymentEvent{paid.intentId, PaymentRefunded}, http.StatusOK, 0},
+		{"WebhookRefundRedelivered", PaymentEvent{paid.intentId, PaymentRefunded}, http.StatusOK, 0},
+		{"WebhookSucceededAfterRefunded", PaymentEvent{paid.intentId, PaymentSucceeded}, http.StatusConflict, 0},
+		{"WebhookSpentSucceeded", PaymentEvent{spent.intentId, PaymentSucceeded}, http.StatusOK, 3000},
+	} {
+		if status := sendTestWebhook(t, env, args.event); status != args.expected {
+			t.Errorf("bad status code for %v, expected %v, got %v", args.name, args.expected, status)
+		}
+		if balance, _ := env.db.Balance(userId, DefaultCurrency); balance.amount != startBalance.amount+args.balance {
+			t.Errorf("bad balance after %v, expected %v, got %v", args.name, startBalance.amount+args.balance, balance.amount)
+		}
+	}
+
+	// A refund of a deposit that has been spent leaves the deposit and wallet alone
+	creditTestWallet(userId, Money{-startBalance.amount - 1000, DefaultCurrency})
+	if status := sendTestWebhook(t, env, PaymentEvent{spent.intentId, PaymentRefunded}); status != http.StatusConflict {
+		t.Errorf("bad status code for refund of spent deposit, expected %v, got %v", http.StatusConflict, status)
+	}
+	if deposit, _ := env.db.GetDeposit(userId, spent.depositId); deposit.status != PaymentSucceeded {
+		t.Errorf("refund of spent deposit should leave it succeeded, got %v", deposit.status)
+	}
+	if balance, _ := env.db.Balance(userId, DefaultCurrency); balance.amount != 2000 {
+		t.Errorf("refund of spent deposit changed the balance, expected %v, got %v", 2000, balance.amount)
+	}
+
+	// Unsigned and tampered webhooks are rejected
+	payload, header, _ := testPayments.SignWebhook(PaymentEvent{declined.intentId, PaymentSucceeded}, time.Now())
+	for name, request := range map[string]*http.Request{
+		"WebhookUnsigned": newWebhookRequest(payload, nil),
+		"WebhookTampered": newWebhookRequest(bytes.Replace(payload, []byte(declined.intentId), []byte(paid.intentId), 1), header),
+	} {
+		recorder := httptest.NewRecorder()
+		env.PaymentWebhook(recorder, request)
+		if result := recorder.Result(); result.StatusCode != http.StatusBadRequest {
+			t.Errorf("bad status code for %v, expected %v, got %v", name, http.StatusBadRequest, result.StatusCode)
+		}
+	}
+}
+
+func TestFakeVerifyWebhook(t *testing.T) {
+	t.Parallel()
+	provider := NewFakePaymentProvider([]byte("secret"))
+	event := PaymentEvent{"fake_intent", PaymentSucceeded}
+	now := time.Now()
+	payload, header, err := provider.SignWebhook(event, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	otherPayload, otherHeader, _ := NewFakePaymentProvider([]byte("other")).SignWebhook(event, now)
+
+	// While rotating secrets the provider signs with both, either may come first
+	_, signature, _ := strings.Cut(header.Get("Payment-Signature"), ",")
+	rotatedHeader := http.Header{}
+	rotatedHeader.Set("Payment-Signature", otherHeader.Get("Payment-Signature")+","+signature)
+
+	for name, args := range map[string]struct {
+		header  http.Header
+		payload []byte
+		now     time.Time
+		valid   bool
+	}{
+		"valid":          {header, payload, now, true},
+		"clock skew":     {header, payload, now.Add(-WebhookTolerance), true},
+		"rotated secret": {rotatedHeader, payload, now, true},
+		"replayed":       {header, payload, now.Add(WebhookTolerance + time.Second), false},
+		"other secret":   {otherHeader, otherPayload, now, false},
+		"no header":      {http.Header{}, payload, now, false},
+		"tampered":       {header, append(payload, ' '), now, false},
+	} {
+		verified, err := provider.VerifyWebhook(args.header, args.payload, args.now)
+		if args.valid && (err != nil || verified != event) {
+			t.Errorf("%v: expected %v, got %v %v", name, event, verified, err)
+		}
+		if !args.valid && err != ErrInvalidWebhook {
+			t.Errorf("%v: expected %v, got %v %v", name, ErrInvalidWebhook, verified, err)
+		}
+	}
+}
@@ -0,0 +1,666 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+)
+
+var ErrDisputeExists error = errors.New("purchase already disputed")
+var ErrNotDisputable error = errors.New("purchase can't be disputed")
+var ErrDisputeClosed error = errors.New("dispute is closed")
+
+// DisputeWindow is how long after a purchase the buyer can dispute it
+const DisputeWindow = 30 * 24 * time.Hour
+
+// MaxDisputeMessageLength is the longest message in a dispute thread, in bytes
+const MaxDisputeMessageLength = 2000
+
+type DisputeStatus string
+
+const (
+	DisputeOpen      DisputeStatus = "open"
+	DisputeReview    DisputeStatus = "under_review"
+	DisputeRefunded  DisputeStatus = "refunded"
+	DisputeRejected  DisputeStatus = "rejected"
+	DisputeWithdrawn DisputeStatus = "withdrawn"
+)
+
+// disputeTransitions lists the statuses each status can move to, refunded, rejected and
+// withdrawn are final
+var disputeTransitions = map[DisputeStatus][]DisputeStatus{
+	DisputeOpen:   {DisputeReview, DisputeRefunded, DisputeRejected, DisputeWithdrawn},
+	DisputeReview: {DisputeRefunded, DisputeRejected, DisputeWithdrawn},
+}
+
+func (s DisputeStatus) CanTransition(to DisputeStatus) bool {
+	return slices.Contains(disputeTransitions[s], to)
+}
+
+// closed reports whether the dispute is settled, its thread is closed and it no longer
+// holds the order's escrow
+func (s DisputeStatus) closed() bool {
+	return len(disputeTransitions[s]) == 0
+}
+
+// Dispute is a buyer's complaint about a purchase, reviewed by an admin. The seller's escrow
+// for the order is frozen while it is open
+type Dispute struct {
+	disputeId  int
+	purchaseId int
+	orderId    int
+	itemId     int
+	buyerId    int
+	sellerId   int   // 0 if the marketplace sold the item
+	amount     Money // price paid for the purchase
+	refunded   int   // refunded to the buyer, in amount's currency
+	status     DisputeStatus
+	reviewerId int // the admin who last moved the dispute, 0 if none has
+	createdAt  time.Time
+	updatedAt  time.Time
+}
+
+func (d Dispute) String() string {
+	return fmt.Sprintf("dispute: %v, purchase: %v, order: %v, item: %v, amount: %v, refunded: %v, status: %v, created: %v, updated: %v",
+		d.disputeId, d.purchaseId, d.orderId, d.itemId, d.amount, Money{d.refunded, d.amount.currency}, d.status,
+		d.createdAt.String(), d.updatedAt.String())
+}
+
+// canAccess reports whether the user is the dispute's buyer or seller
+func (d Dispute) canAccess(userId int) bool {
+	return userId == d.buyerId || (d.sellerId != 0 && userId == d.sellerId)
+}
+
+type DisputeMessage struct {
+	messageId  int
+	disputeId  int
+	authorId   int
+	authorName string
+	body       string
+	createdAt  time.Time
+}
+
+func (d DisputeMessage) String() string {
+	return fmt.Sprintf("message: %v, from: %v, created: %v, body: %q", d.messageId, d.authorName, d.createdAt.String(), d.body)
+}
+
+const disputeColumns = `dispute_id, purchase_id, order_id, item_id, buyer_id, COALESCE(seller_id, 0), CAST(amount*100 AS BIGINT), currency,
+						CAST(refunded*100 AS BIGINT), status, COALESCE(reviewed_by, 0), created_at, updated_at`
+
+func scanDispute(row rowScanner) (Dispute, error) {
+	var dispute Dispute
+	err := row.Scan(&dispute.disputeId, &dispute.purchaseId, &dispute.orderId, &dispute.itemId, &dispute.buyerId, &dispute.sellerId,
+		&dispute.amount.amount, &dispute.amount.currency, &dispute.refunded, &dispute.status, &dispute.reviewerId,
+		&dispute.createdAt, &dispute.updatedAt)
+	return dispute, err
+}
+
+// OpenDispute disputes one of the user's purchases, starting its thread with reason and
+// freezing the order's escrow. sql.ErrNoRows is returned if the purchase isn't theirs,
+// ErrNotDisputable if its order was refunded or DisputeWindow has passed and
+// ErrDisputeExists if it is already disputed
+func (s *SqlDB) OpenDispute(userId int, purchaseId int, reason string, now time.Time) (dispute Dispute, err error) {
+	var tx *sql.Tx
+	tx, err = s.db.Begin()
+	if err != nil {
+		return Dispute{}, err
+	}
+
+	// Rollback or commit depending on err
+	defer func() {
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	// Lock the order so it can't be refunded while the dispute opens
+	var orderStatus OrderStatus
+	var purchasedAt time.Time
+	dispute = Dispute{purchaseId: purchaseId, buyerId: userId}
+	// The seller is who was paid for the purchase, the item may have another one since
+	purchaseQuery := `SELECT purchases.order_id, purchases.item_id, COALESCE(purchases.seller_id, 0), CAST(purchases.price*100 AS BIGINT),
+					  purchases.currency, purchases.purchased_at, orders.status
+					  FROM purchases
+					  JOIN orders ON purchases.order_id=orders.order_id
+					  WHERE purchases.purchase_id=$1 AND purchases.user_id=$2
+					  FOR UPDATE OF orders`
+	err = tx.QueryRow(purchaseQuery, purchaseId, userId).Scan(&dispute.orderId, &dispute.itemId, &dispute.sellerId, &dispute.amount.amount,
+		&dispute.amount.currency, &purchasedAt, &orderStatus)
+	if err != nil {
+		return Dispute{}, err
+	}
+	if orderStatus == OrderRefunded || orderStatus == OrderCancelled || now.Sub(purchasedAt) > DisputeWindow {
+		return Dispute{}, ErrNotDisputable
+	}
+	var exists bool
+	if err = tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM disputes WHERE purchase_id=$1)`, purchaseId).Scan(&exists); err != nil {
+		return Dispute{}, err
+	}
+	if exists {
+		return Dispute{}, ErrDisputeExists
+	}
+
+	addQuery := `INSERT INTO disputes (purchase_id, order_id, item_id, buyer_id, seller_id, amount, currency, status, created_at, updated_at)
+				 VALUES ($1, $2, $3, $4, NULLIF($5, 0), CAST($6 AS NUMERIC(12, 0))/100, $7, $8, $9, $9)
+				 RETURNING ` + disputeColumns
+	dispute, err = scanDispute(tx.QueryRow(addQuery, purchaseId, dispute.orderId, dispute.itemId, userId, dispute.sellerId,
+		dispute.amount.amount, dispute.amount.currency, DisputeOpen, now))
+	if err != nil {
+		return Dispute{}, err
+	}
+	messageQuery := `INSERT INTO dispute_messages (dispute_id, author_id, body, created_at) VALUES ($1, $2, $3, $4)`
+	if _, err = tx.Exec(messageQuery, dispute.disputeId, userId, reason, now); err != nil {
+		return Dispute{}, err
+	}
+	if _, err = freezeEscrows(tx, dispute.orderId); err != nil {
+		return Dispute{}, err
+	}
+	if err = recordDisputeEvent(tx, dispute); err != nil {
+		return Dispute{}, err
+	}
+	return dispute, nil
+}
+
+func (s *SqlDB) GetDispute(disputeId int) (Dispute, error) {
+	return scanDispute(s.db.QueryRow(`SELECT `+disputeColumns+` FROM disputes WHERE dispute_id=$1`, disputeId))
+}
+
+func (s *SqlDB) queryDisputes(query string, args ...any) ([]Dispute, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var disputes []Dispute
+	for rows.Next() {
+		dispute, err := scanDispute(rows)
+		if err != nil {
+			return nil, err
+		}
+		disputes = append(disputes, dispute)
+	}
+
+	return disputes, rows.Err()
+}
+
+// Disputes returns the disputes the user opened or that were opened against their sales,
+// newest first
+func (s *SqlDB) Disputes(userId int) ([]Dispute, error) {
+	return s.queryDisputes(`SELECT `+disputeColumns+` FROM disputes WHERE buyer_id=$1 OR seller_id=$1 ORDER BY dispute_id DESC`, userId)
+}
+
+// ActiveDisputes returns the disputes waiting for an admin, oldest first
+func (s *SqlDB) ActiveDisputes() ([]Dispute, error) {
+	return s.queryDisputes(`SELECT `+disputeColumns+` FROM disputes WHERE status IN ($1, $2) ORDER BY dispute_id`, DisputeOpen, DisputeReview)
+}
+
+// DisputeMessages returns the dispute's thread, oldest first
+func (s *SqlDB) DisputeMessages(disputeId int) ([]DisputeMessage, error) {
+	query := `SELECT dispute_messages.message_id, dispute_messages.dispute_id, dispute_messages.author_id, users.username,
+			  dispute_messages.body, dispute_messages.created_at
+			  FROM dispute_messages
+			  JOIN users ON dispute_messages.author_id=users.user_id
+			  WHERE dispute_messages.dispute_id=$1
+			  ORDER BY dispute_messages.message_id`
+	rows, err := s.db.Query(query, disputeId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var messages []DisputeMessage
+	var message DisputeMessage
+	for rows.Next() {
+		err := rows.Scan(&message.messageId, &message.disputeId, &message.authorId, &message.authorName, &message.body, &message.createdAt)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, message)
+	}
+
+	return messages, rows.Err()
+}
+
+// AddDisputeMessage adds to the dispute's thread, failing with ErrDisputeClosed once the
+// dispute is settled
+func (s *SqlDB) AddDisputeMessage(disputeId int, authorId int, body string) (DisputeMessage, error) {
+	message := DisputeMessage{disputeId: disputeId, authorId: authorId, body: body}
+	query := `WITH added AS (
+				  INSERT INTO dispute_messages (dispute_id, author_id, body)
+				  SELECT dispute_id, $2, $3 FROM disputes WHERE dispute_id=$1 AND status IN ($4, $5)
+				  RETURNING message_id, created_at
+			  )
+			  SELECT added.message_id, users.username, added.created_at FROM added, users WHERE users.user_id=$2`
+	err := s.db.QueryRow(query, disputeId, authorId, body, DisputeOpen, DisputeReview).Scan(&message.messageId, &message.authorName, &message.createdAt)
+	if err == sql.ErrNoRows {
+		return DisputeMessage{}, ErrDisputeClosed
+	}
+	return message, err
+}
+
+// TransitionDispute moves a dispute to a new status as the admin reviewerId, 0 when the
+// buyer withdraws it. Refunding credits refund to the buyer, or the whole amount if refund
+// is 0, taking it from the seller's escrow or from the seller's wallet once the escrow was
+// released. ErrRefundTooLarge is returned if refund is more than the buyer paid. The
+// order's escrow is unfrozen when its last open dispute closes
+func (s *SqlDB) TransitionDispute(disputeId int, to DisputeStatus, refund int, reviewerId int) (dispute Dispute, err error) {
+	var tx *sql.Tx
+	tx, err = s.db.Begin()
+	if err != nil {
+		return Dispute{}, err
+	}
+
+	// Rollback or commit depending on err
+	defer func() {
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	dispute, err = scanDispute(tx.QueryRow(`SELECT `+disputeColumns+` FROM disputes WHERE dispute_id=$1 FOR UPDATE`, disputeId))
+	if err != nil {
+		return Dispute{}, err
+	}
+	if !dispute.status.CanTransition(to) {
+		return Dispute{}, ErrInvalidTransition
+	}
+
+	// Lock the order so refunds of the dispute and the order can't overlap
+	var orderStatus OrderStatus
+	err = tx.QueryRow(`SELECT status FROM orders WHERE order_id=$1 FOR UPDATE`, dispute.orderId).Scan(&orderStatus)
+	if err != nil {
+		return Dispute{}, err
+	}
+
+	if to == DisputeRefunded {
+		if orderStatus == OrderRefunded {
+			return Dispute{}, ErrInvalidTransition
+		}
+		if refund == 0 {
+			refund = dispute.amount.amount
+		}
+		if refund > dispute.amount.amount {
+			return Dispute{}, ErrRefundTooLarge
+		}
+		if err = refundDispute(tx, dispute, refund); err != nil {
+			return Dispute{}, err
+		}
+		dispute.refunded = refund
+	}
+
+	updateQuery := `UPDATE disputes SET status=$1, refunded=CAST($2 AS NUMERIC(12, 0))/100, reviewed_by=COALESCE(NULLIF($3, 0), reviewed_by),
+					updated_at=NOW()
+					WHERE dispute_id=$4
+					RETURNING ` + disputeColumns
+	dispute, err = scanDispute(tx.QueryRow(updateQuery, to, dispute.refunded, reviewerId, disputeId))
+	if err != nil {
+		return Dispute{}, err
+	}
+
+	if to.closed() {
+		var open bool
+		openQuery := `SELECT EXISTS (SELECT 1 FROM disputes WHERE order_id=$1 AND status IN ($2, $3))`
+		if err = tx.QueryRow(openQuery, dispute.orderId, DisputeOpen, DisputeReview).Scan(&open); err != nil {
+			return Dispute{}, err
+		}
+		if !open {
+			if _, err = transitionEscrows(tx, dispute.orderId, EscrowHeld); err != nil {
+				return Dispute{}, err
+			}
+		}
+	}
+	if err = recordDisputeEvent(tx, dispute); err != nil {
+		return Dispute{}, err
+	}
+	return dispute, nil
+}
+
+// refundDispute credits refund to the buyer, taking it from the seller's escrow while it
+// is held or from their wallet once it has been released. Refunds from the wallet keep the
+// hold of the sale, like reverseSales, so held money stays balanced
+func refundDispute(tx *sql.Tx, dispute Dispute, refund int) error {
+	currency := dispute.amount.currency
+	if err := lockWallets(tx, []int{dispute.buyerId, dispute.sellerId}, currency); err != nil {
+		return err
+	}
+	if dispute.sellerId != 0 {
+		escrowQuery := `UPDATE escrows SET amount=amount-CAST($1 AS NUMERIC(12, 0))/100,
+						status=CASE WHEN amount=CAST($1 AS NUMERIC(12, 0))/100 THEN $2 ELSE status END, updated_at=NOW()
+						WHERE order_id=$3 AND seller_id=$4 AND status IN ($5, $6)`
+		result, err := tx.Exec(escrowQuery, refund, EscrowRefunded, dispute.orderId, dispute.sellerId, EscrowHeld, EscrowFrozen)
+		if err != nil {
+			return err
+		}
+		if taken, err := result.RowsAffected(); err != nil {
+			return err
+		} else if taken == 0 {
+			var heldUntil sql.NullTime
+			heldQuery := `SELECT MAX(held_until) FROM ledger_entries WHERE user_id=$1 AND reference_id=$2 AND kind=$3`
+			if err := tx.QueryRow(heldQuery, dispute.sellerId, dispute.orderId, LedgerSale).Scan(&heldUntil); err != nil {
+				return err
+			}
+			reversal := LedgerEntry{userId: dispute.sellerId, amount: Money{refund, currency}, kind: LedgerSaleReversal, referenceId: dispute.orderId,
+				heldUntil: heldUntil.Time}
+			if err := debitWallet(tx, reversal); err != nil {
+				return err
+			}
+		}
+	}
+	credit := LedgerEntry{userId: dispute.buyerId, amount: Money{refund, currency}, kind: LedgerRefund, referenceId: dispute.orderId}
+	_, err := creditWallet(tx, credit)
+	return err
+}
+
+// recordDisputeEvent records the dispute's status as part of tx, subscribers notify the
+// buyer and seller
+func recordDisputeEvent(tx *sql.Tx, dispute Dispute) error {
+	event := disputeUpdatedEvent{dispute.disputeId, dispute.orderId, dispute.buyerId, dispute.sellerId, dispute.status}
+	return recordEvent(tx, EventDisputeUpdated, dispute.buyerId, event)
+}
+
+// disputeFor loads the dispute in the request path and checks the user is a party to it or
+// an admin, writing an error response and returning false otherwise. Other users'
+// disputes are reported as not found
+func (env *Env) disputeFor(w http.ResponseWriter, r *http.Request, userId int) (Dispute, bool) {
+	disputeId, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return Dispute{}, false
+	}
+
+	dispute, err := env.db.GetDispute(disputeId)
+	if err == nil && !dispute.canAccess(userId) {
+		var isAdmin bool
+		if isAdmin, err = env.db.IsAdmin(userId); err == nil && !isAdmin {
+			err = sql.ErrNoRows
+		}
+	}
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return Dispute{}, false
+		}
+		env.logger.Println(err.Error())
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return Dispute{}, false
+	}
+	return dispute, true
+}
+
+// transitionDispute moves the dispute to status, writing an error response and returning
+// false if it can't
+func (env *Env) transitionDispute(w http.ResponseWriter, disputeId int, to DisputeStatus, refund int, reviewerId int) (Dispute, bool) {
+	dispute, err := env.db.TransitionDispute(disputeId, to, refund, reviewerId)
+	if err != nil {
+		var statusCode int
+		var message string
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			statusCode = http.StatusNotFound
+			message = http.StatusText(statusCode)
+		case err == ErrInvalidTransition:
+			statusCode = http.StatusConflict
+			message = "Dispute already settled"
+		case err == ErrRefundTooLarge:
+			statusCode = http.StatusBadRequest
+			message = "Refund is more than the buyer paid"
+		case err == ErrInsufficientFunds:
+			statusCode = http.StatusConflict
+			message = "Seller can't cover the refund"
+		case err == ErrBalanceTooLarge:
+			statusCode = http.StatusBadRequest
+			message = "Buyer balance limit exceeded"
+		default:
+			env.logger.Println(err.Error())
+			statusCode = http.StatusInternalServerError
+			message = http.StatusText(statusCode)
+		}
+		http.Error(w, message, statusCode)
+		return Dispute{}, false
+	}
+	return dispute, true
+}
+
+// parseDisputeMessage reads a non-empty message of at most MaxDisputeMessageLength from
+// the form field, writing an error response and returning false otherwise
+func parseDisputeMessage(w http.ResponseWriter, r *http.Request, field string) (string, bool) {
+	message := r.FormValue(field)
+	if len(message) == 0 || len(message) > MaxDisputeMessageLength {
+		http.Error(w, fmt.Sprintf("%v must be between 1 and %v bytes", field, MaxDisputeMessageLength), http.StatusBadRequest)
+		return "", false
+	}
+	return message, true
+}
+
+func (env *Env) OpenDispute(w http.ResponseWriter, r *http.Request) {
+	userId, ok := r.Context().Value(CtxUserId).(int)
+	if !ok {
+		env.logger.Println("context does not include userId for protected endpoint")
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	// Parse purchase id and reason
+	purchaseId, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	reason, ok := parseDisputeMessage(w, r, "reason")
+	if !ok {
+		return
+	}
+
+	// Open the dispute, other users' purchases are reported as not found
+	dispute, err := env.db.OpenDispute(userId, purchaseId, reason, time.Now())
+	if err != nil {
+		var statusCode int
+		var message string
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			statusCode = http.StatusNotFound
+			message = http.StatusText(statusCode)
+		case err == ErrNotDisputable:
+			statusCode = http.StatusBadRequest
+			message = fmt.Sprintf("Purchases can only be disputed for %v days and before they are refunded", DisputeWindow/(24*time.Hour))
+		case err == ErrDisputeExists:
+			statusCode = http.StatusConflict
+			message = "Purchase already disputed"
+		default:
+			env.logger.Println(err.Error())
+			statusCode = http.StatusInternalServerError
+			message = http.StatusText(statusCode)
+		}
+		http.Error(w, message, statusCode)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprintln(w, dispute)
+}
+
+func (env *Env) Disputes(w http.ResponseWriter, r *http.Request) {
+	userId, ok := r.Context().Value(CtxUserId).(int)
+	if !ok {
+		env.logger.Println("context does not include userId for protected endpoint")
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	disputes, err := env.db.Disputes(userId)
+	if err != nil {
+		env.logger.Println(err.Error())
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	// Print disputes as buyer and seller, newest first
+	for _, dispute := range disputes {
+		fmt.Fprintln(w, dispute)
+	}
+}
+
+func (env *Env) Dispute(w http.ResponseWriter, r *http.Request) {
+	userId, ok := r.Context().Value(CtxUserId).(int)
+	if !ok {
+		env.logger.Println("context does not include userId for protected endpoint")
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	dispute, ok := env.disputeFor(w, r, userId)
+	if !ok {
+		return
+	}
+	messages, err := env.db.DisputeMessages(dispute.disputeId)
+	if err != nil {
+		env.logger.Println(err.Error())
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	// Print dispute followed by its thread
+	fmt.Fprintln(w, dispute)
+	for _, message := range messages {
+		fmt.Fprintln(w, message)
+	}
+}
+
+func (env *Env) AddDisputeMessage(w http.ResponseWriter, r *http.Request) {
+	userId, ok := r.Context().Value(CtxUserId).(int)
+	if !ok {
+		env.logger.Println("context does not include userId for protected endpoint")
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	dispute, ok := env.disputeFor(w, r, userId)
+	if !ok {
+		return
+	}
+	body, ok := parseDisputeMessage(w, r, "message")
+	if !ok {
+		return
+	}
+
+	message, err := env.db.AddDisputeMessage(dispute.disputeId, userId, body)
+	if err != nil {
+		if err == ErrDisputeClosed {
+			http.Error(w, "Dispute is closed", http.StatusConflict)
+			return
+		}
+		env.logger.Println(err.Error())
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprintln(w, message)
+}
+
+// WithdrawDispute lets the buyer drop their dispute
+func (env *Env) WithdrawDispute(w http.ResponseWriter, r *http.Request) {
+	userId, ok := r.Context().Value(CtxUserId).(int)
+	if !ok {
+		env.logger.Println("context does not include userId for protected endpoint")
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	dispute, ok := env.disputeFor(w, r, userId)
+	if !ok {
+		return
+	}
+	if dispute.buyerId != userId {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	if dispute, ok = env.transitionDispute(w, dispute.disputeId, DisputeWithdrawn, 0, 0); ok {
+		fmt.Fprintln(w, dispute)
+	}
+}
+
+func (env *Env) ActiveDisputes(w http.ResponseWriter, r *http.Request) {
+	userId, ok := r.Context().Value(CtxUserId).(int)
+	if !ok {
+		env.logger.Println("context does not include userId for protected endpoint")
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if !env.requireAdmin(w, userId) {
+		return
+	}
+
+	disputes, err := env.db.ActiveDisputes()
+	if err != nil {
+		env.logger.Println(err.Error())
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	// Print the queue, oldest first
+	for _, dispute := range disputes {
+		fmt.Fprintln(w, dispute)
+	}
+}
+
+// resolveDispute is the admin handler moving a dispute to status, refunds take an optional
+// amount and refund the whole purchase without one
+func (env *Env) resolveDispute(to DisputeStatus) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userId, ok := r.Context().Value(CtxUserId).(int)
+		if !ok {
+			env.logger.Println("context does not include userId for protected endpoint")
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		if !env.requireAdmin(w, userId) {
+			return
+		}
+
+		// Parse dispute id and refund
+		disputeId, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		refund := 0
+		if value := r.FormValue("amount"); to == DisputeRefunded && len(value) != 0 {
+			refund, err = parseAmount(value)
+			if err != nil || refund == 0 {
+				http.Error(w, "Invalid amount", http.StatusBadRequest)
+				return
+			}
+		}
+
+		if dispute, ok := env.transitionDispute(w, disputeId, to, refund, userId); ok {
+			fmt.Fprintln(w, dispute)
+		}
+	}
+}
+
+// ReviewDispute marks a dispute as being looked at by an admin
+func (env *Env) ReviewDispute(w http.ResponseWriter, r *http.Request) {
+	env.resolveDispute(DisputeReview)(w, r)
+}
+
+// RefundDispute refunds the buyer all or part of a disputed purchase
+func (env *Env) RefundDispute(w http.ResponseWriter, r *http.Request) {
+	env.resolveDispute(DisputeRefunded)(w, r)
+}
+
+// RejectDispute closes a dispute without a refund, releasing the seller's escrow
+func (env *Env) RejectDispute(w http.ResponseWriter, r *http.Request) {
+	env.resolveDispute(DisputeRejected)(w, r)
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testDisputeTransitionsTable = map[string]struct {
+	from     DisputeStatus
+	to       DisputeStatus
+	expected bool
+}{
+	"review open":      {DisputeOpen, DisputeReview, true},
+	"refund open":      {DisputeOpen, DisputeRefunded, true},
+	"reject reviewed":  {DisputeReview, DisputeRejected, true},
+	"withdraw open":    {DisputeOpen, DisputeWithdrawn, true},
+	"reopen reviewed":  {DisputeReview, DisputeOpen, false},
+	"refund rejected":  {DisputeRejected, DisputeRefunded, false},
+	"refund refunded":  {DisputeRefunded, DisputeRefunded, false},
+	"review withdrawn": {DisputeWithdrawn, DisputeReview, false},
+}
+
+func TestDisputeStatusCanTransition(t *testing.T) {
+	t.Parallel()
+	for name, args := range testDisputeTransitionsTable {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			if answer := args.from.CanTransition(args.to); answer != args.expected {
+				t.Errorf("%v -> %v, got %v, expected %v", args.from, args.to, answer, args.expected)
+			}
+		})
+	}
+}
+
+// disputeTestRequest calls a handler taking an id in its path as userId
+func disputeTestRequest(handler http.HandlerFunc, target string, id int, userId int) (int, string) {
+	recorder := httptest.NewRecorder()
+	request := newCartRequest("POST", target, userId)
+	request.SetPathValue("id", fmt.Sprint(id))
+	handler(recorder, request)
+	result := recorder.Result()
+	body, _ := io.ReadAll(result.Body)
+	return result.StatusCode, string(body)
+}
+
+func TestDisputes(t *testing.T) {
+	env := NewTestEnv()
+	env.db = newTestDB(t)
+	buyerId, sellerId, adminId := 1, 2, 3
+	startBuyerBalance, _ := env.db.Balance(buyerId, DefaultCurrency)
+	startSellerBalance, _ := env.db.Balance(sellerId, DefaultCurrency)
+
+	purchase := func() (orderId int, purchaseId int) {
+		t.Helper()
+		creditTestWallet(buyerId, Money{17500, DefaultCurrency})
+		orderId, err := env.db.Purchase(buyerId, 1, 0, "", DefaultCurrency)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return orderId, purchases[len(purchases)-1].purchaseId
+	}
+	openDispute := func(purchaseId int) Dispute {
+		t.Helper()
+		status, body := disputeTestRequest(env.OpenDispute, fmt.Sprintf("/api/purchases/%v/dispute?reason=broken", purchaseId), purchaseId, buyerId)
+		if status != http.StatusCreated {
+			t.Fatalf("bad status code opening a dispute, expected %v, got %v: %v", http.StatusCreated, status, body)
+		}
+		return disputes[len(disputes)-1]
+	}
+	expectBalance := func(name string, userId int, expected int) {
+		t.Helper()
+		if balance, _ := env.db.Balance(userId, DefaultCurrency); balance.amount != expected {
+			t.Errorf("bad balance for user %v after %v, expected %v, got %v", userId, name, expected, balance.amount)
+		}
+	}
+
+	// Opening a dispute freezes the seller's escrow
+	orderId, purchaseId := purchase()
+	for _, args := range []struct {
+		name     string
+		userId   int
+		query    string
+		expected int
+	}{
+		{"OpenNoReason", buyerId, "", http.StatusBadRequest},
+		{"OpenNotBuyer", sellerId, "?reason=broken", http.StatusNotFound},
+		{"OpenDispute", buyerId, "?reason=broken", http.StatusCreated},
+		{"OpenDisputeAgain", buyerId, "?reason=broken", http.StatusConflict},
+	} {
+		target := fmt.Sprintf("/api/purchases/%v/dispute%v", purchaseId, args.query)
+		if status, body := disputeTestRequest(env.OpenDispute, target, purchaseId, args.userId); status != args.expected {
+			t.Errorf("bad status code for %v, expected %v, got %v: %v", args.name, args.expected, status, body)
+		}
+	}
+	refunded := disputes[len(disputes)-1]
+	if status := confirmTestReceipt(env, orderId, buyerId); status != http.StatusConflict {
+		t.Errorf("bad status code confirming a disputed order, expected %v, got %v", http.StatusConflict, status)
+	}
+
+	// The buyer, seller and admins share the thread
+	for _, args := range []struct {
+		name     string
+		userId   int
+		query    string
+		expected int
+	}{
+		{"MessageNoBody", sellerId, "", http.StatusBadRequest},
+		{"MessageSeller", sellerId, "?message=sent+it", http.StatusCreated},
+		{"MessageAdmin", adminId, "?message=checking", http.StatusCreated},
+	} {
+		target := fmt.Sprintf("/api/disputes/%v/messages%v", refunded.disputeId, args.query)
+		if status, body := disputeTestRequest(env.AddDisputeMessage, target, refunded.disputeId, args.userId); status != args.expected {
+			t.Errorf("bad status code for %v, expected %v, got %v: %v", args.name, args.expected, status, body)
+		}
+	}
+	status, body := disputeTestRequest(env.Dispute, fmt.Sprintf("/api/disputes/%v", refunded.disputeId), refunded.disputeId, sellerId)
+	if status != http.StatusOK || !strings.Contains(body, `from: test_user`) || !strings.Contains(body, `body: "sent it"`) ||
+		!strings.Contains(body, `from: admin_test_user`) {
+		t.Errorf("bad dispute thread, got %v: %q", status, body)
+	}
+
+	// Admins review and refund part of the purchase from escrow
+	recorder := httptest.NewRecorder()
+	env.ActiveDisputes(recorder, newCartRequest("GET", "/api/admin/disputes", adminId))
+	if body, _ := io.ReadAll(recorder.Result().Body); !strings.Contains(string(body), fmt.Sprintf("dispute: %v,", refunded.disputeId)) {
+		t.Errorf("open dispute missing from the queue, got %q", body)
+	}
+	for _, args := range []struct {
+		name     string
+		handler  http.HandlerFunc
+		userId   int
+		query    string
+		expected int
+	}{
+		{"ReviewNotAdmin", env.ReviewDispute, sellerId, "", http.StatusForbidden},
+		{"ReviewDispute", env.ReviewDispute, adminId, "", http.StatusOK},
+		{"RefundTooMuch", env.RefundDispute, adminId, "?amount=175.01", http.StatusBadRequest},
+		{"RefundInvalidAmount", env.RefundDispute, adminId, "?amount=0", http.StatusBadRequest},
+		{"RefundPart", env.RefundDispute, adminId, "?amount=50", http.StatusOK},
+		{"RefundAgain", env.RefundDispute, adminId, "?amount=50", http.StatusConflict},
+		{"RejectRefunded", env.RejectDispute, adminId, "", http.StatusConflict},
+	} {
+		target := fmt.Sprintf("/api/admin/disputes/%v/action%v", refunded.disputeId, args.query)
+		if status, body := disputeTestRequest(args.handler, target, refunded.disputeId, args.userId); status != args.expected {
+			t.Errorf("bad status code for %v, expected %v, got %v: %v", args.name, args.expected, status, body)
+		}
+	}
+	if status, _ := disputeTestRequest(env.AddDisputeMessage, "/api/disputes/1/messages?message=thanks", refunded.disputeId, buyerId); status != http.StatusConflict {
+		t.Errorf("bad status code messaging a closed dispute, expected %v, got %v", http.StatusConflict, status)
+	}
+	// Both parties are notified in-app of each change
+	if _, err := env.dispatchEvents(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	for _, userId := range []int{buyerId, sellerId} {
+		var subjects []string
+		inApp, _ := env.db.InAppNotifications(userId)
+		for _, notification := range slices.Backward(inApp) {
+			if notification.kind == NotificationDispute && strings.HasPrefix(notification.subject, fmt.Sprintf("Dispute %v ", refunded.disputeId)) {
+				subjects = append(subjects, notification.subject)
+			}
+		}
+		expected := []string{}
+		for _, status := range []DisputeStatus{DisputeOpen, DisputeReview, DisputeRefunded} {
+			expected = append(expected, fmt.Sprintf("Dispute %v is %v", refunded.disputeId, strings.ReplaceAll(string(status), "_", " ")))
+		}
+		if !slices.Equal(subjects, expected) {
+			t.Errorf("bad notifications for user %v, expected %v, got %v", userId, expected, subjects)
+		}
+	}
+	expectBalance("partial refund", buyerId, startBuyerBalance.amount+5000)
+
+	// What is left in escrow is released to the seller
+	if status := confirmTestReceipt(env, orderId, buyerId); status != http.StatusOK {
+		t.Errorf("bad status code confirming after the dispute, expected %v, got %v", http.StatusOK, status)
+	}
+	expectBalance("release", sellerId, startSellerBalance.amount+12500)
+
+	// Refunding the order only returns what the dispute didn't
+	if err := env.db.TransitionOrder(orderId, OrderRefunded); err != nil {
+		t.Fatal(err)
+	}
+	expectBalance("order refund", buyerId, startBuyerBalance.amount+17500)
+	expectBalance("order refund", sellerId, startSellerBalance.amount)
+
+	// Released sales are refunded from the seller's wallet
+	orderId, purchaseId = purchase()
+	if status := confirmTestReceipt(env, orderId, buyerId); status != http.StatusOK {
+		t.Fatalf("bad status code confirming, expected %v, got %v", http.StatusOK, status)
+	}
+	released := openDispute(purchaseId)
+	if status, body := disputeTestRequest(env.RefundDispute, "/api/admin/disputes/refund", released.disputeId, adminId); status != http.StatusOK {
+		t.Errorf("bad status code refunding a released sale, expected %v, got %v: %v", http.StatusOK, status, body)
+	}
+	expectBalance("released refund", buyerId, startBuyerBalance.amount+17500*2)
+	expectBalance("released refund", sellerId, startSellerBalance.amount)
+
+	// Rejected and withdrawn disputes unfreeze the escrow
+	orderId, purchaseId = purchase()
+	rejected := openDispute(purchaseId)
+	if status, body := disputeTestRequest(env.WithdrawDispute, "/api/disputes/withdraw", rejected.disputeId, sellerId); status != http.StatusForbidden {
+		t.Errorf("bad status code withdrawing as the seller, expected %v, got %v: %v", http.StatusForbidden, status, body)
+	}
+	if status, body := disputeTestRequest(env.RejectDispute, "/api/admin/disputes/reject", rejected.disputeId, adminId); status != http.StatusOK {
+		t.Errorf("bad status code rejecting, expected %v, got %v: %v", http.StatusOK, status, body)
+	}
+	if status := confirmTestReceipt(env, orderId, buyerId); status != http.StatusOK {
+		t.Errorf("bad status code confirming after a rejected dispute, expected %v, got %v", http.StatusOK, status)
+	}
+
+	orderId, purchaseId = purchase()
+	withdrawn := openDispute(purchaseId)
+	if status, body := disputeTestRequest(env.WithdrawDispute, "/api/disputes/withdraw", withdrawn.disputeId, buyerId); status != http.StatusOK {
+		t.Errorf("bad status code withdrawing, expected %v, got %v: %v", http.StatusOK, status, body)
+	}
+	if status := confirmTestReceipt(env, orderId, buyerId); status != http.StatusOK {
+		t.Errorf("bad status code confirming after a withdrawn dispute, expected %v, got %v", http.StatusOK, status)
+	}
+
+	recorder = httptest.NewRecorder()
+	env.Disputes(recorder, newCartRequest("GET", "/api/disputes", sellerId))
+	if body, _ := io.ReadAll(recorder.Result().Body); strings.Count(string(body), "dispute: ") != 4 {
+		t.Errorf("expected the seller's 4 disputes, got %q", body)
+	}
+}
@@ -1,13 +1,27 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
 	"log"
-	"net"
+	"math/big"
+	"mime"
 	"net/http"
+	"net/netip"
+	"os"
+	"path"
 	"runtime/debug"
 	"strconv"
+	"strings"
 	"time"
 
 	_ "github.com/lib/pq"
@@ -20,22 +34,143 @@ const (
 )
 
 type Env struct {
-	logger *log.Logger
-	db     DB
+	logger              *log.Logger
+	db                  DB
+	trustedProxies      []netip.Prefix // peers allowed to set forwarding headers
+	blobs               BlobStore
+	mediaURLs           URLSigner
+	rates               RateProvider
+	priceChanges        chan struct{}                              // wakes the price scheduler
+	payments            PaymentProvider                            // nil if deposits are disabled
+	payouts             PayoutProvider                             // nil if withdrawals are disabled
+	notificationSenders map[NotificationChannel]NotificationSender // notifications on channels without one fail
+	webhookClient       *http.Client                               // see NewWebhookClient
+	events              *EventBus
 }
 
 func NewEnv() (*Env, error) {
-	sqlDb, err := NewSqlDB()
+	logger := log.Default()
+
+	trustedProxies, err := parseTrustedProxies(os.Getenv("TRUSTED_PROXIES"))
+	if err != nil {
+		return nil, err
+	}
+
+	// Media is stored on the local filesystem, links are signed so they can be served without a session
+	mediaDir := os.Getenv("MEDIA_DIR")
+	if len(mediaDir) == 0 {
+		mediaDir = "media"
+	}
+	blobs, err := NewLocalBlobStore(mediaDir)
+	if err != nil {
+		return nil, err
+	}
+	mediaKey := []byte(os.Getenv("MEDIA_SIGNING_KEY"))
+	if len(mediaKey) == 0 {
+		logger.Println("MEDIA_SIGNING_KEY not set, media links will not survive a restart")
+		mediaKey = make([]byte, TokenLength)
+		if _, err := rand.Read(mediaKey); err != nil {
+			return nil, err
+		}
+	}
+
+	// Without a rates file only same currency payments are possible
+	rates := StaticRates{DefaultCurrency: big.NewRat(1, 1)}
+	if ratesFile := os.Getenv("EXCHANGE_RATES_FILE"); len(ratesFile) != 0 {
+		rates, err = LoadStaticRates(ratesFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Deposits need a payment provider, the fake one succeeds every payment so it's only
+	// for local development
+	var payments PaymentProvider
+	switch provider := os.Getenv("PAYMENT_PROVIDER"); provider {
+	case "":
+		logger.Println("PAYMENT_PROVIDER not set, deposits are disabled")
+	case "fake":
+		webhookSecret := []byte(os.Getenv("PAYMENT_WEBHOOK_SECRET"))
+		if len(webhookSecret) == 0 {
+			webhookSecret = make([]byte, TokenLength)
+			if _, err := rand.Read(webhookSecret); err != nil {
+				return nil, err
+			}
+		}
+		payments = NewFakePaymentProvider(webhookSecret)
+	default:
+		return nil, fmt.Errorf("unknown payment provider %q", provider)
+	}
+
+	// Withdrawals need a payout provider, the fake one pays nothing out
+	var payouts PayoutProvider
+	switch provider := os.Getenv("PAYOUT_PROVIDER"); provider {
+	case "":
+		logger.Println("PAYOUT_PROVIDER not set, withdrawals are disabled")
+	case "fake":
+		payouts = NewFakePayoutProvider()
+	default:
+		return nil, fmt.Errorf("unknown payout provider %q", provider)
+	}
+
+	// Notifications are emailed through an SMTP relay, webhooks and in-app need no setup.
+	// Webhook notifications and webhook endpoints share a client that only reaches public addresses
+	webhookClient := NewWebhookClient(WebhookDeliveryTimeout)
+	notificationSenders := map[NotificationChannel]NotificationSender{
+		ChannelWebhook: WebhookNotificationSender{webhookClient},
+	}
+	if smtpAddr := os.Getenv("SMTP_ADDR"); len(smtpAddr) != 0 {
+		smtpFrom := os.Getenv("SMTP_FROM")
+		if len(smtpFrom) == 0 {
+			return nil, errors.New("SMTP_FROM must be set with SMTP_ADDR")
+		}
+		sender, err := NewSMTPSender(smtpAddr, smtpFrom, os.Getenv("SMTP_USERNAME"), os.Getenv("SMTP_PASSWORD"))
+		if err != nil {
+			return nil, err
+		}
+		notificationSenders[ChannelEmail] = sender
+	} else {
+		logger.Println("SMTP_ADDR not set, email notifications are disabled")
+	}
+
+	sqlDb, err := NewSqlDB(rates)
 	if err != nil {
 		return nil, err
 	}
 
+	// Domain events notify users and are sent to webhooks, and are logged until analytics
+	// subscribes to them
+	events := &EventBus{}
+	events.Subscribe("notifications", NotificationEventHandler(sqlDb), notificationEventTypes...)
+	events.Subscribe("webhooks", WebhookEventHandler(sqlDb), webhookEventTypes...)
+	events.Subscribe("log", LogEventHandler(logger), EventUserRegistered, EventPurchaseCreated, EventDepositSucceeded)
+
 	return &Env{
-		logger: log.Default(),
-		db:     sqlDb,
+		logger:              logger,
+		db:                  sqlDb,
+		trustedProxies:      trustedProxies,
+		blobs:               blobs,
+		mediaURLs:           URLSigner{key: mediaKey, prefix: "/media"},
+		rates:               rates,
+		priceChanges:        make(chan struct{}, 1),
+		payments:            payments,
+		payouts:             payouts,
+		notificationSenders: notificationSenders,
+		webhookClient:       webhookClient,
+		events:              events,
 	}, err
 }
 
+// isSecureRequest reports whether the client connection is over https, either
+// directly or as reported by a trusted reverse proxy
+func (env *Env) isSecureRequest(r *http.Request) bool {
+	if r.TLS != nil {
+		return true
+	}
+	addr, err := peerAddr(r)
+	return err == nil && env.isTrustedProxy(addr) && strings.EqualFold(forwardedProto(r.Header), "https")
+}
+
 func (env *Env) Balance(w http.ResponseWriter, r *http.Request) {
 	userId, ok := r.Context().Value(CtxUserId).(int)
 	if !ok {
@@ -44,14 +179,35 @@ func (env *Env) Balance(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Get balance
-	balance, err := env.db.Balance(userId)
+	// Get one wallet if a currency is given, otherwise all of them
+	var balances []Money
+	var err error
+	if len(r.FormValue("currency")) != 0 {
+		var currency Currency
+		var balance Money
+		currency, err = parseCurrency(r.FormValue("currency"))
+		if err != nil {
+			http.Error(w, "Unknown currency", http.StatusBadRequest)
+			return
+		}
+		balance, err = env.db.Balance(userId, currency)
+		balances = []Money{balance}
+	} else {
+		balances, err = env.db.Balances(userId)
+	}
 	if err != nil {
 		env.logger.Println(err.Error())
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
-	fmt.Fprintln(w, "Balance:", convertMoneyPrintable(balance))
+
+	// Users without a wallet have nothing in the default currency
+	if len(balances) == 0 {
+		balances = []Money{{currency: DefaultCurrency}}
+	}
+	for _, balance := range balances {
+		fmt.Fprintln(w, "Balance:", balance)
+	}
 }
 
 func (env *Env) Purchase(w http.ResponseWriter, r *http.Request) {
@@ -69,65 +225,526 @@ func (env *Env) Purchase(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Get optional variant id, required for items with variants
+	var variantId int
+	if variant := r.FormValue("variant"); len(variant) != 0 {
+		variantId, err = strconv.Atoi(variant)
+		if err != nil || variantId <= 0 {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Get currency to pay in
+	currency, err := parseCurrency(r.FormValue("currency"))
+	if err != nil {
+		http.Error(w, "Unknown currency", http.StatusBadRequest)
+		return
+	}
+
 	// Attempt purchase
-	if err := env.db.Purchase(userId, itemId); err != nil {
+	orderId, err := env.db.Purchase(userId, itemId, variantId, r.FormValue("coupon"), currency)
+	if err != nil {
+		if message, ok := couponErrorMessage(err); ok {
+			http.Error(w, message, http.StatusBadRequest)
+			return
+		}
 		var statusCode int
+		var message string
 		switch err {
 		case ErrInsufficientFunds:
 			statusCode = http.StatusForbidden
-			fmt.Fprintln(w, "Insufficient funds")
+			message = "Insufficient funds"
+		case ErrOutOfStock:
+			statusCode = http.StatusConflict
+			message = "Out of stock"
+		case ErrVariantRequired:
+			statusCode = http.StatusBadRequest
+			message = "Variant required"
+		case ErrNoExchangeRate:
+			statusCode = http.StatusBadRequest
+			message = "No exchange rate"
+		case sql.ErrNoRows:
+			statusCode = http.StatusNotFound
 		default:
 			env.logger.Println(err.Error())
 			statusCode = http.StatusInternalServerError
 		}
-		http.Error(w, http.StatusText(statusCode), statusCode)
+		// Write status before any message so it isn't sent as 200
+		if len(message) == 0 {
+			message = http.StatusText(statusCode)
+		}
+		http.Error(w, message, statusCode)
 		return
 	}
 
-	fmt.Fprintln(w, "Success")
+	fmt.Fprintln(w, "Success, order:", orderId)
+}
+
+// parsePriceParam parses an optional price query parameter, returning -1 when absent
+func parsePriceParam(value string) (int, error) {
+	if len(value) == 0 {
+		return -1, nil
+	}
+	return parseAmount(value)
+}
+
+// parseLimitParam parses an optional page size, capped at MaxItemsLimit
+func parseLimitParam(value string) (int, error) {
+	if len(value) == 0 {
+		return DefaultItemsLimit, nil
+	}
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit <= 0 {
+		return 0, strconv.ErrSyntax
+	}
+	return min(limit, MaxItemsLimit), nil
+}
+
+func parseItemQuery(r *http.Request) (ItemQuery, error) {
+	params := r.URL.Query()
+	itemQuery := ItemQuery{
+		cursor: params.Get("cursor"),
+		name:   params.Get("name"),
+		sort:   SortNewest,
+	}
+
+	var err error
+	if itemQuery.limit, err = parseLimitParam(params.Get("limit")); err != nil {
+		return itemQuery, err
+	}
+	if itemQuery.minPrice, err = parsePriceParam(params.Get("min_price")); err != nil {
+		return itemQuery, err
+	}
+	if itemQuery.maxPrice, err = parsePriceParam(params.Get("max_price")); err != nil {
+		return itemQuery, err
+	}
+	if category := params.Get("category"); len(category) != 0 {
+		itemQuery.categoryId, err = strconv.Atoi(category)
+		if err != nil || itemQuery.categoryId <= 0 {
+			return itemQuery, strconv.ErrSyntax
+		}
+	}
+	// Attribute filters are given as attr.<name>=<value>, values are typed by parsing them
+	// as JSON and are otherwise strings, so attr.memory_gb=12 matches the number 12
+	for key, values := range params {
+		name, ok := strings.CutPrefix(key, "attr.")
+		if !ok || len(name) == 0 {
+			continue
+		}
+		if itemQuery.attributes == nil {
+			itemQuery.attributes = make(Attributes)
+		}
+		var value any
+		if err := json.Unmarshal([]byte(values[0]), &value); err != nil {
+			value = values[0]
+		}
+		itemQuery.attributes[name] = value
+	}
+	if sort := params.Get("sort"); len(sort) != 0 {
+		switch itemQuery.sort = ItemSort(sort); itemQuery.sort {
+		case SortNewest, SortPriceAsc, SortPriceDesc, SortName:
+		default:
+			return itemQuery, strconv.ErrSyntax
+		}
+	}
+	return itemQuery, nil
+}
+
+func (env *Env) Items(w http.ResponseWriter, r *http.Request) {
+	// Parse pagination, filters and sort
+	itemQuery, err := parseItemQuery(r)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	// Get items
+	page, err := env.db.Items(itemQuery)
+	if err != nil {
+		if err == ErrInvalidCursor {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		env.logger.Println(err.Error())
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	// Print items, the cursor for the next page is sent as a header
+	if len(page.nextCursor) != 0 {
+		w.Header().Set("X-Next-Cursor", page.nextCursor)
+	}
+	for _, item := range page.items {
+		fmt.Fprintln(w, item)
+	}
 }
 
-func (env *Env) Deposit(w http.ResponseWriter, r *http.Request) {
+func (env *Env) Categories(w http.ResponseWriter, r *http.Request) {
+	// Get categories
+	categories, err := env.db.Categories()
+	if err != nil {
+		env.logger.Println(err.Error())
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	// Print category tree
+	for _, root := range buildCategoryTree(categories) {
+		root.Write(w, 0)
+	}
+}
+
+func (env *Env) Item(w http.ResponseWriter, r *http.Request) {
+	// Get item id
+	itemId, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	// Get item
+	item, err := env.db.GetItem(itemId)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+		env.logger.Println(err.Error())
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	// Get variants
+	variants, err := env.db.ItemVariants(itemId)
+	if err != nil {
+		env.logger.Println(err.Error())
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	// Print item followed by its variants
+	fmt.Fprintln(w, item)
+	for _, variant := range variants {
+		fmt.Fprintln(w, variant)
+	}
+}
+
+// sellerItem loads the item in the request path and checks it belongs to the user,
+// writing an error response and returning false otherwise
+func (env *Env) sellerItem(w http.ResponseWriter, r *http.Request, userId int) (Item, bool) {
+	itemId, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return Item{}, false
+	}
+
+	item, err := env.db.GetItem(itemId)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return Item{}, false
+		}
+		env.logger.Println(err.Error())
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return Item{}, false
+	}
+
+	if item.sellerId != userId {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return Item{}, false
+	}
+	return item, true
+}
+
+// SetItemSeller lets an admin list an item under a seller, who can then manage its images,
+// prices and reviews and is paid for its sales. An empty seller unassigns the item
+func (env *Env) SetItemSeller(w http.ResponseWriter, r *http.Request) {
 	userId, ok := r.Context().Value(CtxUserId).(int)
 	if !ok {
 		env.logger.Println("context does not include userId for protected endpoint")
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
+	if !env.requireAdmin(w, userId) {
+		return
+	}
 
-	var err error
+	itemId, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	item, err := env.db.SetItemSeller(itemId, r.FormValue("seller"))
+	if err != nil {
+		var statusCode int
+		var message string
+		switch err {
+		case sql.ErrNoRows:
+			statusCode = http.StatusNotFound
+			message = http.StatusText(statusCode)
+		case ErrUnknownSeller:
+			statusCode = http.StatusBadRequest
+			message = "Unknown seller"
+		default:
+			env.logger.Println(err.Error())
+			statusCode = http.StatusInternalServerError
+			message = http.StatusText(statusCode)
+		}
+		http.Error(w, message, statusCode)
+		return
+	}
+	fmt.Fprintln(w, item)
+}
+
+// requireAdmin checks the user is an admin, writing an error response and returning
+// false otherwise
+func (env *Env) requireAdmin(w http.ResponseWriter, userId int) bool {
+	isAdmin, err := env.db.IsAdmin(userId)
+	if err != nil {
+		env.logger.Println(err.Error())
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return false
+	}
+	if !isAdmin {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+func (env *Env) printItemImage(w io.Writer, itemImage ItemImage) {
+	expires := time.Now().Add(SignedURLLifetime)
+	fmt.Fprintf(w, "id: %v, url: %v, thumbnail: %v, type: %v, size: %vx%v\n",
+		itemImage.imageId, env.mediaURLs.Sign(itemImage.blobKey, expires), env.mediaURLs.Sign(itemImage.thumbKey, expires),
+		itemImage.contentType, itemImage.width, itemImage.height)
+}
+
+func (env *Env) UploadItemImage(w http.ResponseWriter, r *http.Request) {
+	userId, ok := r.Context().Value(CtxUserId).(int)
+	if !ok {
+		env.logger.Println("context does not include userId for protected endpoint")
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	// Only the seller can add images
+	item, ok := env.sellerItem(w, r, userId)
+	if !ok {
+		return
+	}
+
+	// Read upload, leaving room in the body limit for multipart headers
+	r.Body = http.MaxBytesReader(w, r.Body, MaxImageSize+1<<20)
+	file, _, err := r.FormFile("image")
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+	data, err := io.ReadAll(io.LimitReader(file, MaxImageSize+1))
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	if len(data) > MaxImageSize {
+		http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	// Sniff content type rather than trusting the client
+	contentType := http.DetectContentType(data)
+	ext, ok := imageContentTypes[contentType]
+	if !ok {
+		http.Error(w, http.StatusText(http.StatusUnsupportedMediaType), http.StatusUnsupportedMediaType)
+		return
+	}
+
+	// Check dimensions before decoding so huge images can't exhaust memory
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || config.Width*config.Height > MaxImagePixels {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	// Generate thumbnail, jpegs stay jpeg and everything else becomes png to keep transparency
+	var thumb bytes.Buffer
+	thumbExt := ".png"
+	if contentType == "image/jpeg" {
+		thumbExt = ".jpg"
+		err = jpeg.Encode(&thumb, thumbnail(img, ThumbnailSize), nil)
+	} else {
+		err = png.Encode(&thumb, thumbnail(img, ThumbnailSize))
+	}
+	if err != nil {
+		env.logger.Println(err.Error())
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	// Store blobs
+	name, err := generateToken(16)
+	if err != nil {
+		env.logger.Println(err.Error())
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	itemImage := ItemImage{
+		itemId:      item.itemId,
+		blobKey:     fmt.Sprintf("items/%v/%v%v", item.itemId, name, ext),
+		thumbKey:    fmt.Sprintf("items/%v/%v_thumb%v", item.itemId, name, thumbExt),
+		contentType: contentType,
+		width:       config.Width,
+		height:      config.Height,
+	}
+	if err := env.blobs.Put(itemImage.blobKey, bytes.NewReader(data)); err != nil {
+		env.logger.Println(err.Error())
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if err := env.blobs.Put(itemImage.thumbKey, &thumb); err != nil {
+		env.logger.Println(err.Error())
+		env.blobs.Delete(itemImage.blobKey)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	// Record image, removing the blobs again if that fails
+	itemImage, err = env.db.AddItemImage(itemImage)
+	if err != nil {
+		env.logger.Println(err.Error())
+		env.blobs.Delete(itemImage.blobKey)
+		env.blobs.Delete(itemImage.thumbKey)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
 
-	// Parse deposit amount (conver to internal integer representation)
-	var depositAmountFloat float64
-	depositAmountFloat, err = strconv.ParseFloat(r.FormValue("amount"), 64)
-	depositAmount := int(depositAmountFloat * 100)
-	if err != nil || depositAmount <= 0 {
+	w.WriteHeader(http.StatusCreated)
+	env.printItemImage(w, itemImage)
+}
+
+func (env *Env) ItemImages(w http.ResponseWriter, r *http.Request) {
+	// Get item id
+	itemId, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
 		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 		return
 	}
 
-	// Deposit money
-	balance, err := env.db.Deposit(userId, depositAmount)
+	// Get images
+	images, err := env.db.ItemImages(itemId)
 	if err != nil {
 		env.logger.Println(err.Error())
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
-	fmt.Fprintln(w, "New balance:", convertMoneyPrintable(balance))
+
+	// Print images with signed links
+	for _, itemImage := range images {
+		env.printItemImage(w, itemImage)
+	}
 }
 
-func (env *Env) Items(w http.ResponseWriter, r *http.Request) {
-	// Get items
-	items, err := env.db.Items()
+func (env *Env) DeleteItemImage(w http.ResponseWriter, r *http.Request) {
+	userId, ok := r.Context().Value(CtxUserId).(int)
+	if !ok {
+		env.logger.Println("context does not include userId for protected endpoint")
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	// Only the seller can remove images
+	item, ok := env.sellerItem(w, r, userId)
+	if !ok {
+		return
+	}
+	imageId, err := strconv.Atoi(r.PathValue("imageId"))
 	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	// Delete record then blobs, a leftover blob is harmless but a dangling record is not
+	itemImage, err := env.db.DeleteItemImage(item.itemId, imageId)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
 		env.logger.Println(err.Error())
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
+	for _, key := range []string{itemImage.blobKey, itemImage.thumbKey} {
+		if err := env.blobs.Delete(key); err != nil {
+			env.logger.Println(err.Error())
+		}
+	}
 
-	// Print items
-	for _, item := range items {
-		fmt.Fprintln(w, item)
+	fmt.Fprintln(w, "Success")
+}
+
+// Media serves blobs behind signed links, the signature stands in for a session
+func (env *Env) Media(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	if !env.mediaURLs.Verify(key, r.URL.Query(), time.Now()) {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	blob, err := env.blobs.Open(key)
+	if err != nil {
+		if err == ErrBlobNotFound || err == ErrInvalidBlobKey {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+		env.logger.Println(err.Error())
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	defer blob.Close()
+
+	w.Header().Set("Content-Type", mime.TypeByExtension(path.Ext(key)))
+	w.Header().Set("Cache-Control", "private, max-age=3600")
+	io.Copy(w, blob)
+}
+
+func (env *Env) SearchItems(w http.ResponseWriter, r *http.Request) {
+	// Parse search query and limit
+	params := r.URL.Query()
+	searchQuery := strings.TrimSpace(params.Get("q"))
+	if len(searchQuery) == 0 {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	limit, err := parseLimitParam(params.Get("limit"))
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	// Search items
+	results, err := env.db.SearchItems(searchQuery, limit)
+	if err != nil {
+		env.logger.Println(err.Error())
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	// Print results, best match first
+	for _, result := range results {
+		fmt.Fprintln(w, result)
 	}
 }
 
@@ -177,15 +794,13 @@ func (env *Env) Register(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Register account
-	user, err := env.db.Register(username, passwordHash)
+	_, err = env.db.Register(username, passwordHash)
 	if err != nil {
 		env.logger.Println(err.Error())
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
 
-	// Log and return
-	env.logger.Printf("%q registered\n", user.username)
 	w.WriteHeader(http.StatusCreated)
 	fmt.Fprintln(w, "Success")
 }
@@ -210,8 +825,8 @@ func (env *Env) Login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Parse IP addr
-	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	// Resolve client IP addr
+	host, err := env.clientIP(r)
 	if err != nil {
 		env.logger.Println(err.Error())
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
@@ -228,13 +843,14 @@ func (env *Env) Login(w http.ResponseWriter, r *http.Request) {
 
 	// Send session cookies
 	expiresAt := time.Now().Add(time.Hour * 24)
+	secure := env.isSecureRequest(r)
 	http.SetCookie(w, &http.Cookie{
 		Name:     "session_id",
 		Value:    session.sessionId,
 		Expires:  expiresAt,
 		HttpOnly: true, // prevent client side js from reading
 		SameSite: http.SameSiteLaxMode,
-		// Secure: true,
+		Secure:   secure,
 	})
 	http.SetCookie(w, &http.Cookie{
 		Name:     "csrf_token",
@@ -242,7 +858,7 @@ func (env *Env) Login(w http.ResponseWriter, r *http.Request) {
 		Expires:  expiresAt,
 		HttpOnly: false, // need js to read to put in header
 		SameSite: http.SameSiteLaxMode,
-		// Secure: true,
+		Secure:   secure,
 	})
 
 	// Update last login
@@ -282,11 +898,30 @@ func (env *Env) AuthMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	}
 }
 
+func (env *Env) SecurityHeadersMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		header := w.Header()
+		header.Set("X-Content-Type-Options", "nosniff")
+		header.Set("X-Frame-Options", "DENY")
+		header.Set("Referrer-Policy", "no-referrer")
+		header.Set("Content-Security-Policy", "default-src 'none'; frame-ancestors 'none'")
+		// Only send HSTS over https, browsers ignore it on plain http anyway
+		if env.isSecureRequest(r) {
+			header.Set("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+		}
+		next(w, r)
+	}
+}
+
 func (env *Env) LogMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
 		defer func() {
-			env.logger.Println(r.RemoteAddr, r.Method, r.URL, time.Since(start))
+			host, err := env.clientIP(r)
+			if err != nil {
+				host = r.RemoteAddr
+			}
+			env.logger.Println(host, r.Method, r.URL, time.Since(start))
 		}()
 		next(w, r)
 	}
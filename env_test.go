@@ -1,15 +1,31 @@
 package main
 
 import (
+	"bytes"
+	"cmp"
+	"context"
+	"database/sql"
+	"encoding/json"
 	"errors"
+	"image"
+	"image/png"
 	"io"
 	"log"
+	"maps"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
 
+// TestDB is an in-memory stand-in for SqlDB so handler tests don't need a database. The
+// SQL of the money paths is tested against Postgres in postgres_test.go
 type TestDB struct {
 	users     []User
 	items     []Item
@@ -22,35 +38,104 @@ func hashPasswordNoErr(password string) string {
 	return passwordHash
 }
 
-var users = []User{
+// testPasswordHash is the hash of "password", hashed once since hashing is slow
+var testPasswordHash = hashPasswordNoErr("password")
+
+var seedUsers = []User{
 	{
 		userId:       1,
 		username:     "test_user",
-		passwordHash: hashPasswordNoErr("password"),
-		balance:      0.0,
+		passwordHash: testPasswordHash,
 		lastLogin:    time.Now(),
 		createdAt:    time.Now(),
 	},
 	{
 		userId:       2,
 		username:     "rich_test_user",
-		passwordHash: hashPasswordNoErr("password"),
-		balance:      20000,
+		passwordHash: testPasswordHash,
+		lastLogin:    time.Now(),
+		createdAt:    time.Now(),
+	},
+	{
+		userId:       3,
+		username:     "admin_test_user",
+		passwordHash: testPasswordHash,
+		isAdmin:      true,
 		lastLogin:    time.Now(),
 		createdAt:    time.Now(),
 	},
 }
 
-var items = []Item{
+var seedItems = []Item{
 	{
 		itemId:      1,
 		name:        "Nvidia RTX 3060 12GB",
 		description: "Graphics Card",
 		price:       17500,
+		currency:    DefaultCurrency,
+		sellerId:    2,
+		categoryIds: []int64{3},
+		attributes:  Attributes{"memory_gb": 12.0, "brand": "MSI"},
+	},
+	{
+		itemId:      2,
+		name:        "AMD Ryzen 5 5600X",
+		description: "Processor",
+		price:       12999,
+		currency:    DefaultCurrency,
+		categoryIds: []int64{2},
+	},
+	{
+		itemId:      3,
+		name:        "Nvidia RTX 4070 12GB",
+		description: "Graphics Card",
+		price:       52900,
+		currency:    DefaultCurrency,
+		categoryIds: []int64{3},
+		attributes:  Attributes{"memory_gb": 12.0},
+	},
+}
+
+var seedVariants = []ItemVariant{
+	{
+		variantId:  1,
+		itemId:     3,
+		sku:        "RTX4070-12-FE",
+		price:      52900,
+		stock:      1,
+		attributes: Attributes{"brand": "Founders Edition"},
+	},
+	{
+		variantId:  2,
+		itemId:     3,
+		sku:        "RTX4070-12-ASUS",
+		price:      54900,
+		stock:      0,
+		attributes: Attributes{"brand": "ASUS"},
 	},
 }
 
-var sessions = []Session{
+var seedCategories = []Category{
+	{categoryId: 1, parentId: 0, name: "Components"},
+	{categoryId: 2, parentId: 1, name: "Processors"},
+	{categoryId: 3, parentId: 1, name: "Graphics Cards"},
+	{categoryId: 4, parentId: 0, name: "Peripherals"},
+}
+
+// categorySubtree returns categoryId and the ids of all its descendants
+func categorySubtree(categoryId int) []int64 {
+	subtree := []int64{int64(categoryId)}
+	for i := 0; i < len(subtree); i++ {
+		for _, category := range categories {
+			if int64(category.parentId) == subtree[i] {
+				subtree = append(subtree, int64(category.categoryId))
+			}
+		}
+	}
+	return subtree
+}
+
+var seedSessions = []Session{
 	{
 		sessionId:  "session",
 		csrfToken:  "csrf",
@@ -69,8 +154,542 @@ var sessions = []Session{
 
 var purchases []Purchase
 
-func (t TestDB) Items() ([]Item, error) {
-	return items, nil
+var itemImages []ItemImage
+
+type userCartLine struct {
+	userId int
+	line   CartLine
+}
+
+var cartLines []userCartLine
+
+var orders []Order
+
+var seedCoupons = []Coupon{
+	{couponId: 1, code: "TENOFF", kind: CouponPercent, amount: 10, currency: DefaultCurrency, maxUsesPerUser: 1},
+	{couponId: 2, code: "EXPIRED", kind: CouponFixed, amount: 500, currency: DefaultCurrency, expiresAt: time.Now().Add(-time.Hour)},
+}
+
+var itemPrices []ItemPrice
+
+type userWallet struct {
+	userId  int
+	balance Money
+}
+
+var seedWallets = []userWallet{
+	{userId: 2, balance: Money{20000, DefaultCurrency}},
+	{userId: 2, balance: Money{10000, "EUR"}},
+}
+
+// The TestDB state, shared by the package. Tests that change it start from fresh seed
+// data with newTestDB
+var (
+	users      []User
+	items      []Item
+	variants   []ItemVariant
+	categories []Category
+	sessions   []Session
+	coupons    []Coupon
+	wallets    []userWallet
+)
+
+func init() {
+	resetTestDB()
+}
+
+// resetTestDB replaces the TestDB state with copies of the seed data
+func resetTestDB() {
+	users, items, variants = slices.Clone(seedUsers), slices.Clone(seedItems), slices.Clone(seedVariants)
+	categories, sessions, coupons = slices.Clone(seedCategories), slices.Clone(seedSessions), slices.Clone(seedCoupons)
+	wallets = slices.Clone(seedWallets)
+	purchases, itemImages, cartLines, orders, itemPrices = nil, nil, nil, nil, nil
+	deposits, ledger, withdrawals, transfers, escrows = nil, nil, nil, nil, nil
+	disputes, disputeMessages, reviews, reviewFlags, wishlist = nil, nil, nil, nil, nil
+	testNotificationSettings, notifications, notifiedEvents = map[int]NotificationSettings{}, nil, nil
+	domainEvents, eventReceipts = nil, nil
+	webhookEndpoints, webhookEvents, webhookDeliveries = nil, nil, nil
+	giftCards, couponRedemptions = nil, nil
+}
+
+// newTestDB gives the test fresh seed data and puts fresh seed data back for the tests
+// after it, so tests don't depend on what ran before them. The state is shared, so tests
+// using it mustn't be parallel
+func newTestDB(t *testing.T) TestDB {
+	t.Helper()
+	resetTestDB()
+	t.Cleanup(resetTestDB)
+	return TestDB{}
+}
+
+// testRates are the rates in testdata, the same file the static provider reads in production
+var testRates, _ = LoadStaticRates("testdata/rates.json")
+
+// testWallet returns the index of the user's wallet in currency, opening it if needed
+func testWallet(userId int, currency Currency) int {
+	walletIdx := slices.IndexFunc(wallets, func(wallet userWallet) bool {
+		return wallet.userId == userId && wallet.balance.currency == currency
+	})
+	if walletIdx < 0 {
+		wallets = append(wallets, userWallet{userId, Money{currency: currency}})
+		walletIdx = len(wallets) - 1
+	}
+	return walletIdx
+}
+
+var deposits []Deposit
+
+// ledger only records the entries of orders, withdrawals, transfers and gift cards
+var ledger []LedgerEntry
+
+var withdrawals []Withdrawal
+
+var transfers []Transfer
+
+var escrows []Escrow
+
+var disputes []Dispute
+
+var disputeMessages []DisputeMessage
+
+var reviews []Review
+
+// testWishlistItem mirrors a wishlist_items row
+type testWishlistItem struct {
+	userId     int
+	itemId     int
+	target     int
+	notifiedAt time.Time
+	addedAt    time.Time
+}
+
+var wishlist []testWishlistItem
+
+var testNotificationSettings map[int]NotificationSettings
+
+var notifications []Notification
+
+// notifiedEvents are the domain events notifications were enqueued for, standing in for
+// notification_outbox.domain_event_id
+var notifiedEvents []int
+
+// testEnqueueNotification mirrors enqueueNotification
+func testEnqueueNotification(notification EventNotification) error {
+	userId, kind := notification.userId, notification.kind
+	subject, body, err := renderNotification(kind, notification.data)
+	if err != nil {
+		return err
+	}
+	settings := testNotificationSettings[userId]
+	for _, channel := range notificationChannels {
+		if !settings.enabled(kind, channel) {
+			continue
+		}
+		notification := Notification{notificationId: len(notifications) + 1, userId: userId, kind: kind, channel: channel,
+			address: settings.address(channel), subject: subject, body: body, status: NotificationPending,
+			nextAttemptAt: time.Now(), createdAt: time.Now()}
+		if channel == ChannelInApp {
+			notification.status, notification.sentAt = NotificationSent, time.Now()
+		}
+		notifications = append(notifications, notification)
+	}
+	return nil
+}
+
+var domainEvents []DomainEvent
+
+// testEventReceipt mirrors a domain_event_receipts row
+type testEventReceipt struct {
+	subscriber    string
+	eventId       int
+	attempts      int
+	lastError     string
+	nextAttemptAt time.Time
+	handledAt     time.Time
+}
+
+var eventReceipts []testEventReceipt
+
+// testRecordEvent mirrors recordEvent
+func testRecordEvent(eventType EventType, userId int, data any) error {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	domainEvents = append(domainEvents, DomainEvent{eventId: len(domainEvents) + 1, eventType: eventType, userId: userId,
+		data: encoded, createdAt: time.Now()})
+	return nil
+}
+
+var webhookEndpoints []WebhookEndpoint
+
+// testWebhookEvent mirrors a webhook_events row
+type testWebhookEvent struct {
+	eventId       int
+	domainEventId int
+	eventType     EventType
+	userId        int
+	data          []byte
+	createdAt     time.Time
+}
+
+var webhookEvents []testWebhookEvent
+
+var webhookDeliveries []WebhookDelivery
+
+// testEnqueueWebhookEvent mirrors enqueueWebhookEvent
+func testEnqueueWebhookEvent(eventId int, eventType EventType, webhook EventWebhook) error {
+	userId := webhook.userId
+	if slices.ContainsFunc(webhookEvents, func(event testWebhookEvent) bool {
+		return event.domainEventId == eventId && event.userId == userId
+	}) {
+		return nil
+	}
+	encoded, err := json.Marshal(webhook.data)
+	if err != nil {
+		return err
+	}
+	event := testWebhookEvent{len(webhookEvents) + 1, eventId, eventType, userId, encoded, time.Now()}
+	webhookEvents = append(webhookEvents, event)
+	for _, endpoint := range webhookEndpoints {
+		if endpoint.subscribed(eventType, webhook) {
+			webhookDeliveries = append(webhookDeliveries, WebhookDelivery{deliveryId: len(webhookDeliveries) + 1, eventId: event.eventId,
+				endpointId: endpoint.endpointId, eventType: eventType, status: DeliveryPending, nextAttemptAt: time.Now(), createdAt: time.Now()})
+		}
+	}
+	return nil
+}
+
+// reviewFlags records which user reported which review, standing in for review_flags
+var reviewFlags []struct{ userId, reviewId int }
+
+// testItemRatings mirrors the rating subqueries of itemColumns
+func testItemRatings(item Item) Item {
+	for _, review := range reviews {
+		if review.itemId == item.itemId && !review.hidden {
+			item.reviewCount++
+			item.ratingTotal += review.rating
+		}
+	}
+	return item
+}
+
+// testGiftCard stands in for a gift_cards row, the code is kept as its hash
+type testGiftCard struct {
+	codeHash string
+	card     GiftCard
+}
+
+var giftCards []testGiftCard
+
+// testPayments is shared by test envs so tests can sign webhooks for the intents it creates
+var testPayments = NewFakePaymentProvider([]byte("test"))
+
+var testPayouts = NewFakePayoutProvider()
+
+// couponRedemptions records which user used which coupon, standing in for orders.coupon_id
+var couponRedemptions []struct{ userId, couponId int }
+
+// memBlobStore keeps blobs in memory for handler tests
+type memBlobStore struct {
+	mu    sync.Mutex
+	blobs map[string][]byte
+}
+
+func (m *memBlobStore) Put(key string, r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.blobs[key] = data
+	return nil
+}
+
+func (m *memBlobStore) Open(key string) (io.ReadCloser, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, ok := m.blobs[key]
+	if !ok {
+		return nil, ErrBlobNotFound
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (m *memBlobStore) Delete(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.blobs, key)
+	return nil
+}
+
+// itemBefore orders items the same way SqlDB.Items does for sort
+func itemBefore(sort ItemSort, a, b Item) bool {
+	switch sort {
+	case SortPriceAsc:
+		return a.price < b.price || (a.price == b.price && a.itemId < b.itemId)
+	case SortPriceDesc:
+		return a.price > b.price || (a.price == b.price && a.itemId > b.itemId)
+	case SortName:
+		return a.name < b.name || (a.name == b.name && a.itemId < b.itemId)
+	default:
+		return a.itemId > b.itemId
+	}
+}
+
+func (t TestDB) Items(itemQuery ItemQuery) (ItemPage, error) {
+	var cursorItem Item
+	hasCursor := len(itemQuery.cursor) != 0
+	if hasCursor {
+		cursor, err := decodeItemCursor(itemQuery.sort, itemQuery.cursor)
+		if err != nil {
+			return ItemPage{}, err
+		}
+		cursorItem = Item{itemId: cursor.ItemId, price: cursor.Price, name: cursor.Name}
+	}
+
+	var subtree []int64
+	if itemQuery.categoryId != 0 {
+		subtree = categorySubtree(itemQuery.categoryId)
+	}
+
+	var matched []Item
+	for _, item := range items {
+		if !itemHasAttributes(item, itemQuery.attributes) {
+			continue
+		}
+		if subtree != nil && !slices.ContainsFunc(item.categoryIds, func(id int64) bool { return slices.Contains(subtree, id) }) {
+			continue
+		}
+		if itemQuery.minPrice >= 0 && item.price < itemQuery.minPrice ||
+			itemQuery.maxPrice >= 0 && item.price > itemQuery.maxPrice ||
+			!strings.Contains(strings.ToLower(item.name), strings.ToLower(itemQuery.name)) ||
+			hasCursor && !itemBefore(itemQuery.sort, cursorItem, item) {
+			continue
+		}
+		matched = append(matched, testItemRatings(item))
+	}
+	slices.SortFunc(matched, func(a, b Item) int {
+		if itemBefore(itemQuery.sort, a, b) {
+			return -1
+		}
+		return 1
+	})
+
+	var page ItemPage
+	page.items = matched
+	if len(matched) > itemQuery.limit {
+		page.items = matched[:itemQuery.limit]
+		page.nextCursor = encodeItemCursor(itemQuery.sort, page.items[len(page.items)-1])
+	}
+	return page, nil
+}
+
+// containsAttributes mirrors jsonb @> for flat attribute objects
+func containsAttributes(attributes, filter Attributes) bool {
+	for key, value := range filter {
+		if actual, ok := attributes[key]; !ok || !reflect.DeepEqual(actual, value) {
+			return false
+		}
+	}
+	return true
+}
+
+// itemHasAttributes matches the item's attributes or any variant's merged attributes
+func itemHasAttributes(item Item, filter Attributes) bool {
+	if containsAttributes(item.attributes, filter) {
+		return true
+	}
+	for _, variant := range variants {
+		if variant.itemId != item.itemId {
+			continue
+		}
+		merged := maps.Clone(item.attributes)
+		if merged == nil {
+			merged = make(Attributes)
+		}
+		maps.Copy(merged, variant.attributes)
+		if containsAttributes(merged, filter) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t TestDB) ItemVariants(itemId int) ([]ItemVariant, error) {
+	var itemVariants []ItemVariant
+	for _, variant := range variants {
+		if variant.itemId == itemId {
+			if item, err := t.GetItem(itemId); err == nil {
+				variant.currency = item.currency
+			}
+			itemVariants = append(itemVariants, variant)
+		}
+	}
+	return itemVariants, nil
+}
+
+func (t TestDB) SchedulePriceChange(change ItemPrice) (int, error) {
+	itemIdx := slices.IndexFunc(items, func(item Item) bool { return item.itemId == change.itemId })
+	if itemIdx < 0 {
+		return 0, sql.ErrNoRows
+	}
+	if !slices.ContainsFunc(itemPrices, func(price ItemPrice) bool { return price.itemId == change.itemId }) {
+		now := time.Now()
+		itemPrices = append(itemPrices, ItemPrice{priceId: len(itemPrices) + 1, itemId: change.itemId, price: items[itemIdx].price, startsAt: now, appliedAt: now})
+	}
+	change.priceId = len(itemPrices) + 1
+	itemPrices = append(itemPrices, change)
+	return change.priceId, nil
+}
+
+func (t TestDB) ItemPrices(itemId int, includeScheduled bool) ([]ItemPrice, error) {
+	var prices []ItemPrice
+	for _, price := range slices.Backward(itemPrices) {
+		if price.itemId == itemId && (includeScheduled || !price.appliedAt.IsZero()) {
+			prices = append(prices, price)
+		}
+	}
+	slices.SortStableFunc(prices, func(a, b ItemPrice) int { return b.startsAt.Compare(a.startsAt) })
+	return prices, nil
+}
+
+// ApplyPriceChanges mirrors the SqlDB query, picking the latest running sale or else the
+// latest applied regular price for each changed item
+func (t TestDB) ApplyPriceChanges(now time.Time) (int, []PriceAlert, time.Time, error) {
+	changed := 0
+	var itemIds []int
+	for i, price := range itemPrices {
+		if price.appliedAt.IsZero() && !price.startsAt.After(now) {
+			itemPrices[i].appliedAt = now
+			changed++
+			itemIds = append(itemIds, price.itemId)
+		}
+	}
+	for i, price := range itemPrices {
+		if price.isSale() && price.endedAt.IsZero() && !price.appliedAt.IsZero() && !price.endsAt.After(now) {
+			itemPrices[i].endedAt = now
+			changed++
+			itemIds = append(itemIds, price.itemId)
+		}
+	}
+
+	for _, itemId := range slices.Compact(slices.Sorted(slices.Values(itemIds))) {
+		var current *ItemPrice
+		for i, price := range itemPrices {
+			if price.itemId != itemId || price.appliedAt.IsZero() || !price.endedAt.IsZero() {
+				continue
+			}
+			if current == nil || (price.isSale() && !current.isSale()) ||
+				(price.isSale() == current.isSale() && !price.startsAt.Before(current.startsAt)) {
+				current = &itemPrices[i]
+			}
+		}
+		if itemIdx := slices.IndexFunc(items, func(item Item) bool { return item.itemId == itemId }); itemIdx >= 0 && current != nil {
+			items[itemIdx].price = current.price
+			testRecordEvent(EventItemUpdated, items[itemIdx].sellerId, itemUpdatedEvent{itemId, items[itemIdx].sellerId,
+				Money{current.price, items[itemIdx].currency}})
+		}
+	}
+
+	var alerts []PriceAlert
+	for i, entry := range wishlist {
+		itemIdx := slices.IndexFunc(items, func(item Item) bool { return item.itemId == entry.itemId })
+		if !slices.Contains(itemIds, entry.itemId) || entry.target < 0 || itemIdx < 0 {
+			continue
+		}
+		item := items[itemIdx]
+		switch {
+		case item.price > entry.target:
+			wishlist[i].notifiedAt = time.Time{}
+		case entry.notifiedAt.IsZero():
+			wishlist[i].notifiedAt = now
+			alert := PriceAlert{entry.userId, item.itemId, item.name, Money{item.price, item.currency}, Money{entry.target, item.currency}}
+			alerts = append(alerts, alert)
+			testRecordEvent(EventPriceDropped, alert.userId, priceDroppedEvent{alert.userId, alert.itemId, alert.itemName, alert.price, alert.target})
+		}
+	}
+
+	var next time.Time
+	earliest := func(due time.Time) {
+		if next.IsZero() || due.Before(next) {
+			next = due
+		}
+	}
+	for _, price := range itemPrices {
+		if price.appliedAt.IsZero() {
+			earliest(price.startsAt)
+		}
+		if price.isSale() && price.endedAt.IsZero() {
+			earliest(price.endsAt)
+		}
+	}
+	return changed, alerts, next, nil
+}
+
+func (t TestDB) Categories() ([]Category, error) {
+	return categories, nil
+}
+
+// SearchItems is a simple stand in for Postgres full-text search, ranking by the number
+// of query terms found with name matches weighted above description matches
+func (t TestDB) SearchItems(searchQuery string, limit int) ([]ItemSearchResult, error) {
+	terms := strings.Fields(strings.ToLower(searchQuery))
+	var results []ItemSearchResult
+	for _, item := range items {
+		var rank float64
+		snippet := item.name + " - " + item.description
+		for _, term := range terms {
+			if strings.Contains(strings.ToLower(item.name), term) {
+				rank += 1
+			}
+			if strings.Contains(strings.ToLower(item.description), term) {
+				rank += 0.4
+			}
+			if idx := strings.Index(strings.ToLower(snippet), term); idx >= 0 {
+				snippet = snippet[:idx] + "<b>" + snippet[idx:idx+len(term)] + "</b>" + snippet[idx+len(term):]
+			}
+		}
+		if rank > 0 {
+			results = append(results, ItemSearchResult{item: testItemRatings(item), rank: rank, snippet: snippet})
+		}
+	}
+	slices.SortStableFunc(results, func(a, b ItemSearchResult) int {
+		return cmp.Compare(b.rank, a.rank)
+	})
+	return results[:min(limit, len(results))], nil
+}
+
+func (t TestDB) AddItemImage(image ItemImage) (ItemImage, error) {
+	id := 0
+	for _, itemImage := range itemImages {
+		id = max(id, itemImage.imageId)
+	}
+	image.imageId = id + 1
+	image.createdAt = time.Now()
+	itemImages = append(itemImages, image)
+	return image, nil
+}
+
+func (t TestDB) ItemImages(itemId int) ([]ItemImage, error) {
+	var images []ItemImage
+	for _, image := range itemImages {
+		if image.itemId == itemId {
+			images = append(images, image)
+		}
+	}
+	return images, nil
+}
+
+func (t TestDB) DeleteItemImage(itemId int, imageId int) (ItemImage, error) {
+	for i, image := range itemImages {
+		if image.itemId == itemId && image.imageId == imageId {
+			itemImages = slices.Delete(itemImages, i, i+1)
+			return image, nil
+		}
+	}
+	return ItemImage{}, sql.ErrNoRows
 }
 
 func (t TestDB) Purchases(userId int) ([]UserPurchase, error) {
@@ -108,10 +727,24 @@ func (t TestDB) Purchases(userId int) ([]UserPurchase, error) {
 			continue
 		}
 
+		// Find variant
+		var sku string
+		for _, variant := range variants {
+			if purchase.variantId == variant.variantId {
+				sku = variant.sku
+				break
+			}
+		}
+
 		userPurchases = append(userPurchases, UserPurchase{
+			purchase.purchaseId,
 			user.username,
 			item.name,
-			item.price,
+			sku,
+			purchase.price,
+			purchase.listPrice,
+			purchase.discount,
+			purchase.currency,
 			purchase.purchasedAt,
 		})
 	}
@@ -128,13 +761,40 @@ func (t TestDB) GetUserFromUsername(username string) (User, error) {
 	return User{}, errors.New("user not found")
 }
 
+func (t TestDB) IsAdmin(userId int) (bool, error) {
+	for _, user := range users {
+		if user.userId == userId {
+			return user.isAdmin, nil
+		}
+	}
+	return false, sql.ErrNoRows
+}
+
 func (t TestDB) GetItem(itemId int) (Item, error) {
 	for _, item := range items {
 		if item.itemId == itemId {
-			return item, nil
+			return testItemRatings(item), nil
+		}
+	}
+	return Item{}, sql.ErrNoRows
+}
+
+func (t TestDB) SetItemSeller(itemId int, sellerUsername string) (Item, error) {
+	sellerId := 0
+	if len(sellerUsername) != 0 {
+		seller, err := t.GetUserFromUsername(sellerUsername)
+		if err != nil {
+			return Item{}, ErrUnknownSeller
+		}
+		sellerId = seller.userId
+	}
+	for i := range items {
+		if items[i].itemId == itemId {
+			items[i].sellerId = sellerId
+			return testItemRatings(items[i]), nil
 		}
 	}
-	return Item{}, errors.New("item not found")
+	return Item{}, sql.ErrNoRows
 }
 
 func (t TestDB) Register(username, passwordHash string) (User, error) {
@@ -151,13 +811,12 @@ func (t TestDB) Register(username, passwordHash string) (User, error) {
 		userId:       id + 1,
 		username:     username,
 		passwordHash: passwordHash,
-		balance:      0,
 		lastLogin:    time.Now(),
 		createdAt:    time.Now(),
 	}
 
 	users = append(users, user)
-	return user, nil
+	return user, testRecordEvent(EventUserRegistered, user.userId, userRegisteredEvent{user.userId, user.username})
 }
 
 func sessionExists(sessionId string) bool {
@@ -201,36 +860,34 @@ func (t TestDB) GetSession(sessionId string) (Session, error) {
 	}
 	return Session{}, errors.New("could not find session")
 }
-func (t TestDB) Balance(userId int) (int, error) {
-	for _, user := range users {
-		if user.userId == userId {
-			return user.balance, nil
+func (t TestDB) Balances(userId int) ([]Money, error) {
+	var balances []Money
+	for _, wallet := range wallets {
+		if wallet.userId == userId {
+			balances = append(balances, wallet.balance)
 		}
 	}
-	return 0, errors.New("could not find user")
+	slices.SortFunc(balances, func(a, b Money) int { return strings.Compare(string(a.currency), string(b.currency)) })
+	return balances, nil
 }
-func (t TestDB) Deposit(userId int, amount int) (int, error) {
-	for i, user := range users {
-		if user.userId == userId {
-			user.balance += amount
-			users[i] = user
-			return user.balance, nil
-		}
-	}
-	return 0, errors.New("could not find user")
+func (t TestDB) Balance(userId int, currency Currency) (Money, error) {
+	return wallets[testWallet(userId, currency)].balance, nil
 }
-func (t TestDB) Purchase(userId int, itemId int) error {
-	var user *User
-	var userIdx int
-	for i, currUser := range users {
-		if currUser.userId == userId {
-			user = &currUser
-			userIdx = i
-			break
-		}
+
+// creditTestWallet adds amount to the user's wallet, or takes it if negative, to set up
+// balances for tests
+func creditTestWallet(userId int, amount Money) (Money, error) {
+	walletIdx := testWallet(userId, amount.currency)
+	if wallets[walletIdx].balance.amount+amount.amount > MaxAmount {
+		return Money{}, ErrBalanceTooLarge
 	}
-	if user == nil {
-		return errors.New("could not find user")
+	wallets[walletIdx].balance.amount += amount.amount
+	return wallets[walletIdx].balance, nil
+}
+
+func (t TestDB) Purchase(userId int, itemId int, variantId int, couponCode string, currency Currency) (int, error) {
+	if !slices.ContainsFunc(users, func(user User) bool { return user.userId == userId }) {
+		return 0, errors.New("could not find user")
 	}
 
 	var item *Item
@@ -241,37 +898,1236 @@ func (t TestDB) Purchase(userId int, itemId int) error {
 		}
 	}
 	if item == nil {
-		return errors.New("could not find item")
+		return 0, sql.ErrNoRows
 	}
 
-	if user.balance < item.price {
-		return ErrInsufficientFunds
+	// find variant, required if the item has any
+	price := item.price
+	variantIdx := -1
+	for i, variant := range variants {
+		if variant.itemId != itemId {
+			continue
+		}
+		if variantId == 0 {
+			return 0, ErrVariantRequired
+		}
+		if variant.variantId == variantId {
+			variantIdx = i
+			price = variant.price
+		}
+	}
+	if variantId != 0 && variantIdx < 0 {
+		return 0, sql.ErrNoRows
+	}
+	if variantIdx >= 0 && variants[variantIdx].stock <= 0 {
+		return 0, ErrOutOfStock
 	}
 
-	// update user balance
-	user.balance -= item.price
-	users[userIdx] = *user
-
-	// get max purchase id
-	var id int
-	for _, purchase := range purchases {
-		id = max(purchase.purchaseId, id)
+	unitPrice, err := convertMoney(Money{price, item.currency}, currency, testRates)
+	if err != nil {
+		return 0, err
+	}
+	lines := []OrderLine{{itemId: itemId, variantId: variantId, quantity: 1, unitPrice: unitPrice.amount}}
+	couponIdx, err := testApplyCoupon(couponCode, userId, lines, currency)
+	if err != nil {
+		return 0, err
+	}
+	total, _ := orderTotals(lines)
+	walletIdx := testWallet(userId, currency)
+	if wallets[walletIdx].balance.amount < total {
+		return 0, ErrInsufficientFunds
 	}
 
-	// add purchase
-	purchases = append(purchases, Purchase{
-		id + 1,
-		userId,
-		itemId,
-		time.Now(),
-	})
+	// update wallet and stock
+	wallets[walletIdx].balance.amount -= total
+	if variantIdx >= 0 {
+		variants[variantIdx].stock--
+	}
 
-	return nil
+	testRedeemCoupon(couponIdx, userId)
+	return testCreateOrder(userId, currency, lines), nil
 }
 
-func (t TestDB) UpdateLastLogin(userId int) {
-	for i, user := range users {
-		if user.userId == userId {
+// testApplyCoupon mirrors applyCoupon without counting the use, returning the coupon's
+// index or -1 if code is empty
+func testApplyCoupon(code string, userId int, lines []OrderLine, currency Currency) (int, error) {
+	if len(code) == 0 {
+		return -1, nil
+	}
+	couponIdx := slices.IndexFunc(coupons, func(coupon Coupon) bool { return coupon.code == normaliseCouponCode(code) })
+	if couponIdx < 0 {
+		return -1, ErrCouponNotFound
+	}
+	categories := make(map[int][]int64)
+	for _, item := range items {
+		categories[item.itemId] = item.categoryIds
+	}
+	userUses := 0
+	for _, redemption := range couponRedemptions {
+		if redemption.userId == userId && redemption.couponId == coupons[couponIdx].couponId {
+			userUses++
+		}
+	}
+	coupon, err := coupons[couponIdx].inCurrency(currency, testRates)
+	if err != nil {
+		return -1, err
+	}
+	discounts, err := coupon.Discount(lines, categories, userUses, time.Now())
+	if err != nil {
+		return -1, err
+	}
+	for i := range lines {
+		lines[i].discount = discounts[i]
+	}
+	return couponIdx, nil
+}
+
+func testRedeemCoupon(couponIdx int, userId int) {
+	if couponIdx < 0 {
+		return
+	}
+	coupons[couponIdx].uses++
+	couponRedemptions = append(couponRedemptions, struct{ userId, couponId int }{userId, coupons[couponIdx].couponId})
+}
+
+// findPurchasable mirrors checkPurchasable, returning the price of the item or variant
+func findPurchasable(itemId int, variantId int) (int, int, error) {
+	itemIdx := slices.IndexFunc(items, func(item Item) bool { return item.itemId == itemId })
+	if itemIdx < 0 {
+		return 0, 0, sql.ErrNoRows
+	}
+	hasVariants := slices.ContainsFunc(variants, func(variant ItemVariant) bool { return variant.itemId == itemId })
+	if variantId == 0 {
+		if hasVariants {
+			return 0, 0, ErrVariantRequired
+		}
+		return items[itemIdx].price, -1, nil
+	}
+	variantIdx := slices.IndexFunc(variants, func(variant ItemVariant) bool {
+		return variant.itemId == itemId && variant.variantId == variantId
+	})
+	if variantIdx < 0 {
+		return 0, 0, sql.ErrNoRows
+	}
+	return variants[variantIdx].price, variantIdx, nil
+}
+
+func (t TestDB) Cart(userId int) ([]CartLine, error) {
+	var lines []CartLine
+	for _, userLine := range cartLines {
+		if userLine.userId != userId {
+			continue
+		}
+		line := userLine.line
+		line.unitPrice, _, _ = findPurchasable(line.itemId, line.variantId)
+		if item, err := t.GetItem(line.itemId); err == nil {
+			line.currency = item.currency
+		}
+		lines = append(lines, line)
+	}
+	return lines, nil
+}
+
+func (t TestDB) AddToCart(userId int, itemId int, variantId int, quantity int) error {
+	if _, _, err := findPurchasable(itemId, variantId); err != nil {
+		return err
+	}
+	lineId := 0
+	for i, userLine := range cartLines {
+		lineId = max(lineId, userLine.line.lineId)
+		if userLine.userId == userId && userLine.line.itemId == itemId && userLine.line.variantId == variantId {
+			cartLines[i].line.quantity = min(userLine.line.quantity+quantity, MaxCartQuantity)
+			return nil
+		}
+	}
+	cartLines = append(cartLines, userCartLine{userId, CartLine{lineId: lineId + 1, itemId: itemId, variantId: variantId, quantity: quantity}})
+	return nil
+}
+
+func (t TestDB) UpdateCartLine(userId int, lineId int, quantity int) error {
+	for i, userLine := range cartLines {
+		if userLine.userId == userId && userLine.line.lineId == lineId {
+			cartLines[i].line.quantity = quantity
+			return nil
+		}
+	}
+	return sql.ErrNoRows
+}
+
+func (t TestDB) RemoveCartLine(userId int, lineId int) error {
+	for i, userLine := range cartLines {
+		if userLine.userId == userId && userLine.line.lineId == lineId {
+			cartLines = slices.Delete(cartLines, i, i+1)
+			return nil
+		}
+	}
+	return sql.ErrNoRows
+}
+
+func (t TestDB) Checkout(userId int, couponCode string, currency Currency) (int, int, error) {
+	lines, _ := t.Cart(userId)
+	if len(lines) == 0 {
+		return 0, 0, ErrEmptyCart
+	}
+
+	// Validate every line before changing anything
+	var orderLines []OrderLine
+	for _, line := range lines {
+		price, variantIdx, err := findPurchasable(line.itemId, line.variantId)
+		if err != nil {
+			return 0, 0, err
+		}
+		if variantIdx >= 0 && variants[variantIdx].stock < line.quantity {
+			return 0, 0, ErrOutOfStock
+		}
+		unitPrice, err := convertMoney(Money{price, line.currency}, currency, testRates)
+		if err != nil {
+			return 0, 0, err
+		}
+		orderLines = append(orderLines, OrderLine{itemId: line.itemId, variantId: line.variantId, quantity: line.quantity, unitPrice: unitPrice.amount})
+	}
+	couponIdx, err := testApplyCoupon(couponCode, userId, orderLines, currency)
+	if err != nil {
+		return 0, 0, err
+	}
+	total, _ := orderTotals(orderLines)
+	walletIdx := testWallet(userId, currency)
+	if wallets[walletIdx].balance.amount < total {
+		return 0, 0, ErrInsufficientFunds
+	}
+
+	// Apply
+	wallets[walletIdx].balance.amount -= total
+	for _, line := range lines {
+		if _, variantIdx, _ := findPurchasable(line.itemId, line.variantId); variantIdx >= 0 {
+			variants[variantIdx].stock -= line.quantity
+		}
+	}
+	testRedeemCoupon(couponIdx, userId)
+	cartLines = slices.DeleteFunc(cartLines, func(userLine userCartLine) bool { return userLine.userId == userId })
+	return testCreateOrder(userId, currency, orderLines), total, nil
+}
+
+// testCreateOrder mirrors createOrder, recording a paid order and a purchase per unit
+func testCreateOrder(userId int, currency Currency, lines []OrderLine) int {
+	order := Order{orderId: len(orders) + 1, userId: userId, status: OrderPaid, currency: currency, createdAt: time.Now(), updatedAt: time.Now()}
+	for i, line := range lines {
+		line.lineId = i + 1
+		line.currency = currency
+		var sellerId int
+		if item, err := (TestDB{}).GetItem(line.itemId); err == nil {
+			line.itemName, sellerId = item.name, item.sellerId
+		}
+		for _, variant := range variants {
+			if variant.variantId == line.variantId {
+				line.sku = variant.sku
+			}
+		}
+		order.lines = append(order.lines, line)
+		for _, unitDiscount := range unitDiscounts(line.discount, line.quantity) {
+			purchases = append(purchases, Purchase{len(purchases) + 1, userId, line.itemId, line.variantId,
+				line.unitPrice, unitDiscount, line.unitPrice - unitDiscount, currency, time.Now(), order.orderId, sellerId})
+		}
+	}
+	order.total, order.discount = orderTotals(lines)
+	orders = append(orders, order)
+
+	// Record the payment, put the sellers' proceeds in escrow and record the event like
+	// createOrder does
+	ledger = append(ledger, LedgerEntry{userId: userId, amount: Money{-order.total, currency}, kind: LedgerPurchase, referenceId: order.orderId})
+	for _, line := range lines {
+		if item, err := (TestDB{}).GetItem(line.itemId); err == nil && item.sellerId != 0 {
+			sale := line.unitPrice*line.quantity - line.discount
+			escrowIdx := slices.IndexFunc(escrows, func(escrow Escrow) bool {
+				return escrow.orderId == order.orderId && escrow.sellerId == item.sellerId
+			})
+			if escrowIdx >= 0 {
+				escrows[escrowIdx].amount.amount += sale
+				continue
+			}
+			escrows = append(escrows, Escrow{escrowId: len(escrows) + 1, orderId: order.orderId, sellerId: item.sellerId,
+				amount: Money{sale, currency}, status: EscrowHeld, releaseAt: time.Now().Add(EscrowPeriod), createdAt: time.Now(), updatedAt: time.Now()})
+		}
+	}
+	event := purchaseCreatedEvent{OrderId: order.orderId, UserId: userId, Total: Money{order.total, currency},
+		Discount: Money{order.discount, currency}}
+	for _, line := range lines {
+		item, _ := (TestDB{}).GetItem(line.itemId)
+		event.Lines = append(event.Lines, purchaseEventLine{line.itemId, line.variantId, item.sellerId, line.quantity,
+			Money{line.unitPrice*line.quantity - line.discount, currency}})
+	}
+	testRecordEvent(EventPurchaseCreated, userId, event)
+	return order.orderId
+}
+
+// testReleaseEscrow mirrors releaseEscrows for a single escrow
+func testReleaseEscrow(escrowIdx int, now time.Time) {
+	escrow := escrows[escrowIdx]
+	creditTestWallet(escrow.sellerId, escrow.amount)
+	ledger = append(ledger, LedgerEntry{userId: escrow.sellerId, amount: escrow.amount, kind: LedgerSale, referenceId: escrow.orderId,
+		heldUntil: now.Add(SaleHold)})
+	escrows[escrowIdx].status, escrows[escrowIdx].updatedAt = EscrowReleased, now
+}
+
+func (t TestDB) ConfirmReceipt(userId int, orderId int, now time.Time) ([]Escrow, error) {
+	if _, err := t.GetOrder(userId, orderId); err != nil {
+		return nil, err
+	}
+	var held []int
+	for i, escrow := range escrows {
+		if escrow.orderId != orderId {
+			continue
+		}
+		if escrow.status == EscrowFrozen {
+			return nil, ErrEscrowFrozen
+		}
+		if escrow.status == EscrowHeld {
+			held = append(held, i)
+		}
+	}
+	if len(held) == 0 {
+		return nil, ErrInvalidTransition
+	}
+	var released []Escrow
+	for _, escrowIdx := range held {
+		testReleaseEscrow(escrowIdx, now)
+		released = append(released, escrows[escrowIdx])
+	}
+	return released, nil
+}
+
+func (t TestDB) ReleaseDueEscrows(now time.Time) (int, error) {
+	released := 0
+	for i, escrow := range escrows {
+		if escrow.status == EscrowHeld && !escrow.releaseAt.After(now) {
+			testReleaseEscrow(i, now)
+			released++
+		}
+	}
+	return released, nil
+}
+
+func (t TestDB) Escrows(sellerId int) ([]Escrow, error) {
+	var sellerEscrows []Escrow
+	for _, escrow := range slices.Backward(escrows) {
+		if escrow.sellerId == sellerId {
+			sellerEscrows = append(sellerEscrows, escrow)
+		}
+	}
+	return sellerEscrows, nil
+}
+
+func (t TestDB) Orders(userId int) ([]Order, error) {
+	var userOrders []Order
+	for _, order := range slices.Backward(orders) {
+		if order.userId == userId {
+			order.lines = nil
+			userOrders = append(userOrders, order)
+		}
+	}
+	return userOrders, nil
+}
+
+func (t TestDB) GetOrder(userId int, orderId int) (Order, error) {
+	for _, order := range orders {
+		if order.orderId == orderId && order.userId == userId {
+			return order, nil
+		}
+	}
+	return Order{}, sql.ErrNoRows
+}
+
+func (t TestDB) TransitionOrder(orderId int, to OrderStatus) error {
+	for i, order := range orders {
+		if order.orderId != orderId {
+			continue
+		}
+		if !order.status.CanTransition(to) {
+			return ErrInvalidTransition
+		}
+		if to == OrderRefunded {
+			// Net what each seller was paid and what disputes already refunded, like reverseSales
+			sales := make(map[int]int)
+			refunded := 0
+			for _, entry := range ledger {
+				if entry.referenceId != orderId {
+					continue
+				}
+				switch entry.kind {
+				case LedgerSale, LedgerSaleReversal:
+					sales[entry.userId] += entry.amount.amount
+				case LedgerRefund:
+					refunded += entry.amount.amount
+				}
+			}
+			for sellerId, sale := range sales {
+				if wallets[testWallet(sellerId, order.currency)].balance.amount < sale {
+					return ErrInsufficientFunds
+				}
+			}
+			for i, escrow := range escrows {
+				if escrow.orderId == orderId && escrow.status.CanTransition(EscrowRefunded) {
+					escrows[i].status = EscrowRefunded
+				}
+			}
+			for sellerId, sale := range sales {
+				if sale > 0 {
+					creditTestWallet(sellerId, Money{-sale, order.currency})
+					ledger = append(ledger, LedgerEntry{userId: sellerId, amount: Money{-sale, order.currency}, kind: LedgerSaleReversal, referenceId: orderId})
+				}
+			}
+			if order.total > refunded {
+				refund := Money{order.total - refunded, order.currency}
+				creditTestWallet(order.userId, refund)
+				ledger = append(ledger, LedgerEntry{userId: order.userId, amount: refund, kind: LedgerRefund, referenceId: orderId})
+			}
+		}
+		orders[i].status = to
+		orders[i].updatedAt = time.Now()
+		return nil
+	}
+	return sql.ErrNoRows
+}
+
+func (t TestDB) OpenDispute(userId int, purchaseId int, reason string, now time.Time) (Dispute, error) {
+	purchaseIdx := slices.IndexFunc(purchases, func(purchase Purchase) bool {
+		return purchase.purchaseId == purchaseId && purchase.userId == userId && purchase.orderId != 0
+	})
+	if purchaseIdx < 0 {
+		return Dispute{}, sql.ErrNoRows
+	}
+	purchase := purchases[purchaseIdx]
+	order, err := t.GetOrder(userId, purchase.orderId)
+	if err != nil {
+		return Dispute{}, err
+	}
+	if order.status == OrderRefunded || order.status == OrderCancelled || now.Sub(purchase.purchasedAt) > DisputeWindow {
+		return Dispute{}, ErrNotDisputable
+	}
+	if slices.ContainsFunc(disputes, func(dispute Dispute) bool { return dispute.purchaseId == purchaseId }) {
+		return Dispute{}, ErrDisputeExists
+	}
+
+	dispute := Dispute{
+		disputeId:  len(disputes) + 1,
+		purchaseId: purchaseId,
+		orderId:    purchase.orderId,
+		itemId:     purchase.itemId,
+		buyerId:    userId,
+		sellerId:   purchase.sellerId,
+		amount:     Money{purchase.price, purchase.currency},
+		status:     DisputeOpen,
+		createdAt:  now,
+		updatedAt:  now,
+	}
+	disputes = append(disputes, dispute)
+	if _, err := t.AddDisputeMessage(dispute.disputeId, userId, reason); err != nil {
+		return Dispute{}, err
+	}
+	for i, escrow := range escrows {
+		if escrow.orderId == dispute.orderId && escrow.status.CanTransition(EscrowFrozen) {
+			escrows[i].status = EscrowFrozen
+		}
+	}
+	return dispute, testRecordDisputeEvent(dispute)
+}
+
+// testRecordDisputeEvent mirrors recordDisputeEvent
+func testRecordDisputeEvent(dispute Dispute) error {
+	event := disputeUpdatedEvent{dispute.disputeId, dispute.orderId, dispute.buyerId, dispute.sellerId, dispute.status}
+	return testRecordEvent(EventDisputeUpdated, dispute.buyerId, event)
+}
+
+func (t TestDB) GetDispute(disputeId int) (Dispute, error) {
+	for _, dispute := range disputes {
+		if dispute.disputeId == disputeId {
+			return dispute, nil
+		}
+	}
+	return Dispute{}, sql.ErrNoRows
+}
+
+func (t TestDB) Disputes(userId int) ([]Dispute, error) {
+	var userDisputes []Dispute
+	for _, dispute := range slices.Backward(disputes) {
+		if dispute.buyerId == userId || dispute.sellerId == userId {
+			userDisputes = append(userDisputes, dispute)
+		}
+	}
+	return userDisputes, nil
+}
+
+func (t TestDB) ActiveDisputes() ([]Dispute, error) {
+	var active []Dispute
+	for _, dispute := range disputes {
+		if !dispute.status.closed() {
+			active = append(active, dispute)
+		}
+	}
+	return active, nil
+}
+
+func (t TestDB) DisputeMessages(disputeId int) ([]DisputeMessage, error) {
+	var messages []DisputeMessage
+	for _, message := range disputeMessages {
+		if message.disputeId == disputeId {
+			messages = append(messages, message)
+		}
+	}
+	return messages, nil
+}
+
+func (t TestDB) AddDisputeMessage(disputeId int, authorId int, body string) (DisputeMessage, error) {
+	dispute, err := t.GetDispute(disputeId)
+	if err != nil || dispute.status.closed() {
+		return DisputeMessage{}, ErrDisputeClosed
+	}
+	message := DisputeMessage{messageId: len(disputeMessages) + 1, disputeId: disputeId, authorId: authorId, body: body, createdAt: time.Now()}
+	for _, user := range users {
+		if user.userId == authorId {
+			message.authorName = user.username
+		}
+	}
+	disputeMessages = append(disputeMessages, message)
+	return message, nil
+}
+
+func (t TestDB) TransitionDispute(disputeId int, to DisputeStatus, refund int, reviewerId int) (Dispute, error) {
+	disputeIdx := slices.IndexFunc(disputes, func(dispute Dispute) bool { return dispute.disputeId == disputeId })
+	if disputeIdx < 0 {
+		return Dispute{}, sql.ErrNoRows
+	}
+	dispute := disputes[disputeIdx]
+	if !dispute.status.CanTransition(to) {
+		return Dispute{}, ErrInvalidTransition
+	}
+	order, err := t.GetOrder(dispute.buyerId, dispute.orderId)
+	if err != nil {
+		return Dispute{}, err
+	}
+
+	if to == DisputeRefunded {
+		if order.status == OrderRefunded {
+			return Dispute{}, ErrInvalidTransition
+		}
+		if refund == 0 {
+			refund = dispute.amount.amount
+		}
+		if refund > dispute.amount.amount {
+			return Dispute{}, ErrRefundTooLarge
+		}
+		amount := Money{refund, dispute.amount.currency}
+		if dispute.sellerId != 0 {
+			escrowIdx := slices.IndexFunc(escrows, func(escrow Escrow) bool {
+				return escrow.orderId == dispute.orderId && escrow.sellerId == dispute.sellerId &&
+					(escrow.status == EscrowHeld || escrow.status == EscrowFrozen)
+			})
+			if escrowIdx >= 0 {
+				escrows[escrowIdx].amount.amount -= refund
+				if escrows[escrowIdx].amount.amount == 0 {
+					escrows[escrowIdx].status = EscrowRefunded
+				}
+			} else {
+				if wallets[testWallet(dispute.sellerId, amount.currency)].balance.amount < refund {
+					return Dispute{}, ErrInsufficientFunds
+				}
+				var heldUntil time.Time
+				for _, entry := range ledger {
+					if entry.userId == dispute.sellerId && entry.referenceId == dispute.orderId && entry.kind == LedgerSale && entry.heldUntil.After(heldUntil) {
+						heldUntil = entry.heldUntil
+					}
+				}
+				creditTestWallet(dispute.sellerId, Money{-refund, amount.currency})
+				ledger = append(ledger, LedgerEntry{userId: dispute.sellerId, amount: Money{-refund, amount.currency}, kind: LedgerSaleReversal,
+					referenceId: dispute.orderId, heldUntil: heldUntil})
+			}
+		}
+		if _, err := creditTestWallet(dispute.buyerId, amount); err != nil {
+			return Dispute{}, err
+		}
+		ledger = append(ledger, LedgerEntry{userId: dispute.buyerId, amount: amount, kind: LedgerRefund, referenceId: dispute.orderId})
+		dispute.refunded = refund
+	}
+
+	dispute.status = to
+	dispute.updatedAt = time.Now()
+	if reviewerId != 0 {
+		dispute.reviewerId = reviewerId
+	}
+	disputes[disputeIdx] = dispute
+	if to.closed() && !slices.ContainsFunc(disputes, func(other Dispute) bool { return other.orderId == dispute.orderId && !other.status.closed() }) {
+		for i, escrow := range escrows {
+			if escrow.orderId == dispute.orderId && escrow.status == EscrowFrozen {
+				escrows[i].status = EscrowHeld
+			}
+		}
+	}
+	return dispute, testRecordDisputeEvent(dispute)
+}
+
+// testReviewIdx returns the index of the review matching match, -1 if there is none. Flags
+// are counted into the review like reviewColumns does
+func testReviewIdx(match func(review Review) bool) int {
+	reviewIdx := slices.IndexFunc(reviews, match)
+	if reviewIdx >= 0 {
+		reviews[reviewIdx].flags = 0
+		for _, flag := range reviewFlags {
+			if flag.reviewId == reviews[reviewIdx].reviewId {
+				reviews[reviewIdx].flags++
+			}
+		}
+	}
+	return reviewIdx
+}
+
+func (t TestDB) GetReview(reviewId int) (Review, error) {
+	reviewIdx := testReviewIdx(func(review Review) bool { return review.reviewId == reviewId })
+	if reviewIdx < 0 {
+		return Review{}, sql.ErrNoRows
+	}
+	return reviews[reviewIdx], nil
+}
+
+func (t TestDB) AddReview(userId int, itemId int, rating int, body string) (Review, error) {
+	if item, _ := t.GetItem(itemId); item.sellerId == userId {
+		return Review{}, ErrOwnItem
+	}
+	bought := slices.ContainsFunc(purchases, func(purchase Purchase) bool {
+		return purchase.userId == userId && purchase.itemId == itemId && slices.ContainsFunc(orders, func(order Order) bool {
+			return order.orderId == purchase.orderId && order.status != OrderCancelled && order.status != OrderRefunded
+		})
+	})
+	if !bought {
+		return Review{}, ErrNotVerifiedBuyer
+	}
+	if slices.ContainsFunc(reviews, func(review Review) bool { return review.userId == userId && review.itemId == itemId }) {
+		return Review{}, ErrReviewExists
+	}
+	review := Review{reviewId: len(reviews) + 1, itemId: itemId, userId: userId, rating: rating, body: body, createdAt: time.Now(), updatedAt: time.Now()}
+	for _, user := range users {
+		if user.userId == userId {
+			review.username = user.username
+		}
+	}
+	reviews = append(reviews, review)
+	return review, nil
+}
+
+func (t TestDB) UpdateReview(userId int, itemId int, rating int, body string) (Review, error) {
+	reviewIdx := testReviewIdx(func(review Review) bool { return review.userId == userId && review.itemId == itemId })
+	if reviewIdx < 0 {
+		return Review{}, sql.ErrNoRows
+	}
+	reviews[reviewIdx].rating, reviews[reviewIdx].body, reviews[reviewIdx].updatedAt = rating, body, time.Now()
+	return reviews[reviewIdx], nil
+}
+
+func (t TestDB) DeleteReview(userId int, itemId int) error {
+	reviewIdx := testReviewIdx(func(review Review) bool { return review.userId == userId && review.itemId == itemId })
+	if reviewIdx < 0 {
+		return sql.ErrNoRows
+	}
+	reviewId := reviews[reviewIdx].reviewId
+	reviews = slices.Delete(reviews, reviewIdx, reviewIdx+1)
+	reviewFlags = slices.DeleteFunc(reviewFlags, func(flag struct{ userId, reviewId int }) bool { return flag.reviewId == reviewId })
+	return nil
+}
+
+func (t TestDB) ItemReviews(itemId int) ([]Review, error) {
+	var itemReviews []Review
+	for _, review := range slices.Backward(reviews) {
+		if review.itemId == itemId && !review.hidden {
+			itemReviews = append(itemReviews, review)
+		}
+	}
+	return itemReviews, nil
+}
+
+func (t TestDB) ReplyToReview(reviewId int, reply string) (Review, error) {
+	reviewIdx := testReviewIdx(func(review Review) bool { return review.reviewId == reviewId })
+	if reviewIdx < 0 {
+		return Review{}, sql.ErrNoRows
+	}
+	reviews[reviewIdx].reply, reviews[reviewIdx].repliedAt = reply, time.Now()
+	return reviews[reviewIdx], nil
+}
+
+func (t TestDB) FlagReview(userId int, reviewId int, reason string) error {
+	flag := struct{ userId, reviewId int }{userId, reviewId}
+	if !slices.Contains(reviewFlags, flag) {
+		reviewFlags = append(reviewFlags, flag)
+	}
+	return nil
+}
+
+func (t TestDB) FlaggedReviews() ([]Review, error) {
+	var flagged []Review
+	for i := range reviews {
+		if review, _ := t.GetReview(reviews[i].reviewId); review.flags > 0 {
+			flagged = append(flagged, review)
+		}
+	}
+	slices.SortStableFunc(flagged, func(a, b Review) int { return b.flags - a.flags })
+	return flagged, nil
+}
+
+func (t TestDB) ModerateReview(reviewId int, hidden bool) (Review, error) {
+	reviewIdx := slices.IndexFunc(reviews, func(review Review) bool { return review.reviewId == reviewId })
+	if reviewIdx < 0 {
+		return Review{}, sql.ErrNoRows
+	}
+	reviews[reviewIdx].hidden = hidden
+	reviewFlags = slices.DeleteFunc(reviewFlags, func(flag struct{ userId, reviewId int }) bool { return flag.reviewId == reviewId })
+	return t.GetReview(reviewId)
+}
+
+func (t TestDB) Wishlist(userId int) ([]WishlistEntry, error) {
+	var entries []WishlistEntry
+	for _, entry := range slices.Backward(wishlist) {
+		if entry.userId == userId {
+			item, _ := t.GetItem(entry.itemId)
+			entries = append(entries, WishlistEntry{item: item, target: entry.target, addedAt: entry.addedAt})
+		}
+	}
+	return entries, nil
+}
+
+func (t TestDB) SaveToWishlist(userId int, itemId int, target int) error {
+	entryIdx := slices.IndexFunc(wishlist, func(entry testWishlistItem) bool { return entry.userId == userId && entry.itemId == itemId })
+	if entryIdx < 0 {
+		wishlist = append(wishlist, testWishlistItem{userId: userId, itemId: itemId, target: target, addedAt: time.Now()})
+		return nil
+	}
+	wishlist[entryIdx].target, wishlist[entryIdx].notifiedAt = target, time.Time{}
+	return nil
+}
+
+func (t TestDB) RemoveFromWishlist(userId int, itemId int) error {
+	entryIdx := slices.IndexFunc(wishlist, func(entry testWishlistItem) bool { return entry.userId == userId && entry.itemId == itemId })
+	if entryIdx < 0 {
+		return sql.ErrNoRows
+	}
+	wishlist = slices.Delete(wishlist, entryIdx, entryIdx+1)
+	return nil
+}
+
+func (t TestDB) NotificationSettings(userId int) (NotificationSettings, error) {
+	return testNotificationSettings[userId], nil
+}
+
+func (t TestDB) UpdateNotificationContacts(userId int, email string, webhookURL string) error {
+	settings := testNotificationSettings[userId]
+	settings.email, settings.webhookURL = email, webhookURL
+	testNotificationSettings[userId] = settings
+	return nil
+}
+
+func (t TestDB) SetNotificationPreference(userId int, preference NotificationPreference) error {
+	settings := testNotificationSettings[userId]
+	settings.preferences = slices.DeleteFunc(slices.Clone(settings.preferences), func(existing NotificationPreference) bool {
+		return existing.kind == preference.kind && existing.channel == preference.channel
+	})
+	settings.preferences = append(settings.preferences, preference)
+	testNotificationSettings[userId] = settings
+	return nil
+}
+
+func (t TestDB) InAppNotifications(userId int) ([]Notification, error) {
+	var inApp []Notification
+	for _, notification := range slices.Backward(notifications) {
+		if notification.userId == userId && notification.channel == ChannelInApp {
+			inApp = append(inApp, notification)
+		}
+	}
+	return inApp, nil
+}
+
+func (t TestDB) MarkNotificationRead(userId int, notificationId int, now time.Time) error {
+	for i, notification := range notifications {
+		if notification.notificationId == notificationId && notification.userId == userId && notification.channel == ChannelInApp {
+			if notification.readAt.IsZero() {
+				notifications[i].readAt = now
+			}
+			return nil
+		}
+	}
+	return sql.ErrNoRows
+}
+
+func (t TestDB) ClaimNotifications(now time.Time, limit int) ([]Notification, error) {
+	var claimed []Notification
+	for i, notification := range notifications {
+		if len(claimed) < limit && notification.status == NotificationPending && !notification.nextAttemptAt.After(now) {
+			notifications[i].attempts++
+			notifications[i].nextAttemptAt = now.Add(NotificationLease)
+			claimed = append(claimed, notifications[i])
+		}
+	}
+	return claimed, nil
+}
+
+func (t TestDB) FinishNotification(notificationId int, status NotificationStatus, lastError string, at time.Time) error {
+	for i, notification := range notifications {
+		if notification.notificationId == notificationId {
+			notifications[i].status, notifications[i].lastError, notifications[i].nextAttemptAt = status, lastError, at
+			if status == NotificationSent {
+				notifications[i].sentAt = at
+			}
+		}
+	}
+	return nil
+}
+
+func (t TestDB) EnqueueNotifications(eventId int, eventNotifications []EventNotification) error {
+	if slices.Contains(notifiedEvents, eventId) {
+		return nil
+	}
+	for _, notification := range eventNotifications {
+		if err := testEnqueueNotification(notification); err != nil {
+			return err
+		}
+	}
+	notifiedEvents = append(notifiedEvents, eventId)
+	return nil
+}
+
+func (t TestDB) AddWebhookEndpoint(endpoint WebhookEndpoint) (WebhookEndpoint, error) {
+	count := 0
+	for _, existing := range webhookEndpoints {
+		if existing.userId == endpoint.userId {
+			count++
+		}
+	}
+	if count >= MaxWebhookEndpoints {
+		return WebhookEndpoint{}, ErrTooManyEndpoints
+	}
+	endpoint.endpointId = len(webhookEndpoints) + 1
+	if len(webhookEndpoints) != 0 {
+		endpoint.endpointId = webhookEndpoints[len(webhookEndpoints)-1].endpointId + 1
+	}
+	endpoint.createdAt = time.Now()
+	webhookEndpoints = append(webhookEndpoints, endpoint)
+	return endpoint, nil
+}
+
+func (t TestDB) WebhookEndpoints(userId int) ([]WebhookEndpoint, error) {
+	var endpoints []WebhookEndpoint
+	for _, endpoint := range webhookEndpoints {
+		if endpoint.userId == userId {
+			endpoints = append(endpoints, endpoint)
+		}
+	}
+	return endpoints, nil
+}
+
+func (t TestDB) GetWebhookEndpoint(endpointId int) (WebhookEndpoint, error) {
+	for _, endpoint := range webhookEndpoints {
+		if endpoint.endpointId == endpointId {
+			return endpoint, nil
+		}
+	}
+	return WebhookEndpoint{}, sql.ErrNoRows
+}
+
+func (t TestDB) DeleteWebhookEndpoint(endpointId int) error {
+	webhookEndpoints = slices.DeleteFunc(webhookEndpoints, func(endpoint WebhookEndpoint) bool { return endpoint.endpointId == endpointId })
+	webhookDeliveries = slices.DeleteFunc(webhookDeliveries, func(delivery WebhookDelivery) bool { return delivery.endpointId == endpointId })
+	return nil
+}
+
+func (t TestDB) WebhookDeliveries(endpointId int) ([]WebhookDelivery, error) {
+	var deliveries []WebhookDelivery
+	for _, delivery := range slices.Backward(webhookDeliveries) {
+		if delivery.endpointId == endpointId && len(deliveries) < WebhookDeliveriesLimit {
+			deliveries = append(deliveries, delivery)
+		}
+	}
+	return deliveries, nil
+}
+
+func (t TestDB) RedeliverWebhook(endpointId int, deliveryId int) (WebhookDelivery, error) {
+	for _, delivery := range webhookDeliveries {
+		if delivery.deliveryId == deliveryId && delivery.endpointId == endpointId {
+			redelivery := WebhookDelivery{deliveryId: webhookDeliveries[len(webhookDeliveries)-1].deliveryId + 1, eventId: delivery.eventId,
+				endpointId: endpointId, eventType: delivery.eventType, status: DeliveryPending, nextAttemptAt: time.Now(), createdAt: time.Now()}
+			webhookDeliveries = append(webhookDeliveries, redelivery)
+			return redelivery, nil
+		}
+	}
+	return WebhookDelivery{}, sql.ErrNoRows
+}
+
+func (t TestDB) ClaimWebhookDeliveries(now time.Time, limit int) ([]WebhookDelivery, error) {
+	var claimed []WebhookDelivery
+	for i, delivery := range webhookDeliveries {
+		if len(claimed) == limit || delivery.status != DeliveryPending || delivery.nextAttemptAt.After(now) {
+			continue
+		}
+		webhookDeliveries[i].attempts++
+		webhookDeliveries[i].nextAttemptAt = now.Add(WebhookDeliveryLease)
+		delivery = webhookDeliveries[i]
+
+		endpoint, _ := t.GetWebhookEndpoint(delivery.endpointId)
+		event := webhookEvents[delivery.eventId-1]
+		payload, err := json.Marshal(webhookPayload{event.eventId, event.eventType, event.createdAt, event.data})
+		if err != nil {
+			return nil, err
+		}
+		delivery.url, delivery.secret, delivery.payload = endpoint.url, endpoint.secret, payload
+		claimed = append(claimed, delivery)
+	}
+	return claimed, nil
+}
+
+func (t TestDB) FinishWebhookDelivery(deliveryId int, status DeliveryStatus, responseStatus int, lastError string, at time.Time) error {
+	for i, delivery := range webhookDeliveries {
+		if delivery.deliveryId == deliveryId {
+			webhookDeliveries[i].status, webhookDeliveries[i].responseStatus = status, responseStatus
+			webhookDeliveries[i].lastError, webhookDeliveries[i].nextAttemptAt = lastError, at
+			if status == DeliveryDelivered {
+				webhookDeliveries[i].deliveredAt = at
+			}
+		}
+	}
+	return nil
+}
+
+func (t TestDB) EnqueueWebhookEvents(eventId int, eventType EventType, webhooks []EventWebhook) error {
+	for _, webhook := range webhooks {
+		if err := testEnqueueWebhookEvent(eventId, eventType, webhook); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t TestDB) PendingEvents(subscriber string, types []EventType, now time.Time, limit int) ([]DomainEvent, error) {
+	var pending []DomainEvent
+	for _, event := range domainEvents {
+		if len(pending) == limit || !slices.Contains(types, event.eventType) {
+			continue
+		}
+		receiptIdx := slices.IndexFunc(eventReceipts, func(receipt testEventReceipt) bool {
+			return receipt.subscriber == subscriber && receipt.eventId == event.eventId
+		})
+		if receiptIdx >= 0 {
+			receipt := eventReceipts[receiptIdx]
+			if !receipt.handledAt.IsZero() || receipt.attempts >= MaxEventAttempts || receipt.nextAttemptAt.After(now) {
+				continue
+			}
+			event.attempts = receipt.attempts
+		}
+		pending = append(pending, event)
+	}
+	return pending, nil
+}
+
+func (t TestDB) FinishEvent(subscriber string, eventId int, lastError string, at time.Time) error {
+	receipt := testEventReceipt{subscriber: subscriber, eventId: eventId, attempts: 1, lastError: lastError, nextAttemptAt: at}
+	if len(lastError) == 0 {
+		receipt.handledAt = at
+	}
+	receiptIdx := slices.IndexFunc(eventReceipts, func(existing testEventReceipt) bool {
+		return existing.subscriber == subscriber && existing.eventId == eventId
+	})
+	if receiptIdx < 0 {
+		eventReceipts = append(eventReceipts, receipt)
+		return nil
+	}
+	receipt.attempts += eventReceipts[receiptIdx].attempts
+	eventReceipts[receiptIdx] = receipt
+	return nil
+}
+
+func (t TestDB) CreateDeposit(userId int, intent PaymentIntent) (Deposit, error) {
+	deposit := Deposit{
+		depositId: len(deposits) + 1,
+		userId:    userId,
+		amount:    intent.amount,
+		intentId:  intent.intentId,
+		status:    PaymentPending,
+		createdAt: time.Now(),
+		updatedAt: time.Now(),
+	}
+	deposits = append(deposits, deposit)
+	return deposit, nil
+}
+
+func (t TestDB) GetDeposit(userId int, depositId int) (Deposit, error) {
+	for _, deposit := range deposits {
+		if deposit.depositId == depositId && deposit.userId == userId {
+			return deposit, nil
+		}
+	}
+	return Deposit{}, sql.ErrNoRows
+}
+
+func (t TestDB) SettleDeposit(intentId string, to PaymentStatus) (Deposit, error) {
+	for i, deposit := range deposits {
+		if deposit.intentId != intentId {
+			continue
+		}
+		if deposit.status == to {
+			return deposit, nil
+		}
+		refunding := deposit.status == PaymentSucceeded && to == PaymentRefunded
+		if (deposit.status != PaymentPending && !refunding) || to == PaymentPending {
+			return Deposit{}, ErrDepositSettled
+		}
+		if refunding {
+			if balance, _ := t.Balance(deposit.userId, deposit.amount.currency); balance.amount < deposit.amount.amount {
+				return Deposit{}, ErrInsufficientFunds
+			}
+			creditTestWallet(deposit.userId, Money{-deposit.amount.amount, deposit.amount.currency})
+		}
+		if to == PaymentSucceeded {
+			if _, err := creditTestWallet(deposit.userId, deposit.amount); err != nil {
+				return deposit, err
+			}
+			testRecordEvent(EventDepositSucceeded, deposit.userId, depositSucceededEvent{deposit.depositId, deposit.userId, deposit.amount})
+		}
+		deposits[i].status = to
+		deposits[i].updatedAt = time.Now()
+		return deposits[i], nil
+	}
+	return Deposit{}, sql.ErrNoRows
+}
+
+func (t TestDB) Ledger(userId int) ([]LedgerEntry, error) {
+	var entries []LedgerEntry
+	for _, entry := range slices.Backward(ledger) {
+		if entry.userId == userId {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+func (t TestDB) Transfer(userId int, toUsername string, amount Money, now time.Time) (Transfer, error) {
+	recipient, err := t.GetUserFromUsername(toUsername)
+	if err != nil {
+		return Transfer{}, sql.ErrNoRows
+	}
+	if recipient.userId == userId {
+		return Transfer{}, ErrSelfTransfer
+	}
+	sent := 0
+	for _, transfer := range transfers {
+		if transfer.fromUserId == userId && transfer.amount.currency == amount.currency && transfer.createdAt.After(now.Add(-24*time.Hour)) {
+			sent += transfer.amount.amount
+		}
+	}
+	if sent+amount.amount > DailyTransferLimit {
+		return Transfer{}, ErrTransferLimit
+	}
+	if err := testSpendable(userId, amount, now); err != nil {
+		return Transfer{}, err
+	}
+	fromIdx, toIdx := testWallet(userId, amount.currency), testWallet(recipient.userId, amount.currency)
+
+	transfer := Transfer{
+		transferId: len(transfers) + 1,
+		fromUserId: userId,
+		toUserId:   recipient.userId,
+		toUsername: recipient.username,
+		amount:     amount,
+		createdAt:  now,
+	}
+	for _, user := range users {
+		if user.userId == userId {
+			transfer.fromUsername = user.username
+		}
+	}
+	transfers = append(transfers, transfer)
+	wallets[fromIdx].balance.amount -= amount.amount
+	wallets[toIdx].balance.amount += amount.amount
+	ledger = append(ledger,
+		LedgerEntry{userId: userId, amount: Money{-amount.amount, amount.currency}, kind: LedgerTransferOut, referenceId: transfer.transferId},
+		LedgerEntry{userId: recipient.userId, amount: amount, kind: LedgerTransferIn, referenceId: transfer.transferId})
+	return transfer, nil
+}
+
+func (t TestDB) Transfers(userId int) ([]Transfer, error) {
+	var userTransfers []Transfer
+	for _, transfer := range slices.Backward(transfers) {
+		if transfer.fromUserId == userId || transfer.toUserId == userId {
+			userTransfers = append(userTransfers, transfer)
+		}
+	}
+	return userTransfers, nil
+}
+
+func (t TestDB) IssueGiftCards(cards []GiftCard, adminId int) ([]GiftCard, error) {
+	var issued []GiftCard
+	for _, card := range cards {
+		card.cardId = len(giftCards) + 1
+		card.createdAt = time.Now()
+		giftCards = append(giftCards, testGiftCard{codeHash: hashGiftCardCode(card.code), card: card})
+		issued = append(issued, card)
+	}
+	return issued, nil
+}
+
+func (t TestDB) RedeemGiftCard(userId int, code string, amount int, now time.Time) (GiftCard, Money, error) {
+	cardIdx := slices.IndexFunc(giftCards, func(giftCard testGiftCard) bool {
+		return giftCard.codeHash == hashGiftCardCode(code)
+	})
+	if cardIdx < 0 {
+		return GiftCard{}, Money{}, ErrGiftCardNotFound
+	}
+	card := giftCards[cardIdx].card
+	if err := card.redeemable(userId, amount, now); err != nil {
+		return GiftCard{}, Money{}, err
+	}
+	if amount == 0 {
+		amount = card.balance.amount
+	}
+	balance, err := creditTestWallet(userId, Money{amount, card.value.currency})
+	if err != nil {
+		return GiftCard{}, Money{}, err
+	}
+	card.balance.amount -= amount
+	card.redeemedBy = userId
+	giftCards[cardIdx].card = card
+	ledger = append(ledger, LedgerEntry{userId: userId, amount: Money{amount, card.value.currency}, kind: LedgerGiftCard, referenceId: card.cardId})
+	return card, balance, nil
+}
+
+func (t TestDB) GiftCards(userId int) ([]GiftCard, error) {
+	var cards []GiftCard
+	for _, giftCard := range slices.Backward(giftCards) {
+		if giftCard.card.redeemedBy == userId {
+			cards = append(cards, giftCard.card)
+		}
+	}
+	return cards, nil
+}
+
+func (t TestDB) GiftCardLiability(now time.Time) ([]GiftCardLiability, error) {
+	var report []GiftCardLiability
+	for _, giftCard := range giftCards {
+		card := giftCard.card
+		reportIdx := slices.IndexFunc(report, func(liability GiftCardLiability) bool {
+			return liability.currency == card.value.currency
+		})
+		if reportIdx < 0 {
+			report = append(report, GiftCardLiability{currency: card.value.currency})
+			reportIdx = len(report) - 1
+		}
+		report[reportIdx].cards++
+		report[reportIdx].issued += card.value.amount
+		report[reportIdx].redeemed += card.value.amount - card.balance.amount
+		if card.expiresAt.IsZero() || card.expiresAt.After(now) {
+			report[reportIdx].outstanding += card.balance.amount
+		} else {
+			report[reportIdx].expired += card.balance.amount
+		}
+	}
+	slices.SortFunc(report, func(a, b GiftCardLiability) int {
+		return strings.Compare(string(a.currency), string(b.currency))
+	})
+	return report, nil
+}
+
+// testSpendable checks the user's wallet can pay amount at now without touching sale money
+// still on hold, like availableBalance
+func testSpendable(userId int, amount Money, now time.Time) error {
+	held := 0
+	for _, entry := range ledger {
+		if entry.userId == userId && entry.amount.currency == amount.currency && entry.heldUntil.After(now) {
+			held += entry.amount.amount
+		}
+	}
+	balance := wallets[testWallet(userId, amount.currency)].balance.amount
+	if balance-min(balance, max(held, 0)) < amount.amount {
+		if balance >= amount.amount {
+			return ErrFundsHeld
+		}
+		return ErrInsufficientFunds
+	}
+	return nil
+}
+
+func (t TestDB) RequestWithdrawal(userId int, amount Money, now time.Time) (Withdrawal, error) {
+	walletIdx := testWallet(userId, amount.currency)
+	if err := testSpendable(userId, amount, now); err != nil {
+		return Withdrawal{}, err
+	}
+
+	withdrawal := Withdrawal{
+		withdrawalId: len(withdrawals) + 1,
+		userId:       userId,
+		amount:       amount,
+		status:       WithdrawalPending,
+		createdAt:    now,
+		updatedAt:    now,
+	}
+	withdrawals = append(withdrawals, withdrawal)
+	wallets[walletIdx].balance.amount -= amount.amount
+	ledger = append(ledger, LedgerEntry{userId: userId, amount: Money{-amount.amount, amount.currency}, kind: LedgerWithdrawal,
+		referenceId: withdrawal.withdrawalId})
+	return withdrawal, nil
+}
+
+func (t TestDB) Withdrawals(userId int) ([]Withdrawal, error) {
+	var userWithdrawals []Withdrawal
+	for _, withdrawal := range slices.Backward(withdrawals) {
+		if withdrawal.userId == userId {
+			userWithdrawals = append(userWithdrawals, withdrawal)
+		}
+	}
+	return userWithdrawals, nil
+}
+
+func (t TestDB) PendingWithdrawals() ([]Withdrawal, error) {
+	var pending []Withdrawal
+	for _, withdrawal := range withdrawals {
+		if withdrawal.status == WithdrawalPending {
+			pending = append(pending, withdrawal)
+		}
+	}
+	return pending, nil
+}
+
+func (t TestDB) GetWithdrawal(withdrawalId int) (Withdrawal, error) {
+	for _, withdrawal := range withdrawals {
+		if withdrawal.withdrawalId == withdrawalId {
+			return withdrawal, nil
+		}
+	}
+	return Withdrawal{}, sql.ErrNoRows
+}
+
+func (t TestDB) TransitionWithdrawal(withdrawalId int, to WithdrawalStatus, payoutId string, reviewerId int) (Withdrawal, error) {
+	for i, withdrawal := range withdrawals {
+		if withdrawal.withdrawalId != withdrawalId {
+			continue
+		}
+		if !withdrawal.status.CanTransition(to) {
+			return Withdrawal{}, ErrInvalidTransition
+		}
+		if to.returnsFunds() {
+			creditTestWallet(withdrawal.userId, withdrawal.amount)
+			ledger = append(ledger, LedgerEntry{userId: withdrawal.userId, amount: withdrawal.amount, kind: LedgerWithdrawalReversal,
+				referenceId: withdrawalId})
+		}
+		withdrawal.status = to
+		if len(payoutId) != 0 {
+			withdrawal.payoutId = payoutId
+		}
+		if reviewerId != 0 {
+			withdrawal.reviewerId = reviewerId
+		}
+		withdrawal.updatedAt = time.Now()
+		withdrawals[i] = withdrawal
+		return withdrawal, nil
+	}
+	return Withdrawal{}, sql.ErrNoRows
+}
+
+func (t TestDB) UpdateLastLogin(userId int) {
+	for i, user := range users {
+		if user.userId == userId {
 			user.lastLogin = time.Now()
 			users[i] = user
 			break
@@ -283,9 +2139,18 @@ func (t TestDB) Close() error {
 }
 
 func NewTestEnv() *Env {
+	events := &EventBus{}
+	events.Subscribe("notifications", NotificationEventHandler(TestDB{}), notificationEventTypes...)
+	events.Subscribe("webhooks", WebhookEventHandler(TestDB{}), webhookEventTypes...)
 	return &Env{
-		logger: log.New(io.Discard, "", 0),
-		db:     TestDB{},
+		logger:    log.New(io.Discard, "", 0),
+		db:        TestDB{},
+		blobs:     &memBlobStore{blobs: make(map[string][]byte)},
+		mediaURLs: URLSigner{key: []byte("test"), prefix: "/media"},
+		rates:     testRates,
+		payments:  testPayments,
+		payouts:   testPayouts,
+		events:    events,
 	}
 }
 
@@ -384,3 +2249,521 @@ func TestRegister(t *testing.T) {
 		}
 	})
 }
+
+func TestSecurityHeaders(t *testing.T) {
+	t.Parallel()
+
+	env := NewTestEnv()
+	env.trustedProxies, _ = parseTrustedProxies("192.0.2.1")
+	handler := env.SecurityHeadersMiddleware(func(w http.ResponseWriter, r *http.Request) {})
+
+	t.Run("PlainHTTP", func(t *testing.T) {
+		t.Parallel()
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest("GET", "/health", nil)
+		handler(recorder, request)
+		result := recorder.Result()
+		if result.Header.Get("X-Content-Type-Options") != "nosniff" {
+			t.Error("missing X-Content-Type-Options header")
+		}
+		if hsts := result.Header.Get("Strict-Transport-Security"); hsts != "" {
+			t.Errorf("unexpected HSTS header over plain http: %q", hsts)
+		}
+	})
+
+	t.Run("ForwardedHTTPS", func(t *testing.T) {
+		t.Parallel()
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest("GET", "/health", nil)
+		request.Header.Set("X-Forwarded-Proto", "https")
+		handler(recorder, request)
+		result := recorder.Result()
+		if result.Header.Get("Strict-Transport-Security") == "" {
+			t.Error("missing HSTS header for https request")
+		}
+	})
+}
+
+func TestLoginSecureCookies(t *testing.T) {
+	t.Parallel()
+
+	env := NewTestEnv()
+	env.trustedProxies, _ = parseTrustedProxies("192.0.2.1")
+
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest("POST", "/api/login", nil)
+	request.Header.Set("X-Forwarded-Proto", "https")
+	request.SetBasicAuth("test_user", "password")
+	env.Login(recorder, request)
+	result := recorder.Result()
+	if result.StatusCode != http.StatusOK {
+		t.Fatalf("bad status code for login with valid credentials, expected %v, got %v", http.StatusOK, result.StatusCode)
+	}
+	for _, cookie := range result.Cookies() {
+		if !cookie.Secure {
+			t.Errorf("cookie %q not marked secure over https", cookie.Name)
+		}
+	}
+}
+
+func TestItems(t *testing.T) {
+	t.Parallel()
+
+	env := NewTestEnv()
+
+	getItems := func(t *testing.T, target string) (int, string, string) {
+		t.Helper()
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest("GET", target, nil)
+		env.Items(recorder, request)
+		result := recorder.Result()
+		body, _ := io.ReadAll(result.Body)
+		return result.StatusCode, string(body), result.Header.Get("X-Next-Cursor")
+	}
+
+	t.Run("ItemsPaginated", func(t *testing.T) {
+		t.Parallel()
+		var seen []string
+		target := "/api/items?sort=price_asc&limit=2"
+		for pages := 0; ; pages++ {
+			if pages > len(items) {
+				t.Fatal("pagination did not terminate")
+			}
+			status, body, cursor := getItems(t, target)
+			if status != http.StatusOK {
+				t.Fatalf("bad status code for items page, expected %v, got %v", http.StatusOK, status)
+			}
+			seen = append(seen, strings.Split(strings.TrimSpace(body), "\n")...)
+			if len(cursor) == 0 {
+				break
+			}
+			target = "/api/items?sort=price_asc&limit=2&cursor=" + cursor
+		}
+		if len(seen) != len(items) {
+			t.Fatalf("expected %v items across pages, got %v", len(items), len(seen))
+		}
+		if !strings.Contains(seen[0], "AMD Ryzen 5 5600X") {
+			t.Errorf("expected cheapest item first, got %q", seen[0])
+		}
+	})
+
+	t.Run("ItemsFiltered", func(t *testing.T) {
+		t.Parallel()
+		status, body, _ := getItems(t, "/api/items?name=nvidia&max_price=200")
+		if status != http.StatusOK {
+			t.Fatalf("bad status code for filtered items, expected %v, got %v", http.StatusOK, status)
+		}
+		lines := strings.Split(strings.TrimSpace(body), "\n")
+		if len(lines) != 1 || !strings.Contains(lines[0], "Nvidia RTX 3060 12GB") {
+			t.Errorf("unexpected filtered items: %q", body)
+		}
+	})
+
+	t.Run("ItemsByParentCategory", func(t *testing.T) {
+		t.Parallel()
+		status, body, _ := getItems(t, "/api/items?category=1")
+		if status != http.StatusOK {
+			t.Fatalf("bad status code for items by category, expected %v, got %v", http.StatusOK, status)
+		}
+		if lines := strings.Split(strings.TrimSpace(body), "\n"); len(lines) != len(items) {
+			t.Errorf("expected items from subcategories, got %q", body)
+		}
+		if status, body, _ := getItems(t, "/api/items?category=4"); status != http.StatusOK || len(body) != 0 {
+			t.Errorf("expected no items in empty category, got %v %q", status, body)
+		}
+	})
+
+	t.Run("ItemsByAttributes", func(t *testing.T) {
+		t.Parallel()
+		for target, expected := range map[string]int{
+			"/api/items?attr.memory_gb=12":                2,
+			"/api/items?attr.memory_gb=12&attr.brand=MSI": 1,
+			"/api/items?attr.brand=ASUS":                  1,
+			"/api/items?attr.memory_gb=12GB":              0,
+			"/api/items?max_price=99999999.99":            len(seedItems),
+		} {
+			status, body, _ := getItems(t, target)
+			if status != http.StatusOK {
+				t.Fatalf("bad status code for %v, expected %v, got %v", target, http.StatusOK, status)
+			}
+			if count := strings.Count(body, "\n"); count != expected {
+				t.Errorf("expected %v items for %v, got %q", expected, target, body)
+			}
+		}
+	})
+
+	t.Run("ItemsInvalidParams", func(t *testing.T) {
+		t.Parallel()
+		for _, target := range []string{
+			"/api/items?limit=0",
+			"/api/items?min_price=NaN",
+			"/api/items?max_price=100000000",
+			"/api/items?sort=random",
+			"/api/items?category=abc",
+			"/api/items?cursor=garbage",
+			// {"s":"price_asc","i":1,"p":10000000000}
+			"/api/items?sort=price_asc&cursor=eyJzIjoicHJpY2VfYXNjIiwiaSI6MSwicCI6MTAwMDAwMDAwMDB9",
+		} {
+			if status, _, _ := getItems(t, target); status != http.StatusBadRequest {
+				t.Errorf("bad status code for %v, expected %v, got %v", target, http.StatusBadRequest, status)
+			}
+		}
+	})
+}
+
+func TestSearchItems(t *testing.T) {
+	t.Parallel()
+
+	env := NewTestEnv()
+
+	t.Run("SearchNoQuery", func(t *testing.T) {
+		t.Parallel()
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest("GET", "/api/items/search?q=+", nil)
+		env.SearchItems(recorder, request)
+		result := recorder.Result()
+		if result.StatusCode != http.StatusBadRequest {
+			t.Errorf("bad status code for search with no query, expected %v, got %v", http.StatusBadRequest, result.StatusCode)
+		}
+	})
+
+	t.Run("SearchRanked", func(t *testing.T) {
+		t.Parallel()
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest("GET", "/api/items/search?q=rtx+3060", nil)
+		env.SearchItems(recorder, request)
+		result := recorder.Result()
+		if result.StatusCode != http.StatusOK {
+			t.Fatalf("bad status code for search, expected %v, got %v", http.StatusOK, result.StatusCode)
+		}
+		body, _ := io.ReadAll(result.Body)
+		lines := strings.Split(strings.TrimSpace(string(body)), "\n")
+		if len(lines) != 2 {
+			t.Fatalf("expected 2 results, got %q", body)
+		}
+		if !strings.Contains(lines[0], "<b>3060</b>") {
+			t.Errorf("expected best match highlighted first, got %q", lines[0])
+		}
+	})
+}
+
+func TestItem(t *testing.T) {
+	t.Parallel()
+
+	env := NewTestEnv()
+
+	for name, args := range map[string]struct {
+		id       string
+		expected int
+	}{
+		"ItemFound":    {id: "1", expected: http.StatusOK},
+		"ItemNotFound": {id: "999", expected: http.StatusNotFound},
+		"ItemBadId":    {id: "abc", expected: http.StatusBadRequest},
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			recorder := httptest.NewRecorder()
+			request := httptest.NewRequest("GET", "/api/items/"+args.id, nil)
+			request.SetPathValue("id", args.id)
+			env.Item(recorder, request)
+			result := recorder.Result()
+			if result.StatusCode != args.expected {
+				t.Errorf("bad status code for item %v, expected %v, got %v", args.id, args.expected, result.StatusCode)
+			}
+		})
+	}
+}
+
+func TestSetItemSeller(t *testing.T) {
+	env := NewTestEnv()
+	env.db = newTestDB(t)
+	adminId := 3
+
+	for _, test := range []struct {
+		name     string
+		userId   int
+		target   string
+		id       string
+		expected int
+	}{
+		{"NotAdmin", 1, "/api/admin/items/2/seller?seller=test_user", "2", http.StatusForbidden},
+		{"BadId", adminId, "/api/admin/items/abc/seller?seller=test_user", "abc", http.StatusBadRequest},
+		{"UnknownItem", adminId, "/api/admin/items/999/seller?seller=test_user", "999", http.StatusNotFound},
+		{"UnknownSeller", adminId, "/api/admin/items/2/seller?seller=nobody", "2", http.StatusBadRequest},
+		{"Assign", adminId, "/api/admin/items/2/seller?seller=test_user", "2", http.StatusOK},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			request := newCartRequest("POST", test.target, test.userId)
+			request.SetPathValue("id", test.id)
+			env.SetItemSeller(recorder, request)
+			if result := recorder.Result(); result.StatusCode != test.expected {
+				t.Errorf("bad status code, expected %v, got %v", test.expected, result.StatusCode)
+			}
+		})
+	}
+
+	// The new seller can manage the item, schedule a price change to check
+	t.Run("SellerCanManage", func(t *testing.T) {
+		recorder := httptest.NewRecorder()
+		request := newCartRequest("POST", "/api/items/2/prices?price=99.99", 1)
+		request.SetPathValue("id", "2")
+		env.SchedulePriceChange(recorder, request)
+		if result := recorder.Result(); result.StatusCode != http.StatusOK {
+			t.Errorf("bad status code for price change by assigned seller, expected %v, got %v", http.StatusOK, result.StatusCode)
+		}
+	})
+
+	t.Run("Unassign", func(t *testing.T) {
+		recorder := httptest.NewRecorder()
+		request := newCartRequest("POST", "/api/admin/items/2/seller", adminId)
+		request.SetPathValue("id", "2")
+		env.SetItemSeller(recorder, request)
+		if result := recorder.Result(); result.StatusCode != http.StatusOK {
+			t.Fatalf("bad status code for unassigning seller, expected %v, got %v", http.StatusOK, result.StatusCode)
+		}
+		if item, _ := env.db.GetItem(2); item.sellerId != 0 {
+			t.Errorf("expected item without seller, got seller %v", item.sellerId)
+		}
+	})
+}
+
+func TestCategories(t *testing.T) {
+	t.Parallel()
+
+	env := NewTestEnv()
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest("GET", "/api/categories", nil)
+	env.Categories(recorder, request)
+	result := recorder.Result()
+	if result.StatusCode != http.StatusOK {
+		t.Fatalf("bad status code for categories, expected %v, got %v", http.StatusOK, result.StatusCode)
+	}
+	body, _ := io.ReadAll(result.Body)
+	expected := "id: 1, name: Components\n" +
+		"  id: 2, name: Processors\n" +
+		"  id: 3, name: Graphics Cards\n" +
+		"id: 4, name: Peripherals\n"
+	if string(body) != expected {
+		t.Errorf("got category tree %q, expected %q", body, expected)
+	}
+}
+
+func TestBuildCategoryTree(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		name       string
+		categories []Category
+		expected   string
+	}{
+		{
+			name:       "MissingParent",
+			categories: []Category{{1, 9, "A"}, {2, 1, "B"}},
+			expected:   "id: 1, name: A\n  id: 2, name: B\n",
+		},
+		{
+			name:       "SelfParent",
+			categories: []Category{{1, 1, "A"}, {2, 1, "B"}},
+			expected:   "id: 1, name: A\n  id: 2, name: B\n",
+		},
+		{
+			name:       "TwoCycle",
+			categories: []Category{{1, 2, "A"}, {2, 1, "B"}},
+			expected:   "id: 2, name: B\n  id: 1, name: A\n",
+		},
+		{
+			name:       "CycleWithChild",
+			categories: []Category{{1, 3, "A"}, {2, 1, "B"}, {3, 2, "C"}, {4, 2, "D"}},
+			expected:   "id: 3, name: C\n  id: 1, name: A\n    id: 2, name: B\n      id: 4, name: D\n",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var tree strings.Builder
+			for _, root := range buildCategoryTree(test.categories) {
+				root.Write(&tree, 0)
+			}
+			if tree.String() != test.expected {
+				t.Errorf("got category tree %q, expected %q", tree.String(), test.expected)
+			}
+		})
+	}
+}
+
+func newImageUploadRequest(t *testing.T, itemId string, userId int, data []byte) *http.Request {
+	t.Helper()
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile("image", "upload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(data)
+	form.Close()
+
+	request := httptest.NewRequest("POST", "/api/items/"+itemId+"/images", &body)
+	request.Header.Set("Content-Type", form.FormDataContentType())
+	request.SetPathValue("id", itemId)
+	return request.WithContext(context.WithValue(request.Context(), CtxUserId, userId))
+}
+
+func TestUploadItemImage(t *testing.T) {
+	env := NewTestEnv()
+	env.db = newTestDB(t)
+
+	var upload bytes.Buffer
+	if err := png.Encode(&upload, image.NewRGBA(image.Rect(0, 0, 600, 300))); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("UploadNotSeller", func(t *testing.T) {
+		recorder := httptest.NewRecorder()
+		env.UploadItemImage(recorder, newImageUploadRequest(t, "1", 1, upload.Bytes()))
+		if result := recorder.Result(); result.StatusCode != http.StatusForbidden {
+			t.Errorf("bad status code for upload by non seller, expected %v, got %v", http.StatusForbidden, result.StatusCode)
+		}
+	})
+
+	t.Run("UploadNotImage", func(t *testing.T) {
+		recorder := httptest.NewRecorder()
+		env.UploadItemImage(recorder, newImageUploadRequest(t, "1", 2, []byte("<html></html>")))
+		if result := recorder.Result(); result.StatusCode != http.StatusUnsupportedMediaType {
+			t.Errorf("bad status code for non image upload, expected %v, got %v", http.StatusUnsupportedMediaType, result.StatusCode)
+		}
+	})
+
+	t.Run("UploadValid", func(t *testing.T) {
+		recorder := httptest.NewRecorder()
+		env.UploadItemImage(recorder, newImageUploadRequest(t, "1", 2, upload.Bytes()))
+		result := recorder.Result()
+		if result.StatusCode != http.StatusCreated {
+			t.Fatalf("bad status code for valid upload, expected %v, got %v", http.StatusCreated, result.StatusCode)
+		}
+
+		images, _ := env.db.ItemImages(1)
+		if len(images) != 1 {
+			t.Fatalf("expected 1 image recorded, got %v", len(images))
+		}
+
+		// Thumbnail is served through its signed link
+		link := env.mediaURLs.Sign(images[0].thumbKey, time.Now().Add(time.Minute))
+		recorder = httptest.NewRecorder()
+		request := httptest.NewRequest("GET", link, nil)
+		request.SetPathValue("key", images[0].thumbKey)
+		env.Media(recorder, request)
+		result = recorder.Result()
+		if result.StatusCode != http.StatusOK {
+			t.Fatalf("bad status code for signed thumbnail, expected %v, got %v", http.StatusOK, result.StatusCode)
+		}
+		config, _, err := image.DecodeConfig(result.Body)
+		if err != nil || config.Width != ThumbnailSize || config.Height != ThumbnailSize/2 {
+			t.Errorf("bad thumbnail %+v, %v", config, err)
+		}
+	})
+}
+
+func TestPurchaseVariants(t *testing.T) {
+	t.Parallel()
+
+	env := NewTestEnv()
+
+	for name, args := range map[string]struct {
+		variant  string
+		expected int
+	}{
+		"PurchaseVariantRequired": {variant: "", expected: http.StatusBadRequest},
+		"PurchaseOutOfStock":      {variant: "2", expected: http.StatusConflict},
+		"PurchaseUnknownVariant":  {variant: "99", expected: http.StatusNotFound},
+		"PurchaseInvalidVariant":  {variant: "abc", expected: http.StatusBadRequest},
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			recorder := httptest.NewRecorder()
+			request := httptest.NewRequest("POST", "/api/purchase?id=3&variant="+args.variant, nil)
+			request = request.WithContext(context.WithValue(request.Context(), CtxUserId, 2))
+			env.Purchase(recorder, request)
+			if result := recorder.Result(); result.StatusCode != args.expected {
+				t.Errorf("bad status code for variant %q, expected %v, got %v", args.variant, args.expected, result.StatusCode)
+			}
+		})
+	}
+}
+
+func newCartRequest(method, target string, userId int) *http.Request {
+	request := httptest.NewRequest(method, target, nil)
+	return request.WithContext(context.WithValue(request.Context(), CtxUserId, userId))
+}
+
+func TestCart(t *testing.T) {
+	env := NewTestEnv()
+	env.db = newTestDB(t)
+	richUserId := 2
+	startBalance, _ := env.db.Balance(richUserId, DefaultCurrency)
+
+	t.Run("AddToCartVariantRequired", func(t *testing.T) {
+		recorder := httptest.NewRecorder()
+		env.AddToCart(recorder, newCartRequest("POST", "/api/cart?id=3", richUserId))
+		if result := recorder.Result(); result.StatusCode != http.StatusBadRequest {
+			t.Errorf("bad status code for cart add without variant, expected %v, got %v", http.StatusBadRequest, result.StatusCode)
+		}
+	})
+
+	t.Run("AddToCartInvalidQuantity", func(t *testing.T) {
+		recorder := httptest.NewRecorder()
+		env.AddToCart(recorder, newCartRequest("POST", "/api/cart?id=2&quantity=100", richUserId))
+		if result := recorder.Result(); result.StatusCode != http.StatusBadRequest {
+			t.Errorf("bad status code for cart add with invalid quantity, expected %v, got %v", http.StatusBadRequest, result.StatusCode)
+		}
+	})
+
+	t.Run("CheckoutInsufficientFunds", func(t *testing.T) {
+		recorder := httptest.NewRecorder()
+		env.AddToCart(recorder, newCartRequest("POST", "/api/cart?id=2&quantity=2", richUserId))
+		if result := recorder.Result(); result.StatusCode != http.StatusOK {
+			t.Fatalf("bad status code for cart add, expected %v, got %v", http.StatusOK, result.StatusCode)
+		}
+
+		recorder = httptest.NewRecorder()
+		env.Checkout(recorder, newCartRequest("POST", "/api/checkout", richUserId))
+		if result := recorder.Result(); result.StatusCode != http.StatusForbidden {
+			t.Errorf("bad status code for checkout over balance, expected %v, got %v", http.StatusForbidden, result.StatusCode)
+		}
+		if balance, _ := env.db.Balance(richUserId, DefaultCurrency); balance != startBalance {
+			t.Errorf("balance changed by failed checkout, expected %v, got %v", startBalance, balance)
+		}
+	})
+
+	t.Run("CheckoutValid", func(t *testing.T) {
+		lines, _ := env.db.Cart(richUserId)
+		if len(lines) != 1 {
+			t.Fatalf("expected 1 cart line, got %v", len(lines))
+		}
+		recorder := httptest.NewRecorder()
+		request := newCartRequest("PATCH", "/api/cart/"+strconv.Itoa(lines[0].lineId)+"?quantity=1", richUserId)
+		request.SetPathValue("lineId", strconv.Itoa(lines[0].lineId))
+		env.UpdateCartLine(recorder, request)
+		if result := recorder.Result(); result.StatusCode != http.StatusOK {
+			t.Fatalf("bad status code for cart update, expected %v, got %v", http.StatusOK, result.StatusCode)
+		}
+
+		recorder = httptest.NewRecorder()
+		env.Checkout(recorder, newCartRequest("POST", "/api/checkout", richUserId))
+		if result := recorder.Result(); result.StatusCode != http.StatusOK {
+			t.Fatalf("bad status code for checkout, expected %v, got %v", http.StatusOK, result.StatusCode)
+		}
+		if balance, _ := env.db.Balance(richUserId, DefaultCurrency); balance.amount != startBalance.amount-12999 {
+			t.Errorf("bad balance after checkout, expected %v, got %v", startBalance.amount-12999, balance.amount)
+		}
+		if lines, _ := env.db.Cart(richUserId); len(lines) != 0 {
+			t.Errorf("cart not emptied by checkout, got %v lines", len(lines))
+		}
+	})
+
+	t.Run("CheckoutEmpty", func(t *testing.T) {
+		recorder := httptest.NewRecorder()
+		env.Checkout(recorder, newCartRequest("POST", "/api/checkout", richUserId))
+		if result := recorder.Result(); result.StatusCode != http.StatusBadRequest {
+			t.Errorf("bad status code for empty checkout, expected %v, got %v", http.StatusBadRequest, result.StatusCode)
+		}
+	})
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+var ErrEscrowFrozen error = errors.New("escrow frozen by a dispute")
+
+// EscrowPeriod is how long a seller's proceeds stay in escrow if the buyer never confirms
+// receipt, they are released automatically after it
+const EscrowPeriod = 14 * 24 * time.Hour
+
+// EscrowReleaseInterval is how often the background job releases escrows that are due
+const EscrowReleaseInterval = 10 * time.Minute
+
+type EscrowStatus string
+
+const (
+	EscrowHeld     EscrowStatus = "held"
+	EscrowReleased EscrowStatus = "released"
+	EscrowFrozen   EscrowStatus = "frozen"
+	EscrowRefunded EscrowStatus = "refunded"
+)
+
+// escrowTransitions lists the statuses each status can move to, released and refunded are
+// final. Frozen escrows go back to held, or are settled either way, when their dispute ends
+var escrowTransitions = map[EscrowStatus][]EscrowStatus{
+	EscrowHeld:   {EscrowReleased, EscrowFrozen, EscrowRefunded},
+	EscrowFrozen: {EscrowHeld, EscrowReleased, EscrowRefunded},
+}
+
+func (s EscrowStatus) CanTransition(to EscrowStatus) bool {
+	return slices.Contains(escrowTransitions[s], to)
+}
+
+// Escrow is a seller's share of an order, taken from the buyer on purchase and only
+// credited to the seller when it is released
+type Escrow struct {
+	escrowId  int
+	orderId   int
+	sellerId  int
+	amount    Money
+	status    EscrowStatus
+	releaseAt time.Time // when it is released if the buyer hasn't confirmed receipt
+	createdAt time.Time
+	updatedAt time.Time
+}
+
+func (e Escrow) String() string {
+	return fmt.Sprintf("escrow: %v, order: %v, amount: %v, status: %v, release: %v, updated: %v",
+		e.escrowId, e.orderId, e.amount, e.status, e.releaseAt.String(), e.updatedAt.String())
+}
+
+const escrowColumns = `escrow_id, order_id, seller_id, CAST(amount*100 AS BIGINT), currency, status, release_at, created_at, updated_at`
+
+func scanEscrow(row rowScanner) (Escrow, error) {
+	var escrow Escrow
+	err := row.Scan(&escrow.escrowId, &escrow.orderId, &escrow.sellerId, &escrow.amount.amount, &escrow.amount.currency,
+		&escrow.status, &escrow.releaseAt, &escrow.createdAt, &escrow.updatedAt)
+	return escrow, err
+}
+
+func queryEscrows(q querier, query string, args ...any) ([]Escrow, error) {
+	rows, err := q.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var escrows []Escrow
+	for rows.Next() {
+		escrow, err := scanEscrow(rows)
+		if err != nil {
+			return nil, err
+		}
+		escrows = append(escrows, escrow)
+	}
+
+	return escrows, rows.Err()
+}
+
+// holdEscrows puts each seller's proceeds from the order in escrow until releaseAt
+func holdEscrows(tx *sql.Tx, orderId int, proceeds map[int]int, currency Currency, releaseAt time.Time) error {
+	addQuery := `INSERT INTO escrows (order_id, seller_id, amount, currency, status, release_at)
+				 VALUES ($1, $2, CAST($3 AS NUMERIC(12, 0))/100, $4, $5, $6)`
+	for _, sellerId := range slices.Sorted(maps.Keys(proceeds)) {
+		if _, err := tx.Exec(addQuery, orderId, sellerId, proceeds[sellerId], currency, EscrowHeld, releaseAt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// releaseEscrows credits the sellers of locked held escrows with their sales, still held
+// for SaleHold so refunds can be taken back, and marks them released
+func releaseEscrows(tx *sql.Tx, escrows []Escrow, now time.Time) error {
+	// Credit in seller order so releases can't deadlock with each other
+	escrows = slices.SortedFunc(slices.Values(escrows), func(a, b Escrow) int { return a.sellerId - b.sellerId })
+	escrowIds := make(pq.Int64Array, len(escrows))
+	for i, escrow := range escrows {
+		sale := LedgerEntry{userId: escrow.sellerId, amount: escrow.amount, kind: LedgerSale, referenceId: escrow.orderId, heldUntil: now.Add(SaleHold)}
+		if _, err := creditWallet(tx, sale); err != nil {
+			return err
+		}
+		escrowIds[i] = int64(escrow.escrowId)
+	}
+	_, err := tx.Exec(`UPDATE escrows SET status=$1, updated_at=$2 WHERE escrow_id=ANY($3)`, EscrowReleased, now, escrowIds)
+	return err
+}
+
+// transitionEscrows moves the order's escrows that can go to status to, returning how
+// many moved
+func transitionEscrows(tx *sql.Tx, orderId int, to EscrowStatus) (int, error) {
+	var from pq.StringArray
+	for status, next := range escrowTransitions {
+		if slices.Contains(next, to) {
+			from = append(from, string(status))
+		}
+	}
+	result, err := tx.Exec(`UPDATE escrows SET status=$1, updated_at=NOW() WHERE order_id=$2 AND status=ANY($3)`, to, orderId, from)
+	if err != nil {
+		return 0, err
+	}
+	moved, err := result.RowsAffected()
+	return int(moved), err
+}
+
+// freezeEscrows stops the order's held escrows from being released while a dispute is open
+func freezeEscrows(tx *sql.Tx, orderId int) (int, error) {
+	return transitionEscrows(tx, orderId, EscrowFrozen)
+}
+
+// ConfirmReceipt releases the escrows of the user's order now that they have received it.
+// sql.ErrNoRows is returned if the order isn't theirs, ErrEscrowFrozen if a dispute is
+// holding it and ErrInvalidTransition if nothing is left in escrow
+func (s *SqlDB) ConfirmReceipt(userId int, orderId int, now time.Time) (released []Escrow, err error) {
+	var tx *sql.Tx
+	tx, err = s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	// Rollback or commit depending on err
+	defer func() {
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	// Lock the order so a refund can't run at the same time
+	var exists bool
+	err = tx.QueryRow(`SELECT true FROM orders WHERE order_id=$1 AND user_id=$2 FOR UPDATE`, orderId, userId).Scan(&exists)
+	if err != nil {
+		return nil, err
+	}
+	escrows, err := queryEscrows(tx, `SELECT `+escrowColumns+` FROM escrows WHERE order_id=$1 ORDER BY escrow_id FOR UPDATE`, orderId)
+	if err != nil {
+		return nil, err
+	}
+	for _, escrow := range escrows {
+		switch escrow.status {
+		case EscrowFrozen:
+			return nil, ErrEscrowFrozen
+		case EscrowHeld:
+			released = append(released, escrow)
+		}
+	}
+	if len(released) == 0 {
+		return nil, ErrInvalidTransition
+	}
+
+	if err = releaseEscrows(tx, released, now); err != nil {
+		return nil, err
+	}
+	for i := range released {
+		released[i].status, released[i].updatedAt = EscrowReleased, now
+	}
+	return released, nil
+}
+
+// ReleaseDueEscrows releases the held escrows whose buyers didn't confirm receipt by now,
+// returning how many were released
+func (s *SqlDB) ReleaseDueEscrows(now time.Time) (released int, err error) {
+	var tx *sql.Tx
+	tx, err = s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	// Rollback or commit depending on err
+	defer func() {
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	// Skip escrows a buyer or dispute is changing, they are picked up next time if still due
+	dueQuery := `SELECT ` + escrowColumns + ` FROM escrows WHERE status=$1 AND release_at<=$2
+				 ORDER BY escrow_id FOR UPDATE SKIP LOCKED`
+	escrows, err := queryEscrows(tx, dueQuery, EscrowHeld, now)
+	if err != nil {
+		return 0, err
+	}
+	if len(escrows) == 0 {
+		return 0, nil
+	}
+	if err = releaseEscrows(tx, escrows, now); err != nil {
+		return 0, err
+	}
+	return len(escrows), nil
+}
+
+// Escrows returns the escrows holding the seller's proceeds, newest first
+func (s *SqlDB) Escrows(sellerId int) ([]Escrow, error) {
+	return queryEscrows(s.db, `SELECT `+escrowColumns+` FROM escrows WHERE seller_id=$1 ORDER BY escrow_id DESC`, sellerId)
+}
+
+// RunEscrowReleaser releases escrows as they come due until done is closed
+func (env *Env) RunEscrowReleaser(done <-chan struct{}) {
+	ticker := time.NewTicker(EscrowReleaseInterval)
+	defer ticker.Stop()
+	for {
+		released, err := env.db.ReleaseDueEscrows(time.Now())
+		if err != nil {
+			env.logger.Println("escrow releaser:", err.Error())
+		} else if released != 0 {
+			env.logger.Println("escrow releaser: released", released, "escrows")
+		}
+
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+	}
+}
+
+func (env *Env) ConfirmReceipt(w http.ResponseWriter, r *http.Request) {
+	userId, ok := r.Context().Value(CtxUserId).(int)
+	if !ok {
+		env.logger.Println("context does not include userId for protected endpoint")
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	// Get order id
+	orderId, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	// Release the sellers' proceeds, other users' orders are reported as not found
+	released, err := env.db.ConfirmReceipt(userId, orderId, time.Now())
+	if err != nil {
+		var statusCode int
+		var message string
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			statusCode = http.StatusNotFound
+			message = http.StatusText(statusCode)
+		case err == ErrEscrowFrozen:
+			statusCode = http.StatusConflict
+			message = "Order is under dispute"
+		case err == ErrInvalidTransition:
+			statusCode = http.StatusConflict
+			message = "Nothing left in escrow"
+		default:
+			env.logger.Println(err.Error())
+			statusCode = http.StatusInternalServerError
+			message = http.StatusText(statusCode)
+		}
+		http.Error(w, message, statusCode)
+		return
+	}
+	for _, escrow := range released {
+		fmt.Fprintln(w, escrow)
+	}
+}
+
+func (env *Env) Escrows(w http.ResponseWriter, r *http.Request) {
+	userId, ok := r.Context().Value(CtxUserId).(int)
+	if !ok {
+		env.logger.Println("context does not include userId for protected endpoint")
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	escrows, err := env.db.Escrows(userId)
+	if err != nil {
+		env.logger.Println(err.Error())
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	// Print the seller's escrows, newest first
+	for _, escrow := range escrows {
+		fmt.Fprintln(w, escrow)
+	}
+}
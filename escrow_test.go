@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testEscrowTransitionsTable = map[string]struct {
+	from     EscrowStatus
+	to       EscrowStatus
+	expected bool
+}{
+	"release held":    {EscrowHeld, EscrowReleased, true},
+	"freeze held":     {EscrowHeld, EscrowFrozen, true},
+	"refund held":     {EscrowHeld, EscrowRefunded, true},
+	"unfreeze":        {EscrowFrozen, EscrowHeld, true},
+	"release frozen":  {EscrowFrozen, EscrowReleased, true},
+	"refund frozen":   {EscrowFrozen, EscrowRefunded, true},
+	"refund released": {EscrowReleased, EscrowRefunded, false},
+	"freeze released": {EscrowReleased, EscrowFrozen, false},
+	"release refund":  {EscrowRefunded, EscrowReleased, false},
+}
+
+func TestEscrowStatusCanTransition(t *testing.T) {
+	t.Parallel()
+	for name, args := range testEscrowTransitionsTable {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			if answer := args.from.CanTransition(args.to); answer != args.expected {
+				t.Errorf("%v -> %v, got %v, expected %v", args.from, args.to, answer, args.expected)
+			}
+		})
+	}
+}
+
+// confirmTestReceipt calls the ConfirmReceipt handler for an order as userId
+func confirmTestReceipt(env *Env, orderId int, userId int) int {
+	recorder := httptest.NewRecorder()
+	request := newCartRequest("POST", fmt.Sprintf("/api/orders/%v/confirm", orderId), userId)
+	request.SetPathValue("id", fmt.Sprint(orderId))
+	env.ConfirmReceipt(recorder, request)
+	return recorder.Result().StatusCode
+}
+
+func TestEscrow(t *testing.T) {
+	env := NewTestEnv()
+	env.db = newTestDB(t)
+	buyerId, sellerId := 1, 2
+	startSellerBalance, _ := env.db.Balance(sellerId, DefaultCurrency)
+
+	purchase := func() int {
+		t.Helper()
+		creditTestWallet(buyerId, Money{17500, DefaultCurrency})
+		orderId, err := env.db.Purchase(buyerId, 1, 0, "", DefaultCurrency)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return orderId
+	}
+	expectSellerBalance := func(name string, expected int) {
+		t.Helper()
+		if balance, _ := env.db.Balance(sellerId, DefaultCurrency); balance.amount != expected {
+			t.Errorf("bad seller balance after %v, expected %v, got %v", name, expected, balance.amount)
+		}
+	}
+
+	// The seller is paid once the buyer confirms receipt
+	confirmed := purchase()
+	expectSellerBalance("purchase", startSellerBalance.amount)
+	recorder := httptest.NewRecorder()
+	env.Escrows(recorder, newCartRequest("GET", "/api/escrows", sellerId))
+	if body, _ := io.ReadAll(recorder.Result().Body); !strings.Contains(string(body), fmt.Sprintf("order: %v, amount: 175.00 USD, status: held", confirmed)) {
+		t.Errorf("held escrow missing for the seller, got %q", body)
+	}
+	for _, args := range []struct {
+		name     string
+		userId   int
+		expected int
+	}{
+		{"ConfirmNotBuyer", sellerId, http.StatusNotFound},
+		{"ConfirmReceipt", buyerId, http.StatusOK},
+		{"ConfirmReceiptAgain", buyerId, http.StatusConflict},
+	} {
+		if status := confirmTestReceipt(env, confirmed, args.userId); status != args.expected {
+			t.Errorf("bad status code for %v, expected %v, got %v", args.name, args.expected, status)
+		}
+	}
+	expectSellerBalance("confirmation", startSellerBalance.amount+17500)
+
+	// Disputed escrows can't be released
+	frozen := purchase()
+	for i := range escrows {
+		if escrows[i].orderId == frozen {
+			escrows[i].status = EscrowFrozen
+		}
+	}
+	if status := confirmTestReceipt(env, frozen, buyerId); status != http.StatusConflict {
+		t.Errorf("bad status code confirming a disputed order, expected %v, got %v", http.StatusConflict, status)
+	}
+
+	// Unconfirmed escrows are released when they come due
+	due := purchase()
+	if released, _ := env.db.ReleaseDueEscrows(time.Now()); released != 0 {
+		t.Errorf("released escrows before they were due, got %v", released)
+	}
+	if released, _ := env.db.ReleaseDueEscrows(time.Now().Add(EscrowPeriod + time.Minute)); released != 1 {
+		t.Errorf("expected the due escrow to be released, got %v", released)
+	}
+	expectSellerBalance("auto release", startSellerBalance.amount+35000)
+	if status := confirmTestReceipt(env, due, buyerId); status != http.StatusConflict {
+		t.Errorf("bad status code confirming a released order, expected %v, got %v", http.StatusConflict, status)
+	}
+
+	// Refunds return escrowed money to the buyer without touching the seller
+	refunded := purchase()
+	buyerBalance, _ := env.db.Balance(buyerId, DefaultCurrency)
+	if err := env.db.TransitionOrder(refunded, OrderRefunded); err != nil {
+		t.Fatal(err)
+	}
+	if balance, _ := env.db.Balance(buyerId, DefaultCurrency); balance.amount != buyerBalance.amount+17500 {
+		t.Errorf("buyer not refunded from escrow, expected %v, got %v", buyerBalance.amount+17500, balance.amount)
+	}
+	expectSellerBalance("refund", startSellerBalance.amount+35000)
+	if err := env.db.TransitionOrder(frozen, OrderRefunded); err != nil {
+		t.Fatal(err)
+	}
+	if released, _ := env.db.ReleaseDueEscrows(time.Now().Add(EscrowPeriod + time.Minute)); released != 0 {
+		t.Errorf("refunded escrows were released, got %v", released)
+	}
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"slices"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	// EventDispatchInterval is how often the dispatcher looks for events to hand to subscribers
+	EventDispatchInterval = 5 * time.Second
+	// EventDispatchBatch is the most events each subscriber is given at once
+	EventDispatchBatch = 100
+	// MaxEventAttempts is how many times a subscriber is given an event before giving up
+	MaxEventAttempts = 10
+	// EventRetryDelay is the wait before a subscriber is given an event again, it doubles
+	// each attempt
+	EventRetryDelay = 30 * time.Second
+)
+
+// EventType names something that happened in the marketplace. Webhook endpoints subscribe
+// to the same types
+type EventType string
+
+const (
+	EventUserRegistered   EventType = "user.registered"
+	EventPurchaseCreated  EventType = "purchase.created"
+	EventDepositSucceeded EventType = "deposit.succeeded"
+	EventItemUpdated      EventType = "item.updated"
+	EventDisputeUpdated   EventType = "dispute.updated"
+	EventPriceDropped     EventType = "price.dropped"
+)
+
+// The data recorded with each type of event, subscribers decode it into the same types
+
+type userRegisteredEvent struct {
+	UserId   int    `json:"user_id"`
+	Username string `json:"username"`
+}
+
+type purchaseCreatedEvent struct {
+	OrderId  int                 `json:"order_id"`
+	UserId   int                 `json:"user_id"`
+	Total    Money               `json:"total"`
+	Discount Money               `json:"discount"`
+	Lines    []purchaseEventLine `json:"lines"`
+}
+
+type purchaseEventLine struct {
+	ItemId    int   `json:"item_id"`
+	VariantId int   `json:"variant_id"`
+	SellerId  int   `json:"seller_id"` // 0 for items the marketplace sells
+	Quantity  int   `json:"quantity"`
+	Amount    Money `json:"amount"`
+}
+
+type depositSucceededEvent struct {
+	DepositId int   `json:"deposit_id"`
+	UserId    int   `json:"user_id"`
+	Amount    Money `json:"amount"`
+}
+
+type itemUpdatedEvent struct {
+	ItemId   int   `json:"item_id"`
+	SellerId int   `json:"seller_id"`
+	Price    Money `json:"price"`
+}
+
+type disputeUpdatedEvent struct {
+	DisputeId int           `json:"dispute_id"`
+	OrderId   int           `json:"order_id"`
+	BuyerId   int           `json:"buyer_id"`
+	SellerId  int           `json:"seller_id"`
+	Status    DisputeStatus `json:"status"`
+}
+
+type priceDroppedEvent struct {
+	UserId   int    `json:"user_id"`
+	ItemId   int    `json:"item_id"`
+	ItemName string `json:"item_name"`
+	Price    Money  `json:"price"`
+	Target   Money  `json:"target"`
+}
+
+// DomainEvent is something that happened, recorded in the outbox in the same transaction
+// as the change so it is there if and only if the change committed
+type DomainEvent struct {
+	eventId   int
+	eventType EventType
+	userId    int // who the event is about
+	data      json.RawMessage
+	createdAt time.Time
+	attempts  int // times the subscriber it was fetched for has failed it
+}
+
+func (e DomainEvent) String() string {
+	return fmt.Sprintf("event: %v, type: %v, user: %v, data: %s, created: %v", e.eventId, e.eventType, e.userId, e.data, e.createdAt.String())
+}
+
+// Decode unmarshals the event's data into v
+func (e DomainEvent) Decode(v any) error {
+	return json.Unmarshal(e.data, v)
+}
+
+// retry returns when a subscriber that failed the event at now should be given it again,
+// backing off exponentially, and false once it has failed MaxEventAttempts times
+func (e DomainEvent) retry(now time.Time) (time.Time, bool) {
+	attempts := e.attempts + 1
+	if attempts >= MaxEventAttempts {
+		return now, false
+	}
+	return now.Add(EventRetryDelay << (attempts - 1)), true
+}
+
+// recordEvent writes an event about userId to the outbox as part of tx
+func recordEvent(tx *sql.Tx, eventType EventType, userId int, data any) error {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`INSERT INTO domain_events (type, user_id, data) VALUES ($1, NULLIF($2, 0), $3)`, eventType, userId, encoded)
+	return err
+}
+
+// PendingEvents returns up to limit events of types the subscriber hasn't handled yet, oldest
+// first. Events it has failed are left out until their retry is due at now, and once it has
+// failed them MaxEventAttempts times
+func (s *SqlDB) PendingEvents(subscriber string, types []EventType, now time.Time, limit int) ([]DomainEvent, error) {
+	eventTypes := make(pq.StringArray, len(types))
+	for i, eventType := range types {
+		eventTypes[i] = string(eventType)
+	}
+	query := `SELECT domain_events.event_id, domain_events.type, COALESCE(domain_events.user_id, 0), domain_events.data,
+					 domain_events.created_at, COALESCE(receipts.attempts, 0)
+			  FROM domain_events
+			  LEFT JOIN domain_event_receipts AS receipts ON receipts.event_id=domain_events.event_id AND receipts.subscriber=$1
+			  WHERE domain_events.type=ANY($2) AND receipts.handled_at IS NULL
+			  AND (receipts.event_id IS NULL OR (receipts.attempts<$3 AND receipts.next_attempt_at<=$4))
+			  ORDER BY domain_events.event_id LIMIT $5`
+	rows, err := s.db.Query(query, subscriber, eventTypes, MaxEventAttempts, now, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []DomainEvent
+	for rows.Next() {
+		var event DomainEvent
+		var data []byte
+		err := rows.Scan(&event.eventId, &event.eventType, &event.userId, &data, &event.createdAt, &event.attempts)
+		if err != nil {
+			return nil, err
+		}
+		event.data = data
+		events = append(events, event)
+	}
+
+	return events, rows.Err()
+}
+
+// FinishEvent records that the subscriber handled the event at at, or if lastError is set
+// that it failed and should be given the event again at at
+func (s *SqlDB) FinishEvent(subscriber string, eventId int, lastError string, at time.Time) error {
+	query := `INSERT INTO domain_event_receipts (subscriber, event_id, attempts, last_error, next_attempt_at, handled_at)
+			  VALUES ($1, $2, 1, $3, $4, CASE WHEN $3='' THEN $4 END)
+			  ON CONFLICT (subscriber, event_id) DO UPDATE SET attempts=domain_event_receipts.attempts+1,
+			  last_error=EXCLUDED.last_error, next_attempt_at=EXCLUDED.next_attempt_at, handled_at=EXCLUDED.handled_at`
+	_, err := s.db.Exec(query, subscriber, eventId, lastError, at)
+	return err
+}
+
+// EventHandler reacts to an event. Events are delivered at least once, so handlers must
+// tolerate being given one again, and an error has the event retried later
+type EventHandler func(event DomainEvent) error
+
+type eventSubscriber struct {
+	name    string // identifies what the subscriber has handled, so must stay the same
+	types   []EventType
+	handler EventHandler
+}
+
+// EventBus hands the events in the outbox to its subscribers. Each subscriber gets every
+// event of the types it subscribed to, including those recorded before it was added, until
+// it handles them or gives up. One subscriber failing doesn't hold back the others
+type EventBus struct {
+	subscribers []eventSubscriber
+}
+
+// Subscribe adds a subscriber to events of types under name, which must be unique. It
+// isn't safe to call once the dispatcher is running
+func (b *EventBus) Subscribe(name string, handler EventHandler, types ...EventType) {
+	if len(name) == 0 || slices.ContainsFunc(b.subscribers, func(s eventSubscriber) bool { return s.name == name }) {
+		panic(fmt.Sprintf("events: invalid or duplicate subscriber %q", name))
+	}
+	b.subscribers = append(b.subscribers, eventSubscriber{name, types, handler})
+}
+
+// handleEvent calls the subscriber's handler, turning a panic into an error so the event
+// is retried rather than the dispatcher stopping
+func handleEvent(subscriber eventSubscriber, event DomainEvent) (err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			err = fmt.Errorf("panic: %v", recovered)
+		}
+	}()
+	return subscriber.handler(event)
+}
+
+// dispatchEvents gives each subscriber the events due for it by now, returning how many
+// were handled. A subscriber whose events can't be fetched or finished is skipped until
+// the next dispatch, and the first such error is returned once the others had their turn
+func (env *Env) dispatchEvents(now time.Time) (int, error) {
+	handled := 0
+	var firstErr error
+	for _, subscriber := range env.events.subscribers {
+		subscriberHandled, err := env.dispatchSubscriber(subscriber, now)
+		handled += subscriberHandled
+		if err != nil {
+			env.logger.Printf("subscriber %v: %v", subscriber.name, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return handled, firstErr
+}
+
+// dispatchSubscriber gives the subscriber the events due for it by now, returning how many
+// it handled
+func (env *Env) dispatchSubscriber(subscriber eventSubscriber, now time.Time) (int, error) {
+	events, err := env.db.PendingEvents(subscriber.name, subscriber.types, now, EventDispatchBatch)
+	if err != nil {
+		return 0, err
+	}
+
+	handled := 0
+	for _, event := range events {
+		at, lastError := time.Now(), ""
+		if handleErr := handleEvent(subscriber, event); handleErr != nil {
+			var retrying bool
+			at, retrying = event.retry(now)
+			lastError = handleErr.Error()
+			env.logger.Printf("subscriber %v, event %v: %v", subscriber.name, event.eventId, lastError)
+			if !retrying {
+				env.logger.Printf("subscriber %v gave up on event %v", subscriber.name, event.eventId)
+			}
+		} else {
+			handled++
+		}
+		if err := env.db.FinishEvent(subscriber.name, event.eventId, lastError, at); err != nil {
+			return handled, err
+		}
+	}
+	return handled, nil
+}
+
+// RunEventDispatcher hands events to subscribers until done is closed
+func (env *Env) RunEventDispatcher(done <-chan struct{}) {
+	ticker := time.NewTicker(EventDispatchInterval)
+	defer ticker.Stop()
+	for {
+		// Errors are logged by subscriber as they happen
+		if handled, _ := env.dispatchEvents(time.Now()); handled != 0 {
+			env.logger.Println("event dispatcher: handled", handled, "events")
+		}
+
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+	}
+}
+
+// LogEventHandler logs each event it is given
+func LogEventHandler(logger *log.Logger) EventHandler {
+	return func(event DomainEvent) error {
+		logger.Printf("%v %v about user %v: %s", event.eventType, event.eventId, event.userId, event.data)
+		return nil
+	}
+}
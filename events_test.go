@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestEventRetry(t *testing.T) {
+	t.Parallel()
+	now := time.Now()
+	for _, args := range []struct {
+		attempts int
+		retrying bool
+		at       time.Time
+	}{
+		{0, true, now.Add(EventRetryDelay)},
+		{3, true, now.Add(8 * EventRetryDelay)},
+		{MaxEventAttempts - 1, false, now},
+	} {
+		if at, retrying := (DomainEvent{attempts: args.attempts}).retry(now); retrying != args.retrying || !at.Equal(args.at) {
+			t.Errorf("bad retry after %v attempts, expected %v at %v, got %v at %v", args.attempts, args.retrying, args.at, retrying, at)
+		}
+	}
+}
+
+func TestEventBusSubscribe(t *testing.T) {
+	t.Parallel()
+	bus := &EventBus{}
+	bus.Subscribe("log", func(DomainEvent) error { return nil }, EventUserRegistered)
+	for _, name := range []string{"", "log"} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("expected subscribing %q to panic", name)
+				}
+			}()
+			bus.Subscribe(name, func(DomainEvent) error { return nil }, EventUserRegistered)
+		}()
+	}
+}
+
+func TestEvents(t *testing.T) {
+	env := NewTestEnv()
+	env.db = newTestDB(t)
+	env.events = &EventBus{}
+	buyerId := 1
+
+	// Subscribers only get the types they subscribed to, and each keeps its own progress
+	var orders []int
+	env.events.Subscribe("orders", func(event DomainEvent) error {
+		var data struct {
+			OrderId int `json:"order_id"`
+		}
+		if err := event.Decode(&data); err != nil {
+			return err
+		}
+		orders = append(orders, data.OrderId)
+		return nil
+	}, EventPurchaseCreated)
+	var flaky []EventType
+	env.events.Subscribe("flaky", func(event DomainEvent) error {
+		if event.eventType == EventPurchaseCreated && event.attempts == 0 {
+			return errors.New("analytics down")
+		}
+		flaky = append(flaky, event.eventType)
+		return nil
+	}, EventPurchaseCreated, EventUserRegistered)
+	env.events.Subscribe("broken", func(event DomainEvent) error { panic("bug") }, EventUserRegistered)
+
+	creditTestWallet(buyerId, Money{17500, DefaultCurrency})
+	orderId, err := env.db.Purchase(buyerId, 1, 0, "", DefaultCurrency)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testRecordEvent(EventUserRegistered, buyerId, map[string]any{"user_id": buyerId, "username": "test_user"})
+
+	now := time.Now()
+	if handled, err := env.dispatchEvents(now); handled != 2 || err != nil {
+		t.Errorf("expected the order and a registration handled, got %v, %v", handled, err)
+	}
+	if len(orders) != 1 || orders[0] != orderId {
+		t.Errorf("bad orders handled, got %v", orders)
+	}
+	if handled, _ := env.dispatchEvents(now); handled != 0 {
+		t.Errorf("events handled again before their retry, got %v", handled)
+	}
+
+	// Failed events are retried after a backoff until the subscriber gives up
+	now = now.Add(EventRetryDelay)
+	if handled, _ := env.dispatchEvents(now); handled != 1 {
+		t.Errorf("expected the failed purchase to be retried, got %v", handled)
+	}
+	if len(flaky) != 2 || flaky[0] != EventUserRegistered || flaky[1] != EventPurchaseCreated {
+		t.Errorf("bad events handled, got %v", flaky)
+	}
+	for attempt := 3; attempt <= MaxEventAttempts; attempt++ {
+		now = now.Add(EventRetryDelay << (attempt - 2))
+		if handled, err := env.dispatchEvents(now); handled != 0 || err != nil {
+			t.Fatalf("attempt %v, expected nothing handled, got %v, %v", attempt, handled, err)
+		}
+	}
+	if pending, _ := env.db.PendingEvents("broken", []EventType{EventUserRegistered}, now.Add(time.Hour), 10); len(pending) != 0 {
+		t.Errorf("expected the broken subscriber to give up, got %v", pending)
+	}
+	for _, receipt := range eventReceipts {
+		if receipt.subscriber == "broken" && (receipt.attempts != MaxEventAttempts || receipt.lastError != "panic: bug") {
+			t.Errorf("bad receipt for the broken subscriber, got %+v", receipt)
+		}
+	}
+
+	// New subscribers are given the events recorded before them
+	var backfilled int
+	env.events.Subscribe("backfill", func(DomainEvent) error { backfilled++; return nil }, EventPurchaseCreated, EventUserRegistered)
+	if handled, _ := env.dispatchEvents(now); handled != 2 || backfilled != 2 {
+		t.Errorf("expected both events backfilled, got %v", handled)
+	}
+}
+
+// unreachableEventsDB fails to fetch the events of one subscriber
+type unreachableEventsDB struct {
+	TestDB
+	subscriber string
+}
+
+func (d unreachableEventsDB) PendingEvents(subscriber string, types []EventType, now time.Time, limit int) ([]DomainEvent, error) {
+	if subscriber == d.subscriber {
+		return nil, errors.New("connection reset")
+	}
+	return d.TestDB.PendingEvents(subscriber, types, now, limit)
+}
+
+func TestEventsSubscriberUnreachable(t *testing.T) {
+	env := NewTestEnv()
+	env.db = unreachableEventsDB{newTestDB(t), "first"}
+	env.events = &EventBus{}
+	var handled []string
+	for _, name := range []string{"first", "second"} {
+		env.events.Subscribe(name, func(DomainEvent) error { handled = append(handled, name); return nil }, EventUserRegistered)
+	}
+	testRecordEvent(EventUserRegistered, 1, userRegisteredEvent{1, "test_user"})
+
+	// The subscriber after the one that can't be reached still gets its events
+	count, err := env.dispatchEvents(time.Now())
+	if count != 1 || err == nil || len(handled) != 1 || handled[0] != "second" {
+		t.Errorf("expected only the second subscriber to handle the event and an error, got %v, %v, %v", count, err, handled)
+	}
+}
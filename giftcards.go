@@ -0,0 +1,402 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var ErrGiftCardNotFound error = errors.New("gift card not found")
+var ErrGiftCardExpired error = errors.New("gift card expired")
+var ErrGiftCardRedeemed error = errors.New("gift card already redeemed")
+
+const (
+	GiftCardCodeLength = 12 // bytes, the code is its base64 encoding
+	MaxGiftCardBatch   = 1000
+)
+
+// GiftCard is store credit bought with a code. The first user to redeem a card claims it,
+// they can move its balance into their wallet all at once or a part at a time
+type GiftCard struct {
+	cardId     int
+	code       string // only known when the card is issued, the hash is stored
+	codeSuffix string // the end of the code, to tell cards apart
+	value      Money
+	balance    Money     // what hasn't been redeemed yet
+	expiresAt  time.Time // zero if the card doesn't expire
+	redeemedBy int       // the user who claimed the card, 0 if nobody has
+	createdAt  time.Time
+}
+
+func (g GiftCard) String() string {
+	expires := "never"
+	if !g.expiresAt.IsZero() {
+		expires = g.expiresAt.String()
+	}
+	return fmt.Sprintf("gift card: %v, code: ...%v, value: %v, balance: %v, expires: %v",
+		g.cardId, g.codeSuffix, g.value, g.balance, expires)
+}
+
+// GiftCardLiability summarises the gift cards issued in a currency. Outstanding is the
+// balance of unexpired cards the marketplace still owes, expired is balance nobody can
+// redeem any more
+type GiftCardLiability struct {
+	currency    Currency
+	cards       int
+	issued      int
+	redeemed    int
+	outstanding int
+	expired     int
+}
+
+func (g GiftCardLiability) String() string {
+	return fmt.Sprintf("currency: %v, cards: %v, issued: %v, redeemed: %v, outstanding: %v, expired: %v",
+		g.currency, g.cards, Money{g.issued, g.currency}, Money{g.redeemed, g.currency},
+		Money{g.outstanding, g.currency}, Money{g.expired, g.currency})
+}
+
+// hashGiftCardCode is how codes are stored, so they can't be read back from the database
+func hashGiftCardCode(code string) string {
+	hash := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(hash[:])
+}
+
+// newGiftCards generates count cards worth value with random codes
+func newGiftCards(count int, value Money, expiresAt time.Time) ([]GiftCard, error) {
+	cards := make([]GiftCard, count)
+	for i := range cards {
+		code, err := generateToken(GiftCardCodeLength)
+		if err != nil {
+			return nil, err
+		}
+		cards[i] = GiftCard{code: code, codeSuffix: code[len(code)-4:], value: value, balance: value, expiresAt: expiresAt}
+	}
+	return cards, nil
+}
+
+const giftCardColumns = `card_id, code_suffix, CAST(value*100 AS BIGINT), CAST(balance*100 AS BIGINT), currency, expires_at,
+						 COALESCE(redeemed_by, 0), created_at`
+
+func scanGiftCard(row rowScanner) (GiftCard, error) {
+	var card GiftCard
+	var expiresAt sql.NullTime
+	err := row.Scan(&card.cardId, &card.codeSuffix, &card.value.amount, &card.balance.amount, &card.value.currency, &expiresAt,
+		&card.redeemedBy, &card.createdAt)
+	card.balance.currency = card.value.currency
+	card.expiresAt = expiresAt.Time
+	return card, err
+}
+
+// IssueGiftCards stores new cards issued by the admin, all or none of them
+func (s *SqlDB) IssueGiftCards(cards []GiftCard, adminId int) (issued []GiftCard, err error) {
+	var tx *sql.Tx
+	tx, err = s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	// Rollback or commit depending on err
+	defer func() {
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	addQuery := `INSERT INTO gift_cards (code_hash, code_suffix, value, balance, currency, expires_at, issued_by)
+				 VALUES ($1, $2, CAST($3 AS NUMERIC(12, 0))/100, CAST($3 AS NUMERIC(12, 0))/100, $4, $5, $6)
+				 RETURNING card_id, created_at`
+	for _, card := range cards {
+		expiresAt := sql.NullTime{Time: card.expiresAt, Valid: !card.expiresAt.IsZero()}
+		err = tx.QueryRow(addQuery, hashGiftCardCode(card.code), card.codeSuffix, card.value.amount, card.value.currency,
+			expiresAt, adminId).Scan(&card.cardId, &card.createdAt)
+		if err != nil {
+			return nil, err
+		}
+		issued = append(issued, card)
+	}
+	return issued, nil
+}
+
+// RedeemGiftCard moves amount from the card with code into the user's wallet, or its
+// whole balance if amount is 0. The first redemption claims the card so only that user can
+// redeem the rest. ErrInsufficientFunds is returned if the card holds less than amount
+func (s *SqlDB) RedeemGiftCard(userId int, code string, amount int, now time.Time) (card GiftCard, balance Money, err error) {
+	var tx *sql.Tx
+	tx, err = s.db.Begin()
+	if err != nil {
+		return GiftCard{}, Money{}, err
+	}
+
+	// Rollback or commit depending on err
+	defer func() {
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	// Lock the card so concurrent redemptions are applied one at a time
+	getQuery := `SELECT ` + giftCardColumns + ` FROM gift_cards WHERE code_hash=$1 FOR UPDATE`
+	card, err = scanGiftCard(tx.QueryRow(getQuery, hashGiftCardCode(code)))
+	if err == sql.ErrNoRows {
+		return GiftCard{}, Money{}, ErrGiftCardNotFound
+	} else if err != nil {
+		return GiftCard{}, Money{}, err
+	}
+	if err = card.redeemable(userId, amount, now); err != nil {
+		return GiftCard{}, Money{}, err
+	}
+	if amount == 0 {
+		amount = card.balance.amount
+	}
+
+	updateQuery := `UPDATE gift_cards SET balance=balance-CAST($1 AS NUMERIC(12, 0))/100, redeemed_by=$2,
+					redeemed_at=COALESCE(redeemed_at, $3)
+					WHERE card_id=$4`
+	if _, err = tx.Exec(updateQuery, amount, userId, now, card.cardId); err != nil {
+		return GiftCard{}, Money{}, err
+	}
+	card.balance.amount -= amount
+	card.redeemedBy = userId
+
+	credit := LedgerEntry{userId: userId, amount: Money{amount, card.value.currency}, kind: LedgerGiftCard, referenceId: card.cardId}
+	balance, err = creditWallet(tx, credit)
+	if err != nil {
+		return GiftCard{}, Money{}, err
+	}
+	return card, balance, nil
+}
+
+// redeemable checks the user can redeem amount from the card at now, 0 being the whole balance
+func (g GiftCard) redeemable(userId int, amount int, now time.Time) error {
+	if g.redeemedBy != 0 && g.redeemedBy != userId {
+		return ErrGiftCardRedeemed
+	}
+	if !g.expiresAt.IsZero() && !now.Before(g.expiresAt) {
+		return ErrGiftCardExpired
+	}
+	if g.balance.amount == 0 {
+		return ErrGiftCardRedeemed
+	}
+	if amount > g.balance.amount {
+		return ErrInsufficientFunds
+	}
+	return nil
+}
+
+// GiftCards returns the cards the user has claimed, newest first
+func (s *SqlDB) GiftCards(userId int) ([]GiftCard, error) {
+	query := `SELECT ` + giftCardColumns + ` FROM gift_cards WHERE redeemed_by=$1 ORDER BY card_id DESC`
+	rows, err := s.db.Query(query, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var cards []GiftCard
+	for rows.Next() {
+		card, err := scanGiftCard(rows)
+		if err != nil {
+			return nil, err
+		}
+		cards = append(cards, card)
+	}
+
+	return cards, rows.Err()
+}
+
+// GiftCardLiability reports the cards issued in each currency and what is still owed on
+// them at now
+func (s *SqlDB) GiftCardLiability(now time.Time) ([]GiftCardLiability, error) {
+	query := `SELECT currency, COUNT(*), CAST(SUM(value)*100 AS BIGINT), CAST(SUM(value-balance)*100 AS BIGINT),
+			  CAST(COALESCE(SUM(balance) FILTER (WHERE expires_at IS NULL OR expires_at>$1), 0)*100 AS BIGINT),
+			  CAST(COALESCE(SUM(balance) FILTER (WHERE expires_at<=$1), 0)*100 AS BIGINT)
+			  FROM gift_cards GROUP BY currency ORDER BY currency`
+	rows, err := s.db.Query(query, now)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var report []GiftCardLiability
+	var liability GiftCardLiability
+	for rows.Next() {
+		err := rows.Scan(&liability.currency, &liability.cards, &liability.issued, &liability.redeemed, &liability.outstanding, &liability.expired)
+		if err != nil {
+			return nil, err
+		}
+		report = append(report, liability)
+	}
+
+	return report, rows.Err()
+}
+
+// IssueGiftCards generates a batch of cards, the codes are only shown in the response
+func (env *Env) IssueGiftCards(w http.ResponseWriter, r *http.Request) {
+	userId, ok := r.Context().Value(CtxUserId).(int)
+	if !ok {
+		env.logger.Println("context does not include userId for protected endpoint")
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if !env.requireAdmin(w, userId) {
+		return
+	}
+
+	// Parse batch size, value and expiry
+	count := 1
+	if value := r.FormValue("count"); len(value) != 0 {
+		var err error
+		count, err = strconv.Atoi(value)
+		if err != nil || count <= 0 || count > MaxGiftCardBatch {
+			http.Error(w, fmt.Sprintf("Count must be between 1 and %v", MaxGiftCardBatch), http.StatusBadRequest)
+			return
+		}
+	}
+	currency, err := parseCurrency(r.FormValue("currency"))
+	if err != nil {
+		http.Error(w, "Unknown currency", http.StatusBadRequest)
+		return
+	}
+	value, err := ParseMoney(r.FormValue("value"), currency)
+	if err != nil || value.amount == 0 {
+		http.Error(w, "Invalid value", http.StatusBadRequest)
+		return
+	}
+	expiresAt, err := parseTimeParam(r.FormValue("expires"))
+	if err != nil || (!expiresAt.IsZero() && !expiresAt.After(time.Now())) {
+		http.Error(w, "Invalid expiry", http.StatusBadRequest)
+		return
+	}
+
+	// Generate and store the cards
+	cards, err := newGiftCards(count, value, expiresAt)
+	if err != nil {
+		env.logger.Println(err.Error())
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	cards, err = env.db.IssueGiftCards(cards, userId)
+	if err != nil {
+		env.logger.Println(err.Error())
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	for _, card := range cards {
+		fmt.Fprintf(w, "%v, code: %v\n", card, card.code)
+	}
+}
+
+func (env *Env) GiftCardLiability(w http.ResponseWriter, r *http.Request) {
+	userId, ok := r.Context().Value(CtxUserId).(int)
+	if !ok {
+		env.logger.Println("context does not include userId for protected endpoint")
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if !env.requireAdmin(w, userId) {
+		return
+	}
+
+	report, err := env.db.GiftCardLiability(time.Now())
+	if err != nil {
+		env.logger.Println(err.Error())
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	// Print a line per currency
+	for _, liability := range report {
+		fmt.Fprintln(w, liability)
+	}
+}
+
+func (env *Env) RedeemGiftCard(w http.ResponseWriter, r *http.Request) {
+	userId, ok := r.Context().Value(CtxUserId).(int)
+	if !ok {
+		env.logger.Println("context does not include userId for protected endpoint")
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	// Parse code and the optional amount, the whole balance is redeemed without one
+	code := r.FormValue("code")
+	if len(code) == 0 {
+		http.Error(w, "Code required", http.StatusBadRequest)
+		return
+	}
+	amount := 0
+	if value := r.FormValue("amount"); len(value) != 0 {
+		var err error
+		amount, err = parseAmount(value)
+		if err != nil || amount == 0 {
+			http.Error(w, "Invalid amount", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Redeem into the wallet in the card's currency
+	card, balance, err := env.db.RedeemGiftCard(userId, code, amount, time.Now())
+	if err != nil {
+		var statusCode int
+		var message string
+		switch err {
+		case ErrGiftCardNotFound:
+			statusCode = http.StatusNotFound
+			message = "Invalid gift card"
+		case ErrGiftCardRedeemed:
+			statusCode = http.StatusConflict
+			message = "Gift card already redeemed"
+		case ErrGiftCardExpired:
+			statusCode = http.StatusBadRequest
+			message = "Gift card expired"
+		case ErrInsufficientFunds:
+			statusCode = http.StatusBadRequest
+			message = "Amount exceeds the gift card balance"
+		case ErrBalanceTooLarge:
+			statusCode = http.StatusBadRequest
+			message = "Balance limit exceeded"
+		default:
+			env.logger.Println(err.Error())
+			statusCode = http.StatusInternalServerError
+			message = http.StatusText(statusCode)
+		}
+		http.Error(w, message, statusCode)
+		return
+	}
+	fmt.Fprintln(w, card)
+	fmt.Fprintln(w, "New balance:", balance)
+}
+
+func (env *Env) GiftCards(w http.ResponseWriter, r *http.Request) {
+	userId, ok := r.Context().Value(CtxUserId).(int)
+	if !ok {
+		env.logger.Println("context does not include userId for protected endpoint")
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	cards, err := env.db.GiftCards(userId)
+	if err != nil {
+		env.logger.Println(err.Error())
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	// Print claimed cards with what is left on them, newest first
+	for _, card := range cards {
+		fmt.Fprintln(w, card)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGiftCards(t *testing.T) {
+	env := NewTestEnv()
+	env.db = newTestDB(t)
+	userId, otherId, adminId := 1, 2, 3
+	startBalance, _ := env.db.Balance(userId, DefaultCurrency)
+
+	for _, args := range []struct {
+		name     string
+		userId   int
+		query    string
+		expected int
+	}{
+		{"IssueNotAdmin", userId, "value=50", http.StatusForbidden},
+		{"IssueNoValue", adminId, "", http.StatusBadRequest},
+		{"IssueInvalidValue", adminId, "value=-50", http.StatusBadRequest},
+		{"IssueUnknownCurrency", adminId, "value=50&currency=XYZ", http.StatusBadRequest},
+		{"IssueTooMany", adminId, "value=50&count=1001", http.StatusBadRequest},
+		{"IssueExpired", adminId, "value=50&expires=2020-01-01T00:00:00Z", http.StatusBadRequest},
+		{"IssueGiftCards", adminId, "value=50&count=3", http.StatusCreated},
+	} {
+		recorder := httptest.NewRecorder()
+		env.IssueGiftCards(recorder, newCartRequest("POST", "/api/admin/gift-cards?"+args.query, args.userId))
+		if result := recorder.Result(); result.StatusCode != args.expected {
+			t.Errorf("bad status code for %v, expected %v, got %v", args.name, args.expected, result.StatusCode)
+		}
+	}
+
+	// Cards are issued with their own codes, which are only stored hashed
+	cards, err := newGiftCards(2, Money{5000, DefaultCurrency}, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cards[0].code == cards[1].code || !strings.HasSuffix(cards[0].code, cards[0].codeSuffix) {
+		t.Fatalf("bad gift card codes, got %q and %q", cards[0].code, cards[1].code)
+	}
+	cards, _ = env.db.IssueGiftCards(cards, adminId)
+	card := cards[0]
+
+	redeem := func(userId int, query string) int {
+		recorder := httptest.NewRecorder()
+		env.RedeemGiftCard(recorder, newCartRequest("POST", "/api/gift-cards/redeem?"+query, userId))
+		return recorder.Result().StatusCode
+	}
+	redeemed := 0
+	for _, args := range []struct {
+		name     string
+		userId   int
+		query    string
+		redeemed int
+		expected int
+	}{
+		{"RedeemNoCode", userId, "", 0, http.StatusBadRequest},
+		{"RedeemUnknownCode", userId, "code=nope", 0, http.StatusNotFound},
+		{"RedeemInvalidAmount", userId, "code=" + card.code + "&amount=-1", 0, http.StatusBadRequest},
+		{"RedeemTooMuch", userId, "code=" + card.code + "&amount=50.01", 0, http.StatusBadRequest},
+		{"RedeemPart", userId, "code=" + card.code + "&amount=20", 2000, http.StatusOK},
+		{"RedeemClaimed", otherId, "code=" + card.code, 0, http.StatusConflict},
+		{"RedeemRest", userId, "code=" + card.code, 3000, http.StatusOK},
+		{"RedeemAgain", userId, "code=" + card.code, 0, http.StatusConflict},
+	} {
+		if status := redeem(args.userId, args.query); status != args.expected {
+			t.Errorf("bad status code for %v, expected %v, got %v", args.name, args.expected, status)
+		}
+		redeemed += args.redeemed
+		if balance, _ := env.db.Balance(userId, DefaultCurrency); balance.amount != startBalance.amount+redeemed {
+			t.Errorf("bad balance after %v, expected %v, got %v", args.name, startBalance.amount+redeemed, balance.amount)
+		}
+	}
+	if entries, _ := env.db.Ledger(userId); len(entries) == 0 || entries[0].kind != LedgerGiftCard || entries[0].referenceId != card.cardId {
+		t.Errorf("redemption missing from the ledger, got %v", entries)
+	}
+
+	recorder := httptest.NewRecorder()
+	env.GiftCards(recorder, newCartRequest("GET", "/api/gift-cards", userId))
+	if body, _ := io.ReadAll(recorder.Result().Body); !strings.Contains(string(body), "code: ..."+card.codeSuffix+", value: 50.00 USD, balance: 0.00 USD") {
+		t.Errorf("redeemed gift card missing, got %q", body)
+	}
+
+	// Cards can't be redeemed once they expire, what is left on them is no longer owed
+	expired := cards[1]
+	if _, _, err := env.db.RedeemGiftCard(userId, expired.code, 0, expired.expiresAt); err != ErrGiftCardExpired {
+		t.Errorf("redeeming an expired card, expected %v, got %v", ErrGiftCardExpired, err)
+	}
+	report, _ := env.db.GiftCardLiability(expired.expiresAt)
+	if len(report) != 1 {
+		t.Fatalf("expected liability in one currency, got %v", report)
+	}
+	expected := GiftCardLiability{currency: DefaultCurrency, cards: 5, issued: 25000, redeemed: 5000, outstanding: 15000, expired: 5000}
+	if report[0] != expected {
+		t.Errorf("bad liability, expected %v, got %v", expected, report[0])
+	}
+
+	recorder = httptest.NewRecorder()
+	env.GiftCardLiability(recorder, newCartRequest("GET", "/api/admin/gift-cards/liability", userId))
+	if status := recorder.Result().StatusCode; status != http.StatusForbidden {
+		t.Errorf("bad status code for liability as a user, expected %v, got %v", http.StatusForbidden, status)
+	}
+}
@@ -18,15 +18,124 @@ func main() {
 	}
 	defer env.db.Close()
 
+	// Apply scheduled price changes in the background
+	schedulerDone := make(chan struct{})
+	defer close(schedulerDone)
+	go env.RunPriceScheduler(schedulerDone)
+
+	// Release escrows buyers haven't confirmed in time
+	releaserDone := make(chan struct{})
+	defer close(releaserDone)
+	go env.RunEscrowReleaser(releaserDone)
+
+	// Hand domain events from the outbox to their subscribers
+	dispatcherDone := make(chan struct{})
+	defer close(dispatcherDone)
+	go env.RunEventDispatcher(dispatcherDone)
+
+	// Deliver notifications from the outbox
+	notifierDone := make(chan struct{})
+	defer close(notifierDone)
+	go env.RunNotificationWorker(notifierDone)
+
+	// Deliver webhooks from the outbox
+	webhooksDone := make(chan struct{})
+	defer close(webhooksDone)
+	go env.RunWebhookWorker(webhooksDone)
+
 	http.HandleFunc("GET   /health", func(w http.ResponseWriter, r *http.Request) {})
 	http.HandleFunc("GET   /api/items", env.PanicMiddleware(env.LogMiddleware(env.AuthMiddleware(env.Items))))
+	http.HandleFunc("GET   /api/items/{id}", env.PanicMiddleware(env.LogMiddleware(env.AuthMiddleware(env.Item))))
+	http.HandleFunc("GET   /api/items/{id}/images", env.PanicMiddleware(env.LogMiddleware(env.AuthMiddleware(env.ItemImages))))
+	http.HandleFunc("POST  /api/items/{id}/images", env.PanicMiddleware(env.LogMiddleware(env.AuthMiddleware(env.UploadItemImage))))
+	http.HandleFunc("DELETE /api/items/{id}/images/{imageId}", env.PanicMiddleware(env.LogMiddleware(env.AuthMiddleware(env.DeleteItemImage))))
+	http.HandleFunc("GET   /api/items/{id}/price-history", env.PanicMiddleware(env.LogMiddleware(env.AuthMiddleware(env.PriceHistory))))
+	http.HandleFunc("POST  /api/items/{id}/prices", env.PanicMiddleware(env.LogMiddleware(env.AuthMiddleware(env.SchedulePriceChange))))
+	http.HandleFunc("GET   /api/items/{id}/reviews", env.PanicMiddleware(env.LogMiddleware(env.AuthMiddleware(env.ItemReviews))))
+	http.HandleFunc("POST  /api/items/{id}/review", env.PanicMiddleware(env.LogMiddleware(env.AuthMiddleware(env.AddReview))))
+	http.HandleFunc("PATCH /api/items/{id}/review", env.PanicMiddleware(env.LogMiddleware(env.AuthMiddleware(env.UpdateReview))))
+	http.HandleFunc("DELETE /api/items/{id}/review", env.PanicMiddleware(env.LogMiddleware(env.AuthMiddleware(env.DeleteReview))))
+	http.HandleFunc("POST  /api/reviews/{id}/reply", env.PanicMiddleware(env.LogMiddleware(env.AuthMiddleware(env.ReplyToReview))))
+	http.HandleFunc("POST  /api/reviews/{id}/flag", env.PanicMiddleware(env.LogMiddleware(env.AuthMiddleware(env.FlagReview))))
+	http.HandleFunc("POST  /api/admin/items/{id}/seller", env.PanicMiddleware(env.LogMiddleware(env.AuthMiddleware(env.SetItemSeller))))
+	http.HandleFunc("GET   /api/admin/reviews/flagged", env.PanicMiddleware(env.LogMiddleware(env.AuthMiddleware(env.FlaggedReviews))))
+	http.HandleFunc("POST  /api/admin/reviews/{id}/hide", env.PanicMiddleware(env.LogMiddleware(env.AuthMiddleware(env.HideReview))))
+	http.HandleFunc("POST  /api/admin/reviews/{id}/restore", env.PanicMiddleware(env.LogMiddleware(env.AuthMiddleware(env.RestoreReview))))
+	http.HandleFunc("POST  /api/items/{id}/wishlist", env.PanicMiddleware(env.LogMiddleware(env.AuthMiddleware(env.SaveToWishlist))))
+	http.HandleFunc("DELETE /api/items/{id}/wishlist", env.PanicMiddleware(env.LogMiddleware(env.AuthMiddleware(env.RemoveFromWishlist))))
+	http.HandleFunc("GET   /api/wishlist", env.PanicMiddleware(env.LogMiddleware(env.AuthMiddleware(env.Wishlist))))
+	http.HandleFunc("GET   /api/items/search", env.PanicMiddleware(env.LogMiddleware(env.AuthMiddleware(env.SearchItems))))
+	http.HandleFunc("GET   /api/categories", env.PanicMiddleware(env.LogMiddleware(env.AuthMiddleware(env.Categories))))
 	http.HandleFunc("GET   /api/purchases", env.PanicMiddleware(env.LogMiddleware(env.AuthMiddleware(env.Purchases))))
 	http.HandleFunc("GET   /api/balance", env.PanicMiddleware(env.LogMiddleware(env.AuthMiddleware(env.Balance))))
 	http.HandleFunc("PATCH /api/deposit", env.PanicMiddleware(env.LogMiddleware(env.AuthMiddleware(env.Deposit))))
+	http.HandleFunc("GET   /api/deposits/{id}", env.PanicMiddleware(env.LogMiddleware(env.AuthMiddleware(env.DepositStatus))))
+	http.HandleFunc("POST  /api/deposits/{id}/confirm", env.PanicMiddleware(env.LogMiddleware(env.AuthMiddleware(env.ConfirmDeposit))))
+	http.HandleFunc("POST  /api/payments/webhook", env.PanicMiddleware(env.LogMiddleware(env.PaymentWebhook)))
+	http.HandleFunc("GET   /api/ledger", env.PanicMiddleware(env.LogMiddleware(env.AuthMiddleware(env.Ledger))))
+	http.HandleFunc("POST  /api/transfer", env.PanicMiddleware(env.LogMiddleware(env.AuthMiddleware(env.Transfer))))
+	http.HandleFunc("GET   /api/transfers", env.PanicMiddleware(env.LogMiddleware(env.AuthMiddleware(env.Transfers))))
+	http.HandleFunc("POST  /api/gift-cards/redeem", env.PanicMiddleware(env.LogMiddleware(env.AuthMiddleware(env.RedeemGiftCard))))
+	http.HandleFunc("GET   /api/gift-cards", env.PanicMiddleware(env.LogMiddleware(env.AuthMiddleware(env.GiftCards))))
+	http.HandleFunc("GET   /api/withdrawals", env.PanicMiddleware(env.LogMiddleware(env.AuthMiddleware(env.Withdrawals))))
+	http.HandleFunc("POST  /api/withdrawals", env.PanicMiddleware(env.LogMiddleware(env.AuthMiddleware(env.RequestWithdrawal))))
+	http.HandleFunc("GET   /api/admin/withdrawals", env.PanicMiddleware(env.LogMiddleware(env.AuthMiddleware(env.PendingWithdrawals))))
+	http.HandleFunc("POST  /api/admin/withdrawals/{id}/approve", env.PanicMiddleware(env.LogMiddleware(env.AuthMiddleware(env.ApproveWithdrawal))))
+	http.HandleFunc("POST  /api/admin/withdrawals/{id}/reject", env.PanicMiddleware(env.LogMiddleware(env.AuthMiddleware(env.RejectWithdrawal))))
+	http.HandleFunc("POST  /api/admin/gift-cards", env.PanicMiddleware(env.LogMiddleware(env.AuthMiddleware(env.IssueGiftCards))))
+	http.HandleFunc("GET   /api/admin/gift-cards/liability", env.PanicMiddleware(env.LogMiddleware(env.AuthMiddleware(env.GiftCardLiability))))
 	http.HandleFunc("POST  /api/purchase", env.PanicMiddleware(env.LogMiddleware(env.AuthMiddleware(env.Purchase))))
+	http.HandleFunc("GET   /media/{key...}", env.PanicMiddleware(env.LogMiddleware(env.Media)))
+	http.HandleFunc("GET   /api/cart", env.PanicMiddleware(env.LogMiddleware(env.AuthMiddleware(env.Cart))))
+	http.HandleFunc("POST  /api/cart", env.PanicMiddleware(env.LogMiddleware(env.AuthMiddleware(env.AddToCart))))
+	http.HandleFunc("PATCH /api/cart/{lineId}", env.PanicMiddleware(env.LogMiddleware(env.AuthMiddleware(env.UpdateCartLine))))
+	http.HandleFunc("DELETE /api/cart/{lineId}", env.PanicMiddleware(env.LogMiddleware(env.AuthMiddleware(env.RemoveCartLine))))
+	http.HandleFunc("POST  /api/checkout", env.PanicMiddleware(env.LogMiddleware(env.AuthMiddleware(env.Checkout))))
+	http.HandleFunc("GET   /api/orders", env.PanicMiddleware(env.LogMiddleware(env.AuthMiddleware(env.Orders))))
+	http.HandleFunc("GET   /api/orders/{id}", env.PanicMiddleware(env.LogMiddleware(env.AuthMiddleware(env.Order))))
+	http.HandleFunc("POST  /api/orders/{id}/confirm", env.PanicMiddleware(env.LogMiddleware(env.AuthMiddleware(env.ConfirmReceipt))))
+	http.HandleFunc("GET   /api/escrows", env.PanicMiddleware(env.LogMiddleware(env.AuthMiddleware(env.Escrows))))
+	http.HandleFunc("POST  /api/purchases/{id}/dispute", env.PanicMiddleware(env.LogMiddleware(env.AuthMiddleware(env.OpenDispute))))
+	http.HandleFunc("GET   /api/disputes", env.PanicMiddleware(env.LogMiddleware(env.AuthMiddleware(env.Disputes))))
+	http.HandleFunc("GET   /api/disputes/{id}", env.PanicMiddleware(env.LogMiddleware(env.AuthMiddleware(env.Dispute))))
+	http.HandleFunc("POST  /api/disputes/{id}/messages", env.PanicMiddleware(env.LogMiddleware(env.AuthMiddleware(env.AddDisputeMessage))))
+	http.HandleFunc("POST  /api/disputes/{id}/withdraw", env.PanicMiddleware(env.LogMiddleware(env.AuthMiddleware(env.WithdrawDispute))))
+	http.HandleFunc("GET   /api/admin/disputes", env.PanicMiddleware(env.LogMiddleware(env.AuthMiddleware(env.ActiveDisputes))))
+	http.HandleFunc("POST  /api/admin/disputes/{id}/review", env.PanicMiddleware(env.LogMiddleware(env.AuthMiddleware(env.ReviewDispute))))
+	http.HandleFunc("POST  /api/admin/disputes/{id}/refund", env.PanicMiddleware(env.LogMiddleware(env.AuthMiddleware(env.RefundDispute))))
+	http.HandleFunc("POST  /api/admin/disputes/{id}/reject", env.PanicMiddleware(env.LogMiddleware(env.AuthMiddleware(env.RejectDispute))))
+	http.HandleFunc("GET   /api/notifications", env.PanicMiddleware(env.LogMiddleware(env.AuthMiddleware(env.Notifications))))
+	http.HandleFunc("POST  /api/notifications/{id}/read", env.PanicMiddleware(env.LogMiddleware(env.AuthMiddleware(env.ReadNotification))))
+	http.HandleFunc("GET   /api/notifications/settings", env.PanicMiddleware(env.LogMiddleware(env.AuthMiddleware(env.NotificationSettings))))
+	http.HandleFunc("PATCH /api/notifications/settings", env.PanicMiddleware(env.LogMiddleware(env.AuthMiddleware(env.UpdateNotificationContacts))))
+	http.HandleFunc("PATCH /api/notifications/preferences", env.PanicMiddleware(env.LogMiddleware(env.AuthMiddleware(env.SetNotificationPreference))))
+	http.HandleFunc("GET   /api/webhooks", env.PanicMiddleware(env.LogMiddleware(env.AuthMiddleware(env.WebhookEndpoints))))
+	http.HandleFunc("POST  /api/webhooks", env.PanicMiddleware(env.LogMiddleware(env.AuthMiddleware(env.AddWebhookEndpoint))))
+	http.HandleFunc("DELETE /api/webhooks/{id}", env.PanicMiddleware(env.LogMiddleware(env.AuthMiddleware(env.DeleteWebhookEndpoint))))
+	http.HandleFunc("GET   /api/webhooks/{id}/deliveries", env.PanicMiddleware(env.LogMiddleware(env.AuthMiddleware(env.WebhookDeliveries))))
+	http.HandleFunc("POST  /api/webhooks/{id}/deliveries/{deliveryId}/redeliver", env.PanicMiddleware(env.LogMiddleware(env.AuthMiddleware(env.RedeliverWebhook))))
+	http.HandleFunc("GET   /api/admin/webhooks", env.PanicMiddleware(env.LogMiddleware(env.AuthMiddleware(env.IntegrationWebhooks))))
+	http.HandleFunc("POST  /api/admin/webhooks", env.PanicMiddleware(env.LogMiddleware(env.AuthMiddleware(env.AddIntegrationWebhook))))
 	http.HandleFunc("POST  /api/register", env.PanicMiddleware(env.LogMiddleware(env.Register)))
 	http.HandleFunc("POST  /api/login", env.PanicMiddleware(env.LogMiddleware(env.Login)))
-	err = http.ListenAndServe(":3000", nil)
+
+	server := &http.Server{
+		Addr:    ":3000",
+		Handler: env.SecurityHeadersMiddleware(http.DefaultServeMux.ServeHTTP),
+	}
+
+	// Serve https if a certificate is configured, the pair is reloaded when the files change
+	certFile, keyFile := os.Getenv("TLS_CERT_FILE"), os.Getenv("TLS_KEY_FILE")
+	if len(certFile) != 0 && len(keyFile) != 0 {
+		reloader, err := newCertReloader(certFile, keyFile)
+		if err != nil {
+			log.Fatalln(err.Error())
+		}
+		server.TLSConfig = reloader.TLSConfig()
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		err = server.ListenAndServe()
+	}
 	if err != nil {
 		log.Fatalln(err.Error())
 	}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"image"
+	"image/color"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+var ErrInvalidBlobKey error = errors.New("invalid blob key")
+var ErrBlobNotFound error = errors.New("blob not found")
+
+const (
+	MaxImageSize      = 10 << 20 // bytes
+	MaxImagePixels    = 40_000_000
+	ThumbnailSize     = 256 // max width and height
+	SignedURLLifetime = time.Hour
+)
+
+// Content types accepted for item images, checked by sniffing not by trusting the client
+var imageContentTypes = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+}
+
+// BlobStore stores opaque blobs under slash separated keys
+type BlobStore interface {
+	Put(key string, r io.Reader) error
+	Open(key string) (io.ReadCloser, error)
+	Delete(key string) error
+}
+
+type LocalBlobStore struct {
+	root string
+}
+
+func NewLocalBlobStore(root string) (*LocalBlobStore, error) {
+	if err := os.MkdirAll(root, 0750); err != nil {
+		return nil, err
+	}
+	return &LocalBlobStore{root: root}, nil
+}
+
+// path maps a key to a file under root, rejecting keys that would escape it
+func (l *LocalBlobStore) path(key string) (string, error) {
+	if len(key) == 0 || !fs.ValidPath(key) {
+		return "", ErrInvalidBlobKey
+	}
+	return filepath.Join(l.root, filepath.FromSlash(key)), nil
+}
+
+// Put writes to a temporary file first so readers never see a partial blob
+func (l *LocalBlobStore) Put(key string, r io.Reader) (err error) {
+	name, err := l.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(name), 0750); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(name), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	if _, err = io.Copy(tmp, r); err != nil {
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), name)
+}
+
+func (l *LocalBlobStore) Open(key string) (io.ReadCloser, error) {
+	name, err := l.path(key)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrBlobNotFound
+	}
+	return file, err
+}
+
+func (l *LocalBlobStore) Delete(key string) error {
+	name, err := l.path(key)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// URLSigner produces and checks expiring links to blobs
+type URLSigner struct {
+	key    []byte
+	prefix string // path the media handler is mounted on
+}
+
+func (u URLSigner) signature(blobKey string, expires int64) string {
+	mac := hmac.New(sha256.New, u.key)
+	mac.Write([]byte(blobKey))
+	mac.Write([]byte{0})
+	mac.Write([]byte(strconv.FormatInt(expires, 10)))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (u URLSigner) Sign(blobKey string, expires time.Time) string {
+	query := url.Values{}
+	query.Set("expires", strconv.FormatInt(expires.Unix(), 10))
+	query.Set("sig", u.signature(blobKey, expires.Unix()))
+	return path.Join(u.prefix, blobKey) + "?" + query.Encode()
+}
+
+// Verify checks the signature and expiry of a link to blobKey
+func (u URLSigner) Verify(blobKey string, query url.Values, now time.Time) bool {
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil || now.Unix() > expires {
+		return false
+	}
+	return hmac.Equal([]byte(query.Get("sig")), []byte(u.signature(blobKey, expires)))
+}
+
+// thumbnail scales img down to fit within size x size, averaging the source pixels
+// covered by each destination pixel. Images already small enough are returned as is
+func thumbnail(img image.Image, size int) image.Image {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width <= size && height <= size {
+		return img
+	}
+
+	thumbWidth, thumbHeight := size, size
+	if width > height {
+		thumbHeight = max(1, height*size/width)
+	} else {
+		thumbWidth = max(1, width*size/height)
+	}
+
+	thumb := image.NewRGBA(image.Rect(0, 0, thumbWidth, thumbHeight))
+	for y := 0; y < thumbHeight; y++ {
+		y0 := bounds.Min.Y + y*height/thumbHeight
+		y1 := max(y0+1, bounds.Min.Y+(y+1)*height/thumbHeight)
+		for x := 0; x < thumbWidth; x++ {
+			x0 := bounds.Min.X + x*width/thumbWidth
+			x1 := max(x0+1, bounds.Min.X+(x+1)*width/thumbWidth)
+
+			var r, g, b, a, count uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := img.At(sx, sy).RGBA()
+					r, g, b, a = r+uint64(cr), g+uint64(cg), b+uint64(cb), a+uint64(ca)
+					count++
+				}
+			}
+			thumb.Set(x, y, color.RGBA64{
+				R: uint16(r / count),
+				G: uint16(g / count),
+				B: uint16(b / count),
+				A: uint16(a / count),
+			})
+		}
+	}
+	return thumb
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"image"
+	"io"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLocalBlobStore(t *testing.T) {
+	t.Parallel()
+
+	store, err := NewLocalBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.Put("items/1/image.png", strings.NewReader("data")); err != nil {
+		t.Fatal(err)
+	}
+	blob, err := store.Open("items/1/image.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(blob)
+	blob.Close()
+	if string(data) != "data" {
+		t.Errorf("got blob %q, expected %q", data, "data")
+	}
+
+	if err := store.Delete("items/1/image.png"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Open("items/1/image.png"); err != ErrBlobNotFound {
+		t.Errorf("expected ErrBlobNotFound after delete, got %v", err)
+	}
+
+	for _, key := range []string{"", "../escape", "/absolute", "items/../../escape"} {
+		if err := store.Put(key, strings.NewReader("data")); err != ErrInvalidBlobKey {
+			t.Errorf("expected ErrInvalidBlobKey for %q, got %v", key, err)
+		}
+	}
+}
+
+func TestURLSigner(t *testing.T) {
+	t.Parallel()
+
+	signer := URLSigner{key: []byte("secret"), prefix: "/media"}
+	now := time.Now()
+	link, err := url.Parse(signer.Sign("items/1/image.png", now.Add(time.Minute)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if link.Path != "/media/items/1/image.png" {
+		t.Errorf("got path %q", link.Path)
+	}
+
+	if !signer.Verify("items/1/image.png", link.Query(), now) {
+		t.Error("valid link rejected")
+	}
+	if signer.Verify("items/1/other.png", link.Query(), now) {
+		t.Error("link accepted for a different key")
+	}
+	if signer.Verify("items/1/image.png", link.Query(), now.Add(time.Hour)) {
+		t.Error("expired link accepted")
+	}
+	other := URLSigner{key: []byte("other"), prefix: "/media"}
+	if other.Verify("items/1/image.png", link.Query(), now) {
+		t.Error("link accepted with a different key")
+	}
+}
+
+func TestThumbnail(t *testing.T) {
+	t.Parallel()
+
+	for name, args := range map[string]struct {
+		width, height        int
+		expectedW, expectedH int
+	}{
+		"landscape": {1000, 500, 256, 128},
+		"portrait":  {300, 1200, 64, 256},
+		"small":     {100, 50, 100, 50},
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			bounds := thumbnail(image.NewRGBA(image.Rect(0, 0, args.width, args.height)), ThumbnailSize).Bounds()
+			if bounds.Dx() != args.expectedW || bounds.Dy() != args.expectedH {
+				t.Errorf("got %vx%v, expected %vx%v", bounds.Dx(), bounds.Dy(), args.expectedW, args.expectedH)
+			}
+		})
+	}
+}
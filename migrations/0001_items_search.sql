@@ -0,0 +1,8 @@
+-- Full-text search over item name and description, name ranks above description
+ALTER TABLE public.items
+    ADD COLUMN IF NOT EXISTS search tsvector GENERATED ALWAYS AS (
+        setweight(to_tsvector('english', name), 'A') ||
+        setweight(to_tsvector('english', coalesce(description, '')), 'B')
+    ) STORED;
+
+CREATE INDEX IF NOT EXISTS items_search_idx ON public.items USING gin (search);
@@ -0,0 +1,16 @@
+-- Category hierarchy, a NULL parent is a top level category
+CREATE TABLE IF NOT EXISTS public.categories (
+    category_id serial PRIMARY KEY,
+    parent_id integer REFERENCES public.categories(category_id) ON UPDATE CASCADE ON DELETE CASCADE,
+    name character varying(64) NOT NULL,
+    UNIQUE NULLS NOT DISTINCT (parent_id, name)
+);
+
+-- Items can be in any number of categories
+CREATE TABLE IF NOT EXISTS public.item_categories (
+    item_id integer NOT NULL REFERENCES public.items(item_id) ON UPDATE CASCADE ON DELETE CASCADE,
+    category_id integer NOT NULL REFERENCES public.categories(category_id) ON UPDATE CASCADE ON DELETE CASCADE,
+    PRIMARY KEY (item_id, category_id)
+);
+
+CREATE INDEX IF NOT EXISTS item_categories_category_id_idx ON public.item_categories (category_id);
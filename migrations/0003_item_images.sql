@@ -0,0 +1,17 @@
+-- Items are listed by a seller, existing items have none
+ALTER TABLE public.items
+    ADD COLUMN IF NOT EXISTS seller_id integer REFERENCES public.users(user_id) ON UPDATE CASCADE ON DELETE SET NULL;
+
+-- Image blobs live in the blob store, only their keys are kept here
+CREATE TABLE IF NOT EXISTS public.item_images (
+    image_id serial PRIMARY KEY,
+    item_id integer NOT NULL REFERENCES public.items(item_id) ON UPDATE CASCADE ON DELETE CASCADE,
+    blob_key character varying(256) NOT NULL,
+    thumb_key character varying(256) NOT NULL,
+    content_type character varying(32) NOT NULL,
+    width integer NOT NULL,
+    height integer NOT NULL,
+    created_at timestamp with time zone DEFAULT now() NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS item_images_item_id_idx ON public.item_images (item_id);
@@ -0,0 +1,22 @@
+-- Free form typed attributes, variants inherit and override their item's attributes
+ALTER TABLE public.items
+    ADD COLUMN IF NOT EXISTS attributes jsonb DEFAULT '{}'::jsonb NOT NULL;
+
+CREATE INDEX IF NOT EXISTS items_attributes_idx ON public.items USING gin (attributes jsonb_path_ops);
+
+-- Purchasable variants of an item, each with its own price and stock
+CREATE TABLE IF NOT EXISTS public.item_variants (
+    variant_id serial PRIMARY KEY,
+    item_id integer NOT NULL REFERENCES public.items(item_id) ON UPDATE CASCADE ON DELETE CASCADE,
+    sku character varying(64) NOT NULL UNIQUE,
+    price numeric(10,2) NOT NULL,
+    stock integer DEFAULT 0 NOT NULL CHECK (stock >= 0),
+    attributes jsonb DEFAULT '{}'::jsonb NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS item_variants_item_id_idx ON public.item_variants (item_id);
+CREATE INDEX IF NOT EXISTS item_variants_attributes_idx ON public.item_variants USING gin (attributes jsonb_path_ops);
+
+-- Purchases of items with variants record which one was bought
+ALTER TABLE public.purchases
+    ADD COLUMN IF NOT EXISTS variant_id integer REFERENCES public.item_variants(variant_id) ON UPDATE CASCADE ON DELETE SET NULL;
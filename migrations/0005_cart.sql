@@ -0,0 +1,10 @@
+-- Persistent shopping cart, prices are looked up live so only quantities are kept
+CREATE TABLE IF NOT EXISTS public.cart_lines (
+    line_id serial PRIMARY KEY,
+    user_id integer NOT NULL REFERENCES public.users(user_id) ON UPDATE CASCADE ON DELETE CASCADE,
+    item_id integer NOT NULL REFERENCES public.items(item_id) ON UPDATE CASCADE ON DELETE CASCADE,
+    variant_id integer REFERENCES public.item_variants(variant_id) ON UPDATE CASCADE ON DELETE CASCADE,
+    quantity integer NOT NULL CHECK (quantity > 0),
+    added_at timestamp with time zone DEFAULT now() NOT NULL,
+    UNIQUE NULLS NOT DISTINCT (user_id, item_id, variant_id)
+);
@@ -0,0 +1,45 @@
+-- Orders group the lines bought together, status changes are validated by the server
+CREATE TABLE IF NOT EXISTS public.orders (
+    order_id serial PRIMARY KEY,
+    user_id integer NOT NULL REFERENCES public.users(user_id) ON UPDATE CASCADE ON DELETE CASCADE,
+    status character varying(16) NOT NULL CHECK (status IN ('pending', 'paid', 'fulfilled', 'cancelled', 'refunded')),
+    total numeric(10,2) NOT NULL,
+    created_at timestamp with time zone DEFAULT now() NOT NULL,
+    updated_at timestamp with time zone DEFAULT now() NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS orders_user_id_idx ON public.orders (user_id, order_id);
+
+CREATE TABLE IF NOT EXISTS public.order_lines (
+    line_id serial PRIMARY KEY,
+    order_id integer NOT NULL REFERENCES public.orders(order_id) ON UPDATE CASCADE ON DELETE CASCADE,
+    item_id integer NOT NULL REFERENCES public.items(item_id) ON UPDATE CASCADE ON DELETE CASCADE,
+    variant_id integer REFERENCES public.item_variants(variant_id) ON UPDATE CASCADE ON DELETE SET NULL,
+    quantity integer NOT NULL CHECK (quantity > 0),
+    unit_price numeric(10,2) NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS order_lines_order_id_idx ON public.order_lines (order_id);
+
+-- Purchases remain one row per unit bought and point at the order they were part of
+ALTER TABLE public.purchases
+    ADD COLUMN IF NOT EXISTS order_id integer REFERENCES public.orders(order_id) ON UPDATE CASCADE ON DELETE SET NULL;
+
+-- Existing purchases become paid single line orders
+DO $$
+DECLARE
+    purchase record;
+    new_order_id integer;
+BEGIN
+    FOR purchase IN SELECT * FROM public.purchases WHERE order_id IS NULL ORDER BY purchase_id LOOP
+        INSERT INTO public.orders (user_id, status, total, created_at, updated_at)
+        VALUES (purchase.user_id, 'paid', purchase.price, purchase.purchased_at, purchase.purchased_at)
+        RETURNING order_id INTO new_order_id;
+
+        INSERT INTO public.order_lines (order_id, item_id, variant_id, quantity, unit_price)
+        VALUES (new_order_id, purchase.item_id, purchase.variant_id, 1, purchase.price);
+
+        UPDATE public.purchases SET order_id=new_order_id WHERE purchase_id=purchase.purchase_id;
+    END LOOP;
+END
+$$;
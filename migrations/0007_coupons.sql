@@ -0,0 +1,48 @@
+-- Coupon codes, amount is a whole percentage for percent coupons and money for fixed ones.
+-- A NULL limit or expiry means unlimited
+CREATE TABLE IF NOT EXISTS public.coupons (
+    coupon_id serial PRIMARY KEY,
+    code character varying(32) NOT NULL UNIQUE CHECK (code = upper(code)),
+    kind character varying(8) NOT NULL CHECK (kind IN ('percent', 'fixed')),
+    amount numeric(10,2) NOT NULL CHECK (amount > 0),
+    min_spend numeric(10,2) DEFAULT 0 NOT NULL,
+    expires_at timestamp with time zone,
+    max_uses integer,
+    max_uses_per_user integer,
+    uses integer DEFAULT 0 NOT NULL,
+    created_at timestamp with time zone DEFAULT now() NOT NULL,
+    CHECK (kind <> 'percent' OR amount <= 100)
+);
+
+-- Restrictions, a coupon with neither applies to everything
+CREATE TABLE IF NOT EXISTS public.coupon_items (
+    coupon_id integer NOT NULL REFERENCES public.coupons(coupon_id) ON UPDATE CASCADE ON DELETE CASCADE,
+    item_id integer NOT NULL REFERENCES public.items(item_id) ON UPDATE CASCADE ON DELETE CASCADE,
+    PRIMARY KEY (coupon_id, item_id)
+);
+
+CREATE TABLE IF NOT EXISTS public.coupon_categories (
+    coupon_id integer NOT NULL REFERENCES public.coupons(coupon_id) ON UPDATE CASCADE ON DELETE CASCADE,
+    category_id integer NOT NULL REFERENCES public.categories(category_id) ON UPDATE CASCADE ON DELETE CASCADE,
+    PRIMARY KEY (coupon_id, category_id)
+);
+
+-- Orders record the coupon used and the discount given
+ALTER TABLE public.orders
+    ADD COLUMN IF NOT EXISTS coupon_id integer REFERENCES public.coupons(coupon_id) ON UPDATE CASCADE ON DELETE SET NULL,
+    ADD COLUMN IF NOT EXISTS discount numeric(10,2) DEFAULT 0 NOT NULL;
+
+CREATE INDEX IF NOT EXISTS orders_coupon_id_idx ON public.orders (coupon_id, user_id);
+
+ALTER TABLE public.order_lines
+    ADD COLUMN IF NOT EXISTS discount numeric(10,2) DEFAULT 0 NOT NULL;
+
+-- Purchases keep price as the amount paid, alongside the list price and discount
+ALTER TABLE public.purchases
+    ADD COLUMN IF NOT EXISTS list_price numeric(10,2),
+    ADD COLUMN IF NOT EXISTS discount numeric(10,2) DEFAULT 0 NOT NULL;
+
+UPDATE public.purchases SET list_price=price WHERE list_price IS NULL;
+
+ALTER TABLE public.purchases
+    ALTER COLUMN list_price SET NOT NULL;
@@ -0,0 +1,22 @@
+-- Price history and scheduled changes. A row with ends_at is a sale, the item goes back to
+-- its regular price when the window ends. applied_at and ended_at are set by the scheduler
+CREATE TABLE IF NOT EXISTS public.item_prices (
+    price_id serial PRIMARY KEY,
+    item_id integer NOT NULL REFERENCES public.items(item_id) ON UPDATE CASCADE ON DELETE CASCADE,
+    price numeric(10,2) NOT NULL CHECK (price >= 0),
+    starts_at timestamp with time zone NOT NULL,
+    ends_at timestamp with time zone,
+    applied_at timestamp with time zone,
+    ended_at timestamp with time zone,
+    created_at timestamp with time zone DEFAULT now() NOT NULL,
+    CHECK (ends_at IS NULL OR ends_at > starts_at)
+);
+
+CREATE INDEX IF NOT EXISTS item_prices_item_id_idx ON public.item_prices (item_id, starts_at);
+CREATE INDEX IF NOT EXISTS item_prices_pending_idx ON public.item_prices (starts_at) WHERE applied_at IS NULL;
+CREATE INDEX IF NOT EXISTS item_prices_sale_end_idx ON public.item_prices (ends_at) WHERE ends_at IS NOT NULL AND ended_at IS NULL;
+
+-- Current prices start the history
+INSERT INTO public.item_prices (item_id, price, starts_at, applied_at)
+SELECT item_id, price, now(), now() FROM public.items
+WHERE NOT EXISTS (SELECT 1 FROM public.item_prices WHERE item_prices.item_id=items.item_id);
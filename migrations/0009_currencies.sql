@@ -0,0 +1,33 @@
+-- Items are priced in a currency, variants and price changes share their item's currency
+ALTER TABLE public.items
+    ADD COLUMN IF NOT EXISTS currency character(3) DEFAULT 'USD' NOT NULL;
+
+-- Balances are held in a wallet per currency
+CREATE TABLE IF NOT EXISTS public.wallets (
+    user_id integer NOT NULL REFERENCES public.users(user_id) ON UPDATE CASCADE ON DELETE CASCADE,
+    currency character(3) NOT NULL,
+    balance numeric(10,2) DEFAULT 0 NOT NULL CHECK (balance >= 0),
+    PRIMARY KEY (user_id, currency)
+);
+
+-- Existing balances become USD wallets
+DO $$
+BEGIN
+    IF EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name='users' AND column_name='balance') THEN
+        INSERT INTO public.wallets (user_id, currency, balance)
+        SELECT user_id, 'USD', balance FROM public.users
+        ON CONFLICT DO NOTHING;
+        ALTER TABLE public.users DROP COLUMN balance;
+    END IF;
+END $$;
+
+-- Orders and purchases record the currency they were paid in
+ALTER TABLE public.orders
+    ADD COLUMN IF NOT EXISTS currency character(3) DEFAULT 'USD' NOT NULL;
+
+ALTER TABLE public.purchases
+    ADD COLUMN IF NOT EXISTS currency character(3) DEFAULT 'USD' NOT NULL;
+
+-- Fixed amount coupons and minimum spends are in the coupon's currency
+ALTER TABLE public.coupons
+    ADD COLUMN IF NOT EXISTS currency character(3) DEFAULT 'USD' NOT NULL;
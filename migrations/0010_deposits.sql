@@ -0,0 +1,14 @@
+-- Deposits are paid through the payment provider and credited to the wallet once the
+-- provider reports the payment succeeded
+CREATE TABLE IF NOT EXISTS public.deposits (
+    deposit_id serial PRIMARY KEY,
+    user_id integer NOT NULL REFERENCES public.users(user_id) ON UPDATE CASCADE ON DELETE CASCADE,
+    amount numeric(10,2) NOT NULL CHECK (amount > 0),
+    currency character(3) NOT NULL,
+    intent_id character varying(128) NOT NULL UNIQUE,
+    status character varying(16) NOT NULL CHECK (status IN ('pending', 'succeeded', 'failed', 'refunded')),
+    created_at timestamp with time zone DEFAULT now() NOT NULL,
+    updated_at timestamp with time zone DEFAULT now() NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS deposits_user_id_idx ON public.deposits (user_id, deposit_id);
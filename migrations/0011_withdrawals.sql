@@ -0,0 +1,46 @@
+-- Admins review withdrawals
+ALTER TABLE public.users
+    ADD COLUMN IF NOT EXISTS is_admin boolean DEFAULT false NOT NULL;
+
+-- Every change to a wallet is recorded, a wallet's balance is the sum of its entries. Sale
+-- money can't be withdrawn until it is no longer held
+CREATE TABLE IF NOT EXISTS public.ledger_entries (
+    entry_id serial PRIMARY KEY,
+    user_id integer NOT NULL REFERENCES public.users(user_id) ON UPDATE CASCADE ON DELETE CASCADE,
+    currency character(3) NOT NULL,
+    amount numeric(10,2) NOT NULL,
+    kind character varying(24) NOT NULL CHECK (kind IN ('opening', 'adjustment', 'deposit', 'purchase', 'refund', 'sale',
+                                                         'sale_reversal', 'withdrawal', 'withdrawal_reversal')),
+    reference_id integer,
+    held_until timestamp with time zone,
+    created_at timestamp with time zone DEFAULT now() NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS ledger_entries_user_id_idx ON public.ledger_entries (user_id, entry_id);
+CREATE INDEX IF NOT EXISTS ledger_entries_held_idx ON public.ledger_entries (user_id, currency, held_until) WHERE held_until IS NOT NULL;
+CREATE INDEX IF NOT EXISTS ledger_entries_reference_id_idx ON public.ledger_entries (reference_id, kind);
+
+-- Existing balances open the ledger
+INSERT INTO public.ledger_entries (user_id, currency, amount, kind)
+SELECT user_id, currency, balance, 'opening' FROM public.wallets
+WHERE NOT EXISTS (
+    SELECT 1 FROM public.ledger_entries
+    WHERE ledger_entries.user_id=wallets.user_id AND ledger_entries.currency=wallets.currency
+);
+
+-- Withdrawals take the money from the wallet when requested and return it if they are
+-- rejected or the payout fails
+CREATE TABLE IF NOT EXISTS public.withdrawals (
+    withdrawal_id serial PRIMARY KEY,
+    user_id integer NOT NULL REFERENCES public.users(user_id) ON UPDATE CASCADE ON DELETE CASCADE,
+    amount numeric(10,2) NOT NULL CHECK (amount > 0),
+    currency character(3) NOT NULL,
+    status character varying(16) NOT NULL CHECK (status IN ('pending', 'processing', 'paid', 'rejected', 'failed')),
+    payout_id character varying(128),
+    reviewed_by integer REFERENCES public.users(user_id) ON UPDATE CASCADE ON DELETE SET NULL,
+    created_at timestamp with time zone DEFAULT now() NOT NULL,
+    updated_at timestamp with time zone DEFAULT now() NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS withdrawals_user_id_idx ON public.withdrawals (user_id, withdrawal_id);
+CREATE INDEX IF NOT EXISTS withdrawals_pending_idx ON public.withdrawals (withdrawal_id) WHERE status='pending';
@@ -0,0 +1,19 @@
+-- Users send each other money from their wallets
+CREATE TABLE IF NOT EXISTS public.transfers (
+    transfer_id serial PRIMARY KEY,
+    from_user_id integer NOT NULL REFERENCES public.users(user_id) ON UPDATE CASCADE ON DELETE CASCADE,
+    to_user_id integer NOT NULL REFERENCES public.users(user_id) ON UPDATE CASCADE ON DELETE CASCADE,
+    amount numeric(10,2) NOT NULL CHECK (amount > 0),
+    currency character(3) NOT NULL,
+    created_at timestamp with time zone DEFAULT now() NOT NULL,
+    CHECK (from_user_id <> to_user_id)
+);
+
+CREATE INDEX IF NOT EXISTS transfers_from_user_id_idx ON public.transfers (from_user_id, created_at);
+CREATE INDEX IF NOT EXISTS transfers_to_user_id_idx ON public.transfers (to_user_id, created_at);
+
+-- Both sides of a transfer are recorded in the ledger
+ALTER TABLE public.ledger_entries DROP CONSTRAINT IF EXISTS ledger_entries_kind_check;
+ALTER TABLE public.ledger_entries ADD CONSTRAINT ledger_entries_kind_check
+    CHECK (kind IN ('opening', 'adjustment', 'deposit', 'purchase', 'refund', 'sale', 'sale_reversal', 'withdrawal',
+                    'withdrawal_reversal', 'transfer_out', 'transfer_in'));
@@ -0,0 +1,23 @@
+-- Gift cards are store credit redeemed into a wallet with a code, only the code's hash is
+-- stored. The first user to redeem a card claims it and can draw the balance down in parts
+CREATE TABLE IF NOT EXISTS public.gift_cards (
+    card_id serial PRIMARY KEY,
+    code_hash character(64) NOT NULL UNIQUE,
+    code_suffix character varying(8) NOT NULL,
+    value numeric(10,2) NOT NULL CHECK (value > 0),
+    balance numeric(10,2) NOT NULL CHECK (balance >= 0 AND balance <= value),
+    currency character(3) NOT NULL,
+    expires_at timestamp with time zone,
+    issued_by integer REFERENCES public.users(user_id) ON UPDATE CASCADE ON DELETE SET NULL,
+    redeemed_by integer REFERENCES public.users(user_id) ON UPDATE CASCADE ON DELETE SET NULL,
+    redeemed_at timestamp with time zone,
+    created_at timestamp with time zone DEFAULT now() NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS gift_cards_redeemed_by_idx ON public.gift_cards (redeemed_by);
+
+-- Redemptions are recorded in the ledger
+ALTER TABLE public.ledger_entries DROP CONSTRAINT IF EXISTS ledger_entries_kind_check;
+ALTER TABLE public.ledger_entries ADD CONSTRAINT ledger_entries_kind_check
+    CHECK (kind IN ('opening', 'adjustment', 'deposit', 'purchase', 'refund', 'sale', 'sale_reversal', 'withdrawal',
+                    'withdrawal_reversal', 'transfer_out', 'transfer_in', 'gift_card'));
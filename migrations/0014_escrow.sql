@@ -0,0 +1,17 @@
+-- Sellers' proceeds are held in escrow until the buyer confirms receipt or the escrow comes
+-- due, and frozen while the order is disputed
+CREATE TABLE IF NOT EXISTS public.escrows (
+    escrow_id serial PRIMARY KEY,
+    order_id integer NOT NULL REFERENCES public.orders(order_id) ON UPDATE CASCADE ON DELETE CASCADE,
+    seller_id integer NOT NULL REFERENCES public.users(user_id) ON UPDATE CASCADE ON DELETE CASCADE,
+    amount numeric(10,2) NOT NULL CHECK (amount > 0),
+    currency character(3) NOT NULL,
+    status character varying(16) NOT NULL CHECK (status IN ('held', 'released', 'frozen', 'refunded')),
+    release_at timestamp with time zone NOT NULL,
+    created_at timestamp with time zone DEFAULT now() NOT NULL,
+    updated_at timestamp with time zone DEFAULT now() NOT NULL,
+    UNIQUE (order_id, seller_id)
+);
+
+CREATE INDEX IF NOT EXISTS escrows_seller_id_idx ON public.escrows (seller_id, escrow_id);
+CREATE INDEX IF NOT EXISTS escrows_due_idx ON public.escrows (release_at) WHERE status = 'held';
@@ -0,0 +1,36 @@
+-- Buyers dispute purchases, the buyer, seller and admins discuss them in a thread until an
+-- admin refunds or rejects them
+CREATE TABLE IF NOT EXISTS public.disputes (
+    dispute_id serial PRIMARY KEY,
+    purchase_id integer NOT NULL UNIQUE REFERENCES public.purchases(purchase_id) ON UPDATE CASCADE ON DELETE CASCADE,
+    order_id integer NOT NULL REFERENCES public.orders(order_id) ON UPDATE CASCADE ON DELETE CASCADE,
+    item_id integer NOT NULL REFERENCES public.items(item_id) ON UPDATE CASCADE ON DELETE CASCADE,
+    buyer_id integer NOT NULL REFERENCES public.users(user_id) ON UPDATE CASCADE ON DELETE CASCADE,
+    seller_id integer REFERENCES public.users(user_id) ON UPDATE CASCADE ON DELETE SET NULL,
+    amount numeric(10,2) NOT NULL,
+    currency character(3) NOT NULL,
+    refunded numeric(10,2) DEFAULT 0 NOT NULL CHECK (refunded >= 0 AND refunded <= amount),
+    status character varying(16) NOT NULL CHECK (status IN ('open', 'under_review', 'refunded', 'rejected', 'withdrawn')),
+    reviewed_by integer REFERENCES public.users(user_id) ON UPDATE CASCADE ON DELETE SET NULL,
+    created_at timestamp with time zone DEFAULT now() NOT NULL,
+    updated_at timestamp with time zone DEFAULT now() NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS disputes_buyer_id_idx ON public.disputes (buyer_id);
+CREATE INDEX IF NOT EXISTS disputes_seller_id_idx ON public.disputes (seller_id);
+CREATE INDEX IF NOT EXISTS disputes_order_id_idx ON public.disputes (order_id);
+CREATE INDEX IF NOT EXISTS disputes_active_idx ON public.disputes (dispute_id) WHERE status IN ('open', 'under_review');
+
+CREATE TABLE IF NOT EXISTS public.dispute_messages (
+    message_id serial PRIMARY KEY,
+    dispute_id integer NOT NULL REFERENCES public.disputes(dispute_id) ON UPDATE CASCADE ON DELETE CASCADE,
+    author_id integer NOT NULL REFERENCES public.users(user_id) ON UPDATE CASCADE ON DELETE CASCADE,
+    body text NOT NULL,
+    created_at timestamp with time zone DEFAULT now() NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS dispute_messages_dispute_id_idx ON public.dispute_messages (dispute_id, message_id);
+
+-- Refunds are taken from escrow, which can be refunded down to nothing
+ALTER TABLE public.escrows DROP CONSTRAINT IF EXISTS escrows_amount_check;
+ALTER TABLE public.escrows ADD CONSTRAINT escrows_amount_check CHECK (amount >= 0);
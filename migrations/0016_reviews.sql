@@ -0,0 +1,25 @@
+-- Buyers review the items they bought once each, sellers reply and admins hide reported
+-- reviews, which then don't count towards the item's rating
+CREATE TABLE IF NOT EXISTS public.reviews (
+    review_id serial PRIMARY KEY,
+    item_id integer NOT NULL REFERENCES public.items(item_id) ON UPDATE CASCADE ON DELETE CASCADE,
+    user_id integer NOT NULL REFERENCES public.users(user_id) ON UPDATE CASCADE ON DELETE CASCADE,
+    rating smallint NOT NULL CHECK (rating BETWEEN 1 AND 5),
+    body text DEFAULT '' NOT NULL,
+    reply text,
+    replied_at timestamp with time zone,
+    hidden boolean DEFAULT false NOT NULL,
+    created_at timestamp with time zone DEFAULT now() NOT NULL,
+    updated_at timestamp with time zone DEFAULT now() NOT NULL,
+    UNIQUE (item_id, user_id)
+);
+
+CREATE INDEX IF NOT EXISTS reviews_visible_idx ON public.reviews (item_id, review_id) WHERE NOT hidden;
+
+CREATE TABLE IF NOT EXISTS public.review_flags (
+    review_id integer NOT NULL REFERENCES public.reviews(review_id) ON UPDATE CASCADE ON DELETE CASCADE,
+    user_id integer NOT NULL REFERENCES public.users(user_id) ON UPDATE CASCADE ON DELETE CASCADE,
+    reason text DEFAULT '' NOT NULL,
+    created_at timestamp with time zone DEFAULT now() NOT NULL,
+    PRIMARY KEY (review_id, user_id)
+);
@@ -0,0 +1,12 @@
+-- Users save items to a wishlist, optionally watching for the price to drop to a target.
+-- notified_at is set when the watch fires and cleared when the price goes back above it
+CREATE TABLE IF NOT EXISTS public.wishlist_items (
+    user_id integer NOT NULL REFERENCES public.users(user_id) ON UPDATE CASCADE ON DELETE CASCADE,
+    item_id integer NOT NULL REFERENCES public.items(item_id) ON UPDATE CASCADE ON DELETE CASCADE,
+    target_price numeric(10,2) CHECK (target_price >= 0),
+    notified_at timestamp with time zone,
+    added_at timestamp with time zone DEFAULT now() NOT NULL,
+    PRIMARY KEY (user_id, item_id)
+);
+
+CREATE INDEX IF NOT EXISTS wishlist_items_watches_idx ON public.wishlist_items (item_id) WHERE target_price IS NOT NULL;
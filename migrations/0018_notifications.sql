@@ -0,0 +1,37 @@
+-- Where users are notified and which channels they want for each kind of notification.
+-- Without a preference row a channel is on once the user has an address for it
+CREATE TABLE IF NOT EXISTS public.notification_settings (
+    user_id integer PRIMARY KEY REFERENCES public.users(user_id) ON UPDATE CASCADE ON DELETE CASCADE,
+    email text,
+    webhook_url text
+);
+
+CREATE TABLE IF NOT EXISTS public.notification_preferences (
+    user_id integer NOT NULL REFERENCES public.users(user_id) ON UPDATE CASCADE ON DELETE CASCADE,
+    kind text NOT NULL,
+    channel text NOT NULL CHECK (channel IN ('in_app', 'email', 'webhook')),
+    enabled boolean NOT NULL,
+    PRIMARY KEY (user_id, kind, channel)
+);
+
+-- Notifications are written here in the same transaction as the change they are about and
+-- delivered by the worker. In-app notifications are sent as soon as they are stored
+CREATE TABLE IF NOT EXISTS public.notification_outbox (
+    notification_id serial PRIMARY KEY,
+    user_id integer NOT NULL REFERENCES public.users(user_id) ON UPDATE CASCADE ON DELETE CASCADE,
+    kind text NOT NULL,
+    channel text NOT NULL CHECK (channel IN ('in_app', 'email', 'webhook')),
+    address text DEFAULT '' NOT NULL,
+    subject text NOT NULL,
+    body text NOT NULL,
+    status text DEFAULT 'pending' NOT NULL CHECK (status IN ('pending', 'sent', 'failed')),
+    attempts integer DEFAULT 0 NOT NULL,
+    last_error text DEFAULT '' NOT NULL,
+    next_attempt_at timestamp with time zone DEFAULT now() NOT NULL,
+    created_at timestamp with time zone DEFAULT now() NOT NULL,
+    sent_at timestamp with time zone,
+    read_at timestamp with time zone
+);
+
+CREATE INDEX IF NOT EXISTS notification_outbox_pending_idx ON public.notification_outbox (next_attempt_at) WHERE status = 'pending';
+CREATE INDEX IF NOT EXISTS notification_outbox_in_app_idx ON public.notification_outbox (user_id, notification_id) WHERE channel = 'in_app';
@@ -0,0 +1,39 @@
+-- Endpoints receiving marketplace events, those without a user belong to integrations and
+-- receive the events about every user
+CREATE TABLE IF NOT EXISTS public.webhook_endpoints (
+    endpoint_id serial PRIMARY KEY,
+    user_id integer REFERENCES public.users(user_id) ON UPDATE CASCADE ON DELETE CASCADE,
+    url text NOT NULL,
+    secret text NOT NULL,
+    events text[] NOT NULL,
+    created_at timestamp with time zone DEFAULT now() NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS webhook_endpoints_user_id_idx ON public.webhook_endpoints (user_id);
+
+-- Events are written in the same transaction as the change they are about, along with a
+-- delivery to each endpoint subscribed at the time. user_id is who the event is about, NULL
+-- if no one, and is kept if the user is deleted since the event still happened
+CREATE TABLE IF NOT EXISTS public.webhook_events (
+    event_id serial PRIMARY KEY,
+    type text NOT NULL,
+    user_id integer,
+    data jsonb NOT NULL,
+    created_at timestamp with time zone DEFAULT now() NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS public.webhook_deliveries (
+    delivery_id serial PRIMARY KEY,
+    event_id integer NOT NULL REFERENCES public.webhook_events(event_id) ON DELETE CASCADE,
+    endpoint_id integer NOT NULL REFERENCES public.webhook_endpoints(endpoint_id) ON DELETE CASCADE,
+    status text DEFAULT 'pending' NOT NULL CHECK (status IN ('pending', 'delivered', 'failed')),
+    attempts integer DEFAULT 0 NOT NULL,
+    response_status integer,
+    last_error text DEFAULT '' NOT NULL,
+    next_attempt_at timestamp with time zone DEFAULT now() NOT NULL,
+    created_at timestamp with time zone DEFAULT now() NOT NULL,
+    delivered_at timestamp with time zone
+);
+
+CREATE INDEX IF NOT EXISTS webhook_deliveries_pending_idx ON public.webhook_deliveries (next_attempt_at) WHERE status = 'pending';
+CREATE INDEX IF NOT EXISTS webhook_deliveries_endpoint_id_idx ON public.webhook_deliveries (endpoint_id, delivery_id);
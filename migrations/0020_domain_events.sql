@@ -0,0 +1,24 @@
+-- Domain events are written here in the same transaction as the change they are about and
+-- handed to each subscriber by the dispatcher. user_id is kept if the user is deleted since
+-- the event still happened
+CREATE TABLE IF NOT EXISTS public.domain_events (
+    event_id serial PRIMARY KEY,
+    type text NOT NULL,
+    user_id integer,
+    data jsonb NOT NULL,
+    created_at timestamp with time zone DEFAULT now() NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS domain_events_type_idx ON public.domain_events (type, event_id);
+
+-- What each subscriber has done with each event it was given, events without a row are
+-- still to be handed to it
+CREATE TABLE IF NOT EXISTS public.domain_event_receipts (
+    subscriber text NOT NULL,
+    event_id integer NOT NULL REFERENCES public.domain_events(event_id) ON DELETE CASCADE,
+    attempts integer DEFAULT 0 NOT NULL,
+    last_error text DEFAULT '' NOT NULL,
+    next_attempt_at timestamp with time zone DEFAULT now() NOT NULL,
+    handled_at timestamp with time zone,
+    PRIMARY KEY (subscriber, event_id)
+);
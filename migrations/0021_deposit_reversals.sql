@@ -0,0 +1,5 @@
+-- Deposits refunded by the payment provider after succeeding are taken back out of the wallet
+ALTER TABLE public.ledger_entries DROP CONSTRAINT IF EXISTS ledger_entries_kind_check;
+ALTER TABLE public.ledger_entries ADD CONSTRAINT ledger_entries_kind_check
+    CHECK (kind IN ('opening', 'adjustment', 'deposit', 'deposit_reversal', 'purchase', 'refund', 'sale', 'sale_reversal',
+                    'withdrawal', 'withdrawal_reversal', 'transfer_out', 'transfer_in', 'gift_card'));
@@ -0,0 +1,18 @@
+-- Notifications and webhooks are enqueued by subscribers to domain events, which may be
+-- given an event again, so what each event enqueued is recorded and not added twice. Rows
+-- from before have none
+ALTER TABLE public.notification_outbox ADD COLUMN IF NOT EXISTS domain_event_id integer
+    REFERENCES public.domain_events(event_id) ON DELETE SET NULL;
+CREATE UNIQUE INDEX IF NOT EXISTS notification_outbox_domain_event_idx
+    ON public.notification_outbox (domain_event_id, user_id, kind, channel);
+
+ALTER TABLE public.webhook_events ADD COLUMN IF NOT EXISTS domain_event_id integer
+    REFERENCES public.domain_events(event_id) ON DELETE SET NULL;
+CREATE UNIQUE INDEX IF NOT EXISTS webhook_events_domain_event_idx
+    ON public.webhook_events (domain_event_id, COALESCE(user_id, 0));
+
+-- Events recorded before the subscribers existed were notified and sent when they happened
+INSERT INTO public.domain_event_receipts (subscriber, event_id, attempts, handled_at)
+SELECT subscribers.name, domain_events.event_id, 0, NOW()
+FROM public.domain_events, (VALUES ('notifications'), ('webhooks')) AS subscribers (name)
+ON CONFLICT DO NOTHING;
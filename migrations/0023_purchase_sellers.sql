@@ -0,0 +1,10 @@
+-- Who sold each purchase when it was made, so disputes are settled with the seller that
+-- was paid even if the item gets another seller later. Earlier purchases take the item's
+-- seller where the order put money in escrow for them
+ALTER TABLE public.purchases
+    ADD COLUMN IF NOT EXISTS seller_id integer REFERENCES public.users(user_id) ON UPDATE CASCADE ON DELETE SET NULL;
+
+UPDATE public.purchases SET seller_id=items.seller_id
+FROM public.items
+WHERE purchases.item_id=items.item_id AND purchases.seller_id IS NULL
+AND EXISTS (SELECT 1 FROM public.escrows WHERE escrows.order_id=purchases.order_id AND escrows.seller_id=items.seller_id);
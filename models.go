@@ -2,34 +2,52 @@ package main
 
 import (
 	"database/sql"
+	"database/sql/driver"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"os"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
+
+	"github.com/lib/pq"
 )
 
 var ErrInsufficientFunds error = errors.New("insufficient funds")
+var ErrOutOfStock error = errors.New("out of stock")
+var ErrVariantRequired error = errors.New("item has variants, one must be chosen")
 var ErrNoURL error = errors.New("need to set PG_URL env var")
+var ErrInvalidCursor error = errors.New("invalid cursor")
+var ErrUnknownSeller error = errors.New("unknown seller")
 
 const TokenLength = 32
 
 type UserPurchase struct {
+	purchaseId  int
 	username    string
 	itemName    string
-	itemPrice   int
+	variantSku  string // empty if the item has no variants
+	itemPrice   int    // price paid
+	listPrice   int
+	discount    int
+	currency    Currency // currency paid in
 	purchasedAt time.Time
 }
 
 func (u UserPurchase) String() string {
-	return fmt.Sprintf("username: %v, item: %v, price: %v, time: %v", u.username, u.itemName, convertMoneyPrintable(u.itemPrice), u.purchasedAt.String())
+	return fmt.Sprintf("purchase: %v, username: %v, item: %v, sku: %v, price: %v, list price: %v, discount: %v, time: %v", u.purchaseId, u.username, u.itemName, u.variantSku,
+		Money{u.itemPrice, u.currency}, Money{u.listPrice, u.currency}, Money{u.discount, u.currency}, u.purchasedAt.String())
 }
 
 type User struct {
 	userId       int
 	username     string
 	passwordHash string
-	balance      int
+	isAdmin      bool
 	lastLogin    time.Time
 	createdAt    time.Time
 }
@@ -47,41 +65,315 @@ type Item struct {
 	name        string
 	description string
 	price       int
+	currency    Currency
+	sellerId    int // 0 if the item has no seller
+	categoryIds []int64
+	attributes  Attributes
+	reviewCount int // visible reviews
+	ratingTotal int // sum of the visible reviews' ratings
 }
 
 func (i Item) String() string {
-	return fmt.Sprintf("id: %v, name: %v, description: %v, price: %v", i.itemId, i.name, i.description, convertMoneyPrintable(i.price))
+	return fmt.Sprintf("id: %v, name: %v, description: %v, price: %v, seller: %v, categories: %v, attributes: %v, rating: %v, reviews: %v",
+		i.itemId, i.name, i.description, Money{i.price, i.currency}, i.sellerId, i.categoryIds, i.attributes,
+		formatRating(i.ratingTotal, i.reviewCount), i.reviewCount)
+}
+
+// Attributes are typed key/value pairs stored as a JSONB object
+type Attributes map[string]any
+
+func (a Attributes) Value() (driver.Value, error) {
+	if a == nil {
+		return "{}", nil
+	}
+	bytes, err := json.Marshal(a)
+	return string(bytes), err
+}
+
+func (a *Attributes) Scan(src any) error {
+	switch src := src.(type) {
+	case []byte:
+		return json.Unmarshal(src, a)
+	case string:
+		return json.Unmarshal([]byte(src), a)
+	case nil:
+		*a = nil
+		return nil
+	}
+	return fmt.Errorf("cannot scan %T into Attributes", src)
+}
+
+// ItemVariant is a purchasable version of an item, its attributes override the item's
+type ItemVariant struct {
+	variantId  int
+	itemId     int
+	sku        string
+	price      int
+	currency   Currency // the item's currency
+	stock      int
+	attributes Attributes
+}
+
+func (v ItemVariant) String() string {
+	return fmt.Sprintf("variant: %v, sku: %v, price: %v, stock: %v, attributes: %v", v.variantId, v.sku, Money{v.price, v.currency}, v.stock, v.attributes)
+}
+
+type ItemImage struct {
+	imageId     int
+	itemId      int
+	blobKey     string
+	thumbKey    string
+	contentType string
+	width       int
+	height      int
+	createdAt   time.Time
+}
+
+type Category struct {
+	categoryId int
+	parentId   int // 0 for top level categories
+	name       string
+}
+
+type CategoryNode struct {
+	category Category
+	children []*CategoryNode
+}
+
+// buildCategoryTree arranges categories under their parents, keeping the given order
+// among siblings. Categories with a missing parent are treated as top level, as is the
+// last category of a parent cycle so the categories in it aren't dropped from the tree
+func buildCategoryTree(categories []Category) []*CategoryNode {
+	nodes := make(map[int]*CategoryNode, len(categories))
+	for _, category := range categories {
+		nodes[category.categoryId] = &CategoryNode{category: category}
+	}
+
+	// Parents each category has been attached to so far, always a forest
+	attached := make(map[int]int, len(categories))
+	createsCycle := func(categoryId int, parentId int) bool {
+		for ancestor, ok := parentId, true; ok; ancestor, ok = attached[ancestor] {
+			if ancestor == categoryId {
+				return true
+			}
+		}
+		return false
+	}
+
+	var roots []*CategoryNode
+	for _, category := range categories {
+		node := nodes[category.categoryId]
+		if parent, ok := nodes[category.parentId]; ok && !createsCycle(category.categoryId, category.parentId) {
+			parent.children = append(parent.children, node)
+			attached[category.categoryId] = category.parentId
+		} else {
+			roots = append(roots, node)
+		}
+	}
+	return roots
+}
+
+// Write prints the subtree rooted at node, indenting children under their parent
+func (c *CategoryNode) Write(w io.Writer, depth int) {
+	fmt.Fprintf(w, "%vid: %v, name: %v\n", strings.Repeat("  ", depth), c.category.categoryId, c.category.name)
+	for _, child := range c.children {
+		child.Write(w, depth+1)
+	}
+}
+
+type ItemSort string
+
+// Items have no creation time, SortNewest orders by item_id which the items_item_id_seq
+// sequence assigns in insertion order
+const (
+	SortNewest    ItemSort = "newest"
+	SortPriceAsc  ItemSort = "price_asc"
+	SortPriceDesc ItemSort = "price_desc"
+	SortName      ItemSort = "name"
+)
+
+const (
+	DefaultItemsLimit = 20
+	MaxItemsLimit     = 100
+)
+
+// ItemQuery selects a page of items. Prices are in the internal integer representation,
+// a negative bound means no bound. A category matches items in it or any of its descendants
+type ItemQuery struct {
+	cursor     string
+	limit      int
+	minPrice   int
+	maxPrice   int
+	name       string
+	categoryId int        // 0 for any category
+	attributes Attributes // items or any of their variants must have all of these
+	sort       ItemSort
+}
+
+type ItemPage struct {
+	items      []Item
+	nextCursor string // empty on the last page
+}
+
+// itemCursor is the keyset position of the last item on a page, only the key
+// matching sort is used
+type itemCursor struct {
+	Sort   ItemSort `json:"s"`
+	ItemId int      `json:"i"`
+	Price  int      `json:"p,omitempty"`
+	Name   string   `json:"n,omitempty"`
+}
+
+func encodeItemCursor(sort ItemSort, item Item) string {
+	cursor := itemCursor{Sort: sort, ItemId: item.itemId}
+	switch sort {
+	case SortPriceAsc, SortPriceDesc:
+		cursor.Price = item.price
+	case SortName:
+		cursor.Name = item.name
+	}
+	bytes, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(bytes)
+}
+
+func decodeItemCursor(sort ItemSort, encoded string) (itemCursor, error) {
+	var cursor itemCursor
+	bytes, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return cursor, ErrInvalidCursor
+	}
+	if err := json.Unmarshal(bytes, &cursor); err != nil || cursor.Sort != sort {
+		return cursor, ErrInvalidCursor
+	}
+	// Cursors come from clients, a price no item can have would overflow the query
+	if cursor.Price < 0 || cursor.Price > MaxAmount {
+		return cursor, ErrInvalidCursor
+	}
+	return cursor, nil
+}
+
+type ItemSearchResult struct {
+	item    Item
+	rank    float64
+	snippet string
+}
+
+func (i ItemSearchResult) String() string {
+	return fmt.Sprintf("%v, rank: %.4f, snippet: %v", i.item, i.rank, i.snippet)
 }
 
 type Purchase struct {
 	purchaseId  int
 	userId      int
 	itemId      int
+	variantId   int // 0 if the item has no variants
+	listPrice   int
+	discount    int // share of the order discount
+	price       int // price paid
+	currency    Currency
 	purchasedAt time.Time
+	orderId     int
+	sellerId    int // who sold the item at the time, 0 if the marketplace did
 }
 
 type DB interface {
-	Items() ([]Item, error)
+	Items(query ItemQuery) (ItemPage, error)
+	Categories() ([]Category, error)
+	SearchItems(query string, limit int) ([]ItemSearchResult, error)
+	ItemVariants(itemId int) ([]ItemVariant, error)
+	SchedulePriceChange(change ItemPrice) (int, error)
+	ItemPrices(itemId int, includeScheduled bool) ([]ItemPrice, error)
+	ApplyPriceChanges(now time.Time) (int, []PriceAlert, time.Time, error)
+	AddItemImage(image ItemImage) (ItemImage, error)
+	ItemImages(itemId int) ([]ItemImage, error)
+	DeleteItemImage(itemId int, imageId int) (ItemImage, error)
 	Purchases(userId int) ([]UserPurchase, error)
 	GetUserFromUsername(username string) (User, error)
+	IsAdmin(userId int) (bool, error)
 	GetItem(itemId int) (Item, error)
+	SetItemSeller(itemId int, sellerUsername string) (Item, error)
 	Register(username, passwordHash string) (User, error)
 	CreateSession(user User, ipAddr string) (Session, error)
 	GetSession(sessionId string) (Session, error)
 	UpdateLastLogin(userId int)
-	Balance(userId int) (int, error)
-	Deposit(userId int, amount int) (int, error)
-	Purchase(userId int, itemId int) error
+	Balances(userId int) ([]Money, error)
+	Balance(userId int, currency Currency) (Money, error)
+	CreateDeposit(userId int, intent PaymentIntent) (Deposit, error)
+	GetDeposit(userId int, depositId int) (Deposit, error)
+	SettleDeposit(intentId string, to PaymentStatus) (Deposit, error)
+	Ledger(userId int) ([]LedgerEntry, error)
+	Transfer(userId int, toUsername string, amount Money, now time.Time) (Transfer, error)
+	Transfers(userId int) ([]Transfer, error)
+	IssueGiftCards(cards []GiftCard, adminId int) ([]GiftCard, error)
+	RedeemGiftCard(userId int, code string, amount int, now time.Time) (GiftCard, Money, error)
+	GiftCards(userId int) ([]GiftCard, error)
+	GiftCardLiability(now time.Time) ([]GiftCardLiability, error)
+	RequestWithdrawal(userId int, amount Money, now time.Time) (Withdrawal, error)
+	Withdrawals(userId int) ([]Withdrawal, error)
+	PendingWithdrawals() ([]Withdrawal, error)
+	GetWithdrawal(withdrawalId int) (Withdrawal, error)
+	TransitionWithdrawal(withdrawalId int, to WithdrawalStatus, payoutId string, reviewerId int) (Withdrawal, error)
+	Purchase(userId int, itemId int, variantId int, couponCode string, currency Currency) (int, error)
+	Cart(userId int) ([]CartLine, error)
+	AddToCart(userId int, itemId int, variantId int, quantity int) error
+	UpdateCartLine(userId int, lineId int, quantity int) error
+	RemoveCartLine(userId int, lineId int) error
+	Checkout(userId int, couponCode string, currency Currency) (int, int, error)
+	Orders(userId int) ([]Order, error)
+	GetOrder(userId int, orderId int) (Order, error)
+	TransitionOrder(orderId int, to OrderStatus) error
+	ConfirmReceipt(userId int, orderId int, now time.Time) ([]Escrow, error)
+	ReleaseDueEscrows(now time.Time) (int, error)
+	Escrows(sellerId int) ([]Escrow, error)
+	OpenDispute(userId int, purchaseId int, reason string, now time.Time) (Dispute, error)
+	GetDispute(disputeId int) (Dispute, error)
+	Disputes(userId int) ([]Dispute, error)
+	ActiveDisputes() ([]Dispute, error)
+	DisputeMessages(disputeId int) ([]DisputeMessage, error)
+	AddDisputeMessage(disputeId int, authorId int, body string) (DisputeMessage, error)
+	TransitionDispute(disputeId int, to DisputeStatus, refund int, reviewerId int) (Dispute, error)
+	GetReview(reviewId int) (Review, error)
+	AddReview(userId int, itemId int, rating int, body string) (Review, error)
+	UpdateReview(userId int, itemId int, rating int, body string) (Review, error)
+	DeleteReview(userId int, itemId int) error
+	ItemReviews(itemId int) ([]Review, error)
+	ReplyToReview(reviewId int, reply string) (Review, error)
+	FlagReview(userId int, reviewId int, reason string) error
+	FlaggedReviews() ([]Review, error)
+	ModerateReview(reviewId int, hidden bool) (Review, error)
+	Wishlist(userId int) ([]WishlistEntry, error)
+	SaveToWishlist(userId int, itemId int, target int) error
+	RemoveFromWishlist(userId int, itemId int) error
+	NotificationSettings(userId int) (NotificationSettings, error)
+	UpdateNotificationContacts(userId int, email string, webhookURL string) error
+	SetNotificationPreference(userId int, preference NotificationPreference) error
+	InAppNotifications(userId int) ([]Notification, error)
+	MarkNotificationRead(userId int, notificationId int, now time.Time) error
+	ClaimNotifications(now time.Time, limit int) ([]Notification, error)
+	FinishNotification(notificationId int, status NotificationStatus, lastError string, at time.Time) error
+	EnqueueNotifications(eventId int, notifications []EventNotification) error
+	AddWebhookEndpoint(endpoint WebhookEndpoint) (WebhookEndpoint, error)
+	WebhookEndpoints(userId int) ([]WebhookEndpoint, error)
+	GetWebhookEndpoint(endpointId int) (WebhookEndpoint, error)
+	DeleteWebhookEndpoint(endpointId int) error
+	WebhookDeliveries(endpointId int) ([]WebhookDelivery, error)
+	RedeliverWebhook(endpointId int, deliveryId int) (WebhookDelivery, error)
+	ClaimWebhookDeliveries(now time.Time, limit int) ([]WebhookDelivery, error)
+	FinishWebhookDelivery(deliveryId int, status DeliveryStatus, responseStatus int, lastError string, at time.Time) error
+	EnqueueWebhookEvents(eventId int, eventType EventType, webhooks []EventWebhook) error
+	PendingEvents(subscriber string, types []EventType, now time.Time, limit int) ([]DomainEvent, error)
+	FinishEvent(subscriber string, eventId int, lastError string, at time.Time) error
 	Close() error
 }
 
 type SqlDB struct {
-	db   *sql.DB
-	wg   sync.WaitGroup
-	done chan struct{}
+	db    *sql.DB
+	rates RateProvider // converts prices to the currency paid in
+	wg    sync.WaitGroup
+	done  chan struct{}
 }
 
-func NewSqlDB() (*SqlDB, error) {
+func NewSqlDB(rates RateProvider) (*SqlDB, error) {
 	dsn := os.Getenv("PG_URL")
 	if len(dsn) == 0 {
 		return nil, ErrNoURL
@@ -94,8 +386,9 @@ func NewSqlDB() (*SqlDB, error) {
 	}
 
 	sqlDb := SqlDB{
-		db:   db,
-		done: make(chan struct{}),
+		db:    db,
+		rates: rates,
+		done:  make(chan struct{}),
 	}
 
 	// Database cleanup operation on seperate goroutine - possibly move this up to env for logging purposes
@@ -120,32 +413,237 @@ func (s *SqlDB) Close() error {
 	return nil
 }
 
-func (s *SqlDB) Items() ([]Item, error) {
-	query := `SELECT item_id, name, description, CAST(price*100 AS INT) FROM items`
+func (s *SqlDB) Items(itemQuery ItemQuery) (ItemPage, error) {
+	var where []string
+	var args []any
+	arg := func(value any) string {
+		args = append(args, value)
+		return "$" + strconv.Itoa(len(args))
+	}
+
+	// Filters, prices are cast to a wide integer before dividing since up to MaxAmount
+	// minor units wouldn't fit numeric(10, 2) undivided
+	if itemQuery.minPrice >= 0 {
+		where = append(where, "price>=CAST("+arg(itemQuery.minPrice)+" AS NUMERIC(12, 0))/100")
+	}
+	if itemQuery.maxPrice >= 0 {
+		where = append(where, "price<=CAST("+arg(itemQuery.maxPrice)+" AS NUMERIC(12, 0))/100")
+	}
+	if len(itemQuery.name) != 0 {
+		where = append(where, `name ILIKE '%' || `+arg(escapeLike(itemQuery.name))+` || '%'`)
+	}
+	if len(itemQuery.attributes) != 0 {
+		attributes := arg(itemQuery.attributes)
+		where = append(where, `(items.attributes @> `+attributes+` OR EXISTS (
+				SELECT 1 FROM item_variants
+				WHERE item_variants.item_id=items.item_id AND (items.attributes || item_variants.attributes) @> `+attributes+`
+			  ))`)
+	}
+	if itemQuery.categoryId != 0 {
+		where = append(where, `item_id IN (
+				WITH RECURSIVE subtree AS (
+					SELECT category_id FROM categories WHERE category_id=`+arg(itemQuery.categoryId)+`
+					UNION
+					SELECT categories.category_id FROM categories JOIN subtree ON categories.parent_id=subtree.category_id
+				)
+				SELECT item_id FROM item_categories JOIN subtree ON item_categories.category_id=subtree.category_id
+			  )`)
+	}
+
+	// Keyset pagination, item_id breaks ties so the order is total
+	var orderBy string
+	var cursor itemCursor
+	hasCursor := len(itemQuery.cursor) != 0
+	if hasCursor {
+		var err error
+		if cursor, err = decodeItemCursor(itemQuery.sort, itemQuery.cursor); err != nil {
+			return ItemPage{}, err
+		}
+	}
+	switch itemQuery.sort {
+	case SortPriceAsc:
+		orderBy = "price ASC, item_id ASC"
+		if hasCursor {
+			where = append(where, "(price, item_id)>(CAST("+arg(cursor.Price)+" AS NUMERIC(12, 0))/100, "+arg(cursor.ItemId)+")")
+		}
+	case SortPriceDesc:
+		orderBy = "price DESC, item_id DESC"
+		if hasCursor {
+			where = append(where, "(price, item_id)<(CAST("+arg(cursor.Price)+" AS NUMERIC(12, 0))/100, "+arg(cursor.ItemId)+")")
+		}
+	case SortName:
+		orderBy = "name ASC, item_id ASC"
+		if hasCursor {
+			where = append(where, "(name, item_id)>("+arg(cursor.Name)+", "+arg(cursor.ItemId)+")")
+		}
+	default:
+		orderBy = "item_id DESC"
+		if hasCursor {
+			where = append(where, "item_id<"+arg(cursor.ItemId))
+		}
+	}
+
+	query := `SELECT ` + itemColumns + ` FROM items`
+	if len(where) != 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	// Fetch one extra row to know if there is a next page
+	query += " ORDER BY " + orderBy + " LIMIT " + arg(itemQuery.limit+1)
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return ItemPage{}, err
+	}
+	defer rows.Close()
+
+	var page ItemPage
+	var item Item
+
+	for rows.Next() {
+		err := rows.Scan(itemFields(&item)...)
+		if err != nil {
+			return ItemPage{}, err
+		}
+		page.items = append(page.items, item)
+	}
+	if err := rows.Err(); err != nil {
+		return ItemPage{}, err
+	}
+
+	if len(page.items) > itemQuery.limit {
+		page.items = page.items[:itemQuery.limit]
+		page.nextCursor = encodeItemCursor(itemQuery.sort, page.items[len(page.items)-1])
+	}
+	return page, nil
+}
+
+func (s *SqlDB) Categories() ([]Category, error) {
+	query := `SELECT category_id, COALESCE(parent_id, 0), name FROM categories ORDER BY name, category_id`
 	rows, err := s.db.Query(query)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
-	var items []Item
-	var item Item
+	var categories []Category
+	var category Category
 
 	for rows.Next() {
-		err := rows.Scan(&item.itemId, &item.name, &item.description, &item.price)
+		err := rows.Scan(&category.categoryId, &category.parentId, &category.name)
 		if err != nil {
 			return nil, err
 		}
-		items = append(items, item)
+		categories = append(categories, category)
 	}
 
-	return items, nil
+	return categories, rows.Err()
+}
+
+func (s *SqlDB) SearchItems(searchQuery string, limit int) ([]ItemSearchResult, error) {
+	query := `SELECT ` + itemColumns + `,
+			  ts_rank(search, q) AS rank,
+			  ts_headline('english', name || ' - ' || coalesce(description, ''), q, 'MaxFragments=2')
+			  FROM items, websearch_to_tsquery('english', $1) q
+			  WHERE search @@ q
+			  ORDER BY rank DESC, item_id ASC
+			  LIMIT $2`
+
+	rows, err := s.db.Query(query, searchQuery, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []ItemSearchResult
+	var result ItemSearchResult
+
+	for rows.Next() {
+		err := rows.Scan(append(itemFields(&result.item), &result.rank, &result.snippet)...)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, result)
+	}
+
+	return results, rows.Err()
+}
+
+func (s *SqlDB) ItemVariants(itemId int) ([]ItemVariant, error) {
+	query := `SELECT item_variants.variant_id, item_variants.item_id, item_variants.sku, CAST(item_variants.price*100 AS BIGINT), items.currency,
+			  item_variants.stock, item_variants.attributes
+			  FROM item_variants JOIN items ON item_variants.item_id=items.item_id
+			  WHERE item_variants.item_id=$1 ORDER BY item_variants.variant_id`
+	rows, err := s.db.Query(query, itemId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var variants []ItemVariant
+	var variant ItemVariant
+
+	for rows.Next() {
+		err := rows.Scan(&variant.variantId, &variant.itemId, &variant.sku, &variant.price, &variant.currency, &variant.stock, &variant.attributes)
+		if err != nil {
+			return nil, err
+		}
+		variants = append(variants, variant)
+	}
+
+	return variants, rows.Err()
+}
+
+const itemImageColumns = `image_id, item_id, blob_key, thumb_key, content_type, width, height, created_at`
+
+func itemImageFields(image *ItemImage) []any {
+	return []any{&image.imageId, &image.itemId, &image.blobKey, &image.thumbKey, &image.contentType, &image.width, &image.height, &image.createdAt}
+}
+
+func (s *SqlDB) AddItemImage(image ItemImage) (ItemImage, error) {
+	query := `INSERT INTO item_images (item_id, blob_key, thumb_key, content_type, width, height)
+			  VALUES ($1, $2, $3, $4, $5, $6)
+			  RETURNING ` + itemImageColumns
+	row := s.db.QueryRow(query, image.itemId, image.blobKey, image.thumbKey, image.contentType, image.width, image.height)
+	err := row.Scan(itemImageFields(&image)...)
+	return image, err
+}
+
+func (s *SqlDB) ItemImages(itemId int) ([]ItemImage, error) {
+	query := `SELECT ` + itemImageColumns + ` FROM item_images WHERE item_id=$1 ORDER BY image_id`
+	rows, err := s.db.Query(query, itemId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var images []ItemImage
+	var image ItemImage
+
+	for rows.Next() {
+		if err := rows.Scan(itemImageFields(&image)...); err != nil {
+			return nil, err
+		}
+		images = append(images, image)
+	}
+
+	return images, rows.Err()
+}
+
+func (s *SqlDB) DeleteItemImage(itemId int, imageId int) (ItemImage, error) {
+	var image ItemImage
+	query := `DELETE FROM item_images WHERE item_id=$1 AND image_id=$2 RETURNING ` + itemImageColumns
+	row := s.db.QueryRow(query, itemId, imageId)
+	err := row.Scan(itemImageFields(&image)...)
+	return image, err
 }
 
 func (s *SqlDB) Purchases(userId int) ([]UserPurchase, error) {
-	query := `SELECT users.username, items.name, CAST(purchases.price*100 AS INT), purchases.purchased_at
+	query := `SELECT purchases.purchase_id, users.username, items.name, COALESCE(item_variants.sku, ''), CAST(purchases.price*100 AS BIGINT),
+			  CAST(purchases.list_price*100 AS BIGINT), CAST(purchases.discount*100 AS BIGINT), purchases.currency, purchases.purchased_at
 			  FROM users
 			  JOIN purchases ON users.user_id=purchases.user_id
 			  JOIN items ON purchases.item_id=items.item_id
+			  LEFT JOIN item_variants ON purchases.variant_id=item_variants.variant_id
 			  WHERE users.user_id=$1`
 
 	rows, err := s.db.Query(query, userId)
@@ -157,7 +655,7 @@ func (s *SqlDB) Purchases(userId int) ([]UserPurchase, error) {
 	var purchase UserPurchase // declare here so we dont allocate each time
 
 	for rows.Next() {
-		err := rows.Scan(&purchase.username, &purchase.itemName, &purchase.itemPrice, &purchase.purchasedAt)
+		err := rows.Scan(&purchase.purchaseId, &purchase.username, &purchase.itemName, &purchase.variantSku, &purchase.itemPrice, &purchase.listPrice, &purchase.discount, &purchase.currency, &purchase.purchasedAt)
 		if err != nil {
 			return nil, err
 		}
@@ -169,13 +667,27 @@ func (s *SqlDB) Purchases(userId int) ([]UserPurchase, error) {
 
 func scanUser(row *sql.Row) (User, error) {
 	var user User
-	err := row.Scan(&user.userId, &user.username, &user.passwordHash, &user.balance, &user.lastLogin, &user.createdAt)
+	err := row.Scan(&user.userId, &user.username, &user.passwordHash, &user.isAdmin, &user.lastLogin, &user.createdAt)
 	return user, err
 }
 
+// itemColumns are the columns scanned by itemFields, category ids and ratings are aggregated
+// in correlated subqueries so they are an empty array and zeros for uncategorised and
+// unreviewed items
+const itemColumns = `items.item_id, items.name, items.description, CAST(items.price*100 AS BIGINT), items.currency, COALESCE(items.seller_id, 0),
+			  ARRAY(SELECT category_id FROM item_categories WHERE item_categories.item_id=items.item_id ORDER BY category_id),
+			  items.attributes,
+			  (SELECT COUNT(*) FROM reviews WHERE reviews.item_id=items.item_id AND NOT reviews.hidden),
+			  (SELECT COALESCE(SUM(rating), 0) FROM reviews WHERE reviews.item_id=items.item_id AND NOT reviews.hidden)`
+
+func itemFields(item *Item) []any {
+	return []any{&item.itemId, &item.name, &item.description, &item.price, &item.currency, &item.sellerId, (*pq.Int64Array)(&item.categoryIds), &item.attributes,
+		&item.reviewCount, &item.ratingTotal}
+}
+
 func scanItem(row *sql.Row) (Item, error) {
 	var item Item
-	err := row.Scan(&item.itemId, &item.name, &item.description, &item.price)
+	err := row.Scan(itemFields(&item)...)
 	return item, err
 }
 
@@ -215,31 +727,74 @@ func (s *SqlDB) CreateSession(user User, ipAddr string) (Session, error) {
 }
 
 func (s *SqlDB) GetUserFromUsername(username string) (User, error) {
-	query := `SELECT user_id, username, password_hash, CAST(balance*100 AS INT), last_login, created_at FROM users WHERE username=$1`
+	query := `SELECT user_id, username, password_hash, is_admin, last_login, created_at FROM users WHERE username=$1`
 	row := s.db.QueryRow(query, username)
 	return scanUser(row)
 }
 
+func (s *SqlDB) IsAdmin(userId int) (bool, error) {
+	var isAdmin bool
+	err := s.db.QueryRow(`SELECT is_admin FROM users WHERE user_id=$1`, userId).Scan(&isAdmin)
+	return isAdmin, err
+}
+
 func (s *SqlDB) GetItem(itemId int) (Item, error) {
-	query := `SELECT item_id, name, description, CAST(price*100 AS INT) FROM items WHERE item_id=$1`
+	query := `SELECT ` + itemColumns + ` FROM items WHERE item_id=$1`
 	row := s.db.QueryRow(query, itemId)
 	return scanItem(row)
 }
 
+// SetItemSeller lists the item under the user named sellerUsername, or under no seller
+// if it is empty
+func (s *SqlDB) SetItemSeller(itemId int, sellerUsername string) (Item, error) {
+	sellerId := 0
+	if len(sellerUsername) != 0 {
+		err := s.db.QueryRow(`SELECT user_id FROM users WHERE username=$1`, sellerUsername).Scan(&sellerId)
+		if err == sql.ErrNoRows {
+			return Item{}, ErrUnknownSeller
+		}
+		if err != nil {
+			return Item{}, err
+		}
+	}
+
+	query := `UPDATE items SET seller_id=NULLIF($1, 0) WHERE item_id=$2 RETURNING ` + itemColumns
+	return scanItem(s.db.QueryRow(query, sellerId, itemId))
+}
+
 func (s *SqlDB) GetSession(sessionId string) (Session, error) {
 	query := `SELECT * FROM sessions WHERE session_id=$1`
 	row := s.db.QueryRow(query, sessionId)
 	return scanSession(row)
 }
 
-func (s *SqlDB) Register(username, passwordHash string) (User, error) {
-	var user User
-	var err error
+// Register creates the user and welcomes them
+func (s *SqlDB) Register(username, passwordHash string) (user User, err error) {
+	var tx *sql.Tx
+	tx, err = s.db.Begin()
+	if err != nil {
+		return User{}, err
+	}
+
+	// Rollback or commit depending on err
+	defer func() {
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
 	query := `INSERT INTO users (username, password_hash)
 	 		  VALUES ($1, $2) 
-			  RETURNING user_id, username, password_hash, CAST(balance*100 AS INT), last_login, created_at`
-	row := s.db.QueryRow(query, username, passwordHash)
-	err = row.Scan(&user.userId, &user.username, &user.passwordHash, &user.balance, &user.lastLogin, &user.createdAt)
+			  RETURNING user_id, username, password_hash, last_login, created_at`
+	row := tx.QueryRow(query, username, passwordHash)
+	err = row.Scan(&user.userId, &user.username, &user.passwordHash, &user.lastLogin, &user.createdAt)
+	if err != nil {
+		return User{}, err
+	}
+	err = recordEvent(tx, EventUserRegistered, user.userId, userRegisteredEvent{user.userId, user.username})
 	return user, err
 }
 
@@ -253,27 +808,14 @@ func (s *SqlDB) RemoveExpiredSessions() (sql.Result, error) {
 	return s.db.Exec(query)
 }
 
-func (s *SqlDB) Balance(userId int) (int, error) {
-	var balance int
-	query := `SELECT CAST(users.balance*100 AS INT) FROM users WHERE user_id=$1`
-	row := s.db.QueryRow(query, userId)
-	err := row.Scan(&balance)
-	return balance, err
-}
-
-func (s *SqlDB) Deposit(userId int, amount int) (int, error) {
-	var balance int
-	query := `UPDATE users SET balance=balance+CAST($1 AS NUMERIC(10, 2))/100 WHERE users.user_id=$2 RETURNING CAST(users.balance*100 AS INT)`
-	row := s.db.QueryRow(query, amount, userId)
-	err := row.Scan(&balance)
-	return balance, err
-}
-
-func (s *SqlDB) Purchase(userId int, itemId int) (err error) {
+// Purchase buys one of an item, or of one of its variants if it has any, as a single line
+// order paid from the user's wallet in currency. couponCode is optional, when given the
+// coupon must apply or the purchase fails
+func (s *SqlDB) Purchase(userId int, itemId int, variantId int, couponCode string, currency Currency) (orderId int, err error) {
 	var tx *sql.Tx
 	tx, err = s.db.Begin()
 	if err != nil {
-		return err
+		return 0, err
 	}
 
 	// Rollback or commit depending on err
@@ -286,38 +828,57 @@ func (s *SqlDB) Purchase(userId int, itemId int) (err error) {
 		}
 	}()
 
-	// Get item price
-	var price int
-	getPriceQuery := `SELECT CAST(price*100 AS INT) FROM items WHERE items.item_id=$1 FOR UPDATE`
-	row := tx.QueryRow(getPriceQuery, itemId)
-	err = row.Scan(&price)
-	if err != nil {
-		return err
+	// Get item or variant price, variants are locked as their stock changes
+	var price Money
+	if variantId != 0 {
+		var stock int
+		getVariantQuery := `SELECT CAST(item_variants.price*100 AS BIGINT), items.currency, item_variants.stock
+							FROM item_variants JOIN items ON item_variants.item_id=items.item_id
+							WHERE item_variants.variant_id=$1 AND item_variants.item_id=$2 FOR UPDATE OF item_variants`
+		err = tx.QueryRow(getVariantQuery, variantId, itemId).Scan(&price.amount, &price.currency, &stock)
+		if err != nil {
+			return 0, err
+		}
+		if stock <= 0 {
+			return 0, ErrOutOfStock
+		}
+	} else {
+		getPriceQuery := `SELECT CAST(price*100 AS BIGINT), currency, EXISTS (SELECT 1 FROM item_variants WHERE item_variants.item_id=items.item_id)
+						  FROM items WHERE items.item_id=$1 FOR UPDATE`
+		var hasVariants bool
+		err = tx.QueryRow(getPriceQuery, itemId).Scan(&price.amount, &price.currency, &hasVariants)
+		if err != nil {
+			return 0, err
+		}
+		if hasVariants {
+			return 0, ErrVariantRequired
+		}
 	}
 
-	// Get user balance
-	var balance int
-	getBalanceQuery := `SELECT CAST(balance*100 AS INT) FROM users WHERE users.user_id=$1 FOR UPDATE`
-	row = tx.QueryRow(getBalanceQuery, userId)
-	err = row.Scan(&balance)
+	// Price in the currency paid with
+	price, err = convertMoney(price, currency, s.rates)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	// Check for sufficient funds
-	if balance < price {
-		return ErrInsufficientFunds
+	// Apply coupon
+	lines := []OrderLine{{itemId: itemId, variantId: variantId, quantity: 1, unitPrice: price.amount}}
+	var couponId int
+	if len(couponCode) != 0 {
+		couponId, err = applyCoupon(tx, couponCode, userId, lines, currency, s.rates)
+		if err != nil {
+			return 0, err
+		}
 	}
-
-	// Subtract price from balance
-	updateBalanceQuery := `UPDATE users SET balance=balance-CAST($1 AS NUMERIC(10,2))/100 WHERE users.user_id=$2`
-	_, err = tx.Exec(updateBalanceQuery, price, userId)
-	if err != nil {
-		return err
+	// Take variant from stock
+	if variantId != 0 {
+		updateStockQuery := `UPDATE item_variants SET stock=stock-1 WHERE variant_id=$1`
+		_, err = tx.Exec(updateStockQuery, variantId)
+		if err != nil {
+			return 0, err
+		}
 	}
 
-	// Create purchase
-	addPurchaseQuery := `INSERT INTO purchases (user_id, item_id, price) VALUES ($1, $2, CAST($3 AS NUMERIC(10, 2))/100)`
-	_, err = tx.Exec(addPurchaseQuery, userId, itemId, price)
-	return err
+	// Create order and purchase, paid from the wallet
+	return createOrder(tx, userId, OrderPaid, currency, lines, couponId)
 }
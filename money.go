@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strconv"
+	"strings"
+)
+
+var ErrUnknownCurrency error = errors.New("unknown currency")
+var ErrCurrencyMismatch error = errors.New("money in different currencies")
+var ErrNoExchangeRate error = errors.New("no exchange rate")
+var ErrInvalidAmount error = errors.New("invalid amount")
+var ErrAmountTooLarge error = errors.New("amount too large")
+var ErrBalanceTooLarge error = errors.New("balance would exceed the maximum")
+
+// MaxAmount is the largest amount a numeric(10, 2) column holds, in minor units. Queries
+// pass amounts in minor units cast to numeric(12, 0) before dividing by 100 and read them
+// back cast to bigint, both of which hold it
+const MaxAmount = 99999999_99
+
+// Currency is an ISO 4217 code
+type Currency string
+
+// DefaultCurrency is used when a request doesn't name one, and is the currency balances and
+// prices were in before wallets existed
+const DefaultCurrency Currency = "USD"
+
+// currencies lists the supported currencies. Amounts are stored as numeric(10, 2) so only
+// currencies with two minor digits are supported
+var currencies = map[Currency]bool{
+	"USD": true,
+	"EUR": true,
+	"GBP": true,
+	"CAD": true,
+	"AUD": true,
+	"CHF": true,
+}
+
+// parseCurrency parses an optional currency code, returning DefaultCurrency if value is empty
+func parseCurrency(value string) (Currency, error) {
+	if len(value) == 0 {
+		return DefaultCurrency, nil
+	}
+	currency := Currency(strings.ToUpper(value))
+	if !currencies[currency] {
+		return "", ErrUnknownCurrency
+	}
+	return currency, nil
+}
+
+// parseAmount parses a non-negative decimal amount with at most two fractional digits, like
+// "12", "12.3" or "12.34", into minor units. Signs, exponents, spaces and anything else
+// float parsing would accept are rejected
+func parseAmount(value string) (int, error) {
+	whole, fraction, hasPoint := strings.Cut(value, ".")
+	if len(whole) == 0 || (hasPoint && (len(fraction) == 0 || len(fraction) > 2)) {
+		return 0, ErrInvalidAmount
+	}
+	for _, digits := range []string{whole, fraction} {
+		for _, c := range digits {
+			if c < '0' || c > '9' {
+				return 0, ErrInvalidAmount
+			}
+		}
+	}
+
+	// Whole part has at most 8 significant digits, so this can't overflow
+	whole = strings.TrimLeft(whole, "0")
+	if len(whole) > 8 {
+		return 0, ErrAmountTooLarge
+	}
+	amount := 0
+	for _, c := range whole + (fraction + "00")[:2] {
+		amount = amount*10 + int(c-'0')
+	}
+	return amount, nil
+}
+
+// ParseMoney parses an amount in currency, see parseAmount
+func ParseMoney(value string, currency Currency) (Money, error) {
+	amount, err := parseAmount(value)
+	return Money{amount, currency}, err
+}
+
+// Money is an exact amount in the minor unit of its currency
+type Money struct {
+	amount   int
+	currency Currency
+}
+
+func (m Money) Add(other Money) (Money, error) {
+	if m.currency != other.currency {
+		return Money{}, ErrCurrencyMismatch
+	}
+	return Money{m.amount + other.amount, m.currency}, nil
+}
+
+func (m Money) Sub(other Money) (Money, error) {
+	if m.currency != other.currency {
+		return Money{}, ErrCurrencyMismatch
+	}
+	return Money{m.amount - other.amount, m.currency}, nil
+}
+
+func (m Money) Mul(n int) Money {
+	return Money{m.amount * n, m.currency}
+}
+
+// Convert returns m in currency to at rate, rounding half away from zero to the minor unit
+func (m Money) Convert(to Currency, rate *big.Rat) Money {
+	converted := new(big.Rat).Mul(new(big.Rat).SetInt64(int64(m.amount)), rate)
+	quotient, remainder := new(big.Int).QuoRem(converted.Num(), converted.Denom(), new(big.Int))
+	if new(big.Int).Mul(remainder.Abs(remainder), big.NewInt(2)).Cmp(converted.Denom()) >= 0 {
+		quotient.Add(quotient, big.NewInt(int64(converted.Sign())))
+	}
+	return Money{int(quotient.Int64()), to}
+}
+
+func (m Money) String() string {
+	sign, amount := "", m.amount
+	if amount < 0 {
+		sign, amount = "-", -amount
+	}
+	return fmt.Sprintf("%v%v.%02d %v", sign, amount/100, amount%100, m.currency)
+}
+
+// MarshalJSON encodes m like {"amount": "175.00", "currency": "USD"}, the amount is a
+// string so it stays exact
+func (m Money) MarshalJSON() ([]byte, error) {
+	amount, _, _ := strings.Cut(m.String(), " ")
+	return json.Marshal(struct {
+		Amount   string   `json:"amount"`
+		Currency Currency `json:"currency"`
+	}{amount, m.currency})
+}
+
+// UnmarshalJSON decodes money encoded by MarshalJSON
+func (m *Money) UnmarshalJSON(data []byte) error {
+	var decoded struct {
+		Amount   string   `json:"amount"`
+		Currency Currency `json:"currency"`
+	}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return err
+	}
+	value, negative := strings.CutPrefix(decoded.Amount, "-")
+	amount, err := parseAmount(value)
+	if err != nil {
+		return err
+	}
+	if negative {
+		amount = -amount
+	}
+	m.amount, m.currency = amount, decoded.Currency
+	return nil
+}
+
+// RateProvider supplies exchange rates, the amount of to one unit of from is worth
+type RateProvider interface {
+	Rate(from Currency, to Currency) (*big.Rat, error)
+}
+
+// convertMoney converts m to currency to with rates, money already in to is returned as is
+func convertMoney(m Money, to Currency, rates RateProvider) (Money, error) {
+	if m.currency == to {
+		return m, nil
+	}
+	rate, err := rates.Rate(m.currency, to)
+	if err != nil {
+		return Money{}, err
+	}
+	return m.Convert(to, rate), nil
+}
+
+// StaticRates are fixed rates against a base currency, the value of one unit of the base
+// in each currency
+type StaticRates map[Currency]*big.Rat
+
+func (s StaticRates) Rate(from Currency, to Currency) (*big.Rat, error) {
+	fromRate, toRate := s[from], s[to]
+	if fromRate == nil || toRate == nil {
+		return nil, ErrNoExchangeRate
+	}
+	return new(big.Rat).Quo(toRate, fromRate), nil
+}
+
+// LoadStaticRates reads rates from a JSON file like {"base": "USD", "rates": {"EUR": "0.92"}}.
+// Rates are strings so they are parsed exactly
+func LoadStaticRates(path string) (StaticRates, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file struct {
+		Base  Currency
+		Rates map[Currency]string
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+	if !currencies[file.Base] {
+		return nil, fmt.Errorf("exchange rates base: %w", ErrUnknownCurrency)
+	}
+
+	rates := StaticRates{file.Base: big.NewRat(1, 1)}
+	for currency, value := range file.Rates {
+		if !currencies[currency] {
+			return nil, fmt.Errorf("exchange rate for %v: %w", currency, ErrUnknownCurrency)
+		}
+		rate, ok := new(big.Rat).SetString(value)
+		if !ok || rate.Sign() <= 0 {
+			return nil, fmt.Errorf("exchange rate for %v: %w", currency, strconv.ErrSyntax)
+		}
+		rates[currency] = rate
+	}
+	return rates, nil
+}
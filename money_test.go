@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+var testParseAmountTable = map[string]struct {
+	input    string
+	expected int
+	err      error
+}{
+	"integer":           {"12", 1200, nil},
+	"one digit":         {"12.3", 1230, nil},
+	"two digits":        {"0.29", 29, nil},
+	"leading zeros":     {"007.50", 750, nil},
+	"zero":              {"0", 0, nil},
+	"maximum":           {"99999999.99", MaxAmount, nil},
+	"too large":         {"100000000", 0, ErrAmountTooLarge},
+	"three digits":      {"1.234", 0, ErrInvalidAmount},
+	"trailing point":    {"1.", 0, ErrInvalidAmount},
+	"leading point":     {".5", 0, ErrInvalidAmount},
+	"exponent":          {"1e6", 0, ErrInvalidAmount},
+	"nan":               {"NaN", 0, ErrInvalidAmount},
+	"infinity":          {"Inf", 0, ErrInvalidAmount},
+	"negative":          {"-5", 0, ErrInvalidAmount},
+	"plus":              {"+5", 0, ErrInvalidAmount},
+	"hex":               {"0x10", 0, ErrInvalidAmount},
+	"underscore":        {"1_000", 0, ErrInvalidAmount},
+	"comma":             {"1,50", 0, ErrInvalidAmount},
+	"space":             {" 5", 0, ErrInvalidAmount},
+	"empty":             {"", 0, ErrInvalidAmount},
+	"two points":        {"1.2.3", 0, ErrInvalidAmount},
+	"non ascii digits":  {"١٢", 0, ErrInvalidAmount},
+	"many leading zero": {"0000000000000001", 100, nil},
+}
+
+func TestParseAmount(t *testing.T) {
+	t.Parallel()
+	for name, args := range testParseAmountTable {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			amount, err := parseAmount(args.input)
+			if err != args.err || (err == nil && amount != args.expected) {
+				t.Errorf("input %q, got %v %v, expected %v %v", args.input, amount, err, args.expected, args.err)
+			}
+		})
+	}
+}
+
+var amountSeeds []string = []string{
+	"",
+	"0.29",
+	"1e6",
+	"NaN",
+	"99999999.99",
+	"100000000.00",
+}
+
+// wellFormedAmount is the grammar parseAmount accepts, used as the oracle for fuzzing
+var wellFormedAmount = regexp.MustCompile(`^[0-9]+(\.[0-9]{1,2})?$`)
+
+func FuzzParseAmount(f *testing.F) {
+	for _, seed := range amountSeeds {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, value string) {
+		t.Parallel()
+		amount, err := parseAmount(value)
+		if !wellFormedAmount.MatchString(value) {
+			if err != ErrInvalidAmount {
+				t.Fatalf("malformed %q accepted as %v, %v", value, amount, err)
+			}
+			return
+		}
+
+		// Well formed amounts must parse to exactly the decimal value, or be too large
+		exact, _ := new(big.Rat).SetString(value)
+		exact.Mul(exact, big.NewRat(100, 1))
+		if exact.Cmp(big.NewRat(MaxAmount, 1)) > 0 {
+			if err != ErrAmountTooLarge {
+				t.Fatalf("%q above the maximum, got %v, %v", value, amount, err)
+			}
+			return
+		}
+		if err != nil || !exact.IsInt() || exact.Num().Int64() != int64(amount) {
+			t.Fatalf("%q parsed as %v, %v, expected %v", value, amount, err, exact)
+		}
+
+		// Formatting round trips
+		formatted, _, _ := strings.Cut(Money{amount, DefaultCurrency}.String(), " ")
+		if again, err := parseAmount(formatted); err != nil || again != amount {
+			t.Fatalf("%q formatted as %q parsed as %v, %v", value, formatted, again, err)
+		}
+	})
+}
+
+var testMoneyStringTable = map[string]struct {
+	input    Money
+	expected string
+}{
+	"decimal":  {Money{137, "USD"}, "1.37 USD"},
+	"integer":  {Money{100, "EUR"}, "1.00 EUR"},
+	"cents":    {Money{5, "GBP"}, "0.05 GBP"},
+	"zero":     {Money{0, "USD"}, "0.00 USD"},
+	"negative": {Money{-1205, "USD"}, "-12.05 USD"},
+	"large":    {Money{9999999999, "USD"}, "99999999.99 USD"},
+}
+
+func TestMoneyString(t *testing.T) {
+	t.Parallel()
+	for name, args := range testMoneyStringTable {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			if answer := args.input.String(); answer != args.expected {
+				t.Errorf("input %v, got %v, expected %v", args.input.amount, answer, args.expected)
+			}
+		})
+	}
+}
+
+func TestMoneyJSON(t *testing.T) {
+	t.Parallel()
+	for _, args := range []struct {
+		input    Money
+		expected string
+	}{
+		{Money{17500, "USD"}, `{"amount":"175.00","currency":"USD"}`},
+		{Money{-5, "EUR"}, `{"amount":"-0.05","currency":"EUR"}`},
+	} {
+		if answer, err := json.Marshal(args.input); err != nil || string(answer) != args.expected {
+			t.Errorf("input %v, got %s, %v, expected %v", args.input, answer, err, args.expected)
+		}
+		var decoded Money
+		if err := json.Unmarshal([]byte(args.expected), &decoded); err != nil || decoded != args.input {
+			t.Errorf("decoding %v, got %v, %v", args.expected, decoded, err)
+		}
+	}
+	if err := json.Unmarshal([]byte(`{"amount":"1e3","currency":"USD"}`), &Money{}); err != ErrInvalidAmount {
+		t.Errorf("decoding an exponent, expected %v, got %v", ErrInvalidAmount, err)
+	}
+}
+
+var testMoneyConvertTable = map[string]struct {
+	input    Money
+	rate     *big.Rat
+	expected Money
+}{
+	"exact":               {Money{1000, "USD"}, big.NewRat(92, 100), Money{920, "EUR"}},
+	"round down":          {Money{12999, "USD"}, big.NewRat(92, 100), Money{11959, "EUR"}},
+	"round half up":       {Money{1, "USD"}, big.NewRat(1, 2), Money{1, "EUR"}},
+	"round half negative": {Money{-1, "USD"}, big.NewRat(1, 2), Money{-1, "EUR"}},
+	"thirds":              {Money{100, "USD"}, big.NewRat(1, 3), Money{33, "EUR"}},
+	"two thirds":          {Money{100, "USD"}, big.NewRat(2, 3), Money{67, "EUR"}},
+}
+
+func TestMoneyConvert(t *testing.T) {
+	t.Parallel()
+	for name, args := range testMoneyConvertTable {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			if answer := args.input.Convert(args.expected.currency, args.rate); answer != args.expected {
+				t.Errorf("input %v at %v, got %v, expected %v", args.input, args.rate, answer, args.expected)
+			}
+		})
+	}
+}
+
+func TestMoneyArithmetic(t *testing.T) {
+	t.Parallel()
+	sum, err := Money{150, "USD"}.Add(Money{275, "USD"})
+	if err != nil || sum != (Money{425, "USD"}) {
+		t.Errorf("bad sum, got %v %v", sum, err)
+	}
+	difference, err := Money{150, "USD"}.Sub(Money{275, "USD"})
+	if err != nil || difference != (Money{-125, "USD"}) {
+		t.Errorf("bad difference, got %v %v", difference, err)
+	}
+	if _, err := (Money{150, "USD"}).Add(Money{150, "EUR"}); err != ErrCurrencyMismatch {
+		t.Errorf("adding different currencies, expected %v, got %v", ErrCurrencyMismatch, err)
+	}
+}
+
+func TestStaticRates(t *testing.T) {
+	t.Parallel()
+	if testRates == nil {
+		t.Fatal("test rates failed to load")
+	}
+	for _, args := range []struct {
+		from, to Currency
+		expected *big.Rat
+		err      error
+	}{
+		{"USD", "EUR", big.NewRat(92, 100), nil},
+		{"EUR", "USD", big.NewRat(100, 92), nil},
+		{"EUR", "GBP", big.NewRat(79, 92), nil},
+		{"USD", "CAD", nil, ErrNoExchangeRate},
+	} {
+		rate, err := testRates.Rate(args.from, args.to)
+		if err != args.err || (err == nil && rate.Cmp(args.expected) != 0) {
+			t.Errorf("bad rate %v to %v, expected %v %v, got %v %v", args.from, args.to, args.expected, args.err, rate, err)
+		}
+	}
+}
+
+func TestPurchaseCurrency(t *testing.T) {
+	env := NewTestEnv()
+	env.db = newTestDB(t)
+	richUserId := 2
+	startBalance, _ := env.db.Balance(richUserId, "EUR")
+
+	for _, args := range []struct {
+		name     string
+		currency string
+		expected int
+	}{
+		{"PurchaseUnknownCurrency", "XYZ", http.StatusBadRequest},
+		{"PurchaseNoExchangeRate", "CAD", http.StatusBadRequest},
+		{"PurchaseInsufficientFunds", "EUR", http.StatusForbidden},
+	} {
+		recorder := httptest.NewRecorder()
+		env.Purchase(recorder, newCartRequest("POST", "/api/purchase?id=2&currency="+args.currency, richUserId))
+		if result := recorder.Result(); result.StatusCode != args.expected {
+			t.Errorf("bad status code for %v, expected %v, got %v", args.name, args.expected, result.StatusCode)
+		}
+	}
+
+	// 129.99 USD at 0.92 is 119.59 EUR
+	creditTestWallet(richUserId, Money{5000, "EUR"})
+	recorder := httptest.NewRecorder()
+	env.Purchase(recorder, newCartRequest("POST", "/api/purchase?id=2&currency=eur", richUserId))
+	if result := recorder.Result(); result.StatusCode != http.StatusOK {
+		t.Fatalf("bad status code for purchase in EUR, expected %v, got %v", http.StatusOK, result.StatusCode)
+	}
+	expected := Money{startBalance.amount + 5000 - 11959, "EUR"}
+	if balance, _ := env.db.Balance(richUserId, "EUR"); balance != expected {
+		t.Errorf("bad balance after purchase in EUR, expected %v, got %v", expected, balance)
+	}
+}
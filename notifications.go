@@ -0,0 +1,757 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/template"
+	"time"
+)
+
+var ErrNoSender error = errors.New("no sender for notification channel")
+var ErrInternalAddress error = errors.New("webhook address is internal")
+
+const (
+	// NotificationInterval is how often the worker looks for notifications to deliver
+	NotificationInterval = 15 * time.Second
+	// NotificationBatch is the most notifications the worker claims at once
+	NotificationBatch = 50
+	// NotificationLease is how long a claimed notification is left to its worker before
+	// another may retry it
+	NotificationLease = 5 * time.Minute
+	// MaxNotificationAttempts is how many times delivery is tried before giving up
+	MaxNotificationAttempts = 6
+	// NotificationRetryDelay is the wait before the first retry, it doubles each attempt
+	NotificationRetryDelay = time.Minute
+)
+
+type NotificationKind string
+
+const (
+	NotificationRegistered NotificationKind = "registered"
+	NotificationPurchase   NotificationKind = "purchase"
+	NotificationSale       NotificationKind = "sale"
+	NotificationDeposit    NotificationKind = "deposit"
+	NotificationDispute    NotificationKind = "dispute"
+	NotificationPriceDrop  NotificationKind = "price_drop"
+)
+
+var notificationKinds = []NotificationKind{NotificationRegistered, NotificationPurchase, NotificationSale, NotificationDeposit,
+	NotificationDispute, NotificationPriceDrop}
+
+type NotificationChannel string
+
+const (
+	ChannelInApp   NotificationChannel = "in_app"
+	ChannelEmail   NotificationChannel = "email"
+	ChannelWebhook NotificationChannel = "webhook"
+)
+
+var notificationChannels = []NotificationChannel{ChannelInApp, ChannelEmail, ChannelWebhook}
+
+type NotificationStatus string
+
+const (
+	NotificationPending NotificationStatus = "pending"
+	NotificationSent    NotificationStatus = "sent"
+	NotificationFailed  NotificationStatus = "failed"
+)
+
+// notificationTemplate renders the subject and body of a kind of notification from the
+// data given when it is enqueued
+type notificationTemplate struct {
+	subject *template.Template
+	body    *template.Template
+}
+
+func newNotificationTemplate(kind NotificationKind, subject string, body string) notificationTemplate {
+	return notificationTemplate{
+		subject: template.Must(template.New(string(kind) + " subject").Option("missingkey=error").Parse(subject)),
+		body:    template.Must(template.New(string(kind) + " body").Option("missingkey=error").Parse(body)),
+	}
+}
+
+var notificationTemplates = map[NotificationKind]notificationTemplate{
+	NotificationRegistered: newNotificationTemplate(NotificationRegistered,
+		`Welcome, {{.username}}`,
+		`Your account {{.username}} is ready. Top up your wallet to start buying.`),
+	NotificationPurchase: newNotificationTemplate(NotificationPurchase,
+		`Order {{.orderId}} confirmed`,
+		`You paid {{.total}} for order {{.orderId}}. Confirm receipt once it arrives so the seller is paid.`),
+	NotificationSale: newNotificationTemplate(NotificationSale,
+		`You made a sale in order {{.orderId}}`,
+		`Order {{.orderId}} includes {{.amount}} for you, held in escrow until the buyer confirms receipt.`),
+	NotificationDeposit: newNotificationTemplate(NotificationDeposit,
+		`Deposit {{.depositId}} received`,
+		`{{.amount}} was added to your wallet.`),
+	NotificationDispute: newNotificationTemplate(NotificationDispute,
+		`Dispute {{.disputeId}} is {{.status}}`,
+		`The dispute over order {{.orderId}} is now {{.status}}.`),
+	NotificationPriceDrop: newNotificationTemplate(NotificationPriceDrop,
+		`{{.itemName}} dropped to {{.price}}`,
+		`{{.itemName}} on your wishlist now costs {{.price}}, at or below your target of {{.target}}.`),
+}
+
+// renderNotification renders the subject and body of a kind of notification
+func renderNotification(kind NotificationKind, data map[string]any) (subject string, body string, err error) {
+	tmpl, ok := notificationTemplates[kind]
+	if !ok {
+		return "", "", fmt.Errorf("no template for notification kind %q", kind)
+	}
+	var subjectBuf, bodyBuf bytes.Buffer
+	if err := tmpl.subject.Execute(&subjectBuf, data); err != nil {
+		return "", "", err
+	}
+	if err := tmpl.body.Execute(&bodyBuf, data); err != nil {
+		return "", "", err
+	}
+	return subjectBuf.String(), bodyBuf.String(), nil
+}
+
+// notificationEventTypes are the events users are notified of
+var notificationEventTypes = []EventType{EventUserRegistered, EventPurchaseCreated, EventDepositSucceeded, EventDisputeUpdated,
+	EventPriceDropped}
+
+// EventNotification is a notification of kind to a user about an event, rendered from data
+type EventNotification struct {
+	userId int
+	kind   NotificationKind
+	data   map[string]any
+}
+
+// eventNotifications returns the notifications for an event: the buyer and each seller
+// of a purchase, the buyer and seller of a dispute, and the user anything else is about
+func eventNotifications(event DomainEvent) ([]EventNotification, error) {
+	switch event.eventType {
+	case EventUserRegistered:
+		var data userRegisteredEvent
+		if err := event.Decode(&data); err != nil {
+			return nil, err
+		}
+		return []EventNotification{{data.UserId, NotificationRegistered, map[string]any{"username": data.Username}}}, nil
+	case EventPurchaseCreated:
+		var data purchaseCreatedEvent
+		if err := event.Decode(&data); err != nil {
+			return nil, err
+		}
+		notifications := []EventNotification{{data.UserId, NotificationPurchase, map[string]any{"orderId": data.OrderId, "total": data.Total}}}
+		sales := make(map[int]Money)
+		for _, line := range data.Lines {
+			if line.SellerId != 0 {
+				sales[line.SellerId] = Money{sales[line.SellerId].amount + line.Amount.amount, line.Amount.currency}
+			}
+		}
+		for _, sellerId := range slices.Sorted(maps.Keys(sales)) {
+			notifications = append(notifications, EventNotification{sellerId, NotificationSale,
+				map[string]any{"orderId": data.OrderId, "amount": sales[sellerId]}})
+		}
+		return notifications, nil
+	case EventDepositSucceeded:
+		var data depositSucceededEvent
+		if err := event.Decode(&data); err != nil {
+			return nil, err
+		}
+		return []EventNotification{{data.UserId, NotificationDeposit, map[string]any{"depositId": data.DepositId, "amount": data.Amount}}}, nil
+	case EventDisputeUpdated:
+		var data disputeUpdatedEvent
+		if err := event.Decode(&data); err != nil {
+			return nil, err
+		}
+		status := strings.ReplaceAll(string(data.Status), "_", " ")
+		var notifications []EventNotification
+		for _, userId := range []int{data.BuyerId, data.SellerId} {
+			if userId != 0 {
+				notifications = append(notifications, EventNotification{userId, NotificationDispute,
+					map[string]any{"disputeId": data.DisputeId, "orderId": data.OrderId, "status": status}})
+			}
+		}
+		return notifications, nil
+	case EventPriceDropped:
+		var data priceDroppedEvent
+		if err := event.Decode(&data); err != nil {
+			return nil, err
+		}
+		return []EventNotification{{data.UserId, NotificationPriceDrop,
+			map[string]any{"itemId": data.ItemId, "itemName": data.ItemName, "price": data.Price, "target": data.Target}}}, nil
+	}
+	return nil, fmt.Errorf("no notifications for %v events", event.eventType)
+}
+
+// NotificationEventHandler enqueues the notifications for each event it is given
+func NotificationEventHandler(db DB) EventHandler {
+	return func(event DomainEvent) error {
+		notifications, err := eventNotifications(event)
+		if err != nil {
+			return err
+		}
+		return db.EnqueueNotifications(event.eventId, notifications)
+	}
+}
+
+// NotificationPreference turns a channel on or off for a kind of notification
+type NotificationPreference struct {
+	kind    NotificationKind
+	channel NotificationChannel
+	enabled bool
+}
+
+// NotificationSettings are where a user is notified and which channels they chose. Email
+// and webhook are empty when not set
+type NotificationSettings struct {
+	email       string
+	webhookURL  string
+	preferences []NotificationPreference
+}
+
+// enabled reports whether the user gets kind on channel. Channels are on by default once
+// they have somewhere to deliver to, in-app always does
+func (s NotificationSettings) enabled(kind NotificationKind, channel NotificationChannel) bool {
+	switch {
+	case channel == ChannelEmail && len(s.email) == 0:
+		return false
+	case channel == ChannelWebhook && len(s.webhookURL) == 0:
+		return false
+	}
+	for _, preference := range s.preferences {
+		if preference.kind == kind && preference.channel == channel {
+			return preference.enabled
+		}
+	}
+	return true
+}
+
+// address returns where notifications on channel are delivered, empty for in-app
+func (s NotificationSettings) address(channel NotificationChannel) string {
+	switch channel {
+	case ChannelEmail:
+		return s.email
+	case ChannelWebhook:
+		return s.webhookURL
+	}
+	return ""
+}
+
+func (s NotificationSettings) String() string {
+	email, webhookURL := s.email, s.webhookURL
+	if len(email) == 0 {
+		email = "none"
+	}
+	if len(webhookURL) == 0 {
+		webhookURL = "none"
+	}
+	var lines []string
+	lines = append(lines, fmt.Sprintf("email: %v, webhook: %v", email, webhookURL))
+	for _, kind := range notificationKinds {
+		for _, channel := range notificationChannels {
+			lines = append(lines, fmt.Sprintf("kind: %v, channel: %v, enabled: %v", kind, channel, s.enabled(kind, channel)))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Notification is a message to a user on one channel. Rows in the outbox are written in
+// the same transaction as the change they are about and delivered by the worker, in-app
+// notifications are delivered by being stored
+type Notification struct {
+	notificationId int
+	userId         int
+	kind           NotificationKind
+	channel        NotificationChannel
+	address        string // email address or webhook URL, empty in-app
+	subject        string
+	body           string
+	status         NotificationStatus
+	attempts       int
+	lastError      string
+	nextAttemptAt  time.Time
+	createdAt      time.Time
+	sentAt         time.Time // zero until delivered
+	readAt         time.Time // zero until read, in-app only
+}
+
+func (n Notification) String() string {
+	read := "no"
+	if !n.readAt.IsZero() {
+		read = n.readAt.String()
+	}
+	return fmt.Sprintf("notification: %v, kind: %v, subject: %q, body: %q, read: %v, created: %v",
+		n.notificationId, n.kind, n.subject, n.body, read, n.createdAt.String())
+}
+
+// retry returns the status and next attempt time of a notification whose delivery failed
+// at now, backing off exponentially until MaxNotificationAttempts is reached
+func (n Notification) retry(now time.Time) (NotificationStatus, time.Time) {
+	if n.attempts >= MaxNotificationAttempts {
+		return NotificationFailed, now
+	}
+	return NotificationPending, now.Add(NotificationRetryDelay << (n.attempts - 1))
+}
+
+const notificationColumns = `notification_id, user_id, kind, channel, address, subject, body, status, attempts, last_error,
+							 next_attempt_at, created_at, sent_at, read_at`
+
+func scanNotification(row rowScanner) (Notification, error) {
+	var notification Notification
+	var sentAt, readAt sql.NullTime
+	err := row.Scan(&notification.notificationId, &notification.userId, &notification.kind, &notification.channel, &notification.address,
+		&notification.subject, &notification.body, &notification.status, &notification.attempts, &notification.lastError,
+		&notification.nextAttemptAt, &notification.createdAt, &sentAt, &readAt)
+	notification.sentAt, notification.readAt = sentAt.Time, readAt.Time
+	return notification, err
+}
+
+func queryNotifications(q querier, query string, args ...any) ([]Notification, error) {
+	rows, err := q.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var notifications []Notification
+	for rows.Next() {
+		notification, err := scanNotification(rows)
+		if err != nil {
+			return nil, err
+		}
+		notifications = append(notifications, notification)
+	}
+
+	return notifications, rows.Err()
+}
+
+// notificationSettings gets the user's settings, the query always returns a row with the
+// contacts even if the user has no settings or preferences
+func notificationSettings(q querier, userId int) (NotificationSettings, error) {
+	query := `SELECT COALESCE(notification_settings.email, ''), COALESCE(notification_settings.webhook_url, ''),
+			  notification_preferences.kind, notification_preferences.channel, notification_preferences.enabled
+			  FROM (SELECT CAST($1 AS INT) AS user_id) AS users
+			  LEFT JOIN notification_settings ON notification_settings.user_id=users.user_id
+			  LEFT JOIN notification_preferences ON notification_preferences.user_id=users.user_id
+			  ORDER BY notification_preferences.kind, notification_preferences.channel`
+	rows, err := q.Query(query, userId)
+	if err != nil {
+		return NotificationSettings{}, err
+	}
+	defer rows.Close()
+
+	var settings NotificationSettings
+	for rows.Next() {
+		var kind, channel sql.NullString
+		var enabled sql.NullBool
+		if err := rows.Scan(&settings.email, &settings.webhookURL, &kind, &channel, &enabled); err != nil {
+			return NotificationSettings{}, err
+		}
+		if kind.Valid {
+			preference := NotificationPreference{NotificationKind(kind.String), NotificationChannel(channel.String), enabled.Bool}
+			settings.preferences = append(settings.preferences, preference)
+		}
+	}
+	return settings, rows.Err()
+}
+
+// enqueueNotification writes a notification about the event to the outbox for each channel
+// the user has enabled, as part of tx. Channels the event was already enqueued on are
+// skipped so the event can be handled again
+func enqueueNotification(tx *sql.Tx, eventId int, notification EventNotification) error {
+	subject, body, err := renderNotification(notification.kind, notification.data)
+	if err != nil {
+		return err
+	}
+	settings, err := notificationSettings(tx, notification.userId)
+	if err != nil {
+		return err
+	}
+
+	addQuery := `INSERT INTO notification_outbox (domain_event_id, user_id, kind, channel, address, subject, body, status, sent_at)
+				 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, CASE WHEN $8='sent' THEN NOW() END)
+				 ON CONFLICT DO NOTHING`
+	for _, channel := range notificationChannels {
+		if !settings.enabled(notification.kind, channel) {
+			continue
+		}
+		status := NotificationPending
+		if channel == ChannelInApp {
+			status = NotificationSent
+		}
+		_, err := tx.Exec(addQuery, eventId, notification.userId, notification.kind, channel, settings.address(channel), subject, body, status)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// EnqueueNotifications writes the notifications for an event to the outbox together, so
+// none are sent if any can't be
+func (s *SqlDB) EnqueueNotifications(eventId int, notifications []EventNotification) (err error) {
+	var tx *sql.Tx
+	tx, err = s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	// Rollback or commit depending on err
+	defer func() {
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	for _, notification := range notifications {
+		if err = enqueueNotification(tx, eventId, notification); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NotificationSettings returns the user's contact details and channel preferences
+func (s *SqlDB) NotificationSettings(userId int) (NotificationSettings, error) {
+	return notificationSettings(s.db, userId)
+}
+
+// UpdateNotificationContacts sets where the user's email and webhook notifications go,
+// empty values turn the channel off. Notifications already enqueued keep their address
+func (s *SqlDB) UpdateNotificationContacts(userId int, email string, webhookURL string) error {
+	query := `INSERT INTO notification_settings (user_id, email, webhook_url) VALUES ($1, NULLIF($2, ''), NULLIF($3, ''))
+			  ON CONFLICT (user_id) DO UPDATE SET email=EXCLUDED.email, webhook_url=EXCLUDED.webhook_url`
+	_, err := s.db.Exec(query, userId, email, webhookURL)
+	return err
+}
+
+// SetNotificationPreference turns a channel on or off for a kind of the user's notifications
+func (s *SqlDB) SetNotificationPreference(userId int, preference NotificationPreference) error {
+	query := `INSERT INTO notification_preferences (user_id, kind, channel, enabled) VALUES ($1, $2, $3, $4)
+			  ON CONFLICT (user_id, kind, channel) DO UPDATE SET enabled=EXCLUDED.enabled`
+	_, err := s.db.Exec(query, userId, preference.kind, preference.channel, preference.enabled)
+	return err
+}
+
+// InAppNotifications returns the user's in-app notifications, newest first
+func (s *SqlDB) InAppNotifications(userId int) ([]Notification, error) {
+	query := `SELECT ` + notificationColumns + ` FROM notification_outbox WHERE user_id=$1 AND channel=$2
+			  ORDER BY notification_id DESC`
+	return queryNotifications(s.db, query, userId, ChannelInApp)
+}
+
+// MarkNotificationRead marks one of the user's in-app notifications read, sql.ErrNoRows is
+// returned if they have no such notification
+func (s *SqlDB) MarkNotificationRead(userId int, notificationId int, now time.Time) error {
+	query := `UPDATE notification_outbox SET read_at=COALESCE(read_at, $1)
+			  WHERE notification_id=$2 AND user_id=$3 AND channel=$4`
+	result, err := s.db.Exec(query, now, notificationId, userId, ChannelInApp)
+	if err != nil {
+		return err
+	}
+	if marked, err := result.RowsAffected(); err != nil {
+		return err
+	} else if marked == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// ClaimNotifications takes up to limit pending notifications due by now for delivery,
+// counting the attempt and leasing them for NotificationLease so other workers skip them
+func (s *SqlDB) ClaimNotifications(now time.Time, limit int) ([]Notification, error) {
+	query := `UPDATE notification_outbox SET attempts=attempts+1, next_attempt_at=$2
+			  WHERE notification_id IN (
+				  SELECT notification_id FROM notification_outbox WHERE status=$3 AND next_attempt_at<=$1
+				  ORDER BY next_attempt_at, notification_id LIMIT $4 FOR UPDATE SKIP LOCKED
+			  )
+			  RETURNING ` + notificationColumns
+	return queryNotifications(s.db, query, now, now.Add(NotificationLease), NotificationPending, limit)
+}
+
+// FinishNotification records the outcome of a delivery attempt. Sent notifications are
+// stamped with at, pending ones are retried at it
+func (s *SqlDB) FinishNotification(notificationId int, status NotificationStatus, lastError string, at time.Time) error {
+	query := `UPDATE notification_outbox SET status=$1, last_error=$2,
+			  sent_at=CASE WHEN $1='sent' THEN $3 END, next_attempt_at=$3
+			  WHERE notification_id=$4`
+	_, err := s.db.Exec(query, status, lastError, at, notificationId)
+	return err
+}
+
+// NotificationSender delivers notifications on one channel
+type NotificationSender interface {
+	Send(notification Notification) error
+}
+
+// WebhookNotificationSender posts notifications as JSON to the user's webhook URL
+type WebhookNotificationSender struct {
+	client *http.Client
+}
+
+// webhookNotification is the JSON body posted by WebhookNotificationSender
+type webhookNotification struct {
+	Id        int              `json:"id"`
+	Kind      NotificationKind `json:"kind"`
+	Subject   string           `json:"subject"`
+	Body      string           `json:"body"`
+	CreatedAt time.Time        `json:"created_at"`
+}
+
+func (s WebhookNotificationSender) Send(notification Notification) error {
+	payload, err := json.Marshal(webhookNotification{notification.notificationId, notification.kind, notification.subject,
+		notification.body, notification.createdAt})
+	if err != nil {
+		return err
+	}
+	response, err := s.client.Post(notification.address, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("webhook responded %v", response.Status)
+	}
+	return nil
+}
+
+// isInternalIP reports whether ip is on the loopback, a private or link-local network or
+// unspecified, addresses users' webhooks mustn't reach
+func isInternalIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified()
+}
+
+// NewWebhookClient returns the client for posting to URLs users give, webhook notifications
+// and webhook endpoints. Addresses are checked once resolved, when connecting, so hostnames
+// resolving to internal addresses are refused too. Proxies from the environment aren't used
+// since they would connect on the client's behalf, and redirects aren't followed so the
+// response is reported as is
+func NewWebhookClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: timeout,
+		Control: func(network string, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || isInternalIP(ip) {
+				return fmt.Errorf("%v: %w", address, ErrInternalAddress)
+			}
+			return nil
+		},
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: transport,
+		CheckRedirect: func(request *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// deliverNotifications sends the notifications due by now, returning how many were sent
+func (env *Env) deliverNotifications(now time.Time) (int, error) {
+	notifications, err := env.db.ClaimNotifications(now, NotificationBatch)
+	if err != nil {
+		return 0, err
+	}
+
+	sent := 0
+	for _, notification := range notifications {
+		sendErr := ErrNoSender
+		if sender, ok := env.notificationSenders[notification.channel]; ok {
+			sendErr = sender.Send(notification)
+		}
+
+		status, at, lastError := NotificationSent, time.Now(), ""
+		if sendErr != nil {
+			status, at = notification.retry(now)
+			lastError = sendErr.Error()
+			env.logger.Printf("notification %v on %v: %v", notification.notificationId, notification.channel, lastError)
+		} else {
+			sent++
+		}
+		if err := env.db.FinishNotification(notification.notificationId, status, lastError, at); err != nil {
+			return sent, err
+		}
+	}
+	return sent, nil
+}
+
+// RunNotificationWorker delivers notifications from the outbox until done is closed
+func (env *Env) RunNotificationWorker(done <-chan struct{}) {
+	ticker := time.NewTicker(NotificationInterval)
+	defer ticker.Stop()
+	for {
+		sent, err := env.deliverNotifications(time.Now())
+		if err != nil {
+			env.logger.Println("notification worker:", err.Error())
+		} else if sent != 0 {
+			env.logger.Println("notification worker: sent", sent, "notifications")
+		}
+
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+	}
+}
+
+// parseWebhookURL checks value is an absolute https URL, empty is allowed. Where it points
+// is checked by NewWebhookClient when connecting
+func parseWebhookURL(value string) (string, error) {
+	if len(value) == 0 {
+		return "", nil
+	}
+	webhookURL, err := url.Parse(value)
+	if err != nil {
+		return "", err
+	}
+	if webhookURL.Scheme != "https" || len(webhookURL.Host) == 0 {
+		return "", fmt.Errorf("webhook URL must be absolute https")
+	}
+	return webhookURL.String(), nil
+}
+
+func (env *Env) Notifications(w http.ResponseWriter, r *http.Request) {
+	userId, ok := r.Context().Value(CtxUserId).(int)
+	if !ok {
+		env.logger.Println("context does not include userId for protected endpoint")
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	notifications, err := env.db.InAppNotifications(userId)
+	if err != nil {
+		env.logger.Println(err.Error())
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	// Print in-app notifications, newest first
+	for _, notification := range notifications {
+		fmt.Fprintln(w, notification)
+	}
+}
+
+func (env *Env) ReadNotification(w http.ResponseWriter, r *http.Request) {
+	userId, ok := r.Context().Value(CtxUserId).(int)
+	if !ok {
+		env.logger.Println("context does not include userId for protected endpoint")
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	// Get notification id
+	notificationId, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	// Other users' notifications are reported as not found
+	if err := env.db.MarkNotificationRead(userId, notificationId, time.Now()); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+		env.logger.Println(err.Error())
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (env *Env) NotificationSettings(w http.ResponseWriter, r *http.Request) {
+	userId, ok := r.Context().Value(CtxUserId).(int)
+	if !ok {
+		env.logger.Println("context does not include userId for protected endpoint")
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	settings, err := env.db.NotificationSettings(userId)
+	if err != nil {
+		env.logger.Println(err.Error())
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintln(w, settings)
+}
+
+func (env *Env) UpdateNotificationContacts(w http.ResponseWriter, r *http.Request) {
+	userId, ok := r.Context().Value(CtxUserId).(int)
+	if !ok {
+		env.logger.Println("context does not include userId for protected endpoint")
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	// Get email and webhook URL, either can be empty to stop that channel
+	var email string
+	if value := r.FormValue("email"); len(value) != 0 {
+		address, err := mail.ParseAddress(value)
+		if err != nil {
+			http.Error(w, "Invalid email address", http.StatusBadRequest)
+			return
+		}
+		email = address.Address
+	}
+	webhookURL, err := parseWebhookURL(r.FormValue("webhook"))
+	if err != nil {
+		http.Error(w, "Invalid webhook URL", http.StatusBadRequest)
+		return
+	}
+
+	if err := env.db.UpdateNotificationContacts(userId, email, webhookURL); err != nil {
+		env.logger.Println(err.Error())
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintln(w, "Success")
+}
+
+func (env *Env) SetNotificationPreference(w http.ResponseWriter, r *http.Request) {
+	userId, ok := r.Context().Value(CtxUserId).(int)
+	if !ok {
+		env.logger.Println("context does not include userId for protected endpoint")
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	// Get kind, channel and whether it is on
+	preference := NotificationPreference{kind: NotificationKind(r.FormValue("kind")), channel: NotificationChannel(r.FormValue("channel"))}
+	if !slices.Contains(notificationKinds, preference.kind) {
+		http.Error(w, "Unknown notification kind", http.StatusBadRequest)
+		return
+	}
+	if !slices.Contains(notificationChannels, preference.channel) {
+		http.Error(w, "Unknown notification channel", http.StatusBadRequest)
+		return
+	}
+	enabled, err := strconv.ParseBool(r.FormValue("enabled"))
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	preference.enabled = enabled
+
+	if err := env.db.SetNotificationPreference(userId, preference); err != nil {
+		env.logger.Println(err.Error())
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintln(w, "Success")
+}
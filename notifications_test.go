@@ -0,0 +1,297 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testRenderNotificationTable = map[string]struct {
+	kind     NotificationKind
+	data     map[string]any
+	subject  string
+	expected bool
+}{
+	"registered": {NotificationRegistered, map[string]any{"username": "test_user"}, "Welcome, test_user", true},
+	"purchase":   {NotificationPurchase, map[string]any{"orderId": 4, "total": Money{17500, DefaultCurrency}}, "Order 4 confirmed", true},
+	"dispute":    {NotificationDispute, map[string]any{"disputeId": 2, "orderId": 4, "status": "under review"}, "Dispute 2 is under review", true},
+	"price drop": {NotificationPriceDrop, map[string]any{"itemId": 1, "itemName": "GPU", "price": Money{15000, DefaultCurrency},
+		"target": Money{15000, DefaultCurrency}}, "GPU dropped to 150.00 USD", true},
+	"missing data": {NotificationSale, map[string]any{"orderId": 4}, "", false},
+	"unknown kind": {NotificationKind("unknown"), map[string]any{}, "", false},
+}
+
+func TestRenderNotification(t *testing.T) {
+	t.Parallel()
+	for name, args := range testRenderNotificationTable {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			subject, _, err := renderNotification(args.kind, args.data)
+			if (err == nil) != args.expected || subject != args.subject {
+				t.Errorf("got %q, %v, expected %q", subject, err, args.subject)
+			}
+		})
+	}
+}
+
+var testNotificationEnabledTable = map[string]struct {
+	settings NotificationSettings
+	channel  NotificationChannel
+	expected bool
+}{
+	"in-app by default":   {NotificationSettings{}, ChannelInApp, true},
+	"email without one":   {NotificationSettings{}, ChannelEmail, false},
+	"email with one":      {NotificationSettings{email: "a@example.com"}, ChannelEmail, true},
+	"webhook with one":    {NotificationSettings{webhookURL: "https://example.com"}, ChannelWebhook, true},
+	"in-app turned off":   {NotificationSettings{preferences: []NotificationPreference{{NotificationSale, ChannelInApp, false}}}, ChannelInApp, false},
+	"other kind disabled": {NotificationSettings{preferences: []NotificationPreference{{NotificationDeposit, ChannelInApp, false}}}, ChannelInApp, true},
+	"email turned off": {NotificationSettings{email: "a@example.com", preferences: []NotificationPreference{{NotificationSale, ChannelEmail, false}}},
+		ChannelEmail, false},
+}
+
+func TestNotificationSettingsEnabled(t *testing.T) {
+	t.Parallel()
+	for name, args := range testNotificationEnabledTable {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			if answer := args.settings.enabled(NotificationSale, args.channel); answer != args.expected {
+				t.Errorf("got %v, expected %v", answer, args.expected)
+			}
+		})
+	}
+}
+
+func TestNotificationRetry(t *testing.T) {
+	t.Parallel()
+	now := time.Now()
+	for _, args := range []struct {
+		attempts int
+		status   NotificationStatus
+		at       time.Time
+	}{
+		{1, NotificationPending, now.Add(NotificationRetryDelay)},
+		{3, NotificationPending, now.Add(4 * NotificationRetryDelay)},
+		{MaxNotificationAttempts, NotificationFailed, now},
+	} {
+		if status, at := (Notification{attempts: args.attempts}).retry(now); status != args.status || !at.Equal(args.at) {
+			t.Errorf("bad retry after %v attempts, expected %v at %v, got %v at %v", args.attempts, args.status, args.at, status, at)
+		}
+	}
+}
+
+// recordingSender remembers the notifications it sends, failing them all if err is set
+type recordingSender struct {
+	sent []Notification
+	err  error
+}
+
+func (s *recordingSender) Send(notification Notification) error {
+	if s.err != nil {
+		return s.err
+	}
+	s.sent = append(s.sent, notification)
+	return nil
+}
+
+func TestParseWebhookURL(t *testing.T) {
+	t.Parallel()
+	for value, valid := range map[string]bool{
+		"":                          true,
+		"https://example.com/hook":  true,
+		"http://example.com/hook":   false,
+		"ftp://example.com/hook":    false,
+		"/hook":                     false,
+		"https:///hook":             false,
+		"https://127.0.0.1:80/hook": true, // refused when connecting
+	} {
+		if _, err := parseWebhookURL(value); (err == nil) != valid {
+			t.Errorf("%q: expected valid %v, got %v", value, valid, err)
+		}
+	}
+}
+
+func TestWebhookClient(t *testing.T) {
+	t.Parallel()
+
+	for ip, internal := range map[string]bool{
+		"127.0.0.1":       true,
+		"::1":             true,
+		"10.1.2.3":        true,
+		"172.16.0.1":      true,
+		"192.168.1.1":     true,
+		"169.254.169.254": true,
+		"fe80::1":         true,
+		"fd00::1":         true,
+		"0.0.0.0":         true,
+		"::":              true,
+		"::ffff:10.0.0.1": true,
+		"93.184.215.14":   false,
+		"2606:4700::1111": false,
+	} {
+		if isInternalIP(net.ParseIP(ip)) != internal {
+			t.Errorf("%v: expected internal %v", ip, internal)
+		}
+	}
+
+	redirect := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "https://169.254.169.254/latest/meta-data", http.StatusFound)
+	}))
+	defer redirect.Close()
+
+	// Test servers listen on the loopback, which is refused
+	client := NewWebhookClient(time.Second)
+	if _, err := client.Post(redirect.URL, "application/json", nil); !errors.Is(err, ErrInternalAddress) {
+		t.Errorf("posting to the loopback, expected %v, got %v", ErrInternalAddress, err)
+	}
+
+	// Redirects are returned rather than followed
+	client.Transport = redirect.Client().Transport
+	response, err := client.Post(redirect.URL, "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusFound {
+		t.Errorf("bad status code for redirect, expected %v, got %v", http.StatusFound, response.StatusCode)
+	}
+}
+
+func TestNotifications(t *testing.T) {
+	env := NewTestEnv()
+	env.db = newTestDB(t)
+	buyerId, sellerId := 1, 2
+
+	// Webhook notifications are posted to the user's endpoint
+	var received []webhookNotification
+	webhook := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var notification webhookNotification
+		if err := json.NewDecoder(r.Body).Decode(&notification); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		received = append(received, notification)
+	}))
+	defer webhook.Close()
+	email := &recordingSender{}
+	env.notificationSenders = map[NotificationChannel]NotificationSender{
+		ChannelEmail:   email,
+		ChannelWebhook: WebhookNotificationSender{webhook.Client()},
+	}
+
+	request := func(handler http.HandlerFunc, method string, target string, userId int) (int, string) {
+		t.Helper()
+		recorder := httptest.NewRecorder()
+		handler(recorder, newCartRequest(method, target, userId))
+		body, _ := io.ReadAll(recorder.Result().Body)
+		return recorder.Result().StatusCode, string(body)
+	}
+	for _, args := range []struct {
+		name     string
+		handler  http.HandlerFunc
+		userId   int
+		target   string
+		expected int
+	}{
+		{"InvalidEmail", env.UpdateNotificationContacts, buyerId, "/api/notifications/settings?email=nope", http.StatusBadRequest},
+		{"InvalidWebhook", env.UpdateNotificationContacts, buyerId, "/api/notifications/settings?webhook=ftp://example.com", http.StatusBadRequest},
+		{"BuyerContacts", env.UpdateNotificationContacts, buyerId, "/api/notifications/settings?email=Buyer+<buyer@example.com>&webhook=" + webhook.URL, http.StatusOK},
+		{"SellerContacts", env.UpdateNotificationContacts, sellerId, "/api/notifications/settings?email=seller@example.com", http.StatusOK},
+		{"UnknownKind", env.SetNotificationPreference, sellerId, "/api/notifications/preferences?kind=spam&channel=email&enabled=false", http.StatusBadRequest},
+		{"UnknownChannel", env.SetNotificationPreference, sellerId, "/api/notifications/preferences?kind=sale&channel=sms&enabled=false", http.StatusBadRequest},
+		{"InvalidEnabled", env.SetNotificationPreference, sellerId, "/api/notifications/preferences?kind=sale&channel=email&enabled=maybe", http.StatusBadRequest},
+		{"SellerNoSaleEmails", env.SetNotificationPreference, sellerId, "/api/notifications/preferences?kind=sale&channel=email&enabled=false", http.StatusOK},
+	} {
+		if status, body := request(args.handler, "PATCH", args.target, args.userId); status != args.expected {
+			t.Errorf("bad status code for %v, expected %v, got %v: %v", args.name, args.expected, status, body)
+		}
+	}
+	if _, body := request(env.NotificationSettings, "GET", "/api/notifications/settings", sellerId); !strings.Contains(body, "email: seller@example.com, webhook: none") ||
+		!strings.Contains(body, "kind: sale, channel: email, enabled: false") || !strings.Contains(body, "kind: purchase, channel: email, enabled: true") {
+		t.Errorf("bad notification settings, got %q", body)
+	}
+
+	// A purchase notifies the buyer on every channel and the seller in-app only, once its
+	// event is dispatched
+	creditTestWallet(buyerId, Money{17500, DefaultCurrency})
+	orderId, err := env.db.Purchase(buyerId, 1, 0, "", DefaultCurrency)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(notifications) != 0 {
+		t.Errorf("notified before the event was dispatched, got %v", notifications)
+	}
+	if _, err := env.dispatchEvents(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	enqueued := len(notifications)
+	if err := NotificationEventHandler(env.db)(domainEvents[len(domainEvents)-1]); err != nil || len(notifications) != enqueued {
+		t.Errorf("handling the purchase again enqueued %v more notifications, %v", len(notifications)-enqueued, err)
+	}
+	sent, err := env.deliverNotifications(time.Now())
+	if err != nil || sent != 2 {
+		t.Errorf("expected the buyer's email and webhook to be sent, got %v, %v", sent, err)
+	}
+	if len(email.sent) != 1 || email.sent[0].address != "buyer@example.com" || email.sent[0].subject != fmt.Sprintf("Order %v confirmed", orderId) {
+		t.Errorf("bad emails sent, got %v", email.sent)
+	}
+	if len(received) != 1 || received[0].Kind != NotificationPurchase {
+		t.Errorf("bad webhooks received, got %v", received)
+	}
+	if sent, _ := env.deliverNotifications(time.Now()); sent != 0 {
+		t.Errorf("notifications sent twice, got %v", sent)
+	}
+
+	_, body := request(env.Notifications, "GET", "/api/notifications", sellerId)
+	if !strings.Contains(body, fmt.Sprintf("You made a sale in order %v", orderId)) || strings.Count(body, "notification: ") != 1 {
+		t.Errorf("bad in-app notifications, got %q", body)
+	}
+	notificationId := notifications[len(notifications)-1].notificationId
+	for _, args := range []struct {
+		name     string
+		userId   int
+		expected int
+	}{
+		{"ReadOtherUsers", buyerId, http.StatusNotFound},
+		{"Read", sellerId, http.StatusNoContent},
+	} {
+		target := fmt.Sprintf("/api/notifications/%v/read", notificationId)
+		recorder := httptest.NewRecorder()
+		r := newCartRequest("POST", target, args.userId)
+		r.SetPathValue("id", fmt.Sprint(notificationId))
+		env.ReadNotification(recorder, r)
+		if status := recorder.Result().StatusCode; status != args.expected {
+			t.Errorf("bad status code for %v, expected %v, got %v", args.name, args.expected, status)
+		}
+	}
+	if _, body := request(env.Notifications, "GET", "/api/notifications", sellerId); strings.Contains(body, "read: no") {
+		t.Errorf("notification not marked read, got %q", body)
+	}
+
+	// Failed deliveries back off and give up after MaxNotificationAttempts
+	email.err = errors.New("relay down")
+	testEnqueueNotification(EventNotification{sellerId, NotificationDeposit, map[string]any{"depositId": 1, "amount": Money{100, DefaultCurrency}}})
+	failing := notifications[len(notifications)-1]
+	now := time.Now()
+	for attempt := 1; attempt <= MaxNotificationAttempts; attempt++ {
+		if sent, err := env.deliverNotifications(now); sent != 0 || err != nil {
+			t.Fatalf("attempt %v, expected nothing sent, got %v, %v", attempt, sent, err)
+		}
+		if retried, _ := env.deliverNotifications(now); retried != 0 {
+			t.Fatalf("attempt %v retried before its backoff", attempt)
+		}
+		now = now.Add(NotificationRetryDelay << (attempt - 1))
+	}
+	for _, notification := range notifications {
+		if notification.notificationId == failing.notificationId &&
+			(notification.status != NotificationFailed || notification.attempts != MaxNotificationAttempts || notification.lastError != "relay down") {
+			t.Errorf("expected the notification to fail after %v attempts, got %+v", MaxNotificationAttempts, notification)
+		}
+	}
+}
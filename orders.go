@@ -0,0 +1,389 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+var ErrInvalidTransition error = errors.New("invalid status transition")
+
+type OrderStatus string
+
+const (
+	OrderPending   OrderStatus = "pending"
+	OrderPaid      OrderStatus = "paid"
+	OrderFulfilled OrderStatus = "fulfilled"
+	OrderCancelled OrderStatus = "cancelled"
+	OrderRefunded  OrderStatus = "refunded"
+)
+
+// orderTransitions lists the statuses each status can move to, cancelled and
+// refunded are final
+var orderTransitions = map[OrderStatus][]OrderStatus{
+	OrderPending:   {OrderPaid, OrderCancelled},
+	OrderPaid:      {OrderFulfilled, OrderRefunded},
+	OrderFulfilled: {OrderRefunded},
+}
+
+func (s OrderStatus) CanTransition(to OrderStatus) bool {
+	for _, next := range orderTransitions[s] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+type OrderLine struct {
+	lineId    int
+	itemId    int
+	variantId int // 0 if the item has no variants
+	itemName  string
+	sku       string
+	quantity  int
+	unitPrice int      // list price in the order's currency
+	discount  int      // discount on the whole line
+	currency  Currency // the order's currency
+}
+
+func (o OrderLine) String() string {
+	return fmt.Sprintf("line: %v, item: %v, name: %v, sku: %v, price: %v, quantity: %v, discount: %v",
+		o.lineId, o.itemId, o.itemName, o.sku, Money{o.unitPrice, o.currency}, o.quantity, Money{o.discount, o.currency})
+}
+
+// orderTotals returns the amount to pay and the discount for lines
+func orderTotals(lines []OrderLine) (int, int) {
+	total, discount := 0, 0
+	for _, line := range lines {
+		total += line.unitPrice*line.quantity - line.discount
+		discount += line.discount
+	}
+	return total, discount
+}
+
+type Order struct {
+	orderId   int
+	userId    int
+	status    OrderStatus
+	total     int // amount paid
+	discount  int
+	currency  Currency
+	createdAt time.Time
+	updatedAt time.Time
+	lines     []OrderLine // only loaded for a single order
+}
+
+func (o Order) String() string {
+	return fmt.Sprintf("order: %v, status: %v, total: %v, discount: %v, created: %v, updated: %v",
+		o.orderId, o.status, Money{o.total, o.currency}, Money{o.discount, o.currency}, o.createdAt.String(), o.updatedAt.String())
+}
+
+// createOrder records an order for lines, and a purchase row per unit pointing at it with
+// the unit's share of the line discount. The total is taken from the buyer's wallet, failing
+// with ErrInsufficientFunds, and what each seller is owed for their lines is put in escrow
+// for EscrowPeriod. Line prices are in currency. couponId is 0 if no coupon was used
+func createOrder(tx *sql.Tx, userId int, status OrderStatus, currency Currency, lines []OrderLine, couponId int) (int, error) {
+	total, discount := orderTotals(lines)
+
+	var orderId int
+	addOrderQuery := `INSERT INTO orders (user_id, status, total, discount, currency, coupon_id)
+					  VALUES ($1, $2, CAST($3 AS NUMERIC(12, 0))/100, CAST($4 AS NUMERIC(12, 0))/100, $5, NULLIF($6, 0))
+					  RETURNING order_id`
+	err := tx.QueryRow(addOrderQuery, userId, status, total, discount, currency, couponId).Scan(&orderId)
+	if err != nil {
+		return 0, err
+	}
+
+	// Sum what each seller is owed, items without a seller are sold by the marketplace
+	itemIds := make(pq.Int64Array, len(lines))
+	for i, line := range lines {
+		itemIds[i] = int64(line.itemId)
+	}
+	rows, err := tx.Query(`SELECT item_id, COALESCE(seller_id, 0) FROM items WHERE item_id=ANY($1)`, itemIds)
+	if err != nil {
+		return 0, err
+	}
+	itemSellers := make(map[int]int)
+	for rows.Next() {
+		var itemId, sellerId int
+		if err = rows.Scan(&itemId, &sellerId); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		itemSellers[itemId] = sellerId
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+	proceeds := make(map[int]int)
+	for _, line := range lines {
+		if sellerId := itemSellers[line.itemId]; sellerId != 0 {
+			proceeds[sellerId] += line.unitPrice*line.quantity - line.discount
+		}
+	}
+
+	// Pay for the order, the sellers are paid when their escrow is released
+	err = debitWallet(tx, LedgerEntry{userId: userId, amount: Money{total, currency}, kind: LedgerPurchase, referenceId: orderId})
+	if err != nil {
+		return 0, err
+	}
+	if err = holdEscrows(tx, orderId, proceeds, currency, time.Now().Add(EscrowPeriod)); err != nil {
+		return 0, err
+	}
+
+	// Record the order with who sold each line, subscribers notify the buyer and sellers
+	event := purchaseCreatedEvent{OrderId: orderId, UserId: userId, Total: Money{total, currency}, Discount: Money{discount, currency}}
+	for _, line := range lines {
+		event.Lines = append(event.Lines, purchaseEventLine{line.itemId, line.variantId, itemSellers[line.itemId], line.quantity,
+			Money{line.unitPrice*line.quantity - line.discount, currency}})
+	}
+	if err = recordEvent(tx, EventPurchaseCreated, userId, event); err != nil {
+		return 0, err
+	}
+
+	addLineQuery := `INSERT INTO order_lines (order_id, item_id, variant_id, quantity, unit_price, discount)
+					 VALUES ($1, $2, NULLIF($3, 0), $4, CAST($5 AS NUMERIC(12, 0))/100, CAST($6 AS NUMERIC(12, 0))/100)`
+	addPurchaseQuery := `INSERT INTO purchases (user_id, item_id, variant_id, list_price, discount, price, currency, order_id, seller_id)
+						 VALUES ($1, $2, NULLIF($3, 0), CAST($4 AS NUMERIC(12, 0))/100, CAST($5 AS NUMERIC(12, 0))/100, CAST($6 AS NUMERIC(12, 0))/100,
+						 $7, $8, NULLIF($9, 0))`
+	for _, line := range lines {
+		_, err = tx.Exec(addLineQuery, orderId, line.itemId, line.variantId, line.quantity, line.unitPrice, line.discount)
+		if err != nil {
+			return 0, err
+		}
+		for _, unitDiscount := range unitDiscounts(line.discount, line.quantity) {
+			_, err = tx.Exec(addPurchaseQuery, userId, line.itemId, line.variantId, line.unitPrice, unitDiscount, line.unitPrice-unitDiscount,
+				currency, orderId, itemSellers[line.itemId])
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+	return orderId, nil
+}
+
+func (s *SqlDB) Orders(userId int) ([]Order, error) {
+	query := `SELECT order_id, user_id, status, CAST(total*100 AS BIGINT), CAST(discount*100 AS BIGINT), currency, created_at, updated_at
+			  FROM orders WHERE user_id=$1 ORDER BY order_id DESC`
+	rows, err := s.db.Query(query, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var orders []Order
+	var order Order
+
+	for rows.Next() {
+		err := rows.Scan(&order.orderId, &order.userId, &order.status, &order.total, &order.discount, &order.currency, &order.createdAt, &order.updatedAt)
+		if err != nil {
+			return nil, err
+		}
+		orders = append(orders, order)
+	}
+
+	return orders, rows.Err()
+}
+
+// GetOrder returns one of the user's orders with its lines
+func (s *SqlDB) GetOrder(userId int, orderId int) (Order, error) {
+	var order Order
+	orderQuery := `SELECT order_id, user_id, status, CAST(total*100 AS BIGINT), CAST(discount*100 AS BIGINT), currency, created_at, updated_at
+				   FROM orders WHERE order_id=$1 AND user_id=$2`
+	err := s.db.QueryRow(orderQuery, orderId, userId).Scan(&order.orderId, &order.userId, &order.status, &order.total, &order.discount,
+		&order.currency, &order.createdAt, &order.updatedAt)
+	if err != nil {
+		return Order{}, err
+	}
+
+	linesQuery := `SELECT order_lines.line_id, order_lines.item_id, COALESCE(order_lines.variant_id, 0), items.name, COALESCE(item_variants.sku, ''),
+				   order_lines.quantity, CAST(order_lines.unit_price*100 AS BIGINT), CAST(order_lines.discount*100 AS BIGINT)
+				   FROM order_lines
+				   JOIN items ON order_lines.item_id=items.item_id
+				   LEFT JOIN item_variants ON order_lines.variant_id=item_variants.variant_id
+				   WHERE order_lines.order_id=$1
+				   ORDER BY order_lines.line_id`
+	rows, err := s.db.Query(linesQuery, orderId)
+	if err != nil {
+		return Order{}, err
+	}
+	defer rows.Close()
+
+	line := OrderLine{currency: order.currency}
+	for rows.Next() {
+		err := rows.Scan(&line.lineId, &line.itemId, &line.variantId, &line.itemName, &line.sku, &line.quantity, &line.unitPrice, &line.discount)
+		if err != nil {
+			return Order{}, err
+		}
+		order.lines = append(order.lines, line)
+	}
+
+	return order, rows.Err()
+}
+
+// TransitionOrder moves an order to a new status, rejecting transitions the state
+// machine doesn't allow. Refunding credits the order total back to the buyer's wallet in
+// the order's currency, less what disputes already refunded, returning what is still in
+// escrow and taking released sale money back from the sellers, failing with
+// ErrInsufficientFunds if a seller has already withdrawn it
+func (s *SqlDB) TransitionOrder(orderId int, to OrderStatus) (err error) {
+	var tx *sql.Tx
+	tx, err = s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	// Rollback or commit depending on err
+	defer func() {
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	var userId int
+	var total Money
+	var status OrderStatus
+	getOrderQuery := `SELECT user_id, status, CAST(total*100 AS BIGINT), currency FROM orders WHERE order_id=$1 FOR UPDATE`
+	err = tx.QueryRow(getOrderQuery, orderId).Scan(&userId, &status, &total.amount, &total.currency)
+	if err != nil {
+		return err
+	}
+	if !status.CanTransition(to) {
+		return ErrInvalidTransition
+	}
+
+	if to == OrderRefunded {
+		if _, err = transitionEscrows(tx, orderId, EscrowRefunded); err != nil {
+			return err
+		}
+		if err = reverseSales(tx, orderId, userId, total.currency); err != nil {
+			return err
+		}
+
+		// Disputes may already have refunded part of the order
+		var refunded int
+		refundedQuery := `SELECT COALESCE(CAST(SUM(amount)*100 AS BIGINT), 0) FROM ledger_entries
+						  WHERE user_id=$1 AND reference_id=$2 AND kind=$3`
+		if err = tx.QueryRow(refundedQuery, userId, orderId, LedgerRefund).Scan(&refunded); err != nil {
+			return err
+		}
+		if total.amount > refunded {
+			refund := LedgerEntry{userId: userId, amount: Money{total.amount - refunded, total.currency}, kind: LedgerRefund, referenceId: orderId}
+			if _, err = creditWallet(tx, refund); err != nil {
+				return err
+			}
+		}
+	}
+
+	updateQuery := `UPDATE orders SET status=$1, updated_at=NOW() WHERE order_id=$2`
+	_, err = tx.Exec(updateQuery, to, orderId)
+	return err
+}
+
+// reverseSales takes back what the order's sellers were credited, keeping the hold of the
+// sale so held money stays balanced. The sellers' and buyer's wallets are locked
+func reverseSales(tx *sql.Tx, orderId int, buyerId int, currency Currency) error {
+	salesQuery := `SELECT user_id, CAST(SUM(amount)*100 AS BIGINT), MAX(held_until) FROM ledger_entries
+				   WHERE reference_id=$1 AND kind IN ($2, $3) GROUP BY user_id ORDER BY user_id`
+	rows, err := tx.Query(salesQuery, orderId, LedgerSale, LedgerSaleReversal)
+	if err != nil {
+		return err
+	}
+	var sales []LedgerEntry
+	for rows.Next() {
+		sale := LedgerEntry{amount: Money{currency: currency}, kind: LedgerSaleReversal, referenceId: orderId}
+		var heldUntil sql.NullTime
+		if err := rows.Scan(&sale.userId, &sale.amount.amount, &heldUntil); err != nil {
+			rows.Close()
+			return err
+		}
+		sale.heldUntil = heldUntil.Time
+		sales = append(sales, sale)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	userIds := []int{buyerId}
+	for _, sale := range sales {
+		userIds = append(userIds, sale.userId)
+	}
+	if err := lockWallets(tx, userIds, currency); err != nil {
+		return err
+	}
+	for _, sale := range sales {
+		if sale.amount.amount > 0 {
+			if err := debitWallet(tx, sale); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (env *Env) Orders(w http.ResponseWriter, r *http.Request) {
+	userId, ok := r.Context().Value(CtxUserId).(int)
+	if !ok {
+		env.logger.Println("context does not include userId for protected endpoint")
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	// Get order history
+	orders, err := env.db.Orders(userId)
+	if err != nil {
+		env.logger.Println(err.Error())
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	// Print orders, newest first
+	for _, order := range orders {
+		fmt.Fprintln(w, order)
+	}
+}
+
+func (env *Env) Order(w http.ResponseWriter, r *http.Request) {
+	userId, ok := r.Context().Value(CtxUserId).(int)
+	if !ok {
+		env.logger.Println("context does not include userId for protected endpoint")
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	// Get order id
+	orderId, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	// Get order, other users' orders are reported as not found
+	order, err := env.db.GetOrder(userId, orderId)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+		env.logger.Println(err.Error())
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	// Print order followed by its lines
+	fmt.Fprintln(w, order)
+	for _, line := range order.lines {
+		fmt.Fprintln(w, line)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+var testOrderTransitionsTable = map[string]struct {
+	from     OrderStatus
+	to       OrderStatus
+	expected bool
+}{
+	"pay pending":        {OrderPending, OrderPaid, true},
+	"cancel pending":     {OrderPending, OrderCancelled, true},
+	"fulfil paid":        {OrderPaid, OrderFulfilled, true},
+	"refund paid":        {OrderPaid, OrderRefunded, true},
+	"refund fulfilled":   {OrderFulfilled, OrderRefunded, true},
+	"fulfil pending":     {OrderPending, OrderFulfilled, false},
+	"cancel paid":        {OrderPaid, OrderCancelled, false},
+	"reopen cancelled":   {OrderCancelled, OrderPending, false},
+	"refund refunded":    {OrderRefunded, OrderRefunded, false},
+	"unfulfil fulfilled": {OrderFulfilled, OrderPaid, false},
+}
+
+func TestOrderStatusCanTransition(t *testing.T) {
+	t.Parallel()
+	for name, args := range testOrderTransitionsTable {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			if answer := args.from.CanTransition(args.to); answer != args.expected {
+				t.Errorf("%v -> %v, got %v, expected %v", args.from, args.to, answer, args.expected)
+			}
+		})
+	}
+}
+
+func TestOrders(t *testing.T) {
+	env := NewTestEnv()
+	env.db = newTestDB(t)
+	richUserId := 2
+	startBalance, _ := env.db.Balance(richUserId, DefaultCurrency)
+
+	orderId, err := env.db.Purchase(richUserId, 2, 0, "", DefaultCurrency)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	getOrder := func(userId int) *http.Response {
+		recorder := httptest.NewRecorder()
+		request := newCartRequest("GET", "/api/orders/"+strconv.Itoa(orderId), userId)
+		request.SetPathValue("id", strconv.Itoa(orderId))
+		env.Order(recorder, request)
+		return recorder.Result()
+	}
+
+	t.Run("OrderHistory", func(t *testing.T) {
+		recorder := httptest.NewRecorder()
+		env.Orders(recorder, newCartRequest("GET", "/api/orders", richUserId))
+		body, _ := io.ReadAll(recorder.Result().Body)
+		if !strings.HasPrefix(string(body), "order: "+strconv.Itoa(orderId)+", status: paid") {
+			t.Errorf("expected newest order first, got %q", body)
+		}
+	})
+
+	t.Run("OrderDetail", func(t *testing.T) {
+		result := getOrder(richUserId)
+		if result.StatusCode != http.StatusOK {
+			t.Fatalf("bad status code for own order, expected %v, got %v", http.StatusOK, result.StatusCode)
+		}
+		body, _ := io.ReadAll(result.Body)
+		if !strings.Contains(string(body), "name: AMD Ryzen 5 5600X") {
+			t.Errorf("order detail missing line, got %q", body)
+		}
+	})
+
+	t.Run("OrderOtherUser", func(t *testing.T) {
+		if result := getOrder(1); result.StatusCode != http.StatusNotFound {
+			t.Errorf("bad status code for another user's order, expected %v, got %v", http.StatusNotFound, result.StatusCode)
+		}
+	})
+
+	t.Run("OrderRefund", func(t *testing.T) {
+		if err := env.db.TransitionOrder(orderId, OrderPending); err != ErrInvalidTransition {
+			t.Errorf("expected ErrInvalidTransition, got %v", err)
+		}
+		if err := env.db.TransitionOrder(orderId, OrderRefunded); err != nil {
+			t.Fatal(err)
+		}
+		if balance, _ := env.db.Balance(richUserId, DefaultCurrency); balance != startBalance {
+			t.Errorf("bad balance after refund, expected %v, got %v", startBalance, balance)
+		}
+	})
+}
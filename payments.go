@@ -0,0 +1,227 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrUnknownIntent error = errors.New("unknown payment intent")
+var ErrInvalidWebhook error = errors.New("invalid webhook signature")
+var ErrRefundTooLarge error = errors.New("refund larger than the payment")
+var ErrPayoutDeclined error = errors.New("payout declined")
+
+const (
+	MaxWebhookSize   = 64 << 10 // bytes
+	WebhookTolerance = 5 * time.Minute
+)
+
+type PaymentStatus string
+
+const (
+	PaymentPending   PaymentStatus = "pending"
+	PaymentSucceeded PaymentStatus = "succeeded"
+	PaymentFailed    PaymentStatus = "failed"
+	PaymentRefunded  PaymentStatus = "refunded"
+)
+
+// PaymentIntent is a payment the provider has been asked to collect
+type PaymentIntent struct {
+	intentId string
+	amount   Money
+	status   PaymentStatus
+}
+
+// PaymentEvent is a change in the status of an intent reported by a webhook
+type PaymentEvent struct {
+	IntentId string        `json:"intent"`
+	Status   PaymentStatus `json:"status"`
+}
+
+// PaymentProvider collects money from outside the marketplace. Intents are created
+// pending and reported succeeded or failed either by Confirm or by a webhook, whichever
+// the provider does first
+type PaymentProvider interface {
+	CreateIntent(amount Money) (PaymentIntent, error)
+	Confirm(intentId string) (PaymentIntent, error)
+	Refund(intentId string, amount Money) error
+	VerifyWebhook(header http.Header, payload []byte, now time.Time) (PaymentEvent, error)
+}
+
+// FakePaymentProvider keeps intents in memory and succeeds every confirmation, for tests
+// and local development. Webhooks are signed like "t=<unix time>,v1=<hex hmac>" in the
+// Payment-Signature header, SignWebhook produces them
+type FakePaymentProvider struct {
+	secret  []byte
+	mu      sync.Mutex
+	intents map[string]PaymentIntent
+}
+
+func NewFakePaymentProvider(secret []byte) *FakePaymentProvider {
+	return &FakePaymentProvider{secret: secret, intents: make(map[string]PaymentIntent)}
+}
+
+func (f *FakePaymentProvider) CreateIntent(amount Money) (PaymentIntent, error) {
+	token, err := generateToken(TokenLength)
+	if err != nil {
+		return PaymentIntent{}, err
+	}
+	intent := PaymentIntent{intentId: "fake_" + token, amount: amount, status: PaymentPending}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.intents[intent.intentId] = intent
+	return intent, nil
+}
+
+// Confirm succeeds pending intents, intents that are already settled are returned as is
+func (f *FakePaymentProvider) Confirm(intentId string) (PaymentIntent, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	intent, ok := f.intents[intentId]
+	if !ok {
+		return PaymentIntent{}, ErrUnknownIntent
+	}
+	if intent.status == PaymentPending {
+		intent.status = PaymentSucceeded
+		f.intents[intentId] = intent
+	}
+	return intent, nil
+}
+
+// Refund refunds a succeeded intent, only whole refunds are recorded as refunded
+func (f *FakePaymentProvider) Refund(intentId string, amount Money) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	intent, ok := f.intents[intentId]
+	if !ok || intent.status != PaymentSucceeded {
+		return ErrUnknownIntent
+	}
+	if amount.currency != intent.amount.currency {
+		return ErrCurrencyMismatch
+	}
+	if amount.amount > intent.amount.amount {
+		return ErrRefundTooLarge
+	}
+	if amount.amount == intent.amount.amount {
+		intent.status = PaymentRefunded
+		f.intents[intentId] = intent
+	}
+	return nil
+}
+
+// webhookSignature is the hex HMAC-SHA256 of "<timestamp>.<payload>" with secret, how
+// webhooks are signed both by payment providers and by the marketplace
+func webhookSignature(secret []byte, timestamp int64, payload []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte{'.'})
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (f *FakePaymentProvider) signature(timestamp int64, payload []byte) string {
+	return webhookSignature(f.secret, timestamp, payload)
+}
+
+// SignWebhook returns the payload and headers the fake provider would send for event. The
+// intent takes the event's status, as it would have at a real provider sending it
+func (f *FakePaymentProvider) SignWebhook(event PaymentEvent, now time.Time) ([]byte, http.Header, error) {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	f.mu.Lock()
+	if intent, ok := f.intents[event.IntentId]; ok {
+		intent.status = event.Status
+		f.intents[event.IntentId] = intent
+	}
+	f.mu.Unlock()
+
+	header := http.Header{}
+	header.Set("Payment-Signature", fmt.Sprintf("t=%v,v1=%v", now.Unix(), f.signature(now.Unix(), payload)))
+	return payload, header, nil
+}
+
+// VerifyWebhook checks the signature over the timestamp and payload, rejecting webhooks
+// signed more than WebhookTolerance away from now so they can't be replayed later
+func (f *FakePaymentProvider) VerifyWebhook(header http.Header, payload []byte, now time.Time) (PaymentEvent, error) {
+	var timestamp int64 = -1
+	var signatures []string
+	for _, part := range strings.Split(header.Get("Payment-Signature"), ",") {
+		key, value, _ := strings.Cut(part, "=")
+		switch key {
+		case "t":
+			parsed, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return PaymentEvent{}, ErrInvalidWebhook
+			}
+			timestamp = parsed
+		case "v1":
+			signatures = append(signatures, value)
+		}
+	}
+	if timestamp < 0 || now.Sub(time.Unix(timestamp, 0)).Abs() > WebhookTolerance {
+		return PaymentEvent{}, ErrInvalidWebhook
+	}
+
+	// Any of the signatures may match, providers send several while rotating secrets
+	expected := []byte(f.signature(timestamp, payload))
+	valid := false
+	for _, signature := range signatures {
+		if hmac.Equal([]byte(signature), expected) {
+			valid = true
+		}
+	}
+	if !valid {
+		return PaymentEvent{}, ErrInvalidWebhook
+	}
+
+	var event PaymentEvent
+	if err := json.Unmarshal(payload, &event); err != nil || len(event.IntentId) == 0 {
+		return PaymentEvent{}, ErrInvalidWebhook
+	}
+	return event, nil
+}
+
+// PayoutProvider sends money out of the marketplace to the user's account with the
+// provider. Payouts with the same idempotency key are only sent once, so a payout that
+// failed part way can be retried safely. ErrPayoutDeclined is returned if the provider
+// refuses the payout
+type PayoutProvider interface {
+	Payout(userId int, amount Money, idempotencyKey string) (string, error)
+}
+
+// FakePayoutProvider records payouts in memory and sends every one, for tests and local
+// development
+type FakePayoutProvider struct {
+	mu      sync.Mutex
+	payouts map[string]string // payout ids by idempotency key
+}
+
+func NewFakePayoutProvider() *FakePayoutProvider {
+	return &FakePayoutProvider{payouts: make(map[string]string)}
+}
+
+func (f *FakePayoutProvider) Payout(userId int, amount Money, idempotencyKey string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if payoutId, ok := f.payouts[idempotencyKey]; ok {
+		return payoutId, nil
+	}
+	token, err := generateToken(TokenLength)
+	if err != nil {
+		return "", err
+	}
+	f.payouts[idempotencyKey] = "fake_po_" + token
+	return f.payouts[idempotencyKey], nil
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+// newPostgresDB connects to the database PG_TEST_URL names and empties it, skipping the
+// test if it isn't set. The tests here run the SQL TestDB stands in for, so the database
+// must be a disposable one with schema.dump loaded and the migrations applied
+func newPostgresDB(t *testing.T) *SqlDB {
+	t.Helper()
+	url := os.Getenv("PG_TEST_URL")
+	if len(url) == 0 {
+		t.Skip("PG_TEST_URL not set")
+	}
+	t.Setenv("PG_URL", url)
+	db, err := NewSqlDB(testRates)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+		db.db.Close()
+	})
+
+	var tables string
+	tablesQuery := `SELECT string_agg(format('%I.%I', schemaname, tablename), ', ') FROM pg_tables WHERE schemaname='public'`
+	if err := db.db.QueryRow(tablesQuery).Scan(&tables); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.db.Exec(`TRUNCATE ` + tables + ` RESTART IDENTITY CASCADE`); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// addPostgresUser registers a user whose wallet holds balance
+func addPostgresUser(t *testing.T, db *SqlDB, username string, balance int) int {
+	t.Helper()
+	user, err := db.Register(username, "hash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if balance != 0 {
+		opening := LedgerEntry{userId: user.userId, amount: Money{balance, DefaultCurrency}, kind: LedgerAdjustment}
+		if _, err := creditWallet(db.db, opening); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return user.userId
+}
+
+// postgresPurchase buys an item the seller, or the marketplace if sellerId is 0, sells at
+// price, returning the order and purchase
+func postgresPurchase(t *testing.T, db *SqlDB, buyerId int, sellerId int, price int) (int, int) {
+	t.Helper()
+	var itemId, purchaseId int
+	addItemQuery := `INSERT INTO items (name, price, seller_id) VALUES ('Test item', CAST($1 AS NUMERIC(12, 0))/100, NULLIF($2, 0)) RETURNING item_id`
+	if err := db.db.QueryRow(addItemQuery, price, sellerId).Scan(&itemId); err != nil {
+		t.Fatal(err)
+	}
+	orderId, err := db.Purchase(buyerId, itemId, 0, "", DefaultCurrency)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.db.QueryRow(`SELECT purchase_id FROM purchases WHERE order_id=$1`, orderId).Scan(&purchaseId); err != nil {
+		t.Fatal(err)
+	}
+	return orderId, purchaseId
+}
+
+func expectPostgresBalance(t *testing.T, db *SqlDB, name string, userId int, expected int) {
+	t.Helper()
+	if balance, err := db.Balance(userId, DefaultCurrency); err != nil || balance.amount != expected {
+		t.Errorf("%v: bad balance for user %v, expected %v, got %v, %v", name, userId, expected, balance.amount, err)
+	}
+}
+
+func expectPostgresEscrow(t *testing.T, db *SqlDB, name string, sellerId int, amount int, status EscrowStatus) {
+	t.Helper()
+	escrows, err := db.Escrows(sellerId)
+	if err != nil || len(escrows) != 1 || escrows[0].amount.amount != amount || escrows[0].status != status {
+		t.Errorf("%v: expected %v %v in escrow, got %v, %v", name, amount, status, escrows, err)
+	}
+}
+
+// TestPostgresDisputeRefunds refunds a dispute from escrow, releases what is left and then
+// refunds the order, taking the released sale back from the seller
+func TestPostgresDisputeRefunds(t *testing.T) {
+	db := newPostgresDB(t)
+	buyerId := addPostgresUser(t, db, "buyer", 17500)
+	sellerId := addPostgresUser(t, db, "seller", 0)
+	orderId, purchaseId := postgresPurchase(t, db, buyerId, sellerId, 17500)
+	expectPostgresBalance(t, db, "purchase", buyerId, 0)
+	expectPostgresEscrow(t, db, "purchase", sellerId, 17500, EscrowHeld)
+
+	now := time.Now()
+	dispute, err := db.OpenDispute(buyerId, purchaseId, "scratched", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectPostgresEscrow(t, db, "open dispute", sellerId, 17500, EscrowFrozen)
+	if _, err := db.ConfirmReceipt(buyerId, orderId, now); err != ErrEscrowFrozen {
+		t.Errorf("confirmed receipt of a disputed order, expected %v, got %v", ErrEscrowFrozen, err)
+	}
+
+	// A partial refund comes out of escrow, which is held again once the dispute closes
+	if _, err := db.TransitionDispute(dispute.disputeId, DisputeRefunded, 5000, 0); err != nil {
+		t.Fatal(err)
+	}
+	expectPostgresBalance(t, db, "partial refund", buyerId, 5000)
+	expectPostgresEscrow(t, db, "partial refund", sellerId, 12500, EscrowHeld)
+
+	released, err := db.ConfirmReceipt(buyerId, orderId, now)
+	if err != nil || len(released) != 1 {
+		t.Fatalf("expected the escrow to be released, got %v, %v", released, err)
+	}
+	expectPostgresBalance(t, db, "release", sellerId, 12500)
+	expectPostgresEscrow(t, db, "release", sellerId, 12500, EscrowReleased)
+	ledger, err := db.Ledger(sellerId)
+	if err != nil || len(ledger) != 1 || ledger[0].kind != LedgerSale || ledger[0].heldUntil.Before(now.Add(SaleHold-time.Second)) {
+		t.Errorf("expected a held sale in the seller's ledger, got %v, %v", ledger, err)
+	}
+
+	// Refunding the order takes the sale back and credits the buyer what is left
+	if err := db.TransitionOrder(orderId, OrderRefunded); err != nil {
+		t.Fatal(err)
+	}
+	expectPostgresBalance(t, db, "order refund", buyerId, 17500)
+	expectPostgresBalance(t, db, "order refund", sellerId, 0)
+	ledger, _ = db.Ledger(sellerId)
+	if len(ledger) != 2 || ledger[0].kind != LedgerSaleReversal || ledger[0].amount.amount != -12500 || !ledger[0].heldUntil.Equal(ledger[1].heldUntil) {
+		t.Errorf("expected the sale reversed under the same hold, got %v", ledger)
+	}
+}
+
+// TestPostgresReassignedSellerRefund refunds disputes over items that got another seller
+// after they were sold, which are settled with whoever sold them at the time
+func TestPostgresReassignedSellerRefund(t *testing.T) {
+	db := newPostgresDB(t)
+	buyerId := addPostgresUser(t, db, "buyer", 35000)
+	sellerId := addPostgresUser(t, db, "seller", 0)
+	newSellerId := addPostgresUser(t, db, "new_seller", 5000)
+	_, purchaseId := postgresPurchase(t, db, buyerId, sellerId, 17500)
+	_, marketplacePurchaseId := postgresPurchase(t, db, buyerId, 0, 17500)
+
+	now := time.Now()
+	for _, args := range []struct {
+		purchaseId int
+		sellerId   int
+	}{
+		{purchaseId, sellerId},
+		{marketplacePurchaseId, 0},
+	} {
+		var itemId int
+		if err := db.db.QueryRow(`SELECT item_id FROM purchases WHERE purchase_id=$1`, args.purchaseId).Scan(&itemId); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.SetItemSeller(itemId, "new_seller"); err != nil {
+			t.Fatal(err)
+		}
+		dispute, err := db.OpenDispute(buyerId, args.purchaseId, "not as described", now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dispute.sellerId != args.sellerId {
+			t.Errorf("purchase %v, expected the dispute against seller %v, got %v", args.purchaseId, args.sellerId, dispute.sellerId)
+		}
+		if _, err := db.TransitionDispute(dispute.disputeId, DisputeRefunded, 0, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expectPostgresBalance(t, db, "refunds", buyerId, 35000)
+	expectPostgresBalance(t, db, "refunds", newSellerId, 5000)
+	expectPostgresEscrow(t, db, "refunds", sellerId, 0, EscrowRefunded)
+	if escrows, err := db.Escrows(newSellerId); err != nil || len(escrows) != 0 {
+		t.Errorf("expected the new seller to have no escrow, got %v, %v", escrows, err)
+	}
+}
+
+// TestPostgresReleasedDisputeRefund refunds a dispute after the escrow was released, which
+// takes the refund from the seller's wallet and fails if they no longer have it
+func TestPostgresReleasedDisputeRefund(t *testing.T) {
+	db := newPostgresDB(t)
+	buyerId := addPostgresUser(t, db, "buyer", 17500)
+	sellerId := addPostgresUser(t, db, "seller", 0)
+	orderId, purchaseId := postgresPurchase(t, db, buyerId, sellerId, 17500)
+
+	now := time.Now()
+	if _, err := db.ConfirmReceipt(buyerId, orderId, now); err != nil {
+		t.Fatal(err)
+	}
+	dispute, err := db.OpenDispute(buyerId, purchaseId, "broke after a week", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectPostgresEscrow(t, db, "open dispute", sellerId, 17500, EscrowReleased)
+
+	// The seller spends part of the sale
+	tx, err := db.db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := debitWallet(tx, LedgerEntry{userId: sellerId, amount: Money{7500, DefaultCurrency}, kind: LedgerAdjustment}); err != nil {
+		tx.Rollback()
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := db.TransitionDispute(dispute.disputeId, DisputeRefunded, 0, 0); err != ErrInsufficientFunds {
+		t.Errorf("refunded more than the seller has, expected %v, got %v", ErrInsufficientFunds, err)
+	}
+	expectPostgresBalance(t, db, "failed refund", buyerId, 0)
+	expectPostgresBalance(t, db, "failed refund", sellerId, 10000)
+	if dispute, _ := db.GetDispute(dispute.disputeId); dispute.status != DisputeOpen {
+		t.Errorf("failed refund changed the dispute, got %v", dispute)
+	}
+
+	if _, err := db.TransitionDispute(dispute.disputeId, DisputeRefunded, 10000, 0); err != nil {
+		t.Fatal(err)
+	}
+	expectPostgresBalance(t, db, "refund", buyerId, 10000)
+	expectPostgresBalance(t, db, "refund", sellerId, 0)
+}
+
+// TestPostgresReleasedRefundHold refunds a released sale in full, which takes its hold
+// back with it so the seller's other money can still be withdrawn
+func TestPostgresReleasedRefundHold(t *testing.T) {
+	db := newPostgresDB(t)
+	buyerId := addPostgresUser(t, db, "buyer", 17500)
+	sellerId := addPostgresUser(t, db, "seller", 5000)
+	orderId, purchaseId := postgresPurchase(t, db, buyerId, sellerId, 17500)
+
+	expectAvailable := func(name string, balance int, available int) {
+		t.Helper()
+		tx, err := db.db.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tx.Rollback()
+		total, spendable, err := availableBalance(tx, sellerId, DefaultCurrency, time.Now())
+		if err != nil || total.amount != balance || spendable.amount != available {
+			t.Errorf("%v: expected %v available of %v, got %v of %v, %v", name, available, balance, spendable.amount, total.amount, err)
+		}
+	}
+
+	now := time.Now()
+	if _, err := db.ConfirmReceipt(buyerId, orderId, now); err != nil {
+		t.Fatal(err)
+	}
+	expectAvailable("release", 22500, 5000)
+	dispute, err := db.OpenDispute(buyerId, purchaseId, "never arrived", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.TransitionDispute(dispute.disputeId, DisputeRefunded, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	expectAvailable("refund", 5000, 5000)
+	ledger, _ := db.Ledger(sellerId)
+	if len(ledger) != 3 || ledger[0].kind != LedgerSaleReversal || ledger[0].amount.amount != -17500 || !ledger[0].heldUntil.Equal(ledger[1].heldUntil) {
+		t.Errorf("expected the sale reversed under the same hold, got %v", ledger)
+	}
+}
+
+// TestPostgresReleaseDueEscrows releases escrows once they are due, at the largest amount
+// the columns hold
+func TestPostgresReleaseDueEscrows(t *testing.T) {
+	db := newPostgresDB(t)
+	buyerId := addPostgresUser(t, db, "buyer", MaxAmount)
+	sellerId := addPostgresUser(t, db, "seller", 0)
+	postgresPurchase(t, db, buyerId, sellerId, MaxAmount)
+	expectPostgresEscrow(t, db, "purchase", sellerId, MaxAmount, EscrowHeld)
+
+	now := time.Now()
+	if released, err := db.ReleaseDueEscrows(now); released != 0 || err != nil {
+		t.Errorf("released escrow before it was due, got %v, %v", released, err)
+	}
+	if released, err := db.ReleaseDueEscrows(now.Add(EscrowPeriod + time.Minute)); released != 1 || err != nil {
+		t.Errorf("expected the due escrow released, got %v, %v", released, err)
+	}
+	expectPostgresBalance(t, db, "release", sellerId, MaxAmount)
+	expectPostgresEscrow(t, db, "release", sellerId, MaxAmount, EscrowReleased)
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// PriceSchedulerInterval is the longest the scheduler sleeps between checks, it wakes
+// earlier for the next known change or when a change is scheduled
+const PriceSchedulerInterval = time.Minute
+
+// ItemPrice is an entry in an item's price history. Sales have an end time and revert to
+// the regular price, the latest applied change without one
+type ItemPrice struct {
+	priceId   int
+	itemId    int
+	price     int
+	currency  Currency // the item's currency
+	startsAt  time.Time
+	endsAt    time.Time // zero unless the change is a sale
+	appliedAt time.Time // zero until the scheduler applies the change
+	endedAt   time.Time // zero until the scheduler ends the sale
+}
+
+func (p ItemPrice) isSale() bool {
+	return !p.endsAt.IsZero()
+}
+
+func (p ItemPrice) status() string {
+	switch {
+	case p.appliedAt.IsZero():
+		return "scheduled"
+	case !p.isSale():
+		return "applied"
+	case p.endedAt.IsZero():
+		return "on sale"
+	default:
+		return "ended"
+	}
+}
+
+func (p ItemPrice) String() string {
+	ends := "none"
+	if p.isSale() {
+		ends = p.endsAt.String()
+	}
+	return fmt.Sprintf("id: %v, price: %v, starts: %v, ends: %v, status: %v",
+		p.priceId, Money{p.price, p.currency}, p.startsAt.String(), ends, p.status())
+}
+
+// SchedulePriceChange records a price change for the scheduler to apply at its start time.
+// Items without history get their current price as the first entry so there is always a
+// regular price for sales to revert to
+func (s *SqlDB) SchedulePriceChange(change ItemPrice) (priceId int, err error) {
+	var tx *sql.Tx
+	tx, err = s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	// Rollback or commit depending on err
+	defer func() {
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	baselineQuery := `INSERT INTO item_prices (item_id, price, starts_at, applied_at)
+					  SELECT item_id, price, NOW(), NOW() FROM items
+					  WHERE item_id=$1 AND NOT EXISTS (SELECT 1 FROM item_prices WHERE item_id=$1)`
+	if _, err = tx.Exec(baselineQuery, change.itemId); err != nil {
+		return 0, err
+	}
+
+	endsAt := sql.NullTime{Time: change.endsAt, Valid: change.isSale()}
+	addQuery := `INSERT INTO item_prices (item_id, price, starts_at, ends_at)
+				 VALUES ($1, CAST($2 AS NUMERIC(12, 0))/100, $3, $4) RETURNING price_id`
+	err = tx.QueryRow(addQuery, change.itemId, change.price, change.startsAt, endsAt).Scan(&priceId)
+	return priceId, err
+}
+
+// ItemPrices returns an item's price history, newest first. Changes that haven't been
+// applied yet are only included if includeScheduled is set
+func (s *SqlDB) ItemPrices(itemId int, includeScheduled bool) ([]ItemPrice, error) {
+	query := `SELECT item_prices.price_id, item_prices.item_id, CAST(item_prices.price*100 AS BIGINT), items.currency,
+			  item_prices.starts_at, item_prices.ends_at, item_prices.applied_at, item_prices.ended_at
+			  FROM item_prices JOIN items ON item_prices.item_id=items.item_id
+			  WHERE item_prices.item_id=$1 AND (item_prices.applied_at IS NOT NULL OR $2)
+			  ORDER BY item_prices.starts_at DESC, item_prices.price_id DESC`
+	rows, err := s.db.Query(query, itemId, includeScheduled)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var prices []ItemPrice
+	for rows.Next() {
+		var price ItemPrice
+		var endsAt, appliedAt, endedAt sql.NullTime
+		err := rows.Scan(&price.priceId, &price.itemId, &price.price, &price.currency, &price.startsAt, &endsAt, &appliedAt, &endedAt)
+		if err != nil {
+			return nil, err
+		}
+		price.endsAt, price.appliedAt, price.endedAt = endsAt.Time, appliedAt.Time, endedAt.Time
+		prices = append(prices, price)
+	}
+
+	return prices, rows.Err()
+}
+
+// ApplyPriceChanges applies changes that have started and ends sales that are over as of
+// now, then sets each affected item to its current price: the latest running sale if
+// there is one, otherwise the latest applied regular price. It returns the number of
+// changes applied or ended, alerts for the price watches they triggered and when the next
+// change is due, zero if none are
+func (s *SqlDB) ApplyPriceChanges(now time.Time) (changed int, alerts []PriceAlert, next time.Time, err error) {
+	var tx *sql.Tx
+	tx, err = s.db.Begin()
+	if err != nil {
+		return 0, nil, time.Time{}, err
+	}
+
+	// Rollback or commit depending on err
+	defer func() {
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	var itemIds []int64
+	for _, query := range []string{
+		`UPDATE item_prices SET applied_at=$1 WHERE applied_at IS NULL AND starts_at<=$1 RETURNING item_id`,
+		`UPDATE item_prices SET ended_at=$1 WHERE ended_at IS NULL AND applied_at IS NOT NULL AND ends_at<=$1 RETURNING item_id`,
+	} {
+		var ids pq.Int64Array
+		err = tx.QueryRow(`WITH changed AS (`+query+`) SELECT ARRAY(SELECT item_id FROM changed)`, now).Scan(&ids)
+		if err != nil {
+			return 0, nil, time.Time{}, err
+		}
+		changed += len(ids)
+		itemIds = append(itemIds, ids...)
+	}
+
+	if len(itemIds) != 0 {
+		updateItemsQuery := `UPDATE items SET price=current.price FROM (
+								 SELECT DISTINCT ON (item_id) item_id, price FROM item_prices
+								 WHERE item_id=ANY($1) AND applied_at IS NOT NULL AND ended_at IS NULL
+								 ORDER BY item_id, (ends_at IS NOT NULL) DESC, starts_at DESC, price_id DESC
+							 ) AS current
+							 WHERE items.item_id=current.item_id
+							 RETURNING items.item_id, COALESCE(items.seller_id, 0), CAST(items.price*100 AS BIGINT), items.currency`
+		var rows *sql.Rows
+		rows, err = tx.Query(updateItemsQuery, pq.Int64Array(itemIds))
+		if err != nil {
+			return 0, nil, time.Time{}, err
+		}
+		var updated []itemUpdatedEvent
+		for rows.Next() {
+			var item itemUpdatedEvent
+			if err = rows.Scan(&item.ItemId, &item.SellerId, &item.Price.amount, &item.Price.currency); err != nil {
+				rows.Close()
+				return 0, nil, time.Time{}, err
+			}
+			updated = append(updated, item)
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return 0, nil, time.Time{}, err
+		}
+
+		// Record each item's new price for its seller
+		for _, item := range updated {
+			if err = recordEvent(tx, EventItemUpdated, item.SellerId, item); err != nil {
+				return 0, nil, time.Time{}, err
+			}
+		}
+		if alerts, err = triggerPriceWatches(tx, itemIds, now); err != nil {
+			return 0, nil, time.Time{}, err
+		}
+	}
+
+	var nextTime sql.NullTime
+	nextQuery := `SELECT LEAST(
+					  (SELECT MIN(starts_at) FROM item_prices WHERE applied_at IS NULL),
+					  (SELECT MIN(ends_at) FROM item_prices WHERE ends_at IS NOT NULL AND ended_at IS NULL)
+				  )`
+	err = tx.QueryRow(nextQuery).Scan(&nextTime)
+	return changed, alerts, nextTime.Time, err
+}
+
+// schedulerDelay returns how long the scheduler should sleep before the next change at
+// next, capped at PriceSchedulerInterval
+func schedulerDelay(next time.Time, now time.Time) time.Duration {
+	if next.IsZero() {
+		return PriceSchedulerInterval
+	}
+	return max(min(next.Sub(now), PriceSchedulerInterval), 0)
+}
+
+// RunPriceScheduler applies price changes as they come due until done is closed
+func (env *Env) RunPriceScheduler(done <-chan struct{}) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+		case <-env.priceChanges:
+			timer.Stop()
+		case <-done:
+			return
+		}
+
+		now := time.Now()
+		changed, alerts, next, err := env.db.ApplyPriceChanges(now)
+		if err != nil {
+			env.logger.Println("price scheduler:", err.Error())
+		} else if changed != 0 {
+			env.logger.Println("price scheduler: applied", changed, "price changes, raising", len(alerts), "price alerts")
+		}
+		timer.Reset(schedulerDelay(next, now))
+	}
+}
+
+// parseTimeParam parses an optional RFC 3339 time, returning the zero time if value is empty
+func parseTimeParam(value string) (time.Time, error) {
+	if len(value) == 0 {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+func (env *Env) PriceHistory(w http.ResponseWriter, r *http.Request) {
+	userId, ok := r.Context().Value(CtxUserId).(int)
+	if !ok {
+		env.logger.Println("context does not include userId for protected endpoint")
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	// Get item
+	itemId, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	item, err := env.db.GetItem(itemId)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+		env.logger.Println(err.Error())
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	// Get history, upcoming changes are only shown to the seller
+	prices, err := env.db.ItemPrices(item.itemId, item.sellerId == userId)
+	if err != nil {
+		env.logger.Println(err.Error())
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	// Print history, newest first
+	for _, price := range prices {
+		fmt.Fprintln(w, price)
+	}
+}
+
+func (env *Env) SchedulePriceChange(w http.ResponseWriter, r *http.Request) {
+	userId, ok := r.Context().Value(CtxUserId).(int)
+	if !ok {
+		env.logger.Println("context does not include userId for protected endpoint")
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	item, ok := env.sellerItem(w, r, userId)
+	if !ok {
+		return
+	}
+
+	// Get price and window, changes without a start apply immediately
+	price, err := parsePriceParam(r.FormValue("price"))
+	if err != nil || price < 0 {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	startsAt, err := parseTimeParam(r.FormValue("starts"))
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	if startsAt.IsZero() {
+		startsAt = time.Now()
+	}
+	endsAt, err := parseTimeParam(r.FormValue("ends"))
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	if !endsAt.IsZero() && !endsAt.After(startsAt) {
+		http.Error(w, "Sale must end after it starts", http.StatusBadRequest)
+		return
+	}
+
+	priceId, err := env.db.SchedulePriceChange(ItemPrice{itemId: item.itemId, price: price, startsAt: startsAt, endsAt: endsAt})
+	if err != nil {
+		env.logger.Println(err.Error())
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	// Wake the scheduler in case the change is due before its next check
+	select {
+	case env.priceChanges <- struct{}{}:
+	default:
+	}
+
+	fmt.Fprintln(w, "Success, price change:", priceId)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSchedulerDelay(t *testing.T) {
+	t.Parallel()
+	now := time.Now()
+	for name, args := range map[string]struct {
+		next     time.Time
+		expected time.Duration
+	}{
+		"nothing scheduled": {time.Time{}, PriceSchedulerInterval},
+		"due soon":          {now.Add(10 * time.Second), 10 * time.Second},
+		"due later":         {now.Add(time.Hour), PriceSchedulerInterval},
+		"overdue":           {now.Add(-time.Second), 0},
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			if delay := schedulerDelay(args.next, now); delay != args.expected {
+				t.Errorf("bad delay for %v, expected %v, got %v", name, args.expected, delay)
+			}
+		})
+	}
+}
+
+func TestPriceChanges(t *testing.T) {
+	env := NewTestEnv()
+	env.db = newTestDB(t)
+	sellerId, buyerId := 2, 1
+	now := time.Now()
+
+	schedule := func(userId int, values url.Values) int {
+		recorder := httptest.NewRecorder()
+		request := newCartRequest("POST", "/api/items/1/prices?"+values.Encode(), userId)
+		request.SetPathValue("id", "1")
+		env.SchedulePriceChange(recorder, request)
+		return recorder.Result().StatusCode
+	}
+
+	for name, args := range map[string]struct {
+		userId   int
+		values   url.Values
+		expected int
+	}{
+		"NotSeller":    {buyerId, url.Values{"price": {"100"}}, http.StatusForbidden},
+		"MissingPrice": {sellerId, url.Values{}, http.StatusBadRequest},
+		"InvalidStart": {sellerId, url.Values{"price": {"100"}, "starts": {"tomorrow"}}, http.StatusBadRequest},
+		"EndBeforeStart": {sellerId, url.Values{"price": {"100"}, "starts": {now.Format(time.RFC3339)},
+			"ends": {now.Add(-time.Hour).Format(time.RFC3339)}}, http.StatusBadRequest},
+	} {
+		if statusCode := schedule(args.userId, args.values); statusCode != args.expected {
+			t.Errorf("bad status code for %v, expected %v, got %v", name, args.expected, statusCode)
+		}
+	}
+
+	// A sale running for two hours, and a regular price change an hour in
+	sale := url.Values{"price": {"150.00"}, "ends": {now.Add(2 * time.Hour).Format(time.RFC3339)}}
+	if statusCode := schedule(sellerId, sale); statusCode != http.StatusOK {
+		t.Fatalf("bad status code for sale, expected %v, got %v", http.StatusOK, statusCode)
+	}
+	change := url.Values{"price": {"160.00"}, "starts": {now.Add(time.Hour).Format(time.RFC3339)}}
+	if statusCode := schedule(sellerId, change); statusCode != http.StatusOK {
+		t.Fatalf("bad status code for price change, expected %v, got %v", http.StatusOK, statusCode)
+	}
+
+	for _, args := range []struct {
+		at       time.Duration
+		changed  int
+		expected int
+	}{
+		{time.Minute, 1, 15000},
+		{90 * time.Minute, 1, 15000},
+		{3 * time.Hour, 1, 16000},
+		{4 * time.Hour, 0, 16000},
+	} {
+		changed, _, _, _ := env.db.ApplyPriceChanges(now.Add(args.at))
+		if changed != args.changed {
+			t.Errorf("bad changes applied at %v, expected %v, got %v", args.at, args.changed, changed)
+		}
+		if item, _ := env.db.GetItem(1); item.price != args.expected {
+			t.Errorf("bad price at %v, expected %v, got %v", args.at, args.expected, item.price)
+		}
+	}
+
+	// History has the original price, the sale and the change
+	recorder := httptest.NewRecorder()
+	request := newCartRequest("GET", "/api/items/1/price-history", buyerId)
+	request.SetPathValue("id", "1")
+	env.PriceHistory(recorder, request)
+	result := recorder.Result()
+	body, _ := io.ReadAll(result.Body)
+	if lines := strings.Count(string(body), "\n"); lines != 3 {
+		t.Errorf("bad price history length, expected 3, got %v", lines)
+	}
+	if !strings.Contains(string(body), "status: ended") {
+		t.Errorf("ended sale missing from price history, got %q", body)
+	}
+}
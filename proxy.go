@@ -0,0 +1,132 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// parseTrustedProxies parses a comma separated list of CIDRs or bare IPs
+func parseTrustedProxies(list string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if len(entry) == 0 {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			addr, err := netip.ParseAddr(entry)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+func (env *Env) isTrustedProxy(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range env.trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseForwardedAddr parses a node from X-Forwarded-For or a Forwarded for= parameter,
+// accepting an optional port and brackets around IPv6 addresses
+func parseForwardedAddr(node string) (netip.Addr, bool) {
+	node = strings.Trim(strings.TrimSpace(node), `"`)
+	if addrPort, err := netip.ParseAddrPort(node); err == nil {
+		return addrPort.Addr().Unmap(), true
+	}
+	addr, err := netip.ParseAddr(strings.TrimSuffix(strings.TrimPrefix(node, "["), "]"))
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
+
+// forwardedParams returns the values of param for each element of the Forwarded
+// headers (RFC 7239) in order, elements missing the param are returned as ""
+func forwardedParams(header http.Header, param string) []string {
+	var values []string
+	for _, line := range header.Values("Forwarded") {
+		for _, element := range strings.Split(line, ",") {
+			value := ""
+			for _, pair := range strings.Split(element, ";") {
+				key, val, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if ok && strings.EqualFold(key, param) {
+					value = strings.Trim(val, `"`)
+				}
+			}
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// forwardedFor returns the client chain reported by proxies, closest hop last.
+// Forwarded takes precedence over X-Forwarded-For when both are sent
+func forwardedFor(header http.Header) []string {
+	if len(header.Values("Forwarded")) != 0 {
+		return forwardedParams(header, "for")
+	}
+	var nodes []string
+	for _, line := range header.Values("X-Forwarded-For") {
+		nodes = append(nodes, strings.Split(line, ",")...)
+	}
+	return nodes
+}
+
+// peerAddr is the address of the host directly connected to us
+func peerAddr(r *http.Request) (netip.Addr, error) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	return addr.Unmap(), nil
+}
+
+// clientIP resolves the address of the client that made the request. Forwarding headers
+// are only honoured when the peer is a trusted proxy, and are walked from the closest hop
+// back until the first address that isn't a trusted proxy
+func (env *Env) clientIP(r *http.Request) (string, error) {
+	addr, err := peerAddr(r)
+	if err != nil {
+		return "", err
+	}
+
+	nodes := forwardedFor(r.Header)
+	for i := len(nodes) - 1; i >= 0 && env.isTrustedProxy(addr); i-- {
+		// Anything before a malformed hop can't be trusted, stop at the last good address
+		next, ok := parseForwardedAddr(nodes[i])
+		if !ok {
+			break
+		}
+		addr = next
+	}
+	return addr.String(), nil
+}
+
+// forwardedProto returns the protocol reported by the closest proxy
+func forwardedProto(header http.Header) string {
+	if protos := forwardedParams(header, "proto"); len(protos) != 0 {
+		return protos[len(protos)-1]
+	}
+	protos := strings.Split(header.Get("X-Forwarded-Proto"), ",")
+	return strings.TrimSpace(protos[len(protos)-1])
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+var testClientIPTable = map[string]struct {
+	remoteAddr string
+	headers    map[string]string
+	expected   string
+}{
+	"untrusted peer ignores headers": {
+		remoteAddr: "203.0.113.7:4000",
+		headers:    map[string]string{"X-Forwarded-For": "198.51.100.1"},
+		expected:   "203.0.113.7",
+	},
+	"trusted peer without headers": {
+		remoteAddr: "10.0.0.1:4000",
+		expected:   "10.0.0.1",
+	},
+	"x-forwarded-for single hop": {
+		remoteAddr: "10.0.0.1:4000",
+		headers:    map[string]string{"X-Forwarded-For": "198.51.100.1"},
+		expected:   "198.51.100.1",
+	},
+	"x-forwarded-for spoofed prefix": {
+		remoteAddr: "10.0.0.1:4000",
+		headers:    map[string]string{"X-Forwarded-For": "1.2.3.4, 198.51.100.1, 10.0.0.2"},
+		expected:   "198.51.100.1",
+	},
+	"forwarded ipv6 with port": {
+		remoteAddr: "10.0.0.1:4000",
+		headers:    map[string]string{"Forwarded": `for=1.2.3.4, for="[2001:db8::17]:4711";proto=https`},
+		expected:   "2001:db8::17",
+	},
+	"forwarded preferred over x-forwarded-for": {
+		remoteAddr: "10.0.0.1:4000",
+		headers:    map[string]string{"Forwarded": "for=198.51.100.2", "X-Forwarded-For": "198.51.100.1"},
+		expected:   "198.51.100.2",
+	},
+	"malformed hop stops walk": {
+		remoteAddr: "10.0.0.1:4000",
+		headers:    map[string]string{"X-Forwarded-For": "198.51.100.1, garbage, 10.0.0.2"},
+		expected:   "10.0.0.2",
+	},
+}
+
+func TestClientIP(t *testing.T) {
+	t.Parallel()
+
+	env := NewTestEnv()
+	var err error
+	env.trustedProxies, err = parseTrustedProxies("10.0.0.0/8, ::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, args := range testClientIPTable {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			request := httptest.NewRequest("GET", "/", nil)
+			request.RemoteAddr = args.remoteAddr
+			for key, value := range args.headers {
+				request.Header.Set(key, value)
+			}
+			answer, err := env.clientIP(request)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if answer != args.expected {
+				t.Errorf("got %v, expected %v", answer, args.expected)
+			}
+		})
+	}
+}
+
+func TestParseTrustedProxiesInvalid(t *testing.T) {
+	if _, err := parseTrustedProxies("10.0.0.0/8, not-an-ip"); err == nil {
+		t.Error("expected error for invalid proxy entry")
+	}
+}
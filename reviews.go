@@ -0,0 +1,508 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var ErrNotVerifiedBuyer error = errors.New("only buyers of the item can review it")
+var ErrReviewExists error = errors.New("item already reviewed")
+var ErrOwnItem error = errors.New("sellers can't review their own items")
+
+// Reviews rate an item from MinRating to MaxRating stars, with an optional body of at most
+// MaxReviewLength bytes
+const (
+	MinRating       = 1
+	MaxRating       = 5
+	MaxReviewLength = 5000
+)
+
+// Review is a buyer's rating of an item, each buyer reviews an item at most once. Hidden
+// reviews were removed by an admin and don't count towards the item's rating
+type Review struct {
+	reviewId  int
+	itemId    int
+	userId    int
+	username  string
+	rating    int
+	body      string
+	reply     string    // the seller's reply, empty if they haven't
+	repliedAt time.Time // zero if the seller hasn't replied
+	hidden    bool
+	flags     int // reports waiting for an admin
+	createdAt time.Time
+	updatedAt time.Time
+}
+
+func (r Review) String() string {
+	reply := ""
+	if !r.repliedAt.IsZero() {
+		reply = fmt.Sprintf(", reply: %q", r.reply)
+	}
+	return fmt.Sprintf("review: %v, item: %v, user: %v, rating: %v, body: %q%v, created: %v, updated: %v",
+		r.reviewId, r.itemId, r.username, r.rating, r.body, reply, r.createdAt.String(), r.updatedAt.String())
+}
+
+// formatRating formats the average of ratings adding up to total, "none" if there are none
+func formatRating(total int, count int) string {
+	if count == 0 {
+		return "none"
+	}
+	return strconv.FormatFloat(float64(total)/float64(count), 'f', 1, 64)
+}
+
+const reviewColumns = `reviews.review_id, reviews.item_id, reviews.user_id, users.username, reviews.rating, reviews.body,
+					   COALESCE(reviews.reply, ''), reviews.replied_at, reviews.hidden,
+					   (SELECT COUNT(*) FROM review_flags WHERE review_flags.review_id=reviews.review_id),
+					   reviews.created_at, reviews.updated_at`
+
+func scanReview(row rowScanner) (Review, error) {
+	var review Review
+	var repliedAt sql.NullTime
+	err := row.Scan(&review.reviewId, &review.itemId, &review.userId, &review.username, &review.rating, &review.body,
+		&review.reply, &repliedAt, &review.hidden, &review.flags, &review.createdAt, &review.updatedAt)
+	review.repliedAt = repliedAt.Time
+	return review, err
+}
+
+func (s *SqlDB) queryReviews(query string, args ...any) ([]Review, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var reviews []Review
+	for rows.Next() {
+		review, err := scanReview(rows)
+		if err != nil {
+			return nil, err
+		}
+		reviews = append(reviews, review)
+	}
+
+	return reviews, rows.Err()
+}
+
+func (s *SqlDB) GetReview(reviewId int) (Review, error) {
+	query := `SELECT ` + reviewColumns + ` FROM reviews JOIN users ON reviews.user_id=users.user_id WHERE reviews.review_id=$1`
+	return scanReview(s.db.QueryRow(query, reviewId))
+}
+
+// AddReview reviews an item the user bought. ErrOwnItem is returned if they sell it,
+// ErrNotVerifiedBuyer if they haven't bought it in an order that wasn't cancelled or
+// refunded and ErrReviewExists if they have already reviewed it
+func (s *SqlDB) AddReview(userId int, itemId int, rating int, body string) (Review, error) {
+	var sellerId int
+	var bought bool
+	boughtQuery := `SELECT COALESCE((SELECT seller_id FROM items WHERE item_id=$2), 0), EXISTS (
+						SELECT 1 FROM purchases JOIN orders ON purchases.order_id=orders.order_id
+						WHERE purchases.user_id=$1 AND purchases.item_id=$2 AND orders.status NOT IN ($3, $4)
+					)`
+	err := s.db.QueryRow(boughtQuery, userId, itemId, OrderCancelled, OrderRefunded).Scan(&sellerId, &bought)
+	if err != nil {
+		return Review{}, err
+	}
+	if sellerId == userId {
+		return Review{}, ErrOwnItem
+	}
+	if !bought {
+		return Review{}, ErrNotVerifiedBuyer
+	}
+
+	var reviewId int
+	addQuery := `INSERT INTO reviews (item_id, user_id, rating, body) VALUES ($1, $2, $3, $4)
+				 ON CONFLICT (item_id, user_id) DO NOTHING
+				 RETURNING review_id`
+	err = s.db.QueryRow(addQuery, itemId, userId, rating, body).Scan(&reviewId)
+	if err == sql.ErrNoRows {
+		return Review{}, ErrReviewExists
+	} else if err != nil {
+		return Review{}, err
+	}
+	return s.GetReview(reviewId)
+}
+
+// UpdateReview changes the user's review of the item, sql.ErrNoRows is returned if they
+// haven't reviewed it
+func (s *SqlDB) UpdateReview(userId int, itemId int, rating int, body string) (Review, error) {
+	var reviewId int
+	updateQuery := `UPDATE reviews SET rating=$1, body=$2, updated_at=NOW() WHERE item_id=$3 AND user_id=$4 RETURNING review_id`
+	if err := s.db.QueryRow(updateQuery, rating, body, itemId, userId).Scan(&reviewId); err != nil {
+		return Review{}, err
+	}
+	return s.GetReview(reviewId)
+}
+
+// DeleteReview removes the user's review of the item, sql.ErrNoRows is returned if they
+// haven't reviewed it
+func (s *SqlDB) DeleteReview(userId int, itemId int) error {
+	var reviewId int
+	return s.db.QueryRow(`DELETE FROM reviews WHERE item_id=$1 AND user_id=$2 RETURNING review_id`, itemId, userId).Scan(&reviewId)
+}
+
+// ItemReviews returns the item's reviews that aren't hidden, newest first
+func (s *SqlDB) ItemReviews(itemId int) ([]Review, error) {
+	query := `SELECT ` + reviewColumns + ` FROM reviews JOIN users ON reviews.user_id=users.user_id
+			  WHERE reviews.item_id=$1 AND NOT reviews.hidden
+			  ORDER BY reviews.review_id DESC`
+	return s.queryReviews(query, itemId)
+}
+
+// ReplyToReview sets the seller's reply to a review, replacing any earlier reply
+func (s *SqlDB) ReplyToReview(reviewId int, reply string) (Review, error) {
+	var updatedId int
+	updateQuery := `UPDATE reviews SET reply=$1, replied_at=NOW() WHERE review_id=$2 RETURNING review_id`
+	if err := s.db.QueryRow(updateQuery, reply, reviewId).Scan(&updatedId); err != nil {
+		return Review{}, err
+	}
+	return s.GetReview(reviewId)
+}
+
+// FlagReview reports a review to the admins, each user reports a review at most once
+func (s *SqlDB) FlagReview(userId int, reviewId int, reason string) error {
+	query := `INSERT INTO review_flags (review_id, user_id, reason) VALUES ($1, $2, $3) ON CONFLICT (review_id, user_id) DO NOTHING`
+	_, err := s.db.Exec(query, reviewId, userId, reason)
+	return err
+}
+
+// FlaggedReviews returns the reviews with reports waiting for an admin, most reported first
+func (s *SqlDB) FlaggedReviews() ([]Review, error) {
+	query := `SELECT ` + reviewColumns + ` FROM reviews JOIN users ON reviews.user_id=users.user_id
+			  WHERE EXISTS (SELECT 1 FROM review_flags WHERE review_flags.review_id=reviews.review_id)
+			  ORDER BY (SELECT COUNT(*) FROM review_flags WHERE review_flags.review_id=reviews.review_id) DESC, reviews.review_id`
+	return s.queryReviews(query)
+}
+
+// ModerateReview hides or restores a review and clears its reports
+func (s *SqlDB) ModerateReview(reviewId int, hidden bool) (review Review, err error) {
+	var tx *sql.Tx
+	tx, err = s.db.Begin()
+	if err != nil {
+		return Review{}, err
+	}
+
+	// Rollback or commit depending on err
+	defer func() {
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	var updatedId int
+	err = tx.QueryRow(`UPDATE reviews SET hidden=$1 WHERE review_id=$2 RETURNING review_id`, hidden, reviewId).Scan(&updatedId)
+	if err != nil {
+		return Review{}, err
+	}
+	if _, err = tx.Exec(`DELETE FROM review_flags WHERE review_id=$1`, reviewId); err != nil {
+		return Review{}, err
+	}
+	query := `SELECT ` + reviewColumns + ` FROM reviews JOIN users ON reviews.user_id=users.user_id WHERE reviews.review_id=$1`
+	return scanReview(tx.QueryRow(query, reviewId))
+}
+
+// parseReview reads the rating and body of a review from the form, writing an error
+// response and returning false if they are invalid
+func parseReview(w http.ResponseWriter, r *http.Request) (int, string, bool) {
+	rating, err := strconv.Atoi(r.FormValue("rating"))
+	if err != nil || rating < MinRating || rating > MaxRating {
+		http.Error(w, fmt.Sprintf("Rating must be between %v and %v", MinRating, MaxRating), http.StatusBadRequest)
+		return 0, "", false
+	}
+	body := r.FormValue("body")
+	if len(body) > MaxReviewLength {
+		http.Error(w, fmt.Sprintf("Review must be at most %v bytes", MaxReviewLength), http.StatusBadRequest)
+		return 0, "", false
+	}
+	return rating, body, true
+}
+
+// pathReview loads the review in the request path, writing an error response and returning
+// false if it doesn't exist. Hidden reviews are only found by admins
+func (env *Env) pathReview(w http.ResponseWriter, r *http.Request, userId int) (Review, bool) {
+	reviewId, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return Review{}, false
+	}
+
+	review, err := env.db.GetReview(reviewId)
+	if err == nil && review.hidden {
+		var isAdmin bool
+		if isAdmin, err = env.db.IsAdmin(userId); err == nil && !isAdmin {
+			err = sql.ErrNoRows
+		}
+	}
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return Review{}, false
+		}
+		env.logger.Println(err.Error())
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return Review{}, false
+	}
+	return review, true
+}
+
+func (env *Env) ItemReviews(w http.ResponseWriter, r *http.Request) {
+	// Get item
+	itemId, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	item, err := env.db.GetItem(itemId)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+		env.logger.Println(err.Error())
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	reviews, err := env.db.ItemReviews(itemId)
+	if err != nil {
+		env.logger.Println(err.Error())
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	// Print the rating followed by the reviews, newest first
+	fmt.Fprintf(w, "rating: %v, reviews: %v\n", formatRating(item.ratingTotal, item.reviewCount), item.reviewCount)
+	for _, review := range reviews {
+		fmt.Fprintln(w, review)
+	}
+}
+
+func (env *Env) AddReview(w http.ResponseWriter, r *http.Request) {
+	userId, ok := r.Context().Value(CtxUserId).(int)
+	if !ok {
+		env.logger.Println("context does not include userId for protected endpoint")
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	// Parse item id and review
+	itemId, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	rating, body, ok := parseReview(w, r)
+	if !ok {
+		return
+	}
+
+	review, err := env.db.AddReview(userId, itemId, rating, body)
+	if err != nil {
+		switch err {
+		case ErrNotVerifiedBuyer:
+			http.Error(w, "Only buyers of the item can review it", http.StatusForbidden)
+		case ErrOwnItem:
+			http.Error(w, "Sellers can't review their own items", http.StatusForbidden)
+		case ErrReviewExists:
+			http.Error(w, "Item already reviewed", http.StatusConflict)
+		default:
+			env.logger.Println(err.Error())
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprintln(w, review)
+}
+
+func (env *Env) UpdateReview(w http.ResponseWriter, r *http.Request) {
+	userId, ok := r.Context().Value(CtxUserId).(int)
+	if !ok {
+		env.logger.Println("context does not include userId for protected endpoint")
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	// Parse item id and review
+	itemId, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	rating, body, ok := parseReview(w, r)
+	if !ok {
+		return
+	}
+
+	review, err := env.db.UpdateReview(userId, itemId, rating, body)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+		env.logger.Println(err.Error())
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintln(w, review)
+}
+
+func (env *Env) DeleteReview(w http.ResponseWriter, r *http.Request) {
+	userId, ok := r.Context().Value(CtxUserId).(int)
+	if !ok {
+		env.logger.Println("context does not include userId for protected endpoint")
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	itemId, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	if err := env.db.DeleteReview(userId, itemId); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+		env.logger.Println(err.Error())
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ReplyToReview lets the item's seller answer a review
+func (env *Env) ReplyToReview(w http.ResponseWriter, r *http.Request) {
+	userId, ok := r.Context().Value(CtxUserId).(int)
+	if !ok {
+		env.logger.Println("context does not include userId for protected endpoint")
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	review, ok := env.pathReview(w, r, userId)
+	if !ok {
+		return
+	}
+	item, err := env.db.GetItem(review.itemId)
+	if err != nil {
+		env.logger.Println(err.Error())
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if item.sellerId != userId {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	reply := r.FormValue("reply")
+	if len(reply) == 0 || len(reply) > MaxReviewLength {
+		http.Error(w, fmt.Sprintf("Reply must be between 1 and %v bytes", MaxReviewLength), http.StatusBadRequest)
+		return
+	}
+
+	review, err = env.db.ReplyToReview(review.reviewId, reply)
+	if err != nil {
+		env.logger.Println(err.Error())
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintln(w, review)
+}
+
+// FlagReview reports a review for an admin to look at
+func (env *Env) FlagReview(w http.ResponseWriter, r *http.Request) {
+	userId, ok := r.Context().Value(CtxUserId).(int)
+	if !ok {
+		env.logger.Println("context does not include userId for protected endpoint")
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	review, ok := env.pathReview(w, r, userId)
+	if !ok {
+		return
+	}
+	reason := r.FormValue("reason")
+	if len(reason) > MaxReviewLength {
+		http.Error(w, fmt.Sprintf("Reason must be at most %v bytes", MaxReviewLength), http.StatusBadRequest)
+		return
+	}
+
+	if err := env.db.FlagReview(userId, review.reviewId, reason); err != nil {
+		env.logger.Println(err.Error())
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (env *Env) FlaggedReviews(w http.ResponseWriter, r *http.Request) {
+	userId, ok := r.Context().Value(CtxUserId).(int)
+	if !ok {
+		env.logger.Println("context does not include userId for protected endpoint")
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if !env.requireAdmin(w, userId) {
+		return
+	}
+
+	reviews, err := env.db.FlaggedReviews()
+	if err != nil {
+		env.logger.Println(err.Error())
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	// Print the queue with how often each review was reported, most reported first
+	for _, review := range reviews {
+		fmt.Fprintf(w, "%v, flags: %v, hidden: %v\n", review, review.flags, review.hidden)
+	}
+}
+
+// moderateReview is the admin handler hiding or restoring a review
+func (env *Env) moderateReview(hidden bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userId, ok := r.Context().Value(CtxUserId).(int)
+		if !ok {
+			env.logger.Println("context does not include userId for protected endpoint")
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		if !env.requireAdmin(w, userId) {
+			return
+		}
+
+		review, ok := env.pathReview(w, r, userId)
+		if !ok {
+			return
+		}
+		review, err := env.db.ModerateReview(review.reviewId, hidden)
+		if err != nil {
+			env.logger.Println(err.Error())
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintf(w, "%v, hidden: %v\n", review, review.hidden)
+	}
+}
+
+// HideReview removes a review from the item and its rating
+func (env *Env) HideReview(w http.ResponseWriter, r *http.Request) {
+	env.moderateReview(true)(w, r)
+}
+
+// RestoreReview shows a hidden review again, or dismisses the reports of a visible one
+func (env *Env) RestoreReview(w http.ResponseWriter, r *http.Request) {
+	env.moderateReview(false)(w, r)
+}
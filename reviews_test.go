@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+var testFormatRatingTable = map[string]struct {
+	total    int
+	count    int
+	expected string
+}{
+	"none":    {0, 0, "none"},
+	"single":  {4, 1, "4.0"},
+	"average": {9, 2, "4.5"},
+	"rounded": {11, 3, "3.7"},
+}
+
+func TestFormatRating(t *testing.T) {
+	t.Parallel()
+	for name, args := range testFormatRatingTable {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			if answer := formatRating(args.total, args.count); answer != args.expected {
+				t.Errorf("got %v, expected %v", answer, args.expected)
+			}
+		})
+	}
+}
+
+func TestReviews(t *testing.T) {
+	env := NewTestEnv()
+	env.db = newTestDB(t)
+	buyerId, sellerId, adminId, itemId := 1, 2, 3, 1
+
+	itemReviews := func() string {
+		t.Helper()
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest("GET", fmt.Sprintf("/api/items/%v/reviews", itemId), nil)
+		request.SetPathValue("id", fmt.Sprint(itemId))
+		env.ItemReviews(recorder, request)
+		body, _ := io.ReadAll(recorder.Result().Body)
+		return string(body)
+	}
+
+	// Only buyers can review, once
+	if status, body := disputeTestRequest(env.AddReview, "/api/items/1/review?rating=4", itemId, buyerId); status != http.StatusForbidden {
+		t.Errorf("bad status code reviewing without buying, expected %v, got %v: %v", http.StatusForbidden, status, body)
+	}
+	creditTestWallet(buyerId, Money{17500 + 12999, DefaultCurrency})
+	if _, err := env.db.Purchase(buyerId, itemId, 0, "", DefaultCurrency); err != nil {
+		t.Fatal(err)
+	}
+
+	// Refunded purchases don't count and sellers can't review their own items
+	refundedOrderId, err := env.db.Purchase(buyerId, 2, 0, "", DefaultCurrency)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := env.db.TransitionOrder(refundedOrderId, OrderRefunded); err != nil {
+		t.Fatal(err)
+	}
+	if status, body := disputeTestRequest(env.AddReview, "/api/items/2/review?rating=4", 2, buyerId); status != http.StatusForbidden {
+		t.Errorf("bad status code reviewing a refunded purchase, expected %v, got %v: %v", http.StatusForbidden, status, body)
+	}
+	if status, body := disputeTestRequest(env.AddReview, "/api/items/1/review?rating=5", itemId, sellerId); status != http.StatusForbidden {
+		t.Errorf("bad status code reviewing own item, expected %v, got %v: %v", http.StatusForbidden, status, body)
+	}
+
+	for _, args := range []struct {
+		name     string
+		handler  http.HandlerFunc
+		query    string
+		expected int
+	}{
+		{"AddNoRating", env.AddReview, "", http.StatusBadRequest},
+		{"AddRatingTooHigh", env.AddReview, "?rating=6", http.StatusBadRequest},
+		{"AddReview", env.AddReview, "?rating=2&body=scratched", http.StatusCreated},
+		{"AddReviewAgain", env.AddReview, "?rating=5", http.StatusConflict},
+		{"UpdateReview", env.UpdateReview, "?rating=4&body=works+well", http.StatusOK},
+	} {
+		target := fmt.Sprintf("/api/items/%v/review%v", itemId, args.query)
+		if status, body := disputeTestRequest(args.handler, target, itemId, buyerId); status != args.expected {
+			t.Errorf("bad status code for %v, expected %v, got %v: %v", args.name, args.expected, status, body)
+		}
+	}
+	if status, body := disputeTestRequest(env.UpdateReview, "/api/items/1/review?rating=4", itemId, adminId); status != http.StatusNotFound {
+		t.Errorf("bad status code updating a missing review, expected %v, got %v: %v", http.StatusNotFound, status, body)
+	}
+	if body := itemReviews(); !strings.HasPrefix(body, "rating: 4.0, reviews: 1\n") || !strings.Contains(body, `body: "works well"`) {
+		t.Errorf("bad item reviews, got %q", body)
+	}
+	review := reviews[len(reviews)-1]
+
+	// Sellers reply to reviews of their items
+	for _, args := range []struct {
+		name     string
+		userId   int
+		query    string
+		expected int
+	}{
+		{"ReplyNotSeller", buyerId, "?reply=thanks", http.StatusForbidden},
+		{"ReplyEmpty", sellerId, "", http.StatusBadRequest},
+		{"ReplySeller", sellerId, "?reply=thanks", http.StatusOK},
+	} {
+		target := fmt.Sprintf("/api/reviews/%v/reply%v", review.reviewId, args.query)
+		if status, body := disputeTestRequest(env.ReplyToReview, target, review.reviewId, args.userId); status != args.expected {
+			t.Errorf("bad status code for %v, expected %v, got %v: %v", args.name, args.expected, status, body)
+		}
+	}
+	if body := itemReviews(); !strings.Contains(body, `reply: "thanks"`) {
+		t.Errorf("reply missing from the item reviews, got %q", body)
+	}
+
+	// Flagged reviews are queued for admins, hiding them drops them from the rating
+	for _, userId := range []int{sellerId, adminId, sellerId} {
+		if status, body := disputeTestRequest(env.FlagReview, "/api/reviews/flag?reason=spam", review.reviewId, userId); status != http.StatusNoContent {
+			t.Errorf("bad status code flagging, expected %v, got %v: %v", http.StatusNoContent, status, body)
+		}
+	}
+	recorder := httptest.NewRecorder()
+	env.FlaggedReviews(recorder, newCartRequest("GET", "/api/admin/reviews/flagged", adminId))
+	if body, _ := io.ReadAll(recorder.Result().Body); !strings.Contains(string(body), fmt.Sprintf("review: %v,", review.reviewId)) {
+		t.Errorf("flagged review missing from the queue, got %q", body)
+	}
+	if flagged, _ := env.db.GetReview(review.reviewId); flagged.flags != 2 {
+		t.Errorf("expected 2 flags, got %v", flagged.flags)
+	}
+	for _, args := range []struct {
+		name     string
+		handler  http.HandlerFunc
+		userId   int
+		expected int
+	}{
+		{"HideNotAdmin", env.HideReview, sellerId, http.StatusForbidden},
+		{"HideReview", env.HideReview, adminId, http.StatusOK},
+	} {
+		if status, body := disputeTestRequest(args.handler, "/api/admin/reviews/hide", review.reviewId, args.userId); status != args.expected {
+			t.Errorf("bad status code for %v, expected %v, got %v: %v", args.name, args.expected, status, body)
+		}
+	}
+	if body := itemReviews(); body != "rating: none, reviews: 0\n" {
+		t.Errorf("hidden review still listed, got %q", body)
+	}
+	if status, _ := disputeTestRequest(env.ReplyToReview, "/api/reviews/reply?reply=again", review.reviewId, sellerId); status != http.StatusNotFound {
+		t.Errorf("bad status code replying to a hidden review, expected %v, got %v", http.StatusNotFound, status)
+	}
+	if status, body := disputeTestRequest(env.RestoreReview, "/api/admin/reviews/restore", review.reviewId, adminId); status != http.StatusOK {
+		t.Errorf("bad status code restoring, expected %v, got %v: %v", http.StatusOK, status, body)
+	}
+	if body := itemReviews(); !strings.HasPrefix(body, "rating: 4.0, reviews: 1\n") {
+		t.Errorf("restored review missing, got %q", body)
+	}
+
+	// Buyers delete their own reviews
+	if status, body := disputeTestRequest(env.DeleteReview, "/api/items/1/review", itemId, buyerId); status != http.StatusNoContent {
+		t.Errorf("bad status code deleting, expected %v, got %v: %v", http.StatusNoContent, status, body)
+	}
+	if body := itemReviews(); body != "rating: none, reviews: 0\n" {
+		t.Errorf("deleted review still listed, got %q", body)
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// SMTPSender emails notifications through an SMTP relay. The relay is trusted to deliver,
+// a notification counts as sent once it accepts the message
+type SMTPSender struct {
+	addr string // host:port of the relay
+	from string
+	auth smtp.Auth // nil if the relay doesn't need authentication
+}
+
+// NewSMTPSender sends from from through the relay at addr, authenticating with username
+// and password if a username is given
+func NewSMTPSender(addr string, from string, username string, password string) (SMTPSender, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return SMTPSender{}, err
+	}
+	sender := SMTPSender{addr: addr, from: from}
+	if len(username) != 0 {
+		sender.auth = smtp.PlainAuth("", username, password, host)
+	}
+	return sender, nil
+}
+
+// emailMessage formats a plain text email. The subject is encoded so nothing in it can
+// add headers, and line endings are normalised to CRLF
+func emailMessage(from string, to string, subject string, body string, date time.Time) []byte {
+	var message strings.Builder
+	fmt.Fprintf(&message, "From: %v\r\n", from)
+	fmt.Fprintf(&message, "To: %v\r\n", to)
+	fmt.Fprintf(&message, "Subject: %v\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&message, "Date: %v\r\n", date.Format(time.RFC1123Z))
+	message.WriteString("MIME-Version: 1.0\r\n")
+	message.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	message.WriteString("\r\n")
+	message.WriteString(strings.ReplaceAll(strings.ReplaceAll(body, "\r\n", "\n"), "\n", "\r\n"))
+	message.WriteString("\r\n")
+	return []byte(message.String())
+}
+
+func (s SMTPSender) Send(notification Notification) error {
+	message := emailMessage(s.from, notification.address, notification.subject, notification.body, time.Now())
+	return smtp.SendMail(s.addr, s.auth, s.from, []string{notification.address}, message)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeEmail is a message accepted by fakeSMTPServer
+type fakeEmail struct {
+	from string
+	to   []string
+	data string
+}
+
+// fakeSMTPServer speaks just enough SMTP for net/smtp to send mail to it, recording the
+// messages it accepts. Recipients are refused with a permanent error if rejectRecipients
+// is set
+type fakeSMTPServer struct {
+	listener         net.Listener
+	rejectRecipients bool
+	emails           chan fakeEmail
+}
+
+func newFakeSMTPServer(t *testing.T, rejectRecipients bool) *fakeSMTPServer {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &fakeSMTPServer{listener: listener, rejectRecipients: rejectRecipients, emails: make(chan fakeEmail, 10)}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.handle(conn)
+		}
+	}()
+	return server
+}
+
+func (s *fakeSMTPServer) handle(conn net.Conn) {
+	text := textproto.NewConn(conn)
+	defer text.Close()
+
+	var email fakeEmail
+	text.PrintfLine("220 localhost fake SMTP")
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+		command, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(command) {
+		case "EHLO", "HELO":
+			text.PrintfLine("250 localhost")
+		case "MAIL":
+			email = fakeEmail{from: strings.TrimPrefix(arg, "FROM:")}
+			text.PrintfLine("250 OK")
+		case "RCPT":
+			if s.rejectRecipients {
+				text.PrintfLine("550 No such user")
+				continue
+			}
+			email.to = append(email.to, strings.TrimPrefix(arg, "TO:"))
+			text.PrintfLine("250 OK")
+		case "DATA":
+			text.PrintfLine("354 Go ahead")
+			data, err := text.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			email.data = string(data)
+			s.emails <- email
+			text.PrintfLine("250 OK")
+		case "RSET", "NOOP":
+			text.PrintfLine("250 OK")
+		case "QUIT":
+			text.PrintfLine("221 Bye")
+			return
+		default:
+			text.PrintfLine("502 Not implemented")
+		}
+	}
+}
+
+func TestSMTPSender(t *testing.T) {
+	t.Parallel()
+	notification := Notification{notificationId: 1, channel: ChannelEmail, address: "buyer@example.com",
+		subject: "Welcome, Zoë\r\nBcc: everyone@example.com", body: "First line\nSecond line"}
+
+	t.Run("Send", func(t *testing.T) {
+		t.Parallel()
+		server := newFakeSMTPServer(t, false)
+		sender, err := NewSMTPSender(server.listener.Addr().String(), "market@example.com", "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := sender.Send(notification); err != nil {
+			t.Fatal(err)
+		}
+
+		var email fakeEmail
+		select {
+		case email = <-server.emails:
+		case <-time.After(5 * time.Second):
+			t.Fatal("no email received")
+		}
+		if email.from != "<market@example.com>" || len(email.to) != 1 || email.to[0] != "<buyer@example.com>" {
+			t.Errorf("bad envelope, got from %v to %v", email.from, email.to)
+		}
+		headers, body, _ := strings.Cut(email.data, "\n\n")
+		if !strings.Contains(headers, "Subject: =?utf-8?q?") || strings.Contains(headers, "\nBcc:") {
+			t.Errorf("subject not encoded, got %q", headers)
+		}
+		if !strings.Contains(headers, "To: buyer@example.com") {
+			t.Errorf("missing To header, got %q", headers)
+		}
+		if body != "First line\nSecond line\n" {
+			t.Errorf("bad body, got %q", body)
+		}
+	})
+
+	t.Run("RecipientRejected", func(t *testing.T) {
+		t.Parallel()
+		server := newFakeSMTPServer(t, true)
+		sender, _ := NewSMTPSender(server.listener.Addr().String(), "market@example.com", "", "")
+		if err := sender.Send(notification); err == nil {
+			t.Error("expected an error for a rejected recipient")
+		}
+	})
+
+	t.Run("InvalidAddr", func(t *testing.T) {
+		t.Parallel()
+		if _, err := NewSMTPSender("localhost", "market@example.com", "user", "password"); err == nil {
+			t.Error("expected an error for an address without a port")
+		}
+	})
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"crypto/tls"
+	"os"
+	"sync"
+	"time"
+)
+
+// certReloader serves the key pair at certFile/keyFile and reloads it when
+// either file changes on disk, so certificates can be rotated without a restart
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu          sync.RWMutex
+	cert        *tls.Certificate
+	certModTime time.Time
+	keyModTime  time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	reloader := &certReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	if err := reloader.reload(); err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+func (c *certReloader) modTimes() (time.Time, time.Time, error) {
+	certInfo, err := os.Stat(c.certFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	keyInfo, err := os.Stat(c.keyFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	return certInfo.ModTime(), keyInfo.ModTime(), nil
+}
+
+func (c *certReloader) reload() error {
+	certModTime, keyModTime, err := c.modTimes()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cert = &cert
+	c.certModTime = certModTime
+	c.keyModTime = keyModTime
+	return nil
+}
+
+// GetCertificate is used as tls.Config.GetCertificate. If the files have changed
+// since the last load they are reloaded, on failure the previous pair keeps being served
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	certModTime, keyModTime, err := c.modTimes()
+
+	c.mu.RLock()
+	cert := c.cert
+	changed := err == nil && (!certModTime.Equal(c.certModTime) || !keyModTime.Equal(c.keyModTime))
+	c.mu.RUnlock()
+
+	if changed {
+		if err := c.reload(); err == nil {
+			c.mu.RLock()
+			cert = c.cert
+			c.mu.RUnlock()
+		}
+	}
+	return cert, nil
+}
+
+func (c *certReloader) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: c.GetCertificate,
+	}
+}
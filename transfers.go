@@ -0,0 +1,219 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+var ErrSelfTransfer error = errors.New("cannot transfer to yourself")
+var ErrTransferLimit error = errors.New("daily transfer limit reached")
+
+// DailyTransferLimit is the most a user can send in each currency over any 24 hours, in
+// minor units
+const DailyTransferLimit = 1_000_00
+
+// Transfer is money sent from one user's wallet to another's
+type Transfer struct {
+	transferId   int
+	fromUserId   int
+	fromUsername string
+	toUserId     int
+	toUsername   string
+	amount       Money
+	createdAt    time.Time
+}
+
+func (t Transfer) String() string {
+	return fmt.Sprintf("transfer: %v, from: %v, to: %v, amount: %v, created: %v",
+		t.transferId, t.fromUsername, t.toUsername, t.amount, t.createdAt.String())
+}
+
+// Transfer sends amount from the user's wallet to the wallet of the user named
+// toUsername in one transaction. The wallets are locked in user id order so transfers in
+// opposite directions can't deadlock. sql.ErrNoRows is returned if the recipient doesn't
+// exist, ErrTransferLimit if the sender has already sent DailyTransferLimit in the 24 hours
+// before now and ErrFundsHeld if the amount is only covered by sale money on hold at now
+func (s *SqlDB) Transfer(userId int, toUsername string, amount Money, now time.Time) (transfer Transfer, err error) {
+	var tx *sql.Tx
+	tx, err = s.db.Begin()
+	if err != nil {
+		return Transfer{}, err
+	}
+
+	// Rollback or commit depending on err
+	defer func() {
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	transfer = Transfer{fromUserId: userId, toUsername: toUsername, amount: amount}
+	usersQuery := `SELECT (SELECT username FROM users WHERE user_id=$1), user_id FROM users WHERE username=$2`
+	err = tx.QueryRow(usersQuery, userId, toUsername).Scan(&transfer.fromUsername, &transfer.toUserId)
+	if err != nil {
+		return Transfer{}, err
+	}
+	if transfer.toUserId == userId {
+		return Transfer{}, ErrSelfTransfer
+	}
+
+	// Lock both wallets before checking the limit so concurrent transfers are counted
+	if err = lockWallets(tx, []int{userId, transfer.toUserId}, amount.currency); err != nil {
+		return Transfer{}, err
+	}
+	var sent int
+	sentQuery := `SELECT COALESCE(CAST(SUM(amount)*100 AS BIGINT), 0) FROM transfers
+				  WHERE from_user_id=$1 AND currency=$2 AND created_at>$3`
+	err = tx.QueryRow(sentQuery, userId, amount.currency, now.Add(-24*time.Hour)).Scan(&sent)
+	if err != nil {
+		return Transfer{}, err
+	}
+	if sent+amount.amount > DailyTransferLimit {
+		return Transfer{}, ErrTransferLimit
+	}
+	balance, available, err := availableBalance(tx, userId, amount.currency, now)
+	if err != nil {
+		return Transfer{}, err
+	}
+	if available.amount < amount.amount {
+		if balance.amount >= amount.amount {
+			return Transfer{}, ErrFundsHeld
+		}
+		return Transfer{}, ErrInsufficientFunds
+	}
+
+	addQuery := `INSERT INTO transfers (from_user_id, to_user_id, amount, currency, created_at)
+				 VALUES ($1, $2, CAST($3 AS NUMERIC(12, 0))/100, $4, $5)
+				 RETURNING transfer_id, created_at`
+	err = tx.QueryRow(addQuery, userId, transfer.toUserId, amount.amount, amount.currency, now).Scan(&transfer.transferId, &transfer.createdAt)
+	if err != nil {
+		return Transfer{}, err
+	}
+
+	// Move the money, both sides are recorded in the ledger
+	err = debitWallet(tx, LedgerEntry{userId: userId, amount: amount, kind: LedgerTransferOut, referenceId: transfer.transferId})
+	if err != nil {
+		return Transfer{}, err
+	}
+	credit := LedgerEntry{userId: transfer.toUserId, amount: amount, kind: LedgerTransferIn, referenceId: transfer.transferId}
+	if _, err = creditWallet(tx, credit); err != nil {
+		return Transfer{}, err
+	}
+	return transfer, nil
+}
+
+// Transfers returns the transfers the user sent or received, newest first
+func (s *SqlDB) Transfers(userId int) ([]Transfer, error) {
+	query := `SELECT transfers.transfer_id, transfers.from_user_id, senders.username, transfers.to_user_id, recipients.username,
+			  CAST(transfers.amount*100 AS BIGINT), transfers.currency, transfers.created_at
+			  FROM transfers
+			  JOIN users senders ON transfers.from_user_id=senders.user_id
+			  JOIN users recipients ON transfers.to_user_id=recipients.user_id
+			  WHERE transfers.from_user_id=$1 OR transfers.to_user_id=$1
+			  ORDER BY transfers.transfer_id DESC`
+	rows, err := s.db.Query(query, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var transfers []Transfer
+	var transfer Transfer
+	for rows.Next() {
+		err := rows.Scan(&transfer.transferId, &transfer.fromUserId, &transfer.fromUsername, &transfer.toUserId, &transfer.toUsername,
+			&transfer.amount.amount, &transfer.amount.currency, &transfer.createdAt)
+		if err != nil {
+			return nil, err
+		}
+		transfers = append(transfers, transfer)
+	}
+
+	return transfers, rows.Err()
+}
+
+func (env *Env) Transfer(w http.ResponseWriter, r *http.Request) {
+	userId, ok := r.Context().Value(CtxUserId).(int)
+	if !ok {
+		env.logger.Println("context does not include userId for protected endpoint")
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	// Parse recipient, currency and amount
+	toUsername := r.FormValue("to")
+	if len(toUsername) == 0 {
+		http.Error(w, "Recipient required", http.StatusBadRequest)
+		return
+	}
+	currency, err := parseCurrency(r.FormValue("currency"))
+	if err != nil {
+		http.Error(w, "Unknown currency", http.StatusBadRequest)
+		return
+	}
+	amount, err := ParseMoney(r.FormValue("amount"), currency)
+	if err != nil || amount.amount == 0 {
+		http.Error(w, "Invalid amount", http.StatusBadRequest)
+		return
+	}
+
+	// Send the money
+	transfer, err := env.db.Transfer(userId, toUsername, amount, time.Now())
+	if err != nil {
+		var statusCode int
+		var message string
+		switch err {
+		case sql.ErrNoRows:
+			statusCode = http.StatusNotFound
+			message = "Unknown recipient"
+		case ErrSelfTransfer:
+			statusCode = http.StatusBadRequest
+			message = "Cannot transfer to yourself"
+		case ErrInsufficientFunds:
+			statusCode = http.StatusForbidden
+			message = "Insufficient funds"
+		case ErrFundsHeld:
+			statusCode = http.StatusForbidden
+			message = fmt.Sprintf("Funds from sales are held for %v days", SaleHold/(24*time.Hour))
+		case ErrTransferLimit:
+			statusCode = http.StatusForbidden
+			message = fmt.Sprintf("Daily transfer limit of %v reached", Money{DailyTransferLimit, currency})
+		case ErrBalanceTooLarge:
+			statusCode = http.StatusBadRequest
+			message = "Recipient balance limit exceeded"
+		default:
+			env.logger.Println(err.Error())
+			statusCode = http.StatusInternalServerError
+			message = http.StatusText(statusCode)
+		}
+		http.Error(w, message, statusCode)
+		return
+	}
+	fmt.Fprintln(w, transfer)
+}
+
+func (env *Env) Transfers(w http.ResponseWriter, r *http.Request) {
+	userId, ok := r.Context().Value(CtxUserId).(int)
+	if !ok {
+		env.logger.Println("context does not include userId for protected endpoint")
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	transfers, err := env.db.Transfers(userId)
+	if err != nil {
+		env.logger.Println(err.Error())
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	// Print sent and received transfers, newest first
+	for _, transfer := range transfers {
+		fmt.Fprintln(w, transfer)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTransfer(t *testing.T) {
+	env := NewTestEnv()
+	env.db = newTestDB(t)
+	senderId, recipientId := 2, 1
+	startSenderBalance, _ := env.db.Balance(senderId, DefaultCurrency)
+	startRecipientBalance, _ := env.db.Balance(recipientId, DefaultCurrency)
+
+	sent := 0
+	for _, args := range []struct {
+		name     string
+		query    string
+		expected int
+	}{
+		{"TransferNoRecipient", "amount=10", http.StatusBadRequest},
+		{"TransferUnknownRecipient", "to=nobody&amount=10", http.StatusNotFound},
+		{"TransferToSelf", "to=rich_test_user&amount=10", http.StatusBadRequest},
+		{"TransferZero", "to=test_user&amount=0", http.StatusBadRequest},
+		{"TransferInvalidAmount", "to=test_user&amount=-10", http.StatusBadRequest},
+		{"TransferUnknownCurrency", "to=test_user&amount=10&currency=XYZ", http.StatusBadRequest},
+		{"TransferInsufficientFunds", "to=test_user&amount=200.01", http.StatusForbidden},
+		{"Transfer", "to=test_user&amount=25", http.StatusOK},
+	} {
+		recorder := httptest.NewRecorder()
+		env.Transfer(recorder, newCartRequest("POST", "/api/transfer?"+args.query, senderId))
+		if result := recorder.Result(); result.StatusCode != args.expected {
+			t.Errorf("bad status code for %v, expected %v, got %v", args.name, args.expected, result.StatusCode)
+		}
+		if args.expected == http.StatusOK {
+			sent += 2500
+		}
+		if balance, _ := env.db.Balance(senderId, DefaultCurrency); balance.amount != startSenderBalance.amount-sent {
+			t.Errorf("bad sender balance after %v, expected %v, got %v", args.name, startSenderBalance.amount-sent, balance.amount)
+		}
+		if balance, _ := env.db.Balance(recipientId, DefaultCurrency); balance.amount != startRecipientBalance.amount+sent {
+			t.Errorf("bad recipient balance after %v, expected %v, got %v", args.name, startRecipientBalance.amount+sent, balance.amount)
+		}
+	}
+
+	// Both sides see the transfer
+	for _, userId := range []int{senderId, recipientId} {
+		recorder := httptest.NewRecorder()
+		env.Transfers(recorder, newCartRequest("GET", "/api/transfers", userId))
+		if body, _ := io.ReadAll(recorder.Result().Body); !strings.Contains(string(body), "from: rich_test_user, to: test_user, amount: 25.00 USD") {
+			t.Errorf("transfer missing from user %v's history, got %q", userId, body)
+		}
+	}
+	for userId, kind := range map[int]LedgerKind{senderId: LedgerTransferOut, recipientId: LedgerTransferIn} {
+		entries, _ := env.db.Ledger(userId)
+		if len(entries) == 0 || entries[0].kind != kind {
+			t.Errorf("expected %v in user %v's ledger, got %v", kind, userId, entries)
+		}
+	}
+
+	// Transfers are limited over any 24 hours
+	creditTestWallet(senderId, Money{DailyTransferLimit, DefaultCurrency})
+	now := time.Now()
+	if _, err := env.db.Transfer(senderId, "test_user", Money{DailyTransferLimit - 2500 + 1, DefaultCurrency}, now); err != ErrTransferLimit {
+		t.Errorf("transfer over the limit, expected %v, got %v", ErrTransferLimit, err)
+	}
+	if _, err := env.db.Transfer(senderId, "test_user", Money{DailyTransferLimit - 2500, DefaultCurrency}, now); err != nil {
+		t.Errorf("transfer up to the limit, got %v", err)
+	}
+	if _, err := env.db.Transfer(senderId, "test_user", Money{1, "EUR"}, now); err != nil {
+		t.Errorf("limit is per currency, got %v", err)
+	}
+	if _, err := env.db.Transfer(senderId, "test_user", Money{1, DefaultCurrency}, now.Add(24*time.Hour+time.Second)); err != nil {
+		t.Errorf("transfer a day later, got %v", err)
+	}
+	creditTestWallet(senderId, Money{1, "EUR"})
+	creditTestWallet(recipientId, Money{-1, "EUR"})
+}
+
+func TestTransferHeldFunds(t *testing.T) {
+	env := NewTestEnv()
+	env.db = newTestDB(t)
+	buyerId, sellerId := 1, 2
+	startSellerBalance, _ := env.db.Balance(sellerId, DefaultCurrency)
+
+	// The seller is paid for a sale, which is held before it can be sent on
+	creditTestWallet(buyerId, Money{17500, DefaultCurrency})
+	orderId, err := env.db.Purchase(buyerId, 1, 0, "", DefaultCurrency)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := env.db.ConfirmReceipt(buyerId, orderId, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	// 250.00 is more than the seller had before the sale
+	recorder := httptest.NewRecorder()
+	env.Transfer(recorder, newCartRequest("POST", "/api/transfer?to=test_user&amount=250", sellerId))
+	if result := recorder.Result(); result.StatusCode != http.StatusForbidden {
+		t.Errorf("bad status code for transfer of held funds, expected %v, got %v", http.StatusForbidden, result.StatusCode)
+	}
+	if balance, _ := env.db.Balance(sellerId, DefaultCurrency); balance.amount != startSellerBalance.amount+17500 {
+		t.Errorf("transfer of held funds changed the balance, expected %v, got %v", startSellerBalance.amount+17500, balance.amount)
+	}
+
+	amount := Money{startSellerBalance.amount + 17500, DefaultCurrency}
+	if _, err := env.db.Transfer(sellerId, "test_user", amount, time.Now()); err != ErrFundsHeld {
+		t.Errorf("transferring held funds, expected %v, got %v", ErrFundsHeld, err)
+	}
+	if _, err := env.db.Transfer(sellerId, "test_user", amount, time.Now().Add(SaleHold+time.Minute)); err != nil {
+		t.Errorf("transferring funds after the hold, got %v", err)
+	}
+}
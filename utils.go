@@ -3,6 +3,7 @@ package main
 import (
 	"crypto/rand"
 	"encoding/base64"
+	"strings"
 	"unsafe"
 
 	"golang.org/x/crypto/bcrypt"
@@ -26,6 +27,7 @@ func generateToken(length int) (string, error) {
 	return base64.URLEncoding.EncodeToString(bytes), err
 }
 
-func convertMoneyPrintable(money int) float64 {
-	return float64(money) / float64(100.0)
+// escapeLike escapes the LIKE wildcards in s so it is matched literally
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
 }
@@ -29,35 +29,6 @@ func FuzzPasswordHashing(f *testing.F) {
 	})
 }
 
-var testConvertMoneyPrintableTable = map[string]struct {
-	input    int
-	expected float64
-}{
-	"decimal": {
-		input:    137,
-		expected: 1.37,
-	},
-	"integer": {
-		input:    100,
-		expected: 1,
-	},
-}
-
-func TestConvertMoneyPrintable(t *testing.T) {
-	t.Parallel()
-	for name, args := range testConvertMoneyPrintableTable {
-		input := args.input
-		expected := args.expected
-		t.Run(name, func(t *testing.T) {
-			t.Parallel()
-			answer := convertMoneyPrintable(input)
-			if answer != expected {
-				t.Errorf("input %v, got %v, expected %v", input, answer, expected)
-			}
-		})
-	}
-}
-
 func TestGenerateToken(t *testing.T) {
 	_, err := generateToken(TokenLength)
 	if err != nil {
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Deposit limits in minor units
+const (
+	MinDeposit = 1_00
+	MaxDeposit = 10_000_00
+)
+
+// SaleHold is how long money from a sale is held before the seller can withdraw it, so
+// refunds can still be taken back
+const SaleHold = 7 * 24 * time.Hour
+
+type LedgerKind string
+
+const (
+	LedgerOpening            LedgerKind = "opening" // balances from before the ledger
+	LedgerAdjustment         LedgerKind = "adjustment"
+	LedgerDeposit            LedgerKind = "deposit"
+	LedgerDepositReversal    LedgerKind = "deposit_reversal"
+	LedgerPurchase           LedgerKind = "purchase"
+	LedgerRefund             LedgerKind = "refund"
+	LedgerSale               LedgerKind = "sale"
+	LedgerSaleReversal       LedgerKind = "sale_reversal"
+	LedgerWithdrawal         LedgerKind = "withdrawal"
+	LedgerWithdrawalReversal LedgerKind = "withdrawal_reversal"
+	LedgerTransferOut        LedgerKind = "transfer_out"
+	LedgerTransferIn         LedgerKind = "transfer_in"
+	LedgerGiftCard           LedgerKind = "gift_card"
+)
+
+// LedgerEntry is a movement of money in or out of a wallet, a wallet's balance is the sum
+// of its entries. Debits have negative amounts
+type LedgerEntry struct {
+	entryId     int
+	userId      int
+	amount      Money
+	kind        LedgerKind
+	referenceId int       // the deposit, order, withdrawal, transfer or gift card moving the money, 0 if none
+	heldUntil   time.Time // the amount can't be withdrawn before this, zero if never held
+	createdAt   time.Time
+}
+
+func (l LedgerEntry) String() string {
+	held := ""
+	if !l.heldUntil.IsZero() {
+		held = ", held until: " + l.heldUntil.String()
+	}
+	return fmt.Sprintf("entry: %v, amount: %v, kind: %v, reference: %v%v, created: %v",
+		l.entryId, l.amount, l.kind, l.referenceId, held, l.createdAt.String())
+}
+
+// queryRower is satisfied by both *sql.DB and *sql.Tx
+type queryRower interface {
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// querier is satisfied by both *sql.DB and *sql.Tx
+type querier interface {
+	Query(query string, args ...any) (*sql.Rows, error)
+}
+
+// rowScanner is satisfied by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+// Balances returns the user's wallets, a user without any has no balance
+func (s *SqlDB) Balances(userId int) ([]Money, error) {
+	query := `SELECT CAST(balance*100 AS BIGINT), currency FROM wallets WHERE user_id=$1 ORDER BY currency`
+	rows, err := s.db.Query(query, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var balances []Money
+	var balance Money
+	for rows.Next() {
+		if err := rows.Scan(&balance.amount, &balance.currency); err != nil {
+			return nil, err
+		}
+		balances = append(balances, balance)
+	}
+
+	return balances, rows.Err()
+}
+
+// Balance returns the balance of the user's wallet in currency, zero if they don't have one
+func (s *SqlDB) Balance(userId int, currency Currency) (Money, error) {
+	balance := Money{currency: currency}
+	query := `SELECT CAST(balance*100 AS BIGINT) FROM wallets WHERE user_id=$1 AND currency=$2`
+	err := s.db.QueryRow(query, userId, currency).Scan(&balance.amount)
+	if err == sql.ErrNoRows {
+		return balance, nil
+	}
+	return balance, err
+}
+
+// Ledger returns the user's ledger entries in every currency, newest first
+func (s *SqlDB) Ledger(userId int) ([]LedgerEntry, error) {
+	query := `SELECT entry_id, user_id, CAST(amount*100 AS BIGINT), currency, kind, COALESCE(reference_id, 0), held_until, created_at
+			  FROM ledger_entries WHERE user_id=$1 ORDER BY entry_id DESC`
+	rows, err := s.db.Query(query, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []LedgerEntry
+	var entry LedgerEntry
+	for rows.Next() {
+		var heldUntil sql.NullTime
+		err := rows.Scan(&entry.entryId, &entry.userId, &entry.amount.amount, &entry.amount.currency, &entry.kind,
+			&entry.referenceId, &heldUntil, &entry.createdAt)
+		if err != nil {
+			return nil, err
+		}
+		entry.heldUntil = heldUntil.Time
+		entries = append(entries, entry)
+	}
+
+	return entries, rows.Err()
+}
+
+// creditWallet adds entry.amount to the user's wallet in its currency, opening the wallet
+// if needed, and records the entry in the ledger. The new balance is returned, or
+// ErrBalanceTooLarge if it wouldn't fit in the column
+func creditWallet(q queryRower, entry LedgerEntry) (Money, error) {
+	balance := Money{currency: entry.amount.currency}
+	heldUntil := sql.NullTime{Time: entry.heldUntil, Valid: !entry.heldUntil.IsZero()}
+	query := `WITH credited AS (
+				  INSERT INTO wallets (user_id, currency, balance) VALUES ($1, $2, CAST($3 AS NUMERIC(12, 0))/100)
+				  ON CONFLICT (user_id, currency) DO UPDATE SET balance=wallets.balance+EXCLUDED.balance
+				  RETURNING balance
+			  ), entry AS (
+				  INSERT INTO ledger_entries (user_id, currency, amount, kind, reference_id, held_until)
+				  VALUES ($1, $2, CAST($3 AS NUMERIC(12, 0))/100, $4, NULLIF($5, 0), $6)
+			  )
+			  SELECT CAST(balance*100 AS BIGINT) FROM credited`
+	err := q.QueryRow(query, entry.userId, entry.amount.currency, entry.amount.amount, entry.kind, entry.referenceId, heldUntil).Scan(&balance.amount)
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "22003" { // numeric_value_out_of_range
+		return Money{}, ErrBalanceTooLarge
+	}
+	return balance, err
+}
+
+// debitWallet takes entry.amount from the user's wallet in its currency and records it in
+// the ledger as a negative amount, failing with ErrInsufficientFunds if the wallet is
+// missing or doesn't hold enough. The wallet row is locked until tx ends, wallets are
+// locked last
+func debitWallet(tx *sql.Tx, entry LedgerEntry) error {
+	heldUntil := sql.NullTime{Time: entry.heldUntil, Valid: !entry.heldUntil.IsZero()}
+	query := `WITH debited AS (
+				  UPDATE wallets SET balance=balance-CAST($1 AS NUMERIC(12, 0))/100
+				  WHERE user_id=$2 AND currency=$3 AND balance>=CAST($1 AS NUMERIC(12, 0))/100
+				  RETURNING user_id, currency
+			  ), entry AS (
+				  INSERT INTO ledger_entries (user_id, currency, amount, kind, reference_id, held_until)
+				  SELECT user_id, currency, -CAST($1 AS NUMERIC(12, 0))/100, $4, NULLIF($5, 0), CAST($6 AS TIMESTAMP WITH TIME ZONE)
+				  FROM debited
+			  )
+			  SELECT user_id FROM debited`
+	var userId int
+	err := tx.QueryRow(query, entry.amount.amount, entry.userId, entry.amount.currency, entry.kind, entry.referenceId, heldUntil).Scan(&userId)
+	if err == sql.ErrNoRows {
+		return ErrInsufficientFunds
+	}
+	return err
+}
+
+// lockWallets locks the users' wallets in currency in user order, so transactions moving
+// money between the same users can't deadlock
+func lockWallets(tx *sql.Tx, userIds []int, currency Currency) error {
+	ids := make(pq.Int64Array, len(userIds))
+	for i, userId := range userIds {
+		ids[i] = int64(userId)
+	}
+	rows, err := tx.Query(`SELECT user_id FROM wallets WHERE user_id=ANY($1) AND currency=$2 ORDER BY user_id FOR UPDATE`, ids, currency)
+	if err != nil {
+		return err
+	}
+	rows.Close()
+	return rows.Err()
+}
+
+// availableBalance locks the user's wallet in currency and returns its balance and the part
+// of it that can be withdrawn, which excludes sale money still on hold at now
+func availableBalance(tx *sql.Tx, userId int, currency Currency, now time.Time) (Money, Money, error) {
+	balance, available := Money{currency: currency}, Money{currency: currency}
+	balanceQuery := `SELECT CAST(balance*100 AS BIGINT) FROM wallets WHERE user_id=$1 AND currency=$2 FOR UPDATE`
+	err := tx.QueryRow(balanceQuery, userId, currency).Scan(&balance.amount)
+	if err == sql.ErrNoRows {
+		return balance, available, nil
+	} else if err != nil {
+		return balance, available, err
+	}
+
+	var held int
+	heldQuery := `SELECT COALESCE(CAST(SUM(amount)*100 AS BIGINT), 0) FROM ledger_entries
+				  WHERE user_id=$1 AND currency=$2 AND held_until>$3`
+	err = tx.QueryRow(heldQuery, userId, currency, now).Scan(&held)
+	available.amount = balance.amount - min(balance.amount, max(held, 0))
+	return balance, available, err
+}
+
+func (env *Env) Ledger(w http.ResponseWriter, r *http.Request) {
+	userId, ok := r.Context().Value(CtxUserId).(int)
+	if !ok {
+		env.logger.Println("context does not include userId for protected endpoint")
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	entries, err := env.db.Ledger(userId)
+	if err != nil {
+		env.logger.Println(err.Error())
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	// Print entries, newest first
+	for _, entry := range entries {
+		fmt.Fprintln(w, entry)
+	}
+}
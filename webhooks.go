@@ -0,0 +1,693 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+var ErrTooManyEndpoints error = errors.New("too many webhook endpoints")
+
+const (
+	// WebhookDeliveryInterval is how often the worker looks for webhooks to deliver
+	WebhookDeliveryInterval = 10 * time.Second
+	// WebhookDeliveryBatch is the most deliveries the worker claims at once
+	WebhookDeliveryBatch = 50
+	// WebhookDeliveryLease is how long a claimed delivery is left to its worker before
+	// another may retry it, longer than WebhookDeliveryTimeout
+	WebhookDeliveryLease = 2 * time.Minute
+	// WebhookDeliveryTimeout bounds each delivery attempt
+	WebhookDeliveryTimeout = 10 * time.Second
+	// MaxWebhookAttempts is how many times a delivery is tried before giving up
+	MaxWebhookAttempts = 8
+	// WebhookRetryDelay is the wait before the first retry, it doubles each attempt
+	WebhookRetryDelay = 30 * time.Second
+	// MaxWebhookEndpoints is how many endpoints each user, or the integrations, may have
+	MaxWebhookEndpoints = 10
+	// WebhookDeliveriesLimit is how many deliveries the delivery log shows
+	WebhookDeliveriesLimit = 100
+)
+
+// webhookEventTypes are the events endpoints can subscribe to
+var webhookEventTypes = []EventType{EventPurchaseCreated, EventDepositSucceeded, EventItemUpdated}
+
+type DeliveryStatus string
+
+const (
+	DeliveryPending   DeliveryStatus = "pending"
+	DeliveryDelivered DeliveryStatus = "delivered"
+	DeliveryFailed    DeliveryStatus = "failed"
+)
+
+// WebhookEndpoint receives the events it subscribes to about its user. Endpoints without
+// a user belong to integrations set up by admins and receive the events about everyone
+type WebhookEndpoint struct {
+	endpointId int
+	userId     int // 0 for integrations
+	url        string
+	secret     string // signs deliveries
+	events     []EventType
+	createdAt  time.Time
+}
+
+func (e WebhookEndpoint) String() string {
+	return fmt.Sprintf("webhook: %v, url: %v, events: %v, created: %v", e.endpointId, e.url, e.events, e.createdAt.String())
+}
+
+// subscribed reports whether the endpoint is sent the webhook about an event of eventType
+func (e WebhookEndpoint) subscribed(eventType EventType, webhook EventWebhook) bool {
+	if !slices.Contains(e.events, eventType) {
+		return false
+	}
+	if e.userId == 0 {
+		return webhook.integrations
+	}
+	return e.userId == webhook.userId
+}
+
+// WebhookDelivery is an attempt to send an event to an endpoint. Redelivering an event
+// adds a new delivery so the log keeps each one
+type WebhookDelivery struct {
+	deliveryId     int
+	eventId        int
+	endpointId     int
+	eventType      EventType
+	status         DeliveryStatus
+	attempts       int
+	responseStatus int // 0 until the endpoint responds
+	lastError      string
+	nextAttemptAt  time.Time
+	createdAt      time.Time
+	deliveredAt    time.Time // zero until delivered
+
+	// Filled in when claimed for delivery
+	url     string
+	secret  string
+	payload []byte
+}
+
+func (d WebhookDelivery) String() string {
+	return fmt.Sprintf("delivery: %v, event: %v, type: %v, status: %v, attempts: %v, response: %v, error: %q, created: %v",
+		d.deliveryId, d.eventId, d.eventType, d.status, d.attempts, d.responseStatus, d.lastError, d.createdAt.String())
+}
+
+// retry returns the status and next attempt time of a delivery that failed at now, backing
+// off exponentially until MaxWebhookAttempts is reached
+func (d WebhookDelivery) retry(now time.Time) (DeliveryStatus, time.Time) {
+	if d.attempts >= MaxWebhookAttempts {
+		return DeliveryFailed, now
+	}
+	return DeliveryPending, now.Add(WebhookRetryDelay << (d.attempts - 1))
+}
+
+// webhookPayload is the JSON body of a delivery, the same for every delivery of an event
+type webhookPayload struct {
+	Id        int             `json:"id"`
+	Type      EventType       `json:"type"`
+	CreatedAt time.Time       `json:"created_at"`
+	Data      json.RawMessage `json:"data"`
+}
+
+const webhookEndpointColumns = `endpoint_id, COALESCE(user_id, 0), url, secret, events, created_at`
+
+func scanWebhookEndpoint(row rowScanner) (WebhookEndpoint, error) {
+	var endpoint WebhookEndpoint
+	var events pq.StringArray
+	err := row.Scan(&endpoint.endpointId, &endpoint.userId, &endpoint.url, &endpoint.secret, &events, &endpoint.createdAt)
+	for _, event := range events {
+		endpoint.events = append(endpoint.events, EventType(event))
+	}
+	return endpoint, err
+}
+
+const webhookDeliveryColumns = `webhook_deliveries.delivery_id, webhook_deliveries.event_id, webhook_deliveries.endpoint_id,
+								webhook_events.type, webhook_deliveries.status, webhook_deliveries.attempts,
+								COALESCE(webhook_deliveries.response_status, 0), webhook_deliveries.last_error,
+								webhook_deliveries.next_attempt_at, webhook_deliveries.created_at, webhook_deliveries.delivered_at`
+
+func webhookDeliveryFields(delivery *WebhookDelivery, deliveredAt *sql.NullTime) []any {
+	return []any{&delivery.deliveryId, &delivery.eventId, &delivery.endpointId, &delivery.eventType, &delivery.status, &delivery.attempts,
+		&delivery.responseStatus, &delivery.lastError, &delivery.nextAttemptAt, &delivery.createdAt, deliveredAt}
+}
+
+func scanWebhookDelivery(row rowScanner) (WebhookDelivery, error) {
+	var delivery WebhookDelivery
+	var deliveredAt sql.NullTime
+	err := row.Scan(webhookDeliveryFields(&delivery, &deliveredAt)...)
+	delivery.deliveredAt = deliveredAt.Time
+	return delivery, err
+}
+
+// EventWebhook is what the webhooks of a user, and maybe the integrations, are sent about
+// an event
+type EventWebhook struct {
+	userId       int  // whose endpoints are sent it, 0 for no user's
+	integrations bool // whether integrations are sent it too
+	data         any
+}
+
+// eventWebhooks returns what to send webhooks about an event. Integrations are sent each
+// event as recorded, as are the webhooks of the user it is about, except for purchases
+// where each seller's webhooks are sent only their part of the order
+func eventWebhooks(event DomainEvent) ([]EventWebhook, error) {
+	if event.eventType != EventPurchaseCreated {
+		return []EventWebhook{{event.userId, true, event.data}}, nil
+	}
+	var purchase purchaseCreatedEvent
+	if err := event.Decode(&purchase); err != nil {
+		return nil, err
+	}
+	sellerLines := make(map[int][]purchaseEventLine)
+	for _, line := range purchase.Lines {
+		if line.SellerId != 0 {
+			sellerLines[line.SellerId] = append(sellerLines[line.SellerId], line)
+		}
+	}
+	webhooks := []EventWebhook{{0, true, event.data}}
+	for _, sellerId := range slices.Sorted(maps.Keys(sellerLines)) {
+		webhooks = append(webhooks, EventWebhook{sellerId, false, map[string]any{"order_id": purchase.OrderId, "buyer_id": purchase.UserId,
+			"seller_id": sellerId, "lines": sellerLines[sellerId]}})
+	}
+	return webhooks, nil
+}
+
+// WebhookEventHandler enqueues deliveries of each event it is given to the endpoints
+// subscribed to it
+func WebhookEventHandler(db DB) EventHandler {
+	return func(event DomainEvent) error {
+		webhooks, err := eventWebhooks(event)
+		if err != nil {
+			return err
+		}
+		return db.EnqueueWebhookEvents(event.eventId, event.eventType, webhooks)
+	}
+}
+
+// enqueueWebhookEvent records a webhook event about the domain event and a pending
+// delivery to each endpoint subscribed to it, as part of tx. Nothing is added if the
+// webhook was already recorded so the domain event can be handled again
+func enqueueWebhookEvent(tx *sql.Tx, eventId int, eventType EventType, webhook EventWebhook) error {
+	encoded, err := json.Marshal(webhook.data)
+	if err != nil {
+		return err
+	}
+	query := `WITH event AS (
+				  INSERT INTO webhook_events (domain_event_id, type, user_id, data) VALUES ($1, $2, NULLIF($3, 0), $4)
+				  ON CONFLICT DO NOTHING RETURNING event_id
+			  )
+			  INSERT INTO webhook_deliveries (event_id, endpoint_id)
+			  SELECT event.event_id, webhook_endpoints.endpoint_id FROM event, webhook_endpoints
+			  WHERE $2=ANY(webhook_endpoints.events) AND ((webhook_endpoints.user_id IS NULL AND $5) OR webhook_endpoints.user_id=$3)`
+	_, err = tx.Exec(query, eventId, eventType, webhook.userId, encoded, webhook.integrations)
+	return err
+}
+
+// EnqueueWebhookEvents records the webhooks for a domain event together, so none are sent
+// if any can't be
+func (s *SqlDB) EnqueueWebhookEvents(eventId int, eventType EventType, webhooks []EventWebhook) (err error) {
+	var tx *sql.Tx
+	tx, err = s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	// Rollback or commit depending on err
+	defer func() {
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	for _, webhook := range webhooks {
+		if err = enqueueWebhookEvent(tx, eventId, eventType, webhook); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AddWebhookEndpoint registers an endpoint, returning ErrTooManyEndpoints if its user
+// already has MaxWebhookEndpoints
+func (s *SqlDB) AddWebhookEndpoint(endpoint WebhookEndpoint) (added WebhookEndpoint, err error) {
+	var tx *sql.Tx
+	tx, err = s.db.Begin()
+	if err != nil {
+		return WebhookEndpoint{}, err
+	}
+
+	// Rollback or commit depending on err
+	defer func() {
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	// Serialise registrations by the same user so the limit holds
+	if _, err = tx.Exec(`SELECT pg_advisory_xact_lock(hashtext('webhook_endpoints'), $1)`, endpoint.userId); err != nil {
+		return WebhookEndpoint{}, err
+	}
+	var count int
+	err = tx.QueryRow(`SELECT COUNT(*) FROM webhook_endpoints WHERE COALESCE(user_id, 0)=$1`, endpoint.userId).Scan(&count)
+	if err != nil {
+		return WebhookEndpoint{}, err
+	}
+	if count >= MaxWebhookEndpoints {
+		return WebhookEndpoint{}, ErrTooManyEndpoints
+	}
+
+	events := make(pq.StringArray, len(endpoint.events))
+	for i, event := range endpoint.events {
+		events[i] = string(event)
+	}
+	addQuery := `INSERT INTO webhook_endpoints (user_id, url, secret, events) VALUES (NULLIF($1, 0), $2, $3, $4)
+				 RETURNING ` + webhookEndpointColumns
+	return scanWebhookEndpoint(tx.QueryRow(addQuery, endpoint.userId, endpoint.url, endpoint.secret, events))
+}
+
+// WebhookEndpoints returns the user's endpoints, or the integrations' if userId is 0
+func (s *SqlDB) WebhookEndpoints(userId int) ([]WebhookEndpoint, error) {
+	query := `SELECT ` + webhookEndpointColumns + ` FROM webhook_endpoints WHERE COALESCE(user_id, 0)=$1 ORDER BY endpoint_id`
+	rows, err := s.db.Query(query, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var endpoints []WebhookEndpoint
+	for rows.Next() {
+		endpoint, err := scanWebhookEndpoint(rows)
+		if err != nil {
+			return nil, err
+		}
+		endpoints = append(endpoints, endpoint)
+	}
+
+	return endpoints, rows.Err()
+}
+
+func (s *SqlDB) GetWebhookEndpoint(endpointId int) (WebhookEndpoint, error) {
+	query := `SELECT ` + webhookEndpointColumns + ` FROM webhook_endpoints WHERE endpoint_id=$1`
+	return scanWebhookEndpoint(s.db.QueryRow(query, endpointId))
+}
+
+// DeleteWebhookEndpoint removes an endpoint along with its delivery log
+func (s *SqlDB) DeleteWebhookEndpoint(endpointId int) error {
+	_, err := s.db.Exec(`DELETE FROM webhook_endpoints WHERE endpoint_id=$1`, endpointId)
+	return err
+}
+
+// WebhookDeliveries returns the endpoint's latest deliveries, newest first
+func (s *SqlDB) WebhookDeliveries(endpointId int) ([]WebhookDelivery, error) {
+	query := `SELECT ` + webhookDeliveryColumns + ` FROM webhook_deliveries
+			  JOIN webhook_events ON webhook_deliveries.event_id=webhook_events.event_id
+			  WHERE webhook_deliveries.endpoint_id=$1
+			  ORDER BY webhook_deliveries.delivery_id DESC LIMIT $2`
+	rows, err := s.db.Query(query, endpointId, WebhookDeliveriesLimit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var deliveries []WebhookDelivery
+	for rows.Next() {
+		delivery, err := scanWebhookDelivery(rows)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, delivery)
+	}
+
+	return deliveries, rows.Err()
+}
+
+// RedeliverWebhook queues the event of one of the endpoint's deliveries to be sent to it
+// again, sql.ErrNoRows is returned if the endpoint has no such delivery
+func (s *SqlDB) RedeliverWebhook(endpointId int, deliveryId int) (WebhookDelivery, error) {
+	query := `WITH redelivery AS (
+				  INSERT INTO webhook_deliveries (event_id, endpoint_id)
+				  SELECT event_id, endpoint_id FROM webhook_deliveries WHERE delivery_id=$1 AND endpoint_id=$2
+				  RETURNING *
+			  )
+			  SELECT ` + strings.ReplaceAll(webhookDeliveryColumns, "webhook_deliveries.", "redelivery.") + `
+			  FROM redelivery JOIN webhook_events ON redelivery.event_id=webhook_events.event_id`
+	return scanWebhookDelivery(s.db.QueryRow(query, deliveryId, endpointId))
+}
+
+// ClaimWebhookDeliveries takes up to limit pending deliveries due by now, counting the
+// attempt and leasing them for WebhookDeliveryLease so other workers skip them. Claimed
+// deliveries come with their endpoint and payload
+func (s *SqlDB) ClaimWebhookDeliveries(now time.Time, limit int) ([]WebhookDelivery, error) {
+	query := `UPDATE webhook_deliveries SET attempts=webhook_deliveries.attempts+1, next_attempt_at=$2
+			  FROM webhook_events, webhook_endpoints
+			  WHERE webhook_deliveries.delivery_id IN (
+				  SELECT delivery_id FROM webhook_deliveries WHERE status=$3 AND next_attempt_at<=$1
+				  ORDER BY next_attempt_at, delivery_id LIMIT $4 FOR UPDATE SKIP LOCKED
+			  )
+			  AND webhook_events.event_id=webhook_deliveries.event_id AND webhook_endpoints.endpoint_id=webhook_deliveries.endpoint_id
+			  RETURNING ` + webhookDeliveryColumns + `, webhook_endpoints.url, webhook_endpoints.secret,
+			  webhook_events.created_at, webhook_events.data`
+	rows, err := s.db.Query(query, now, now.Add(WebhookDeliveryLease), DeliveryPending, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var deliveries []WebhookDelivery
+	for rows.Next() {
+		var delivery WebhookDelivery
+		var deliveredAt sql.NullTime
+		var createdAt time.Time
+		var data []byte
+		fields := append(webhookDeliveryFields(&delivery, &deliveredAt), &delivery.url, &delivery.secret, &createdAt, &data)
+		if err := rows.Scan(fields...); err != nil {
+			return nil, err
+		}
+		delivery.deliveredAt = deliveredAt.Time
+		payload := webhookPayload{delivery.eventId, delivery.eventType, createdAt, data}
+		if delivery.payload, err = json.Marshal(payload); err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, delivery)
+	}
+
+	return deliveries, rows.Err()
+}
+
+// FinishWebhookDelivery records the outcome of a delivery attempt. Delivered deliveries
+// are stamped with at, pending ones are retried at it
+func (s *SqlDB) FinishWebhookDelivery(deliveryId int, status DeliveryStatus, responseStatus int, lastError string, at time.Time) error {
+	query := `UPDATE webhook_deliveries SET status=$1, response_status=NULLIF($2, 0), last_error=$3,
+			  delivered_at=CASE WHEN $1='delivered' THEN $4 END, next_attempt_at=$4
+			  WHERE delivery_id=$5`
+	_, err := s.db.Exec(query, status, responseStatus, lastError, at, deliveryId)
+	return err
+}
+
+// sendWebhook posts the delivery's payload to its endpoint signed with the endpoint's
+// secret, like payment webhooks: "t=<unix time>,v1=<hex hmac>" in Webhook-Signature. It
+// returns the response status, which must be 2xx for the delivery to succeed
+func sendWebhook(client *http.Client, delivery WebhookDelivery, now time.Time) (int, error) {
+	request, err := http.NewRequest("POST", delivery.url, bytes.NewReader(delivery.payload))
+	if err != nil {
+		return 0, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("Webhook-Id", strconv.Itoa(delivery.eventId))
+	request.Header.Set("Webhook-Event", string(delivery.eventType))
+	request.Header.Set("Webhook-Signature",
+		fmt.Sprintf("t=%v,v1=%v", now.Unix(), webhookSignature([]byte(delivery.secret), now.Unix(), delivery.payload)))
+
+	response, err := client.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(response.Body, MaxWebhookSize))
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return response.StatusCode, fmt.Errorf("endpoint responded %v", response.Status)
+	}
+	return response.StatusCode, nil
+}
+
+// deliverWebhooks sends the deliveries due by now, returning how many succeeded
+func (env *Env) deliverWebhooks(now time.Time) (int, error) {
+	deliveries, err := env.db.ClaimWebhookDeliveries(now, WebhookDeliveryBatch)
+	if err != nil {
+		return 0, err
+	}
+
+	delivered := 0
+	for _, delivery := range deliveries {
+		responseStatus, sendErr := sendWebhook(env.webhookClient, delivery, time.Now())
+		status, at, lastError := DeliveryDelivered, time.Now(), ""
+		if sendErr != nil {
+			status, at = delivery.retry(now)
+			lastError = sendErr.Error()
+			env.logger.Printf("webhook delivery %v to endpoint %v: %v", delivery.deliveryId, delivery.endpointId, lastError)
+		} else {
+			delivered++
+		}
+		if err := env.db.FinishWebhookDelivery(delivery.deliveryId, status, responseStatus, lastError, at); err != nil {
+			return delivered, err
+		}
+	}
+	return delivered, nil
+}
+
+// RunWebhookWorker delivers webhooks from the outbox until done is closed
+func (env *Env) RunWebhookWorker(done <-chan struct{}) {
+	ticker := time.NewTicker(WebhookDeliveryInterval)
+	defer ticker.Stop()
+	for {
+		delivered, err := env.deliverWebhooks(time.Now())
+		if err != nil {
+			env.logger.Println("webhook worker:", err.Error())
+		} else if delivered != 0 {
+			env.logger.Println("webhook worker: delivered", delivered, "webhooks")
+		}
+
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+	}
+}
+
+// parseWebhookEvents parses a comma separated list of event types, at least one is needed
+func parseWebhookEvents(value string) ([]EventType, error) {
+	var events []EventType
+	for _, part := range strings.Split(value, ",") {
+		event := EventType(strings.TrimSpace(part))
+		if !slices.Contains(webhookEventTypes, event) {
+			return nil, fmt.Errorf("unknown webhook event %q", event)
+		}
+		if !slices.Contains(events, event) {
+			events = append(events, event)
+		}
+	}
+	return events, nil
+}
+
+// addWebhookEndpoint returns a handler registering an endpoint for the requesting user,
+// or for the integrations if integration is set
+func (env *Env) addWebhookEndpoint(integration bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userId, ok := r.Context().Value(CtxUserId).(int)
+		if !ok {
+			env.logger.Println("context does not include userId for protected endpoint")
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		endpoint := WebhookEndpoint{userId: userId}
+		if integration {
+			if !env.requireAdmin(w, userId) {
+				return
+			}
+			endpoint.userId = 0
+		}
+
+		// Get URL and events
+		url, err := parseWebhookURL(r.FormValue("url"))
+		if err != nil || len(url) == 0 {
+			http.Error(w, "Invalid webhook URL", http.StatusBadRequest)
+			return
+		}
+		events, err := parseWebhookEvents(r.FormValue("events"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		endpoint.url, endpoint.events = url, events
+
+		// The secret is only shown now, receivers verify deliveries with it
+		endpoint.secret, err = generateToken(TokenLength)
+		if err != nil {
+			env.logger.Println(err.Error())
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		endpoint, err = env.db.AddWebhookEndpoint(endpoint)
+		if err != nil {
+			if err == ErrTooManyEndpoints {
+				http.Error(w, fmt.Sprintf("At most %v webhook endpoints", MaxWebhookEndpoints), http.StatusConflict)
+				return
+			}
+			env.logger.Println(err.Error())
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, "%v, secret: %v\n", endpoint, endpoint.secret)
+	}
+}
+
+func (env *Env) AddWebhookEndpoint(w http.ResponseWriter, r *http.Request) {
+	env.addWebhookEndpoint(false)(w, r)
+}
+
+func (env *Env) AddIntegrationWebhook(w http.ResponseWriter, r *http.Request) {
+	env.addWebhookEndpoint(true)(w, r)
+}
+
+// webhookEndpoints returns a handler listing the requesting user's endpoints, or the
+// integrations' if integration is set
+func (env *Env) webhookEndpoints(integration bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userId, ok := r.Context().Value(CtxUserId).(int)
+		if !ok {
+			env.logger.Println("context does not include userId for protected endpoint")
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		if integration {
+			if !env.requireAdmin(w, userId) {
+				return
+			}
+			userId = 0
+		}
+
+		endpoints, err := env.db.WebhookEndpoints(userId)
+		if err != nil {
+			env.logger.Println(err.Error())
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		for _, endpoint := range endpoints {
+			fmt.Fprintln(w, endpoint)
+		}
+	}
+}
+
+func (env *Env) WebhookEndpoints(w http.ResponseWriter, r *http.Request) {
+	env.webhookEndpoints(false)(w, r)
+}
+
+func (env *Env) IntegrationWebhooks(w http.ResponseWriter, r *http.Request) {
+	env.webhookEndpoints(true)(w, r)
+}
+
+// pathWebhookEndpoint gets the endpoint in the request path if the user owns it, or it is
+// an integration's and they are an admin, writing an error response and returning false
+// otherwise. Other users' endpoints are reported as not found
+func (env *Env) pathWebhookEndpoint(w http.ResponseWriter, r *http.Request, userId int) (WebhookEndpoint, bool) {
+	endpointId, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return WebhookEndpoint{}, false
+	}
+
+	endpoint, err := env.db.GetWebhookEndpoint(endpointId)
+	if err == nil && endpoint.userId == 0 {
+		var isAdmin bool
+		if isAdmin, err = env.db.IsAdmin(userId); err == nil && !isAdmin {
+			err = sql.ErrNoRows
+		}
+	} else if err == nil && endpoint.userId != userId {
+		err = sql.ErrNoRows
+	}
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return WebhookEndpoint{}, false
+		}
+		env.logger.Println(err.Error())
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return WebhookEndpoint{}, false
+	}
+	return endpoint, true
+}
+
+func (env *Env) DeleteWebhookEndpoint(w http.ResponseWriter, r *http.Request) {
+	userId, ok := r.Context().Value(CtxUserId).(int)
+	if !ok {
+		env.logger.Println("context does not include userId for protected endpoint")
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	endpoint, ok := env.pathWebhookEndpoint(w, r, userId)
+	if !ok {
+		return
+	}
+	if err := env.db.DeleteWebhookEndpoint(endpoint.endpointId); err != nil {
+		env.logger.Println(err.Error())
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (env *Env) WebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	userId, ok := r.Context().Value(CtxUserId).(int)
+	if !ok {
+		env.logger.Println("context does not include userId for protected endpoint")
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	endpoint, ok := env.pathWebhookEndpoint(w, r, userId)
+	if !ok {
+		return
+	}
+	deliveries, err := env.db.WebhookDeliveries(endpoint.endpointId)
+	if err != nil {
+		env.logger.Println(err.Error())
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	// Print the delivery log, newest first
+	for _, delivery := range deliveries {
+		fmt.Fprintln(w, delivery)
+	}
+}
+
+func (env *Env) RedeliverWebhook(w http.ResponseWriter, r *http.Request) {
+	userId, ok := r.Context().Value(CtxUserId).(int)
+	if !ok {
+		env.logger.Println("context does not include userId for protected endpoint")
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	endpoint, ok := env.pathWebhookEndpoint(w, r, userId)
+	if !ok {
+		return
+	}
+	deliveryId, err := strconv.Atoi(r.PathValue("deliveryId"))
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	delivery, err := env.db.RedeliverWebhook(endpoint.endpointId, deliveryId)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+		env.logger.Println(err.Error())
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprintln(w, delivery)
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var testParseWebhookEventsTable = map[string]struct {
+	input    string
+	expected []EventType
+}{
+	"one":        {"purchase.created", []EventType{EventPurchaseCreated}},
+	"several":    {"purchase.created, deposit.succeeded", []EventType{EventPurchaseCreated, EventDepositSucceeded}},
+	"duplicates": {"item.updated,item.updated", []EventType{EventItemUpdated}},
+	"unknown":    {"purchase.created,order.shipped", nil},
+	"empty":      {"", nil},
+}
+
+func TestParseWebhookEvents(t *testing.T) {
+	t.Parallel()
+	for name, args := range testParseWebhookEventsTable {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			answer, err := parseWebhookEvents(args.input)
+			if (err == nil) != (args.expected != nil) || fmt.Sprint(answer) != fmt.Sprint(args.expected) {
+				t.Errorf("input %q, got %v, %v, expected %v", args.input, answer, err, args.expected)
+			}
+		})
+	}
+}
+
+func TestWebhookEndpointSubscribed(t *testing.T) {
+	t.Parallel()
+	seller := WebhookEndpoint{userId: 2, events: []EventType{EventPurchaseCreated}}
+	integration := WebhookEndpoint{events: []EventType{EventPurchaseCreated}}
+	for _, args := range []struct {
+		endpoint  WebhookEndpoint
+		eventType EventType
+		webhook   EventWebhook
+		expected  bool
+	}{
+		{seller, EventPurchaseCreated, EventWebhook{userId: 2}, true},
+		{seller, EventPurchaseCreated, EventWebhook{userId: 1, integrations: true}, false},
+		{seller, EventPurchaseCreated, EventWebhook{integrations: true}, false},
+		{seller, EventItemUpdated, EventWebhook{userId: 2}, false},
+		{integration, EventPurchaseCreated, EventWebhook{userId: 1, integrations: true}, true},
+		{integration, EventPurchaseCreated, EventWebhook{integrations: true}, true},
+		{integration, EventPurchaseCreated, EventWebhook{userId: 2}, false},
+		{integration, EventDepositSucceeded, EventWebhook{userId: 1, integrations: true}, false},
+	} {
+		if answer := args.endpoint.subscribed(args.eventType, args.webhook); answer != args.expected {
+			t.Errorf("endpoint of %v subscribed to %v for %+v, got %v, expected %v",
+				args.endpoint.userId, args.eventType, args.webhook, answer, args.expected)
+		}
+	}
+}
+
+func TestWebhookDeliveryRetry(t *testing.T) {
+	t.Parallel()
+	now := time.Now()
+	for _, args := range []struct {
+		attempts int
+		status   DeliveryStatus
+		at       time.Time
+	}{
+		{1, DeliveryPending, now.Add(WebhookRetryDelay)},
+		{4, DeliveryPending, now.Add(8 * WebhookRetryDelay)},
+		{MaxWebhookAttempts, DeliveryFailed, now},
+	} {
+		if status, at := (WebhookDelivery{attempts: args.attempts}).retry(now); status != args.status || !at.Equal(args.at) {
+			t.Errorf("bad retry after %v attempts, expected %v at %v, got %v at %v", args.attempts, args.status, args.at, status, at)
+		}
+	}
+}
+
+// receivedWebhook is a request accepted by webhookReceiver
+type receivedWebhook struct {
+	header  http.Header
+	payload webhookPayload
+	body    []byte
+}
+
+// webhookReceiver records the webhooks posted to it, responding with status
+type webhookReceiver struct {
+	mu       sync.Mutex
+	status   int
+	received []receivedWebhook
+}
+
+func (rc *webhookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	var payload webhookPayload
+	json.Unmarshal(body, &payload)
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.received = append(rc.received, receivedWebhook{r.Header.Clone(), payload, body})
+	w.WriteHeader(rc.status)
+}
+
+// verify checks the webhook was signed with secret like payment webhooks are
+func (w receivedWebhook) verify(secret string) bool {
+	var timestamp int64 = -1
+	var signature string
+	for _, part := range strings.Split(w.header.Get("Webhook-Signature"), ",") {
+		key, value, _ := strings.Cut(part, "=")
+		switch key {
+		case "t":
+			timestamp, _ = strconv.ParseInt(value, 10, 64)
+		case "v1":
+			signature = value
+		}
+	}
+	return timestamp > 0 && signature == webhookSignature([]byte(secret), timestamp, w.body)
+}
+
+func TestWebhooks(t *testing.T) {
+	env := NewTestEnv()
+	env.db = newTestDB(t)
+	buyerId, sellerId, adminId := 1, 2, 3
+
+	receiver := &webhookReceiver{status: http.StatusOK}
+	server := httptest.NewTLSServer(receiver)
+	defer server.Close()
+	env.webhookClient = server.Client()
+
+	request := func(handler http.HandlerFunc, method string, target string, userId int, pathValues ...string) (int, string) {
+		t.Helper()
+		recorder := httptest.NewRecorder()
+		r := newCartRequest(method, target, userId)
+		for i := 0; i+1 < len(pathValues); i += 2 {
+			r.SetPathValue(pathValues[i], pathValues[i+1])
+		}
+		handler(recorder, r)
+		body, _ := io.ReadAll(recorder.Result().Body)
+		return recorder.Result().StatusCode, string(body)
+	}
+	for _, args := range []struct {
+		name     string
+		handler  http.HandlerFunc
+		userId   int
+		target   string
+		expected int
+	}{
+		{"InvalidURL", env.AddWebhookEndpoint, sellerId, "/api/webhooks?url=ftp://example.com&events=purchase.created", http.StatusBadRequest},
+		{"MissingURL", env.AddWebhookEndpoint, sellerId, "/api/webhooks?events=purchase.created", http.StatusBadRequest},
+		{"UnknownEvent", env.AddWebhookEndpoint, sellerId, "/api/webhooks?url=" + server.URL + "&events=order.shipped", http.StatusBadRequest},
+		{"PlainHTTP", env.AddWebhookEndpoint, sellerId, "/api/webhooks?url=http://example.com&events=item.updated", http.StatusBadRequest},
+		{"Seller", env.AddWebhookEndpoint, sellerId, "/api/webhooks?url=" + server.URL + "/seller&events=purchase.created,item.updated", http.StatusCreated},
+		{"IntegrationNotAdmin", env.AddIntegrationWebhook, sellerId, "/api/admin/webhooks?url=" + server.URL + "&events=purchase.created", http.StatusForbidden},
+		{"Integration", env.AddIntegrationWebhook, adminId, "/api/admin/webhooks?url=" + server.URL + "/integration&events=purchase.created,deposit.succeeded", http.StatusCreated},
+	} {
+		if status, body := request(args.handler, "POST", args.target, args.userId); status != args.expected {
+			t.Errorf("bad status code for %v, expected %v, got %v: %v", args.name, args.expected, status, body)
+		}
+	}
+	if len(webhookEndpoints) != 2 {
+		t.Fatalf("expected 2 endpoints, got %v", webhookEndpoints)
+	}
+	seller, integration := webhookEndpoints[0], webhookEndpoints[1]
+	if _, body := request(env.WebhookEndpoints, "GET", "/api/webhooks", sellerId); !strings.Contains(body, server.URL+"/seller") || strings.Contains(body, "/integration") {
+		t.Errorf("bad endpoints listed, got %q", body)
+	}
+	if _, body := request(env.IntegrationWebhooks, "GET", "/api/admin/webhooks", adminId); !strings.Contains(body, server.URL+"/integration") || strings.Contains(body, "/seller") {
+		t.Errorf("bad integrations listed, got %q", body)
+	}
+
+	// A purchase goes to the integration whole and to the seller as their part, once, when its
+	// event is dispatched
+	creditTestWallet(buyerId, Money{17500, DefaultCurrency})
+	orderId, err := env.db.Purchase(buyerId, 1, 0, "", DefaultCurrency)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := env.dispatchEvents(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if err := WebhookEventHandler(env.db)(domainEvents[len(domainEvents)-1]); err != nil || len(webhookDeliveries) != 2 {
+		t.Errorf("handling the purchase again added deliveries, got %v, %v", webhookDeliveries, err)
+	}
+	delivered, err := env.deliverWebhooks(time.Now())
+	if err != nil || delivered != 2 {
+		t.Fatalf("expected 2 webhooks delivered, got %v, %v", delivered, err)
+	}
+	for i, endpoint := range []WebhookEndpoint{integration, seller} {
+		received := receiver.received[i]
+		if !received.verify(endpoint.secret) || received.verify("wrong") {
+			t.Errorf("bad signature for endpoint %v: %v", endpoint.endpointId, received.header.Get("Webhook-Signature"))
+		}
+		var data struct {
+			OrderId  int             `json:"order_id"`
+			SellerId int             `json:"seller_id"`
+			Total    json.RawMessage `json:"total"`
+			Lines    []struct {
+				SellerId int                     `json:"seller_id"`
+				Amount   struct{ Amount string } `json:"amount"`
+			} `json:"lines"`
+		}
+		json.Unmarshal(received.payload.Data, &data)
+		whole := endpoint.userId == 0
+		if received.payload.Type != EventPurchaseCreated || received.header.Get("Webhook-Event") != string(EventPurchaseCreated) ||
+			data.OrderId != orderId || (data.SellerId == sellerId) == whole || (data.Total != nil) != whole ||
+			len(data.Lines) != 1 || data.Lines[0].SellerId != sellerId || data.Lines[0].Amount.Amount != "175.00" {
+			t.Errorf("bad webhook for endpoint %v, got %s", endpoint.endpointId, received.body)
+		}
+	}
+	if delivered, _ := env.deliverWebhooks(time.Now()); delivered != 0 {
+		t.Errorf("webhooks delivered twice, got %v", delivered)
+	}
+
+	// Access to the delivery log and redelivery is limited to the owner, and admins for integrations
+	sellerTarget := fmt.Sprintf("/api/webhooks/%v/deliveries", seller.endpointId)
+	integrationTarget := fmt.Sprintf("/api/webhooks/%v/deliveries", integration.endpointId)
+	for _, args := range []struct {
+		name       string
+		userId     int
+		target     string
+		endpointId int
+		expected   int
+	}{
+		{"OtherUsers", buyerId, sellerTarget, seller.endpointId, http.StatusNotFound},
+		{"Owner", sellerId, sellerTarget, seller.endpointId, http.StatusOK},
+		{"IntegrationNotAdmin", sellerId, integrationTarget, integration.endpointId, http.StatusNotFound},
+		{"Integration", adminId, integrationTarget, integration.endpointId, http.StatusOK},
+		{"Missing", sellerId, "/api/webhooks/99/deliveries", 99, http.StatusNotFound},
+	} {
+		status, body := request(env.WebhookDeliveries, "GET", args.target, args.userId, "id", fmt.Sprint(args.endpointId))
+		if status != args.expected {
+			t.Errorf("bad status code for %v, expected %v, got %v", args.name, args.expected, status)
+		}
+		if status == http.StatusOK && !strings.Contains(body, "status: delivered, attempts: 1, response: 200") {
+			t.Errorf("bad delivery log for %v, got %q", args.name, body)
+		}
+	}
+
+	// Failed deliveries back off and give up after MaxWebhookAttempts
+	receiver.status = http.StatusInternalServerError
+	deliveryId := webhookDeliveries[1].deliveryId
+	status, body := request(env.RedeliverWebhook, "POST", sellerTarget, buyerId, "id", fmt.Sprint(seller.endpointId), "deliveryId", fmt.Sprint(deliveryId))
+	if status != http.StatusNotFound {
+		t.Errorf("redelivered another user's webhook, got %v: %v", status, body)
+	}
+	status, body = request(env.RedeliverWebhook, "POST", sellerTarget, sellerId, "id", fmt.Sprint(seller.endpointId), "deliveryId", fmt.Sprint(deliveryId))
+	if status != http.StatusCreated {
+		t.Fatalf("expected the webhook to be redelivered, got %v: %v", status, body)
+	}
+	redelivery := webhookDeliveries[len(webhookDeliveries)-1]
+	now := time.Now()
+	for attempt := 1; attempt <= MaxWebhookAttempts; attempt++ {
+		if delivered, err := env.deliverWebhooks(now); delivered != 0 || err != nil {
+			t.Fatalf("attempt %v, expected nothing delivered, got %v, %v", attempt, delivered, err)
+		}
+		if retried, _ := env.deliverWebhooks(now); retried != 0 {
+			t.Fatalf("attempt %v retried before its backoff", attempt)
+		}
+		now = now.Add(WebhookRetryDelay << (attempt - 1))
+	}
+	if failed := webhookDeliveries[len(webhookDeliveries)-1]; failed.deliveryId != redelivery.deliveryId || failed.status != DeliveryFailed ||
+		failed.attempts != MaxWebhookAttempts || failed.responseStatus != http.StatusInternalServerError {
+		t.Errorf("expected the redelivery to fail after %v attempts, got %v", MaxWebhookAttempts, failed)
+	}
+	if received := receiver.received[len(receiver.received)-1]; received.payload.Id != receiver.received[1].payload.Id {
+		t.Errorf("redelivered a different event, got %s", received.body)
+	}
+
+	// Only the owner can delete an endpoint
+	if status, _ := request(env.DeleteWebhookEndpoint, "DELETE", "/api/webhooks", buyerId, "id", fmt.Sprint(seller.endpointId)); status != http.StatusNotFound {
+		t.Errorf("deleted another user's endpoint, got %v", status)
+	}
+	if status, _ := request(env.DeleteWebhookEndpoint, "DELETE", "/api/webhooks", sellerId, "id", fmt.Sprint(seller.endpointId)); status != http.StatusNoContent {
+		t.Errorf("expected the endpoint to be deleted, got %v", status)
+	}
+	if endpoints, _ := env.db.WebhookEndpoints(sellerId); len(endpoints) != 0 {
+		t.Errorf("expected no endpoints left, got %v", endpoints)
+	}
+}
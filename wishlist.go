@@ -0,0 +1,230 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// WishlistEntry is an item a user saved, with a price watch if target isn't -1
+type WishlistEntry struct {
+	item    Item
+	target  int // notify once the price drops to it, -1 without a watch
+	addedAt time.Time
+}
+
+func (w WishlistEntry) String() string {
+	target := "none"
+	if w.target >= 0 {
+		target = Money{w.target, w.item.currency}.String()
+	}
+	return fmt.Sprintf("%v, target: %v, added: %v", w.item, target, w.addedAt.String())
+}
+
+// PriceAlert is raised when a price change brings an item down to a user's target
+type PriceAlert struct {
+	userId   int
+	itemId   int
+	itemName string
+	price    Money
+	target   Money
+}
+
+func (p PriceAlert) String() string {
+	return fmt.Sprintf("user: %v, item: %v, name: %q, price: %v, target: %v", p.userId, p.itemId, p.itemName, p.price, p.target)
+}
+
+// triggerPriceWatches records a price drop for the watchers of the items whose price is now at or below
+// their target, returning the alerts. Watches are marked notified in the same transaction
+// so each drop is reported once, and watches whose item went back above the target are
+// rearmed
+func triggerPriceWatches(tx *sql.Tx, itemIds pq.Int64Array, now time.Time) ([]PriceAlert, error) {
+	rearmQuery := `UPDATE wishlist_items SET notified_at=NULL FROM items
+				   WHERE wishlist_items.item_id=items.item_id AND items.item_id=ANY($1)
+				   AND wishlist_items.notified_at IS NOT NULL AND items.price>wishlist_items.target_price`
+	if _, err := tx.Exec(rearmQuery, itemIds); err != nil {
+		return nil, err
+	}
+
+	alertQuery := `UPDATE wishlist_items SET notified_at=$2 FROM items
+				   WHERE wishlist_items.item_id=items.item_id AND items.item_id=ANY($1)
+				   AND wishlist_items.notified_at IS NULL AND items.price<=wishlist_items.target_price
+				   RETURNING wishlist_items.user_id, items.item_id, items.name, CAST(items.price*100 AS BIGINT),
+				   CAST(wishlist_items.target_price*100 AS BIGINT), items.currency`
+	rows, err := tx.Query(alertQuery, itemIds, now)
+	if err != nil {
+		return nil, err
+	}
+
+	var alerts []PriceAlert
+	for rows.Next() {
+		var alert PriceAlert
+		err := rows.Scan(&alert.userId, &alert.itemId, &alert.itemName, &alert.price.amount, &alert.target.amount, &alert.price.currency)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		alert.target.currency = alert.price.currency
+		alerts = append(alerts, alert)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// The rows are read before recording since the transaction runs one query at a time
+	for _, alert := range alerts {
+		event := priceDroppedEvent{alert.userId, alert.itemId, alert.itemName, alert.price, alert.target}
+		if err := recordEvent(tx, EventPriceDropped, alert.userId, event); err != nil {
+			return nil, err
+		}
+	}
+	return alerts, nil
+}
+
+// Wishlist returns the items the user saved, most recent first
+func (s *SqlDB) Wishlist(userId int) ([]WishlistEntry, error) {
+	query := `SELECT ` + itemColumns + `, COALESCE(CAST(wishlist_items.target_price*100 AS BIGINT), -1), wishlist_items.added_at
+			  FROM wishlist_items JOIN items ON wishlist_items.item_id=items.item_id
+			  WHERE wishlist_items.user_id=$1
+			  ORDER BY wishlist_items.added_at DESC, items.item_id`
+	rows, err := s.db.Query(query, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var wishlist []WishlistEntry
+	for rows.Next() {
+		var entry WishlistEntry
+		if err := rows.Scan(append(itemFields(&entry.item), &entry.target, &entry.addedAt)...); err != nil {
+			return nil, err
+		}
+		wishlist = append(wishlist, entry)
+	}
+
+	return wishlist, rows.Err()
+}
+
+// SaveToWishlist adds the item to the user's wishlist, or replaces the target of an item
+// already on it. A target of -1 removes the price watch, otherwise the watch is armed again
+func (s *SqlDB) SaveToWishlist(userId int, itemId int, target int) error {
+	query := `INSERT INTO wishlist_items (user_id, item_id, target_price) VALUES ($1, $2, CAST(NULLIF($3, -1) AS NUMERIC(12, 0))/100)
+			  ON CONFLICT (user_id, item_id) DO UPDATE SET target_price=EXCLUDED.target_price, notified_at=NULL`
+	_, err := s.db.Exec(query, userId, itemId, target)
+	return err
+}
+
+// RemoveFromWishlist removes the item from the user's wishlist, sql.ErrNoRows is returned
+// if it isn't on it
+func (s *SqlDB) RemoveFromWishlist(userId int, itemId int) error {
+	result, err := s.db.Exec(`DELETE FROM wishlist_items WHERE user_id=$1 AND item_id=$2`, userId, itemId)
+	if err != nil {
+		return err
+	}
+	if removed, err := result.RowsAffected(); err != nil {
+		return err
+	} else if removed == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func (env *Env) Wishlist(w http.ResponseWriter, r *http.Request) {
+	userId, ok := r.Context().Value(CtxUserId).(int)
+	if !ok {
+		env.logger.Println("context does not include userId for protected endpoint")
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	wishlist, err := env.db.Wishlist(userId)
+	if err != nil {
+		env.logger.Println(err.Error())
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	// Print the saved items, most recent first
+	for _, entry := range wishlist {
+		fmt.Fprintln(w, entry)
+	}
+}
+
+func (env *Env) SaveToWishlist(w http.ResponseWriter, r *http.Request) {
+	userId, ok := r.Context().Value(CtxUserId).(int)
+	if !ok {
+		env.logger.Println("context does not include userId for protected endpoint")
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	// Get item
+	itemId, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	item, err := env.db.GetItem(itemId)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+		env.logger.Println(err.Error())
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	// Get optional target price in the item's currency, a watch at or above the current
+	// price would never fire
+	target, err := parsePriceParam(r.FormValue("target"))
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	if target >= item.price {
+		http.Error(w, "Target must be below the current price", http.StatusBadRequest)
+		return
+	}
+
+	if err := env.db.SaveToWishlist(userId, item.itemId, target); err != nil {
+		env.logger.Println(err.Error())
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	fmt.Fprintln(w, "Success")
+}
+
+func (env *Env) RemoveFromWishlist(w http.ResponseWriter, r *http.Request) {
+	userId, ok := r.Context().Value(CtxUserId).(int)
+	if !ok {
+		env.logger.Println("context does not include userId for protected endpoint")
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	// Get item id
+	itemId, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	if err := env.db.RemoveFromWishlist(userId, itemId); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+		env.logger.Println(err.Error())
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWishlist(t *testing.T) {
+	env := NewTestEnv()
+	env.db = newTestDB(t)
+	userId, watcherId := 1, 3
+	item, _ := env.db.GetItem(1)
+	now := time.Now()
+
+	for _, args := range []struct {
+		name     string
+		userId   int
+		itemId   string
+		query    string
+		expected int
+	}{
+		{"SaveMissingItem", userId, "999", "", http.StatusNotFound},
+		{"SaveInvalidTarget", userId, "1", "?target=-1", http.StatusBadRequest},
+		{"SaveTargetNotBelow", userId, "1", "?target=175", http.StatusBadRequest},
+		{"SaveItem", userId, "1", "", http.StatusOK},
+		{"SaveItemAgain", userId, "1", "", http.StatusOK},
+		{"SaveOtherItem", userId, "2", "", http.StatusOK},
+		{"WatchPrice", watcherId, "1", "?target=150", http.StatusOK},
+	} {
+		recorder := httptest.NewRecorder()
+		request := newCartRequest("POST", "/api/items/"+args.itemId+"/wishlist"+args.query, args.userId)
+		request.SetPathValue("id", args.itemId)
+		env.SaveToWishlist(recorder, request)
+		if status := recorder.Result().StatusCode; status != args.expected {
+			t.Errorf("bad status code for %v, expected %v, got %v", args.name, args.expected, status)
+		}
+	}
+
+	recorder := httptest.NewRecorder()
+	env.Wishlist(recorder, newCartRequest("GET", "/api/wishlist", userId))
+	body, _ := io.ReadAll(recorder.Result().Body)
+	if lines := strings.Split(strings.TrimSpace(string(body)), "\n"); len(lines) != 2 || !strings.HasPrefix(lines[0], "id: 2,") ||
+		!strings.Contains(lines[1], "target: none") {
+		t.Errorf("bad wishlist, got %q", body)
+	}
+
+	// The watch fires once when the price reaches the target, and again after it recovers
+	for _, args := range []struct {
+		price  int
+		alerts int
+	}{
+		{16000, 0},
+		{15000, 1},
+		{14000, 0},
+		{17500, 0},
+		{14500, 1},
+	} {
+		now = now.Add(time.Minute)
+		env.db.SchedulePriceChange(ItemPrice{itemId: item.itemId, price: args.price, startsAt: now})
+		_, alerts, _, _ := env.db.ApplyPriceChanges(now)
+		if len(alerts) != args.alerts {
+			t.Errorf("bad alerts at %v, expected %v, got %v", args.price, args.alerts, alerts)
+		}
+		for _, alert := range alerts {
+			if alert.userId != watcherId || alert.price.amount != args.price || alert.target.amount != 15000 {
+				t.Errorf("bad alert at %v, got %v", args.price, alert)
+			}
+		}
+	}
+
+	// Each alert is in the watcher's notifications, newest first
+	if _, err := env.dispatchEvents(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	var drops []string
+	inApp, _ := env.db.InAppNotifications(watcherId)
+	for _, notification := range inApp {
+		if notification.kind == NotificationPriceDrop {
+			drops = append(drops, notification.subject)
+		}
+	}
+	if expected := []string{item.name + " dropped to 145.00 USD", item.name + " dropped to 150.00 USD"}; !slices.Equal(drops, expected) {
+		t.Errorf("bad price drop notifications, expected %v, got %v", expected, drops)
+	}
+
+	for _, args := range []struct {
+		name     string
+		expected int
+	}{
+		{"Remove", http.StatusNoContent},
+		{"RemoveAgain", http.StatusNotFound},
+	} {
+		recorder := httptest.NewRecorder()
+		request := newCartRequest("DELETE", "/api/items/1/wishlist", userId)
+		request.SetPathValue("id", "1")
+		env.RemoveFromWishlist(recorder, request)
+		if status := recorder.Result().StatusCode; status != args.expected {
+			t.Errorf("bad status code for %v, expected %v, got %v", args.name, args.expected, status)
+		}
+	}
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var ErrFundsHeld error = errors.New("funds from recent sales are held")
+
+// MinWithdrawal is the smallest withdrawal in minor units, payouts cost the marketplace a
+// fixed fee each
+const MinWithdrawal = 10_00
+
+type WithdrawalStatus string
+
+const (
+	WithdrawalPending    WithdrawalStatus = "pending"
+	WithdrawalProcessing WithdrawalStatus = "processing"
+	WithdrawalPaid       WithdrawalStatus = "paid"
+	WithdrawalRejected   WithdrawalStatus = "rejected"
+	WithdrawalFailed     WithdrawalStatus = "failed"
+)
+
+// withdrawalTransitions lists the statuses each status can move to. Approving moves a
+// withdrawal to processing before the payout is sent so it can't be rejected after
+var withdrawalTransitions = map[WithdrawalStatus][]WithdrawalStatus{
+	WithdrawalPending:    {WithdrawalProcessing, WithdrawalRejected},
+	WithdrawalProcessing: {WithdrawalPaid, WithdrawalFailed},
+}
+
+func (s WithdrawalStatus) CanTransition(to WithdrawalStatus) bool {
+	for _, next := range withdrawalTransitions[s] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// returnsFunds reports whether moving to the status gives the money back to the wallet
+func (s WithdrawalStatus) returnsFunds() bool {
+	return s == WithdrawalRejected || s == WithdrawalFailed
+}
+
+// Withdrawal is money taken out of a wallet to be paid out once an admin approves it
+type Withdrawal struct {
+	withdrawalId int
+	userId       int
+	amount       Money
+	status       WithdrawalStatus
+	payoutId     string // the provider's payout, empty until paid
+	reviewerId   int    // the admin who reviewed it, 0 until reviewed
+	createdAt    time.Time
+	updatedAt    time.Time
+}
+
+func (w Withdrawal) String() string {
+	return fmt.Sprintf("withdrawal: %v, user: %v, amount: %v, status: %v, created: %v, updated: %v",
+		w.withdrawalId, w.userId, w.amount, w.status, w.createdAt.String(), w.updatedAt.String())
+}
+
+const withdrawalColumns = `withdrawal_id, user_id, CAST(amount*100 AS BIGINT), currency, status, COALESCE(payout_id, ''),
+						   COALESCE(reviewed_by, 0), created_at, updated_at`
+
+func scanWithdrawal(row rowScanner) (Withdrawal, error) {
+	var withdrawal Withdrawal
+	err := row.Scan(&withdrawal.withdrawalId, &withdrawal.userId, &withdrawal.amount.amount, &withdrawal.amount.currency,
+		&withdrawal.status, &withdrawal.payoutId, &withdrawal.reviewerId, &withdrawal.createdAt, &withdrawal.updatedAt)
+	return withdrawal, err
+}
+
+// RequestWithdrawal takes amount from the user's wallet into a pending withdrawal. Only
+// money that isn't held at now can be withdrawn, ErrFundsHeld is returned if the wallet
+// would hold enough without holds and ErrInsufficientFunds otherwise
+func (s *SqlDB) RequestWithdrawal(userId int, amount Money, now time.Time) (withdrawal Withdrawal, err error) {
+	var tx *sql.Tx
+	tx, err = s.db.Begin()
+	if err != nil {
+		return Withdrawal{}, err
+	}
+
+	// Rollback or commit depending on err
+	defer func() {
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	balance, available, err := availableBalance(tx, userId, amount.currency, now)
+	if err != nil {
+		return Withdrawal{}, err
+	}
+	if available.amount < amount.amount {
+		if balance.amount >= amount.amount {
+			return Withdrawal{}, ErrFundsHeld
+		}
+		return Withdrawal{}, ErrInsufficientFunds
+	}
+
+	addQuery := `INSERT INTO withdrawals (user_id, amount, currency, status)
+				 VALUES ($1, CAST($2 AS NUMERIC(12, 0))/100, $3, $4)
+				 RETURNING ` + withdrawalColumns
+	withdrawal, err = scanWithdrawal(tx.QueryRow(addQuery, userId, amount.amount, amount.currency, WithdrawalPending))
+	if err != nil {
+		return Withdrawal{}, err
+	}
+	err = debitWallet(tx, LedgerEntry{userId: userId, amount: amount, kind: LedgerWithdrawal, referenceId: withdrawal.withdrawalId})
+	if err != nil {
+		return Withdrawal{}, err
+	}
+	return withdrawal, nil
+}
+
+func (s *SqlDB) queryWithdrawals(query string, args ...any) ([]Withdrawal, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var withdrawals []Withdrawal
+	for rows.Next() {
+		withdrawal, err := scanWithdrawal(rows)
+		if err != nil {
+			return nil, err
+		}
+		withdrawals = append(withdrawals, withdrawal)
+	}
+
+	return withdrawals, rows.Err()
+}
+
+// Withdrawals returns the user's withdrawals, newest first
+func (s *SqlDB) Withdrawals(userId int) ([]Withdrawal, error) {
+	return s.queryWithdrawals(`SELECT `+withdrawalColumns+` FROM withdrawals WHERE user_id=$1 ORDER BY withdrawal_id DESC`, userId)
+}
+
+// PendingWithdrawals returns the withdrawals awaiting review, oldest first
+func (s *SqlDB) PendingWithdrawals() ([]Withdrawal, error) {
+	return s.queryWithdrawals(`SELECT `+withdrawalColumns+` FROM withdrawals WHERE status=$1 ORDER BY withdrawal_id`, WithdrawalPending)
+}
+
+func (s *SqlDB) GetWithdrawal(withdrawalId int) (Withdrawal, error) {
+	query := `SELECT ` + withdrawalColumns + ` FROM withdrawals WHERE withdrawal_id=$1`
+	return scanWithdrawal(s.db.QueryRow(query, withdrawalId))
+}
+
+// TransitionWithdrawal moves a withdrawal to a new status, rejecting transitions the state
+// machine doesn't allow. Rejected and failed withdrawals return the money to the wallet.
+// payoutId and reviewerId are recorded when they aren't empty
+func (s *SqlDB) TransitionWithdrawal(withdrawalId int, to WithdrawalStatus, payoutId string, reviewerId int) (withdrawal Withdrawal, err error) {
+	var tx *sql.Tx
+	tx, err = s.db.Begin()
+	if err != nil {
+		return Withdrawal{}, err
+	}
+
+	// Rollback or commit depending on err
+	defer func() {
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	getQuery := `SELECT ` + withdrawalColumns + ` FROM withdrawals WHERE withdrawal_id=$1 FOR UPDATE`
+	withdrawal, err = scanWithdrawal(tx.QueryRow(getQuery, withdrawalId))
+	if err != nil {
+		return Withdrawal{}, err
+	}
+	if !withdrawal.status.CanTransition(to) {
+		return Withdrawal{}, ErrInvalidTransition
+	}
+
+	if to.returnsFunds() {
+		reversal := LedgerEntry{userId: withdrawal.userId, amount: withdrawal.amount, kind: LedgerWithdrawalReversal, referenceId: withdrawalId}
+		if _, err = creditWallet(tx, reversal); err != nil {
+			return Withdrawal{}, err
+		}
+	}
+
+	updateQuery := `UPDATE withdrawals SET status=$1, payout_id=COALESCE(NULLIF($2, ''), payout_id),
+					reviewed_by=COALESCE(NULLIF($3, 0), reviewed_by), updated_at=NOW()
+					WHERE withdrawal_id=$4
+					RETURNING ` + withdrawalColumns
+	return scanWithdrawal(tx.QueryRow(updateQuery, to, payoutId, reviewerId, withdrawalId))
+}
+
+func (env *Env) RequestWithdrawal(w http.ResponseWriter, r *http.Request) {
+	userId, ok := r.Context().Value(CtxUserId).(int)
+	if !ok {
+		env.logger.Println("context does not include userId for protected endpoint")
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if env.payouts == nil {
+		http.Error(w, "Withdrawals unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	// Parse wallet currency and amount
+	currency, err := parseCurrency(r.FormValue("currency"))
+	if err != nil {
+		http.Error(w, "Unknown currency", http.StatusBadRequest)
+		return
+	}
+	amount, err := ParseMoney(r.FormValue("amount"), currency)
+	if err != nil {
+		http.Error(w, "Invalid amount", http.StatusBadRequest)
+		return
+	}
+	if amount.amount < MinWithdrawal {
+		http.Error(w, fmt.Sprintf("Withdrawal must be at least %v", Money{MinWithdrawal, currency}), http.StatusBadRequest)
+		return
+	}
+
+	// Take the money from the wallet until the withdrawal is reviewed
+	withdrawal, err := env.db.RequestWithdrawal(userId, amount, time.Now())
+	if err != nil {
+		switch err {
+		case ErrInsufficientFunds:
+			http.Error(w, "Insufficient funds", http.StatusForbidden)
+		case ErrFundsHeld:
+			http.Error(w, fmt.Sprintf("Funds from sales are held for %v days", SaleHold/(24*time.Hour)), http.StatusForbidden)
+		default:
+			env.logger.Println(err.Error())
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		}
+		return
+	}
+	fmt.Fprintln(w, withdrawal)
+}
+
+func (env *Env) Withdrawals(w http.ResponseWriter, r *http.Request) {
+	userId, ok := r.Context().Value(CtxUserId).(int)
+	if !ok {
+		env.logger.Println("context does not include userId for protected endpoint")
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	withdrawals, err := env.db.Withdrawals(userId)
+	if err != nil {
+		env.logger.Println(err.Error())
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	// Print withdrawals, newest first
+	for _, withdrawal := range withdrawals {
+		fmt.Fprintln(w, withdrawal)
+	}
+}
+
+// PendingWithdrawals is the admin approval queue
+func (env *Env) PendingWithdrawals(w http.ResponseWriter, r *http.Request) {
+	userId, ok := r.Context().Value(CtxUserId).(int)
+	if !ok {
+		env.logger.Println("context does not include userId for protected endpoint")
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if !env.requireAdmin(w, userId) {
+		return
+	}
+
+	withdrawals, err := env.db.PendingWithdrawals()
+	if err != nil {
+		env.logger.Println(err.Error())
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	// Print withdrawals, oldest first
+	for _, withdrawal := range withdrawals {
+		fmt.Fprintln(w, withdrawal)
+	}
+}
+
+// reviewWithdrawal moves the withdrawal to status as reviewed by the admin, writing an
+// error response and returning false if it can't
+func (env *Env) reviewWithdrawal(w http.ResponseWriter, withdrawalId int, adminId int, to WithdrawalStatus, payoutId string) (Withdrawal, bool) {
+	withdrawal, err := env.db.TransitionWithdrawal(withdrawalId, to, payoutId, adminId)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return Withdrawal{}, false
+		}
+		if err == ErrInvalidTransition {
+			http.Error(w, "Withdrawal already reviewed", http.StatusConflict)
+			return Withdrawal{}, false
+		}
+		env.logger.Println(err.Error())
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return Withdrawal{}, false
+	}
+	return withdrawal, true
+}
+
+// ApproveWithdrawal sends the payout for a withdrawal. A withdrawal left processing by a
+// payout that didn't complete can be approved again, the payout is only sent once
+func (env *Env) ApproveWithdrawal(w http.ResponseWriter, r *http.Request) {
+	userId, ok := r.Context().Value(CtxUserId).(int)
+	if !ok {
+		env.logger.Println("context does not include userId for protected endpoint")
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if !env.requireAdmin(w, userId) {
+		return
+	}
+	if env.payouts == nil {
+		http.Error(w, "Withdrawals unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	// Claim the withdrawal unless a previous approval already did
+	withdrawalId, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	withdrawal, err := env.db.GetWithdrawal(withdrawalId)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+		env.logger.Println(err.Error())
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if withdrawal.status != WithdrawalProcessing {
+		if withdrawal, ok = env.reviewWithdrawal(w, withdrawalId, userId, WithdrawalProcessing, ""); !ok {
+			return
+		}
+	}
+
+	// Send the payout, declined payouts return the money to the wallet
+	idempotencyKey := "withdrawal-" + strconv.Itoa(withdrawal.withdrawalId)
+	payoutId, err := env.payouts.Payout(withdrawal.userId, withdrawal.amount, idempotencyKey)
+	if err != nil {
+		if err == ErrPayoutDeclined {
+			if withdrawal, ok = env.reviewWithdrawal(w, withdrawalId, userId, WithdrawalFailed, ""); ok {
+				fmt.Fprintln(w, withdrawal)
+			}
+			return
+		}
+		env.logger.Println(err.Error())
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return
+	}
+	if withdrawal, ok = env.reviewWithdrawal(w, withdrawalId, userId, WithdrawalPaid, payoutId); ok {
+		fmt.Fprintln(w, withdrawal)
+	}
+}
+
+// RejectWithdrawal returns a pending withdrawal's money to the wallet
+func (env *Env) RejectWithdrawal(w http.ResponseWriter, r *http.Request) {
+	userId, ok := r.Context().Value(CtxUserId).(int)
+	if !ok {
+		env.logger.Println("context does not include userId for protected endpoint")
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if !env.requireAdmin(w, userId) {
+		return
+	}
+
+	withdrawalId, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	if withdrawal, ok := env.reviewWithdrawal(w, withdrawalId, userId, WithdrawalRejected, ""); ok {
+		fmt.Fprintln(w, withdrawal)
+	}
+}
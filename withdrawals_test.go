@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testWithdrawalTransitionsTable = map[string]struct {
+	from     WithdrawalStatus
+	to       WithdrawalStatus
+	expected bool
+}{
+	"approve pending":   {WithdrawalPending, WithdrawalProcessing, true},
+	"reject pending":    {WithdrawalPending, WithdrawalRejected, true},
+	"pay processing":    {WithdrawalProcessing, WithdrawalPaid, true},
+	"fail processing":   {WithdrawalProcessing, WithdrawalFailed, true},
+	"pay pending":       {WithdrawalPending, WithdrawalPaid, false},
+	"reject processing": {WithdrawalProcessing, WithdrawalRejected, false},
+	"reject paid":       {WithdrawalPaid, WithdrawalRejected, false},
+	"retry failed":      {WithdrawalFailed, WithdrawalProcessing, false},
+}
+
+func TestWithdrawalStatusCanTransition(t *testing.T) {
+	t.Parallel()
+	for name, args := range testWithdrawalTransitionsTable {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			if answer := args.from.CanTransition(args.to); answer != args.expected {
+				t.Errorf("%v -> %v, got %v, expected %v", args.from, args.to, answer, args.expected)
+			}
+		})
+	}
+}
+
+// decliningPayouts refuses every payout
+type decliningPayouts struct{}
+
+func (decliningPayouts) Payout(userId int, amount Money, idempotencyKey string) (string, error) {
+	return "", ErrPayoutDeclined
+}
+
+// reviewTestWithdrawal calls an admin review handler for a withdrawal as userId
+func reviewTestWithdrawal(handler http.HandlerFunc, action string, withdrawalId int, userId int) (int, string) {
+	recorder := httptest.NewRecorder()
+	request := newCartRequest("POST", fmt.Sprintf("/api/admin/withdrawals/%v/%v", withdrawalId, action), userId)
+	request.SetPathValue("id", fmt.Sprint(withdrawalId))
+	handler(recorder, request)
+	result := recorder.Result()
+	body, _ := io.ReadAll(result.Body)
+	return result.StatusCode, string(body)
+}
+
+func TestWithdrawals(t *testing.T) {
+	env := NewTestEnv()
+	env.db = newTestDB(t)
+	userId, adminId := 2, 3
+	startBalance, _ := env.db.Balance(userId, DefaultCurrency)
+
+	requestWithdrawal := func(amount string) (int, Withdrawal) {
+		recorder := httptest.NewRecorder()
+		env.RequestWithdrawal(recorder, newCartRequest("POST", "/api/withdrawals?amount="+amount, userId))
+		withdrawals, _ := env.db.Withdrawals(userId)
+		if len(withdrawals) == 0 {
+			return recorder.Result().StatusCode, Withdrawal{}
+		}
+		return recorder.Result().StatusCode, withdrawals[0]
+	}
+	expectBalance := func(name string, expected int) {
+		t.Helper()
+		if balance, _ := env.db.Balance(userId, DefaultCurrency); balance.amount != expected {
+			t.Errorf("bad balance after %v, expected %v, got %v", name, expected, balance.amount)
+		}
+	}
+
+	for _, args := range []struct {
+		name     string
+		amount   string
+		expected int
+	}{
+		{"WithdrawInvalidAmount", "1e3", http.StatusBadRequest},
+		{"WithdrawUnderMinimum", "9.99", http.StatusBadRequest},
+		{"WithdrawInsufficientFunds", "200.01", http.StatusForbidden},
+	} {
+		if status, _ := requestWithdrawal(args.amount); status != args.expected {
+			t.Errorf("bad status code for %v, expected %v, got %v", args.name, args.expected, status)
+		}
+		expectBalance(args.name, startBalance.amount)
+	}
+
+	// Approved withdrawals are paid out once
+	status, paid := requestWithdrawal("50")
+	if status != http.StatusOK || paid.status != WithdrawalPending {
+		t.Fatalf("bad withdrawal request, got %v %v", status, paid)
+	}
+	expectBalance("withdrawal request", startBalance.amount-5000)
+
+	recorder := httptest.NewRecorder()
+	env.PendingWithdrawals(recorder, newCartRequest("GET", "/api/admin/withdrawals", adminId))
+	if body, _ := io.ReadAll(recorder.Result().Body); !strings.Contains(string(body), fmt.Sprintf("withdrawal: %v,", paid.withdrawalId)) {
+		t.Errorf("pending withdrawal missing from the queue, got %q", body)
+	}
+
+	for _, args := range []struct {
+		name     string
+		userId   int
+		expected int
+	}{
+		{"ApproveNotAdmin", userId, http.StatusForbidden},
+		{"ApproveWithdrawal", adminId, http.StatusOK},
+		{"ApproveWithdrawalAgain", adminId, http.StatusConflict},
+	} {
+		if status, body := reviewTestWithdrawal(env.ApproveWithdrawal, "approve", paid.withdrawalId, args.userId); status != args.expected {
+			t.Errorf("bad status code for %v, expected %v, got %v: %v", args.name, args.expected, status, body)
+		}
+	}
+	if paid, _ = env.db.GetWithdrawal(paid.withdrawalId); paid.status != WithdrawalPaid || len(paid.payoutId) == 0 || paid.reviewerId != adminId {
+		t.Errorf("approved withdrawal should be paid by the admin, got %v %q %v", paid.status, paid.payoutId, paid.reviewerId)
+	}
+	if status, _ := reviewTestWithdrawal(env.RejectWithdrawal, "reject", paid.withdrawalId, adminId); status != http.StatusConflict {
+		t.Errorf("bad status code rejecting a paid withdrawal, expected %v, got %v", http.StatusConflict, status)
+	}
+	expectBalance("payout", startBalance.amount-5000)
+
+	// Rejected and declined withdrawals return the money
+	_, rejected := requestWithdrawal("20")
+	if status, body := reviewTestWithdrawal(env.RejectWithdrawal, "reject", rejected.withdrawalId, adminId); status != http.StatusOK {
+		t.Errorf("bad status code for rejection, expected %v, got %v: %v", http.StatusOK, status, body)
+	}
+	expectBalance("rejection", startBalance.amount-5000)
+
+	env.payouts = decliningPayouts{}
+	_, declined := requestWithdrawal("10")
+	if status, body := reviewTestWithdrawal(env.ApproveWithdrawal, "approve", declined.withdrawalId, adminId); status != http.StatusOK ||
+		!strings.Contains(body, "status: failed") {
+		t.Errorf("declined payout should fail the withdrawal, got %v: %v", status, body)
+	}
+	expectBalance("declined payout", startBalance.amount-5000)
+
+	if status, _ := reviewTestWithdrawal(env.RejectWithdrawal, "reject", 1000, adminId); status != http.StatusNotFound {
+		t.Errorf("bad status code rejecting a missing withdrawal, expected %v, got %v", http.StatusNotFound, status)
+	}
+}
+
+func TestSaleHold(t *testing.T) {
+	env := NewTestEnv()
+	env.db = newTestDB(t)
+	buyerId, sellerId := 1, 2
+	startBuyerBalance, _ := env.db.Balance(buyerId, DefaultCurrency)
+	startSellerBalance, _ := env.db.Balance(sellerId, DefaultCurrency)
+
+	// The seller is credited for the sale once it leaves escrow but can't withdraw it yet
+	creditTestWallet(buyerId, Money{17500, DefaultCurrency})
+	orderId, err := env.db.Purchase(buyerId, 1, 0, "", DefaultCurrency)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := env.db.ConfirmReceipt(buyerId, orderId, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if balance, _ := env.db.Balance(sellerId, DefaultCurrency); balance.amount != startSellerBalance.amount+17500 {
+		t.Fatalf("seller not credited for sale, expected %v, got %v", startSellerBalance.amount+17500, balance.amount)
+	}
+
+	recorder := httptest.NewRecorder()
+	env.Ledger(recorder, newCartRequest("GET", "/api/ledger", sellerId))
+	if body, _ := io.ReadAll(recorder.Result().Body); !strings.HasPrefix(string(body), "entry: ") || !strings.Contains(string(body), "kind: sale, reference: "+fmt.Sprint(orderId)+", held until: ") {
+		t.Errorf("held sale missing from the ledger, got %q", body)
+	}
+
+	now := time.Now()
+	if _, err := env.db.RequestWithdrawal(sellerId, Money{startSellerBalance.amount + 1, DefaultCurrency}, now); err != ErrFundsHeld {
+		t.Errorf("withdrawing held funds, expected %v, got %v", ErrFundsHeld, err)
+	}
+	if _, err := env.db.RequestWithdrawal(sellerId, Money{startSellerBalance.amount + 17500, DefaultCurrency}, now.Add(SaleHold+time.Minute)); err != nil {
+		t.Errorf("withdrawing funds after the hold, got %v", err)
+	}
+
+	// Refunds take the sale back, which fails once the seller has withdrawn it
+	if err := env.db.TransitionOrder(orderId, OrderRefunded); err != ErrInsufficientFunds {
+		t.Errorf("refunding a withdrawn sale, expected %v, got %v", ErrInsufficientFunds, err)
+	}
+	creditTestWallet(sellerId, Money{17500, DefaultCurrency})
+	if err := env.db.TransitionOrder(orderId, OrderRefunded); err != nil {
+		t.Fatal(err)
+	}
+	if balance, _ := env.db.Balance(sellerId, DefaultCurrency); balance.amount != 0 {
+		t.Errorf("sale not taken back from the seller, expected %v, got %v", 0, balance.amount)
+	}
+	if balance, _ := env.db.Balance(buyerId, DefaultCurrency); balance.amount != startBuyerBalance.amount+17500 {
+		t.Errorf("buyer not refunded, expected %v, got %v", startBuyerBalance.amount+17500, balance.amount)
+	}
+}